@@ -9,10 +9,10 @@ import (
 	"github.com/ystepanoff/nrfcomm/transport"
 )
 
-func NewTransmitter(id protocol.DeviceID) *transport.Transmitter {
-	return transport.NewTransmitterWithDriver(id, stub.New())
+func NewTransmitter(id protocol.DeviceID, opts ...transport.Option) *transport.Transmitter {
+	return transport.NewTransmitterWithDriver(id, stub.New(), opts...)
 }
 
-func NewReceiver(id protocol.DeviceID) *transport.Receiver {
-	return transport.NewReceiverWithDriver(id, stub.New())
+func NewReceiver(id protocol.DeviceID, opts ...transport.Option) *transport.Receiver {
+	return transport.NewReceiverWithDriver(id, stub.New(), opts...)
 }
@@ -0,0 +1,29 @@
+package nrf
+
+import (
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+	"github.com/ystepanoff/nrfcomm/transport"
+)
+
+// MODE register values of the data rates each radio supports. The nRF52
+// series dropped Nrf_250Kbit.
+var (
+	nrf51Modes = map[transport.DataRate]uint32{
+		transport.DataRate1Mbit:   0, // Nrf_1Mbit
+		transport.DataRate2Mbit:   1, // Nrf_2Mbit
+		transport.DataRate250Kbit: 2, // Nrf_250Kbit
+	}
+	nrf52Modes = map[transport.DataRate]uint32{
+		transport.DataRate1Mbit: 0,
+		transport.DataRate2Mbit: 1,
+	}
+)
+
+// modeValue returns the MODE register value for rate, or
+// ErrInvalidDataRate if modes does not include it.
+func modeValue(modes map[transport.DataRate]uint32, rate transport.DataRate) (uint32, error) {
+	if v, ok := modes[rate]; ok {
+		return v, nil
+	}
+	return 0, proto.ErrInvalidDataRate
+}
@@ -0,0 +1,6 @@
+//go:build (tinygo || baremetal) && !nrf51
+
+package nrf
+
+// The nRF52832 and nRF52840, also assumed for other targets.
+var radioModes = nrf52Modes
@@ -0,0 +1,30 @@
+package nrf
+
+import (
+	"testing"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+	"github.com/ystepanoff/nrfcomm/transport"
+)
+
+func TestModeValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		modes map[transport.DataRate]uint32
+		rate  transport.DataRate
+		want  uint32
+		err   error
+	}{
+		{"nRF52 1 Mbit", nrf52Modes, transport.DataRate1Mbit, 0, nil},
+		{"nRF52 2 Mbit", nrf52Modes, transport.DataRate2Mbit, 1, nil},
+		{"nRF52 250 kbit", nrf52Modes, transport.DataRate250Kbit, 0, proto.ErrInvalidDataRate},
+		{"nRF51 250 kbit", nrf51Modes, transport.DataRate250Kbit, 2, nil},
+		{"nRF51 unknown", nrf51Modes, transport.DataRate250Kbit + 1, 0, proto.ErrInvalidDataRate},
+	}
+	for _, tt := range tests {
+		got, err := modeValue(tt.modes, tt.rate)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%s: modeValue() = %d, %v, want %d, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
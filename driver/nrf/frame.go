@@ -0,0 +1,33 @@
+package nrf
+
+import proto "github.com/ystepanoff/nrfcomm/protocol"
+
+// maxLength is PCNF1.MAXLEN, the most bytes the radio sends or takes after
+// the length byte, which counts them; a frame on the air is then at most
+// proto.MaxFrameSize long.
+const maxLength = proto.MaxFrameSize - proto.LengthFieldSize
+
+// frameBufferSize is the size of the buffer PACKETPTR points at: the length
+// byte and up to maxLength bytes after it.
+const frameBufferSize = proto.LengthFieldSize + maxLength
+
+// MAXLEN is an 8-bit field, so larger frames would not build.
+var _ [0xFF - maxLength]struct{}
+
+// txFrameOK reports whether data is a frame the radio sends whole: one that
+// fits the buffer and whose length byte counts the bytes after it, as
+// proto.Config.EncodeFrame writes it. The radio sends as many bytes as the
+// length byte says, whatever the length of data.
+func txFrameOK(data []byte) bool {
+	return len(data) > proto.LengthFieldSize && len(data) <= frameBufferSize &&
+		int(data[0]) == len(data)-proto.LengthFieldSize
+}
+
+// rxFrameLen returns how many bytes of the buffer hold the frame received
+// with the length byte length, of which the radio took at most maxLength.
+func rxFrameLen(length byte) int {
+	if int(length) > maxLength {
+		return frameBufferSize
+	}
+	return proto.LengthFieldSize + int(length)
+}
@@ -0,0 +1,79 @@
+package nrf
+
+import (
+	"bytes"
+	"testing"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+func TestFrameSizes(t *testing.T) {
+	if frameBufferSize != proto.MaxFrameSize {
+		t.Errorf("buffer of %d bytes, want one frame of %d", frameBufferSize, proto.MaxFrameSize)
+	}
+	if maxLength != proto.MaxFrameSize-1 {
+		t.Errorf("MAXLEN = %d, want the %d bytes after the length byte", maxLength, proto.MaxFrameSize-1)
+	}
+}
+
+func TestEncodedFramesFit(t *testing.T) {
+	for _, cfg := range []proto.Config{proto.DefaultConfig(), {MaxFrameSize: 32}} {
+		for _, flags := range []byte{0, proto.FlagTimestamp} {
+			for _, n := range []int{0, cfg.MaxPayloadSize(), 2 * proto.MaxFrameSize} {
+				f := &proto.Frame{SenderID: 1, Type: proto.FrameTypeData, Flags: flags, Payload: bytes.Repeat([]byte{0xAA}, n)}
+				encoded := cfg.EncodeFrame(f)
+				if !txFrameOK(encoded) {
+					t.Errorf("%d-byte frames, flags %#02x, %d bytes: frame of %d bytes refused", cfg.MaxFrameSize, flags, n, len(encoded))
+					continue
+				}
+				// What the radio writes to the buffer on receiving it.
+				var buffer [frameBufferSize]byte
+				copy(buffer[:], encoded)
+				if got := buffer[:rxFrameLen(buffer[0])]; !bytes.Equal(got, encoded) {
+					t.Errorf("%d-byte frames, flags %#02x, %d bytes: received %d of %d bytes", cfg.MaxFrameSize, flags, n, len(got), len(encoded))
+				}
+			}
+		}
+	}
+}
+
+func TestTxFrameOK(t *testing.T) {
+	long := make([]byte, proto.MaxFrameSize+1)
+	long[0] = proto.MaxFrameSize
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"length byte alone", []byte{0}},
+		{"length byte too large", []byte{3, 1, 2}},
+		{"length byte too small", []byte{1, 1, 2}},
+		{"longer than a frame", long},
+	}
+	for _, tt := range tests {
+		if txFrameOK(tt.data) {
+			t.Errorf("%s: txFrameOK() = true", tt.name)
+		}
+	}
+	if !txFrameOK([]byte{2, 1, 2}) {
+		t.Error("txFrameOK() refused a consistent frame")
+	}
+}
+
+func TestRxFrameLen(t *testing.T) {
+	tests := []struct {
+		length byte
+		want   int
+	}{
+		{0, 1},
+		{20, 21},
+		{maxLength, proto.MaxFrameSize},
+		{maxLength + 1, proto.MaxFrameSize},
+		{0xFF, proto.MaxFrameSize},
+	}
+	for _, tt := range tests {
+		if got := rxFrameLen(tt.length); got != tt.want {
+			t.Errorf("rxFrameLen(%d) = %d, want %d", tt.length, got, tt.want)
+		}
+	}
+}
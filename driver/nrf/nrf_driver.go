@@ -3,6 +3,7 @@
 package nrf
 
 import (
+	"sync"
 	"time"
 	"unsafe"
 
@@ -15,31 +16,277 @@ import (
 // Driver provides a RadioDriver backed by the real NRF peripheral registers.
 // It keeps an internal buffer for Frame TX/RX operations.
 type Driver struct {
-	buffer [proto.MaxFrameSize + 1]byte
+	config  Config
+	buffer  [frameBufferSize]byte
+	txPower uint32 // TXPOWER register value, see SetTxPower
+	mode    uint32 // MODE register value, see SetDataRate
+	rate    transport.DataRate
+	address uint32 // configuration restored by Wake
+	prefix  byte
+	channel uint8
+	rssi    int8 // of the frame Rx returned last, see RSSI
+	sampled bool // rssi was measured
+	asleep  bool // see Sleep
+	closed  bool // see Close
+
+	pipes   uint8    // pipes listened on, see EnablePipes; restored by Wake
+	base1   uint32   // address of pipes 1 to 7, see ConfigurePipe
+	prefix1 [8]uint8 // prefixes of pipes 1 to 7, at their index
+
+	mu    sync.Mutex    // guards sent and acked
+	sent  chan struct{} // closed once the TxAsync frame is sent, see awaitSent
+	acked chan struct{} // closed once the done of the last TxAsync returned
+}
+
+// Config configures the driver, see NewWithConfig.
+type Config struct {
+	// NoHWCRC turns the radio's 1-byte CRC off, leaving frames to their
+	// own CRC32: each frame is a byte shorter on the air, but a corrupt one
+	// is only caught once it is decoded. The receiving radio must have it
+	// off too, or it takes the next byte on the air for the CRC and
+	// rejects the frame.
+	NoHWCRC bool
 }
 
-func New() transport.RadioDriver { return &Driver{} }
+func New() transport.RadioDriver { return NewWithConfig(Config{}) }
+
+// NewWithConfig returns a driver configured by cfg.
+func NewWithConfig(cfg Config) transport.RadioDriver { return &Driver{config: cfg} }
 
 func (d *Driver) StartHFCLK() { StartHFCLK() }
 
+// Configure programs the radio for address and channel, restoring the
+// output power, data rate and CRC setting. It may be called again at any
+// time: it waits for a TxAsync frame on the air and disables the radio
+// first, and it reopens a driver closed by Close. While the driver is
+// asleep it only records address and channel for Wake to program.
 func (d *Driver) Configure(address uint32, prefix byte, channel uint8) error {
-	return ConfigureRadio(address, prefix, channel)
+	d.awaitSent()
+	if d.asleep {
+		if channel > 125 {
+			return proto.ErrInvalidChannel
+		}
+		d.address, d.prefix, d.channel = address, prefix, channel
+		d.pipes = 1
+		return nil
+	}
+	if d.closed {
+		StartHFCLK()
+	} else {
+		disableRadio()
+	}
+	if err := d.program(address, prefix, channel); err != nil {
+		return err
+	}
+	d.closed = false
+	d.pipes = 1
+	return nil
+}
+
+// program powers the radio up and configures it for address and channel
+// with the driver's output power, data rate and CRC setting, and enables
+// the RADIO interrupt TxAsync completes from.
+func (d *Driver) program(address uint32, prefix byte, channel uint8) error {
+	if err := ConfigureRadio(address, prefix, channel); err != nil {
+		return err
+	}
+	enableRadioIRQ()
+	d.address, d.prefix, d.channel = address, prefix, channel
+	if d.config.NoHWCRC {
+		nrf.RADIO.CRCCNF.Set(0)
+	}
+	nrf.RADIO.TXPOWER.Set(d.txPower)
+	nrf.RADIO.MODE.Set(d.mode)
+	return nil
+}
+
+// SetTxPower sets the output power to one of the levels the chip
+// supports, 0 dBm until it is called.
+func (d *Driver) SetTxPower(dbm int8) error {
+	v, err := txPowerValue(txPowerLevels, dbm)
+	if err != nil {
+		return err
+	}
+	d.txPower = v
+	nrf.RADIO.TXPOWER.Set(v)
+	return nil
+}
+
+// SetDataRate sets the data rate to one the chip supports, 1 Mbit until it
+// is called. The radio is disabled between transfers, so MODE takes effect
+// with the next one.
+func (d *Driver) SetDataRate(rate transport.DataRate) error {
+	v, err := modeValue(radioModes, rate)
+	if err != nil {
+		return err
+	}
+	d.mode, d.rate = v, rate
+	nrf.RADIO.MODE.Set(v)
+	return nil
 }
 
+// SetChannel moves the radio to channel, waiting for a TxAsync frame on
+// the air and disabling the radio first so that no transfer straddles the
+// change.
 func (d *Driver) SetChannel(channel uint8) error {
 	if channel > 125 {
 		return proto.ErrInvalidChannel
 	}
+	d.awaitSent()
+	if !d.closed && !d.asleep {
+		disableRadio()
+	}
 	nrf.RADIO.FREQUENCY.Set(uint32(channel))
+	d.channel = channel
+	return nil
+}
+
+// ConfigurePipe sets the address of a pipe. Pipe 0 has BASE0, as set by
+// Configure, and pipes 1 to 7 share BASE1, so setting it for one of them
+// moves all; each pipe has its own byte lane in PREFIX0 or PREFIX1.
+func (d *Driver) ConfigurePipe(pipe uint8, address uint32, prefix byte) error {
+	if pipe > 7 {
+		return proto.ErrInvalidPipe
+	}
+	if pipe == 0 {
+		d.address, d.prefix = address, prefix
+		nrf.RADIO.BASE0.Set(address)
+		nrf.RADIO.PREFIX0.Set(withPrefix(nrf.RADIO.PREFIX0.Get(), 0, prefix))
+		return nil
+	}
+	d.base1, d.prefix1[pipe] = address, prefix
+	nrf.RADIO.BASE1.Set(address)
+	if pipe < 4 {
+		nrf.RADIO.PREFIX0.Set(withPrefix(nrf.RADIO.PREFIX0.Get(), pipe, prefix))
+	} else {
+		nrf.RADIO.PREFIX1.Set(withPrefix(nrf.RADIO.PREFIX1.Get(), pipe, prefix))
+	}
+	return nil
+}
+
+// EnablePipes sets RXADDRESSES, the pipes to listen on. Until it is
+// called, and again after Configure, that is pipe 0 alone.
+func (d *Driver) EnablePipes(mask uint8) {
+	d.pipes = mask
+	nrf.RADIO.RXADDRESSES.Set(uint32(mask))
+}
+
+// Sleep disables the radio, powers it down and stops the high-frequency
+// clock. Powering down resets the radio's registers. Until Wake, the radio
+// would never become ready, so Tx, TxBurst, Rx and SampleRSSI fail with
+// ErrAsleep instead of waiting for it.
+func (d *Driver) Sleep() error {
+	d.awaitSent()
+	disableRadio()
+	nrf.RADIO.POWER.Set(0)
+	nrf.CLOCK.TASKS_HFCLKSTOP.Set(1)
+	d.asleep = true
+	return nil
+}
+
+// Close powers the radio down as Sleep does, once a TxAsync frame on the
+// air is sent. The radio operations then fail with ErrClosed, and Wake does
+// not bring the radio back; Configure sets it up again.
+func (d *Driver) Close() error {
+	if d.closed {
+		return nil
+	}
+	if !d.asleep {
+		if err := d.Sleep(); err != nil {
+			return err
+		}
+	}
+	d.closed, d.asleep = true, false
+	return nil
+}
+
+// usable returns the error the radio operations fail with while the driver
+// is closed or asleep.
+func (d *Driver) usable() error {
+	if d.closed {
+		return proto.ErrClosed
+	}
+	if d.asleep {
+		return proto.ErrAsleep
+	}
 	return nil
 }
 
+// Wake restarts the high-frequency clock, powers the radio up and
+// configures it as it was before Sleep, pipes included. It fails with
+// ErrClosed after Close.
+func (d *Driver) Wake() error {
+	if d.closed {
+		return proto.ErrClosed
+	}
+	StartHFCLK()
+	if err := d.program(d.address, d.prefix, d.channel); err != nil {
+		return err
+	}
+	pipes := d.pipes
+	for pipe := uint8(1); pipe < 8; pipe++ {
+		if pipes&(1<<pipe) != 0 {
+			_ = d.ConfigurePipe(pipe, d.base1, d.prefix1[pipe])
+		}
+	}
+	d.EnablePipes(pipes)
+	d.asleep = false
+	return nil
+}
+
+// SampleRSSI enables the receiver and measures the energy on the channel
+// with RSSISTART, returning it in dBm. RSSISAMPLE holds its magnitude.
+func (d *Driver) SampleRSSI() (int8, error) {
+	d.awaitSent()
+	if err := d.usable(); err != nil {
+		return 0, err
+	}
+	nrf.RADIO.EVENTS_READY.Set(0)
+	nrf.RADIO.TASKS_RXEN.Set(1)
+	for nrf.RADIO.EVENTS_READY.Get() == 0 {
+	}
+	nrf.RADIO.EVENTS_RSSIEND.Set(0)
+	nrf.RADIO.TASKS_RSSISTART.Set(1)
+	for nrf.RADIO.EVENTS_RSSIEND.Get() == 0 {
+	}
+	sample := nrf.RADIO.RSSISAMPLE.Get() & 0x7F
+	nrf.RADIO.TASKS_RSSISTOP.Set(1)
+	disableRadio()
+	return -int8(sample), nil
+}
+
+// RSSI returns the signal strength of the frame Rx returned last, which the
+// radio samples as the frame's address is matched, see RxMeta.
+func (d *Driver) RSSI() (int8, error) {
+	if !d.sampled {
+		return 0, proto.ErrNoRSSI
+	}
+	return d.rssi, nil
+}
+
+// Tx transmits data and returns once the radio is disabled again. With
+// shortcuts, see useShorts, it only triggers TXEN and waits for DISABLED.
+// Data that is not an encoded frame, see txFrameOK, fails with
+// ErrInvalidPayload.
 func (d *Driver) Tx(data []byte) error {
-	if len(data) > proto.MaxFrameSize {
+	d.awaitSent()
+	if err := d.usable(); err != nil {
+		return err
+	}
+	if !txFrameOK(data) {
 		return proto.ErrInvalidPayload
 	}
 	copy(d.buffer[:], data)
 	nrf.RADIO.PACKETPTR.Set(uint32(uintptr(unsafe.Pointer(&d.buffer[0]))))
+	if useShorts {
+		nrf.RADIO.SHORTS.Set(nrf.RADIO_SHORTS_READY_START_Msk | nrf.RADIO_SHORTS_END_DISABLE_Msk)
+		nrf.RADIO.EVENTS_DISABLED.Set(0)
+		nrf.RADIO.TASKS_TXEN.Set(1)
+		for nrf.RADIO.EVENTS_DISABLED.Get() == 0 {
+		}
+		nrf.RADIO.SHORTS.Set(0)
+		return nil
+	}
 	nrf.RADIO.EVENTS_READY.Set(0)
 	nrf.RADIO.EVENTS_END.Set(0)
 	nrf.RADIO.TASKS_TXEN.Set(1)
@@ -48,37 +295,106 @@ func (d *Driver) Tx(data []byte) error {
 	nrf.RADIO.TASKS_START.Set(1)
 	for nrf.RADIO.EVENTS_END.Get() == 0 {
 	}
-	nrf.RADIO.TASKS_DISABLE.Set(1)
-	for nrf.RADIO.STATE.Get() != nrf.RADIO_STATE_STATE_Disabled {
+	disableRadio()
+	return nil
+}
+
+// TxBurst transmits frames in order with a single TXEN ramp-up, starting
+// the next frame from TXIDLE as soon as the previous one has ended.
+func (d *Driver) TxBurst(frames [][]byte) error {
+	d.awaitSent()
+	if err := d.usable(); err != nil {
+		return err
+	}
+	for _, data := range frames {
+		if !txFrameOK(data) {
+			return proto.ErrInvalidPayload
+		}
 	}
+	nrf.RADIO.PACKETPTR.Set(uint32(uintptr(unsafe.Pointer(&d.buffer[0]))))
+	nrf.RADIO.EVENTS_READY.Set(0)
+	nrf.RADIO.TASKS_TXEN.Set(1)
+	for nrf.RADIO.EVENTS_READY.Get() == 0 {
+	}
+	for _, data := range frames {
+		copy(d.buffer[:], data)
+		nrf.RADIO.EVENTS_END.Set(0)
+		nrf.RADIO.TASKS_START.Set(1)
+		for nrf.RADIO.EVENTS_END.Get() == 0 {
+		}
+	}
+	disableRadio()
 	return nil
 }
 
+// rxDone reports whether the frame RxMeta waits for has been received: the
+// radio disabled itself after it with shortcuts, or it ended without.
+func rxDone() bool {
+	if useShorts {
+		return nrf.RADIO.EVENTS_DISABLED.Get() != 0
+	}
+	return nrf.RADIO.EVENTS_END.Get() != 0
+}
+
 func (d *Driver) Rx(timeout time.Duration) ([]byte, error) {
+	p, err := d.RxMeta(timeout)
+	return p.Data, err
+}
+
+// RxMeta waits up to timeout for a frame. The shorts start an RSSI sample
+// when the address of a frame is matched and stop it when the radio is
+// disabled, so that RSSISAMPLE holds the strength of the frame received;
+// CRCSTATUS tells whether it passed the hardware CRC, unless Config.NoHWCRC
+// turned that off. With shortcuts, see useShorts, they also start the
+// receiver once it is ready and disable it after the frame, leaving
+// DISABLED as the only event to wait for.
+func (d *Driver) RxMeta(timeout time.Duration) (transport.RxPacket, error) {
+	d.awaitSent()
+	if err := d.usable(); err != nil {
+		return transport.RxPacket{}, err
+	}
+	d.sampled = false
 	nrf.RADIO.PACKETPTR.Set(uint32(uintptr(unsafe.Pointer(&d.buffer[0]))))
+	shorts := uint32(nrf.RADIO_SHORTS_ADDRESS_RSSISTART_Msk | nrf.RADIO_SHORTS_DISABLED_RSSISTOP_Msk)
+	if useShorts {
+		shorts |= nrf.RADIO_SHORTS_READY_START_Msk | nrf.RADIO_SHORTS_END_DISABLE_Msk
+	}
+	nrf.RADIO.SHORTS.Set(shorts)
+	defer nrf.RADIO.SHORTS.Set(0)
 	nrf.RADIO.EVENTS_READY.Set(0)
 	nrf.RADIO.EVENTS_END.Set(0)
+	nrf.RADIO.EVENTS_DISABLED.Set(0)
+	nrf.RADIO.EVENTS_RSSIEND.Set(0)
 	nrf.RADIO.TASKS_RXEN.Set(1)
-	for nrf.RADIO.EVENTS_READY.Get() == 0 {
+	if !useShorts {
+		for nrf.RADIO.EVENTS_READY.Get() == 0 {
+		}
+		nrf.RADIO.TASKS_START.Set(1)
 	}
-	nrf.RADIO.TASKS_START.Set(1)
 	start := time.Now()
-	for nrf.RADIO.EVENTS_END.Get() == 0 {
+	for !rxDone() {
 		if time.Since(start) > timeout {
-			nrf.RADIO.TASKS_DISABLE.Set(1)
-			for nrf.RADIO.STATE.Get() != nrf.RADIO_STATE_STATE_Disabled {
+			disableRadio()
+			if nrf.RADIO.EVENTS_END.Get() == 0 {
+				return transport.RxPacket{}, proto.ErrTimeout
 			}
-			return nil, proto.ErrTimeout
+			break // the frame ended just as the wait ran out
 		}
 	}
-	nrf.RADIO.TASKS_DISABLE.Set(1)
-	for nrf.RADIO.STATE.Get() != nrf.RADIO_STATE_STATE_Disabled {
+	p := transport.RxPacket{
+		Timestamp: time.Now(),
+		HWCRCOK:   d.config.NoHWCRC || nrf.RADIO.CRCSTATUS.Get() == nrf.RADIO_CRCSTATUS_CRCSTATUS_CRCOk,
+		Pipe:      uint8(nrf.RADIO.RXMATCH.Get()),
+	}
+	if nrf.RADIO.EVENTS_RSSIEND.Get() != 0 {
+		d.rssi, d.sampled = -int8(nrf.RADIO.RSSISAMPLE.Get()&0x7F), true
+		p.RSSI = d.rssi
 	}
-	frameLen := int(d.buffer[0]) + proto.LengthFieldSize
-	if frameLen > proto.MaxFrameSize {
-		frameLen = proto.MaxFrameSize
+	if !useShorts {
+		disableRadio()
 	}
-	out := make([]byte, frameLen)
-	copy(out, d.buffer[:frameLen])
-	return out, nil
+	frameLen := rxFrameLen(d.buffer[0])
+	p.Data = make([]byte, frameLen)
+	copy(p.Data, d.buffer[:frameLen])
+	return p, nil
 }
@@ -0,0 +1,8 @@
+package nrf
+
+// withPrefix returns the value of PREFIX0, for pipes 0 to 3, or PREFIX1,
+// for pipes 4 to 7, reg with the byte lane of pipe set to prefix.
+func withPrefix(reg uint32, pipe uint8, prefix byte) uint32 {
+	shift := 8 * uint32(pipe%4)
+	return reg&^(0xFF<<shift) | uint32(prefix)<<shift
+}
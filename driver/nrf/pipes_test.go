@@ -0,0 +1,23 @@
+package nrf
+
+import "testing"
+
+func TestWithPrefix(t *testing.T) {
+	tests := []struct {
+		reg    uint32
+		pipe   uint8
+		prefix byte
+		want   uint32
+	}{
+		{0x00000000, 0, 0xE7, 0x000000E7},
+		{0x000000E7, 1, 0xC2, 0x0000C2E7},
+		{0x44332211, 3, 0xAA, 0xAA332211},
+		{0x44332211, 4, 0xAA, 0x443322AA},
+		{0x44332211, 6, 0x00, 0x44002211},
+	}
+	for _, tt := range tests {
+		if got := withPrefix(tt.reg, tt.pipe, tt.prefix); got != tt.want {
+			t.Errorf("withPrefix(%#08x, %d, %#02x) = %#08x, want %#08x", tt.reg, tt.pipe, tt.prefix, got, tt.want)
+		}
+	}
+}
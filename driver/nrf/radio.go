@@ -16,6 +16,13 @@ func StartHFCLK() {
 	}
 }
 
+// disableRadio disables the radio and waits until it is.
+func disableRadio() {
+	nrf.RADIO.TASKS_DISABLE.Set(1)
+	for nrf.RADIO.STATE.Get() != nrf.RADIO_STATE_STATE_Disabled {
+	}
+}
+
 // ConfigureRadio sets up mode, power and addressing for the given channel.
 func ConfigureRadio(address uint32, prefix byte, channel uint8) error {
 	if channel > 125 {
@@ -38,7 +45,7 @@ func ConfigureRadio(address uint32, prefix byte, channel uint8) error {
 			(0 << nrf.RADIO_PCNF0_S1LEN_Pos))
 
 	nrf.RADIO.PCNF1.Set(
-		(proto.MaxFrameSize << nrf.RADIO_PCNF1_MAXLEN_Pos) |
+		(maxLength << nrf.RADIO_PCNF1_MAXLEN_Pos) |
 			(0 << nrf.RADIO_PCNF1_STATLEN_Pos) |
 			(3 << nrf.RADIO_PCNF1_BALEN_Pos) |
 			(nrf.RADIO_PCNF1_ENDIAN_Little << nrf.RADIO_PCNF1_ENDIAN_Pos))
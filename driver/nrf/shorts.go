@@ -0,0 +1,10 @@
+//go:build (tinygo || baremetal) && !nrfnoshorts
+
+package nrf
+
+// useShorts has Tx and Rx let the radio chain their steps through SHORTS:
+// READY starts the transfer and END disables the radio, so the CPU waits
+// for the final event alone. The nrfnoshorts tag keeps the
+// register-by-register sequence so the two can be timed against each
+// other on hardware; that comparison has not been made yet.
+const useShorts = true
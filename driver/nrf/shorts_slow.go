@@ -0,0 +1,7 @@
+//go:build (tinygo || baremetal) && nrfnoshorts
+
+package nrf
+
+// useShorts is off: Tx and Rx trigger START and DISABLE themselves, as
+// before shortcuts were used. See shorts.go.
+const useShorts = false
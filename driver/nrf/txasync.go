@@ -0,0 +1,102 @@
+//go:build tinygo || baremetal
+
+package nrf
+
+import (
+	"runtime/interrupt"
+	"runtime/volatile"
+	"time"
+	"unsafe"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+
+	"device/nrf"
+)
+
+const (
+	// txRampUp is how long the radio takes from TXEN to READY, at most.
+	txRampUp = 140 * time.Microsecond
+	// txOverhead is the preamble, address and CRC bytes sent around a
+	// frame.
+	txOverhead = 1 + 4 + 1
+)
+
+// txDone is set by the RADIO interrupt once the TxAsync frame is sent.
+var txDone volatile.Register8
+
+// handleRadioIRQ runs when the radio is disabled after a TxAsync frame. It
+// only marks the frame sent: the interrupt cannot wake a goroutine, and
+// done takes the transport's locks.
+func handleRadioIRQ(interrupt.Interrupt) {
+	if nrf.RADIO.EVENTS_DISABLED.Get() == 0 {
+		return
+	}
+	nrf.RADIO.INTENCLR.Set(nrf.RADIO_INTENCLR_DISABLED_Msk)
+	nrf.RADIO.SHORTS.Set(0)
+	txDone.Set(1)
+}
+
+// TxAsync starts transmitting data and returns without waiting for it to
+// leave the radio. READY starts the frame and END disables the radio
+// whether or not the driver was built with nrfnoshorts, so the frame goes
+// out without the CPU, and the DISABLED interrupt marks it sent. A
+// goroutine sleeps through the frame's airtime rather than spinning, then
+// calls done, after the done of the frame before. Tx, TxBurst, TxAsync,
+// Rx, SampleRSSI, Configure, SetChannel, Sleep and Close wait for the
+// frame first; done may call Sleep, as the transport does to power the
+// radio down after the last frame.
+func (d *Driver) TxAsync(data []byte, done func(error)) error {
+	d.awaitSent()
+	if err := d.usable(); err != nil {
+		return err
+	}
+	if !txFrameOK(data) {
+		return proto.ErrInvalidPayload
+	}
+	copy(d.buffer[:], data)
+	airtime := txRampUp + time.Duration((len(data)+txOverhead)*8)*time.Second/time.Duration(d.rate.BitRate())
+
+	txDone.Set(0)
+	nrf.RADIO.PACKETPTR.Set(uint32(uintptr(unsafe.Pointer(&d.buffer[0]))))
+	nrf.RADIO.SHORTS.Set(nrf.RADIO_SHORTS_READY_START_Msk | nrf.RADIO_SHORTS_END_DISABLE_Msk)
+	nrf.RADIO.EVENTS_DISABLED.Set(0)
+	nrf.RADIO.INTENSET.Set(nrf.RADIO_INTENSET_DISABLED_Msk)
+	nrf.RADIO.TASKS_TXEN.Set(1)
+
+	sent, acked := make(chan struct{}), make(chan struct{})
+	d.mu.Lock()
+	prev := d.acked
+	d.sent, d.acked = sent, acked
+	d.mu.Unlock()
+	go func() {
+		time.Sleep(airtime)
+		for txDone.Get() == 0 {
+			time.Sleep(txRampUp)
+		}
+		close(sent)
+		if prev != nil {
+			<-prev
+		}
+		done(nil)
+		close(acked)
+	}()
+	return nil
+}
+
+// enableRadioIRQ lets the RADIO interrupt through to handleRadioIRQ.
+func enableRadioIRQ() {
+	irq := interrupt.New(nrf.IRQ_RADIO, handleRadioIRQ)
+	irq.Enable()
+}
+
+// awaitSent waits until the frame TxAsync started last has been sent. The
+// done of a frame may call it, from the goroutine that waited for the
+// frame, while the next one is being started.
+func (d *Driver) awaitSent() {
+	d.mu.Lock()
+	sent := d.sent
+	d.mu.Unlock()
+	if sent != nil {
+		<-sent
+	}
+}
@@ -0,0 +1,56 @@
+package nrf
+
+import proto "github.com/ystepanoff/nrfcomm/protocol"
+
+// TXPOWER register values of the output power levels, in dBm, each radio
+// supports. Most levels are written as the level itself, a two's
+// complement byte, but the lowest is 0xD8 on every chip: -40 dBm on the
+// nRF52 series and -30 dBm on the nRF51.
+var (
+	nrf51TxPower = map[int8]uint32{
+		4:   0x04, // Pos4dBm
+		0:   0x00, // 0dBm
+		-4:  0xFC, // Neg4dBm
+		-8:  0xF8, // Neg8dBm
+		-12: 0xF4, // Neg12dBm
+		-16: 0xF0, // Neg16dBm
+		-20: 0xEC, // Neg20dBm
+		-30: 0xD8, // Neg30dBm
+	}
+	nrf52832TxPower = map[int8]uint32{
+		4:   0x04,
+		3:   0x03,
+		0:   0x00,
+		-4:  0xFC,
+		-8:  0xF8,
+		-12: 0xF4,
+		-16: 0xF0,
+		-20: 0xEC,
+		-40: 0xD8, // Neg40dBm
+	}
+	nrf52840TxPower = map[int8]uint32{
+		8:   0x08,
+		7:   0x07,
+		6:   0x06,
+		5:   0x05,
+		4:   0x04,
+		3:   0x03,
+		2:   0x02,
+		0:   0x00,
+		-4:  0xFC,
+		-8:  0xF8,
+		-12: 0xF4,
+		-16: 0xF0,
+		-20: 0xEC,
+		-40: 0xD8,
+	}
+)
+
+// txPowerValue returns the TXPOWER register value for dbm, or
+// ErrInvalidTxPower if levels does not include it.
+func txPowerValue(levels map[int8]uint32, dbm int8) (uint32, error) {
+	if v, ok := levels[dbm]; ok {
+		return v, nil
+	}
+	return 0, proto.ErrInvalidTxPower
+}
@@ -0,0 +1,5 @@
+//go:build (tinygo || baremetal) && nrf51
+
+package nrf
+
+var txPowerLevels = nrf51TxPower
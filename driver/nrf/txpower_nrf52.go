@@ -0,0 +1,5 @@
+//go:build (tinygo || baremetal) && nrf52
+
+package nrf
+
+var txPowerLevels = nrf52832TxPower
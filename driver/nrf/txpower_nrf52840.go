@@ -0,0 +1,6 @@
+//go:build (tinygo || baremetal) && !nrf51 && !nrf52
+
+package nrf
+
+// The nRF52840 of the nice!nano, also assumed for other targets.
+var txPowerLevels = nrf52840TxPower
@@ -0,0 +1,35 @@
+package nrf
+
+import (
+	"testing"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+func TestTxPowerValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		levels map[int8]uint32
+		dbm    int8
+		want   uint32
+		err    error
+	}{
+		{"nRF52840 +8 dBm", nrf52840TxPower, 8, 0x08, nil},
+		{"nRF52840 0 dBm", nrf52840TxPower, 0, 0x00, nil},
+		{"nRF52840 -12 dBm", nrf52840TxPower, -12, 0xF4, nil},
+		{"nRF52840 -40 dBm", nrf52840TxPower, -40, 0xD8, nil},
+		{"nRF52840 -30 dBm", nrf52840TxPower, -30, 0, proto.ErrInvalidTxPower},
+		{"nRF52832 +3 dBm", nrf52832TxPower, 3, 0x03, nil},
+		{"nRF52832 +8 dBm", nrf52832TxPower, 8, 0, proto.ErrInvalidTxPower},
+		{"nRF51 +4 dBm", nrf51TxPower, 4, 0x04, nil},
+		{"nRF51 -30 dBm", nrf51TxPower, -30, 0xD8, nil},
+		{"nRF51 +3 dBm", nrf51TxPower, 3, 0, proto.ErrInvalidTxPower},
+		{"nRF51 -1 dBm", nrf51TxPower, -1, 0, proto.ErrInvalidTxPower},
+	}
+	for _, tt := range tests {
+		got, err := txPowerValue(tt.levels, tt.dbm)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%s: txPowerValue() = %#x, %v, want %#x, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
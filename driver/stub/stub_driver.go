@@ -3,6 +3,7 @@
 package stub
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -15,48 +16,499 @@ type Driver struct {
 	mu    sync.Mutex
 	rxBuf ringBuffer
 	txBuf ringBuffer
+	ready *sync.Cond    // signalled on InjectRx and Sleep, see RxWait
+	sent  *sync.Cond    // signalled when a TxAsync frame is sent
+	busy  bool          // a TxAsync frame is on the air
+	acked chan struct{} // closed once the done of the last TxAsync returned
+
+	// RampUp, if set, is spent busy-waiting every time the radio is
+	// enabled for transmission, like the TXEN ramp-up of real hardware.
+	RampUp time.Duration
+
+	txPower int8
+	rate    transport.DataRate
+	ambient int8 // see SetAmbientRSSI, NoiseFloor until set
+	channel uint8
+	loss    map[uint8]float64 // see SetChannelLoss
+	lost    map[uint8]float64 // frames owed to the loss of each channel
+	asleep  bool
+	closed  bool     // see Close
+	trace   []string // see StartTrace, nil when off
+	signal  int8     // see SetRSSI, 0 until set
+	rssi    int8     // of the frame last received, see RSSI
+	pipes   [8]pipe  // see ConfigurePipe
+	enabled uint8    // pipes listened on but pipe 0, see EnablePipes
+	masked  bool     // enabled is in effect; Configure clears it
+	config  Config
+}
+
+// Config configures the driver, see NewWithConfig.
+type Config struct {
+	// NoHWCRC simulates a radio with its own CRC turned off: injected
+	// packets are all received as passing it, leaving corrupt frames to
+	// the frame CRC.
+	NoHWCRC bool
+}
+
+// pipe is the receive address of a pipe.
+type pipe struct {
+	address uint32
+	prefix  byte
+}
+
+// ErrAsleep is returned by Tx, Rx and SampleRSSI while the radio is
+// asleep.
+var ErrAsleep = proto.ErrAsleep
+
+// NoiseFloor is the energy SampleRSSI reports on a quiet channel.
+const NoiseFloor = -100
+
+func New() transport.RadioDriver { return NewWithConfig(Config{}) }
+
+// NewWithConfig returns a driver configured by cfg.
+func NewWithConfig(cfg Config) transport.RadioDriver {
+	return &Driver{ambient: NoiseFloor, config: cfg}
+}
+
+func (d *Driver) StartHFCLK() {}
+
+// Configure records the address as that of pipe 0, which it makes the only
+// pipe listened on, and tunes to channel.
+// Configure sets the address of pipe 0, listening on it alone, and the
+// channel. It waits for a TxAsync frame on the air and reopens a driver
+// closed by Close.
+func (d *Driver) Configure(address uint32, prefix byte, channel uint8) error {
+	d.mu.Lock()
+	d.awaitSentLocked()
+	d.traceLocked("Configure")
+	d.closed = false
+	d.pipes[0] = pipe{address, prefix}
+	d.masked = false
+	d.mu.Unlock()
+	return d.SetChannel(channel)
+}
+
+// ConfigurePipe records the address of pipe p, see PipeAddress.
+func (d *Driver) ConfigurePipe(p uint8, address uint32, prefix byte) error {
+	if int(p) >= len(d.pipes) {
+		return proto.ErrInvalidPipe
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pipes[p] = pipe{address, prefix}
+	return nil
+}
+
+// EnablePipes sets the pipes, one bit each, on which injected frames are
+// received, see InjectRxPacket.
+func (d *Driver) EnablePipes(mask uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.enabled, d.masked = mask, true
+}
+
+// Pipes returns the pipes listened on, one bit each: those of EnablePipes,
+// or pipe 0 alone since Configure.
+func (d *Driver) Pipes() uint8 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pipesLocked()
+}
+
+func (d *Driver) pipesLocked() uint8 {
+	if !d.masked {
+		return 1
+	}
+	return d.enabled
+}
+
+// PipeAddress returns the address and prefix of pipe p set by Configure or
+// ConfigurePipe.
+func (d *Driver) PipeAddress(p uint8) (address uint32, prefix byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if int(p) >= len(d.pipes) {
+		return 0, 0
+	}
+	return d.pipes[p].address, d.pipes[p].prefix
+}
+
+// SetChannel records the channel, once a TxAsync frame on the air is sent.
+func (d *Driver) SetChannel(channel uint8) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.awaitSentLocked()
+	d.channel = channel
+	return nil
+}
+
+// SetChannelLoss makes the driver lose ratio, between 0 and 1, of the
+// frames it transmits on channel ch, to simulate interference there. Lost
+// frames are spread evenly and do not reach the transmit log.
+func (d *Driver) SetChannelLoss(ch uint8, ratio float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.loss == nil {
+		d.loss = make(map[uint8]float64)
+		d.lost = make(map[uint8]float64)
+	}
+	d.loss[ch] = ratio
+	d.lost[ch] = 0
+}
+
+// dropLocked reports whether the next frame on the current channel is lost.
+func (d *Driver) dropLocked() bool {
+	ratio := d.loss[d.channel]
+	if ratio <= 0 {
+		return false
+	}
+	d.lost[d.channel] += ratio
+	if d.lost[d.channel] < 1 {
+		return false
+	}
+	d.lost[d.channel]--
+	return true
+}
+
+// SetTxPower records the output power, see TxPower.
+func (d *Driver) SetTxPower(dbm int8) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.txPower = dbm
+	return nil
+}
+
+// SetDataRate records the data rate, see DataRate.
+func (d *Driver) SetDataRate(rate transport.DataRate) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rate = rate
+	return nil
+}
+
+// DataRate returns the data rate last set, DataRate1Mbit by default.
+func (d *Driver) DataRate() transport.DataRate {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rate
+}
+
+// SetAmbientRSSI sets the energy, in dBm, that SampleRSSI reports, to
+// simulate other radios on the channel.
+func (d *Driver) SetAmbientRSSI(dbm int8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ambient = dbm
+}
+
+// SampleRSSI returns the energy set with SetAmbientRSSI.
+func (d *Driver) SampleRSSI() (int8, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.usableLocked(); err != nil {
+		return 0, err
+	}
+	return d.ambient, nil
+}
+
+// TxPower returns the output power last set, 0 dBm by default.
+func (d *Driver) TxPower() int8 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.txPower
+}
+
+// Sleep marks the radio as powered down until Wake.
+func (d *Driver) Sleep() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.asleep = true
+	d.traceLocked("Sleep")
+	d.readyLocked().Broadcast()
+	return nil
+}
+
+// Wake marks the radio as powered again. It fails with ErrClosed after
+// Close.
+func (d *Driver) Wake() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return proto.ErrClosed
+	}
+	d.asleep = false
+	d.traceLocked("Wake")
+	return nil
 }
 
-func New() transport.RadioDriver { return &Driver{} }
+// Close waits for a TxAsync frame on the air and marks the radio as
+// released: Tx, Rx, SampleRSSI and Wake fail with ErrClosed until
+// Configure.
+func (d *Driver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.awaitSentLocked()
+	d.closed = true
+	d.traceLocked("Close")
+	d.readyLocked().Broadcast()
+	return nil
+}
+
+// Closed reports whether the driver is closed.
+func (d *Driver) Closed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
 
-func (d *Driver) StartHFCLK()                                                {}
-func (d *Driver) Configure(address uint32, prefix byte, channel uint8) error { return nil }
-func (d *Driver) SetChannel(channel uint8) error                             { return nil }
+// usableLocked returns the error the radio operations fail with while the
+// driver is closed or asleep.
+func (d *Driver) usableLocked() error {
+	if d.closed {
+		return proto.ErrClosed
+	}
+	if d.asleep {
+		return ErrAsleep
+	}
+	return nil
+}
+
+// Asleep reports whether the radio is asleep.
+func (d *Driver) Asleep() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.asleep
+}
+
+// StartTrace starts recording the calls of Configure, Sleep, Wake, Close,
+// Tx, TxBurst and TxAsync, discarding those recorded so far; see Trace.
+func (d *Driver) StartTrace() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.trace = []string{}
+}
+
+// Trace returns the names of the calls recorded since StartTrace.
+func (d *Driver) Trace() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.trace...)
+}
+
+func (d *Driver) traceLocked(call string) {
+	if d.trace != nil {
+		d.trace = append(d.trace, call)
+	}
+}
 
 func (d *Driver) Tx(data []byte) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	d.awaitSentLocked()
+	if err := d.usableLocked(); err != nil {
+		return err
+	}
+	d.traceLocked("Tx")
+	d.rampUp()
+	if d.dropLocked() {
+		return nil
+	}
 	frame := make([]byte, len(data))
 	copy(frame, data)
-	d.txBuf.push(frame)
+	d.txBuf.push(transport.RxPacket{Data: frame})
 	return nil
 }
 
-func (d *Driver) Rx(timeout time.Duration) ([]byte, error) {
-	deadline := time.Now().Add(timeout)
-	for {
+// TxBurst records frames in order, ramping up once for all of them.
+func (d *Driver) TxBurst(frames [][]byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.awaitSentLocked()
+	if err := d.usableLocked(); err != nil {
+		return err
+	}
+	d.traceLocked("TxBurst")
+	d.rampUp()
+	for _, data := range frames {
+		if d.dropLocked() {
+			continue
+		}
+		frame := make([]byte, len(data))
+		copy(frame, data)
+		d.txBuf.push(transport.RxPacket{Data: frame})
+	}
+	return nil
+}
+
+// TxAsync records data as Tx does, but on a goroutine once the frame's
+// airtime at the data rate has passed, and then calls done. A frame sent
+// meanwhile waits for it; done is called in the order the frames were
+// sent, after that of the frame before.
+func (d *Driver) TxAsync(data []byte, done func(error)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.awaitSentLocked()
+	if err := d.usableLocked(); err != nil {
+		return err
+	}
+	d.traceLocked("TxAsync")
+	d.rampUp()
+	d.busy = true
+	frame := append([]byte(nil), data...)
+	airtime := time.Duration(len(frame)) * 8 * time.Second / time.Duration(d.rate.BitRate())
+	prev, acked := d.acked, make(chan struct{})
+	d.acked = acked
+	go func() {
+		time.Sleep(airtime)
 		d.mu.Lock()
-		frame, ok := d.rxBuf.pop()
+		if !d.dropLocked() {
+			d.txBuf.push(transport.RxPacket{Data: frame})
+		}
+		d.busy = false
+		d.sentLocked().Broadcast()
 		d.mu.Unlock()
-		if ok {
-			out := make([]byte, len(frame))
-			copy(out, frame)
-			return out, nil
+		if prev != nil {
+			<-prev
 		}
+		done(nil)
+		close(acked)
+	}()
+	return nil
+}
 
-		if time.Now().After(deadline) {
-			return nil, proto.ErrTimeout
+// awaitSentLocked waits until the frame of TxAsync, if any, is sent.
+func (d *Driver) awaitSentLocked() {
+	for d.busy {
+		d.sentLocked().Wait()
+	}
+}
+
+// sentLocked returns the condition awaitSentLocked waits on.
+func (d *Driver) sentLocked() *sync.Cond {
+	if d.sent == nil {
+		d.sent = sync.NewCond(&d.mu)
+	}
+	return d.sent
+}
+
+func (d *Driver) rampUp() {
+	for start := time.Now(); time.Since(start) < d.RampUp; {
+	}
+}
+
+func (d *Driver) Rx(timeout time.Duration) ([]byte, error) {
+	p, err := d.RxMeta(timeout)
+	return p.Data, err
+}
+
+// RxMeta is Rx returning the packet as injected, see InjectRxPacket.
+func (d *Driver) RxMeta(timeout time.Duration) (transport.RxPacket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	p, err := d.RxWait(ctx)
+	if err == context.DeadlineExceeded {
+		return p, proto.ErrTimeout
+	}
+	return p, err
+}
+
+// RxWait blocks until a frame is injected or ctx is done, returning
+// ctx.Err() in the latter case, see transport.RadioRxWaiter.
+func (d *Driver) RxWait(ctx context.Context) (transport.RxPacket, error) {
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				d.mu.Lock()
+				d.readyLocked().Broadcast()
+				d.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		if err := d.usableLocked(); err != nil {
+			return transport.RxPacket{}, err
+		}
+		if p, ok := d.rxBuf.pop(); ok {
+			d.rssi = p.RSSI
+			p.Data = append([]byte(nil), p.Data...)
+			return p, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return transport.RxPacket{}, err
 		}
-		time.Sleep(1 * time.Millisecond)
+		d.readyLocked().Wait()
 	}
 }
 
+// readyLocked returns the condition RxWait waits on.
+func (d *Driver) readyLocked() *sync.Cond {
+	if d.ready == nil {
+		d.ready = sync.NewCond(&d.mu)
+	}
+	return d.ready
+}
+
 func (d *Driver) InjectRx(data []byte) {
+	d.InjectRxPacket(transport.RxPacket{Data: data, HWCRCOK: true})
+}
+
+// InjectRxRSSI is InjectRx for a frame received at the signal strength
+// rssi, in dBm, which RSSI reports once Rx returns the frame.
+func (d *Driver) InjectRxRSSI(data []byte, rssi int8) {
+	d.InjectRxPacket(transport.RxPacket{Data: data, RSSI: rssi, HWCRCOK: true})
+}
+
+// InjectRxPipe is InjectRx for a frame sent to the address of pipe p. It
+// is lost unless the driver listens on p, see Pipes.
+func (d *Driver) InjectRxPipe(p uint8, data []byte) {
+	d.InjectRxPacket(transport.RxPacket{Data: data, HWCRCOK: true, Pipe: p})
+}
+
+// InjectRxPacket queues p to be received as it is, to fabricate how a
+// frame was received: its strength, its time, whether it passed the
+// hardware CRC and the pipe it matched. A packet without an RSSI gets that
+// of SetRSSI; one for a pipe not listened on is lost. With Config.NoHWCRC,
+// every packet passes the hardware CRC.
+func (d *Driver) InjectRxPacket(p transport.RxPacket) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	frame := make([]byte, len(data))
-	copy(frame, data)
-	d.rxBuf.push(frame)
+	if int(p.Pipe) >= len(d.pipes) || d.pipesLocked()&(1<<p.Pipe) == 0 {
+		return
+	}
+	p.Data = append([]byte(nil), p.Data...)
+	p.HWCRCOK = p.HWCRCOK || d.config.NoHWCRC
+	if p.RSSI == 0 {
+		p.RSSI = d.signal
+	}
+	d.rxBuf.push(p)
+	d.readyLocked().Broadcast()
+}
+
+// SetRSSI sets the signal strength, in dBm, of the frames InjectRx injects
+// from now on, which RSSI reports once Rx returns them. Until it is called
+// they carry none.
+func (d *Driver) SetRSSI(dbm int8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.signal = dbm
+}
+
+// RSSI returns the signal strength of the frame Rx returned last, set by
+// SetRSSI or InjectRxRSSI, and ErrNoRSSI if it has none.
+func (d *Driver) RSSI() (int8, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.rssi == 0 {
+		return 0, proto.ErrNoRSSI
+	}
+	return d.rssi, nil
 }
 
 func (d *Driver) GetTxLog() [][]byte {
@@ -67,16 +519,17 @@ func (d *Driver) GetTxLog() [][]byte {
 
 const ringCapacity = 64
 
+// ringBuffer holds frames, and for those received how they were.
 type ringBuffer struct {
-	data       [ringCapacity][]byte
+	data       [ringCapacity]transport.RxPacket
 	head, tail int // head = next pop, tail = next push
 	count      int
 }
 
-func (rb *ringBuffer) push(frame []byte) {
+func (rb *ringBuffer) push(frame transport.RxPacket) {
 	if rb.count == ringCapacity {
 		// Overwrite the oldest when buffer is full to keep memory bounded
-		rb.data[rb.tail] = nil
+		rb.data[rb.tail] = transport.RxPacket{}
 		rb.head = (rb.head + 1) % ringCapacity
 		rb.count--
 	}
@@ -85,12 +538,12 @@ func (rb *ringBuffer) push(frame []byte) {
 	rb.count++
 }
 
-func (rb *ringBuffer) pop() ([]byte, bool) {
+func (rb *ringBuffer) pop() (transport.RxPacket, bool) {
 	if rb.count == 0 {
-		return nil, false
+		return transport.RxPacket{}, false
 	}
 	frame := rb.data[rb.head]
-	rb.data[rb.head] = nil
+	rb.data[rb.head] = transport.RxPacket{}
 	rb.head = (rb.head + 1) % ringCapacity
 	rb.count--
 	return frame, true
@@ -101,7 +554,7 @@ func (rb *ringBuffer) snapshot() [][]byte {
 	idx := 0
 	i := rb.head
 	for c := 0; c < rb.count; c++ {
-		p := rb.data[i]
+		p := rb.data[i].Data
 		cp := make([]byte, len(p))
 		copy(cp, p)
 		out[idx] = cp
@@ -0,0 +1,634 @@
+//go:build !tinygo && !baremetal
+
+package stub
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+	"github.com/ystepanoff/nrfcomm/transport"
+)
+
+// pairingAck returns an encoded ACK from receiver id for sequence seq.
+func pairingAck(id proto.DeviceID, seq uint32) []byte {
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, uint32(id))
+	return proto.EncodeFrame(&proto.Frame{SenderID: id, Type: proto.FrameTypeAck, Seq: seq, Payload: payload})
+}
+
+func TestBatchingReducesFramesSent(t *testing.T) {
+	const samples = 40
+
+	send := func(batched bool) int {
+		d := New().(*Driver)
+		tx := transport.NewTransmitterWithDriver(0xCAFE, d)
+		// Pair by replaying the receiver's ACK for the first pairing frame.
+		d.InjectRx(pairingAck(0xBEEF, 0))
+		if err := tx.StartPairing(0xBEEF); err != nil {
+			t.Fatalf("StartPairing() error = %v", err)
+		}
+
+		before := len(d.GetTxLog())
+		for i := 0; i < samples; i++ {
+			sample := []byte{byte(i), 0, 0, 0}
+			var err error
+			if batched {
+				err = tx.SendDataBatched(sample)
+			} else {
+				_, err = tx.SendData(sample)
+			}
+			if err != nil {
+				t.Fatalf("send error = %v", err)
+			}
+		}
+		if err := tx.Flush(); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+		return len(d.GetTxLog()) - before
+	}
+
+	plain := send(false)
+	batched := send(true)
+	t.Logf("%d samples: %d frames unbatched, %d frames batched", samples, plain, batched)
+
+	if plain != samples {
+		t.Errorf("unbatched frames = %d, want %d", plain, samples)
+	}
+	if batched > plain/10 {
+		t.Errorf("batched frames = %d, want at most %d", batched, plain/10)
+	}
+}
+
+func BenchmarkSendBurst(b *testing.B) {
+	const frames = 16
+	payloads := make([][]byte, frames)
+	for i := range payloads {
+		payloads[i] = []byte{byte(i), 0, 0, 0}
+	}
+	for _, burst := range []bool{false, true} {
+		name := "Sequential"
+		if burst {
+			name = "Burst"
+		}
+		b.Run(name, func(b *testing.B) {
+			d := New().(*Driver)
+			tx := transport.NewTransmitterWithDriver(0xCAFE, d)
+			d.InjectRx(pairingAck(0xBEEF, 0))
+			if err := tx.StartPairing(0xBEEF); err != nil {
+				b.Fatalf("StartPairing() error = %v", err)
+			}
+			// 130µs is the nRF52 TXEN ramp-up in default mode.
+			d.RampUp = 130 * time.Microsecond
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if burst {
+					if err := tx.SendBurst(payloads); err != nil {
+						b.Fatalf("SendBurst() error = %v", err)
+					}
+					continue
+				}
+				for _, p := range payloads {
+					if _, err := tx.SendData(p); err != nil {
+						b.Fatalf("SendData() error = %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestChannelLoss(t *testing.T) {
+	d := New().(*Driver)
+	if err := d.Configure(proto.DefaultAddress, proto.DefaultPrefix, 7); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	d.SetChannelLoss(7, 0.5)
+	for i := 0; i < 10; i++ {
+		_ = d.Tx([]byte{byte(i)})
+	}
+	if n := len(d.GetTxLog()); n != 5 {
+		t.Errorf("%d of 10 frames sent with half of them lost", n)
+	}
+
+	_ = d.SetChannel(40)
+	for i := 0; i < 10; i++ {
+		_ = d.Tx([]byte{byte(i)})
+	}
+	if n := len(d.GetTxLog()); n != 15 {
+		t.Errorf("%d frames sent after moving to a clear channel, want 15", n)
+	}
+}
+
+func TestAmbientRSSI(t *testing.T) {
+	d := New().(*Driver)
+	tx := transport.NewTransmitterWithDriver(0xCAFE, d, transport.WithCSMA(transport.CSMAConfig{Backoff: 100 * time.Microsecond, Retries: 2}))
+
+	if _, err := tx.SendFrame(proto.FrameTypeControl, []byte{1}); err != nil {
+		t.Fatalf("SendFrame() on a quiet channel error = %v", err)
+	}
+	d.SetAmbientRSSI(-50)
+	if _, err := tx.SendFrame(proto.FrameTypeControl, []byte{2}); err != proto.ErrChannelBusy {
+		t.Errorf("SendFrame() on a busy channel error = %v, want ErrChannelBusy", err)
+	}
+	if n := len(d.GetTxLog()); n != 1 {
+		t.Errorf("%d frames sent, want only the one on the quiet channel", n)
+	}
+}
+
+func TestIdleSleep(t *testing.T) {
+	d := New().(*Driver)
+	tx := transport.NewTransmitterWithDriver(0xCAFE, d)
+	d.InjectRx(pairingAck(0xBEEF, 0))
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	tx.SetIdlePolicy(transport.IdleSleep, 0)
+	if !d.Asleep() {
+		t.Fatal("radio awake after SetIdlePolicy(IdleSleep)")
+	}
+
+	d.StartTrace()
+	seq, err := tx.SendData([]byte{1})
+	if err != nil {
+		t.Fatalf("SendData() error = %v", err)
+	}
+	d.InjectRx(pairingAck(0xBEEF, seq+1))
+	if err := tx.SendDataReliable([]byte{2}, 3); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+	tx.StartHeartbeatTask()
+	time.Sleep(20 * time.Millisecond)
+	tx.StopHeartbeatTask()
+
+	want := "[Wake Tx Sleep Wake Tx Sleep Wake Tx Sleep]"
+	if got := fmt.Sprint(d.Trace()); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+
+	tx.SetIdlePolicy(transport.IdleAwake, 0)
+	if d.Asleep() {
+		t.Error("radio asleep after SetIdlePolicy(IdleAwake)")
+	}
+}
+
+func TestSleepRefusesRadio(t *testing.T) {
+	d := New().(*Driver)
+	if err := d.Sleep(); err != nil {
+		t.Fatalf("Sleep() error = %v", err)
+	}
+	if err := d.Tx([]byte{1}); err != proto.ErrAsleep {
+		t.Errorf("Tx() error = %v, want ErrAsleep", err)
+	}
+	if err := d.TxBurst([][]byte{{1}}); err != proto.ErrAsleep {
+		t.Errorf("TxBurst() error = %v, want ErrAsleep", err)
+	}
+	if _, err := d.Rx(time.Millisecond); err != proto.ErrAsleep {
+		t.Errorf("Rx() error = %v, want ErrAsleep", err)
+	}
+	if _, err := d.SampleRSSI(); err != proto.ErrAsleep {
+		t.Errorf("SampleRSSI() error = %v, want ErrAsleep", err)
+	}
+
+	if err := d.Wake(); err != nil {
+		t.Fatalf("Wake() error = %v", err)
+	}
+	if err := d.Tx([]byte{1}); err != nil {
+		t.Errorf("Tx() after Wake error = %v", err)
+	}
+	if _, err := d.SampleRSSI(); err != nil {
+		t.Errorf("SampleRSSI() after Wake error = %v", err)
+	}
+}
+
+func TestTxAsyncOrder(t *testing.T) {
+	d := New().(*Driver)
+	if err := d.SetDataRate(transport.DataRate250Kbit); err != nil {
+		t.Fatalf("SetDataRate() error = %v", err)
+	}
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 5; i++ {
+		i := i
+		wg.Add(1)
+		err := d.TxAsync(bytes.Repeat([]byte{byte(i)}, 32), func(err error) {
+			defer wg.Done()
+			if err != nil {
+				t.Errorf("frame %d: done error = %v", i, err)
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatalf("TxAsync(%d) error = %v", i, err)
+		}
+	}
+	// Tx waits for the last frame on the air rather than overlapping it.
+	if err := d.Tx([]byte{9}); err != nil {
+		t.Fatalf("Tx() error = %v", err)
+	}
+	wg.Wait()
+
+	if got := fmt.Sprint(order); got != "[0 1 2 3 4]" {
+		t.Errorf("done called in order %s, want [0 1 2 3 4]", got)
+	}
+	log := d.GetTxLog()
+	if len(log) != 6 {
+		t.Fatalf("%d frames sent, want 6", len(log))
+	}
+	for i, frame := range log[:5] {
+		if frame[0] != byte(i) {
+			t.Errorf("frame %d on the air is frame %d", i, frame[0])
+		}
+	}
+	if !bytes.Equal(log[5], []byte{9}) {
+		t.Errorf("last frame = %v, want the one of Tx", log[5])
+	}
+}
+
+func TestTxQueueAsync(t *testing.T) {
+	d := New().(*Driver)
+	tx := transport.NewTransmitterWithDriver(0xCAFE, d, transport.WithTxQueue(transport.TxQueueConfig{FlushOnClose: true}))
+	d.InjectRx(pairingAck(0xBEEF, 0))
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	d.StartTrace()
+	var (
+		mu   sync.Mutex
+		seqs []uint32
+		want []uint32
+	)
+	for i := 0; i < 3; i++ {
+		seq, err := tx.EnqueueFunc([]byte{byte(i)}, func(seq uint32, err error) {
+			if err != nil {
+				t.Errorf("frame %d: done error = %v", seq, err)
+			}
+			mu.Lock()
+			seqs = append(seqs, seq)
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatalf("EnqueueFunc() error = %v", err)
+		}
+		want = append(want, seq)
+	}
+	if err := tx.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if got := fmt.Sprint(d.Trace()); got != "[TxAsync TxAsync TxAsync Close]" {
+		t.Errorf("calls = %s, want the queue to use TxAsync", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(seqs) != fmt.Sprint(want) {
+		t.Errorf("done called for %v, want %v by Close", seqs, want)
+	}
+}
+
+func TestCloseTeardown(t *testing.T) {
+	d := New().(*Driver)
+	tx := transport.NewTransmitterWithDriver(0xCAFE, d, transport.WithGoodbye())
+	d.InjectRx(pairingAck(0xBEEF, 0))
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	d.StartTrace()
+	if err := tx.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := tx.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+	// The goodbye goes out before the radio is released, which happens once.
+	if got := fmt.Sprint(d.Trace()); got != "[Tx Close]" {
+		t.Errorf("transmitter teardown = %s, want [Tx Close]", got)
+	}
+
+	if err := d.Tx([]byte{1}); err != proto.ErrClosed {
+		t.Errorf("Tx() after Close error = %v, want ErrClosed", err)
+	}
+	if _, err := d.Rx(time.Millisecond); err != proto.ErrClosed {
+		t.Errorf("Rx() after Close error = %v, want ErrClosed", err)
+	}
+	if err := d.Wake(); err != proto.ErrClosed {
+		t.Errorf("Wake() after Close error = %v, want ErrClosed", err)
+	}
+	if err := d.Configure(0x12345678, 0xAB, 7); err != nil {
+		t.Fatalf("Configure() error = %v", err)
+	}
+	if d.Closed() {
+		t.Error("driver closed after Configure")
+	}
+
+	rx := transport.NewReceiverWithDriver(0xBEEF, d, transport.WithGoodbye())
+	rx.Listen()
+	pairInjected(t, d, rx)
+	d.StartTrace()
+	if err := rx.Close(); err != nil {
+		t.Fatalf("receiver Close() error = %v", err)
+	}
+	if got := fmt.Sprint(d.Trace()); got != "[Tx Close]" {
+		t.Errorf("receiver teardown = %s, want [Tx Close]", got)
+	}
+}
+
+func TestDataRate(t *testing.T) {
+	d := New().(*Driver)
+	tx := transport.NewTransmitterWithDriver(0xCAFE, d)
+	if d.DataRate() != transport.DataRate1Mbit {
+		t.Errorf("default rate = %v, want 1 Mbit", d.DataRate())
+	}
+	if err := tx.SetDataRate(transport.DataRate250Kbit); err != nil {
+		t.Fatalf("SetDataRate() error = %v", err)
+	}
+	if d.DataRate() != transport.DataRate250Kbit {
+		t.Errorf("rate = %v, want 250 kbit", d.DataRate())
+	}
+}
+
+func TestRxWaitLatency(t *testing.T) {
+	d := New().(*Driver)
+	rx := transport.NewReceiverWithDriver(0xBEEF, d)
+	heard := make(chan time.Time, 1)
+	rx.Use(func(next transport.FrameHandler) transport.FrameHandler {
+		return func(f *proto.Frame) {
+			heard <- time.Now()
+			next(f)
+		}
+	})
+	rx.Listen()
+	defer rx.StopListening()
+	time.Sleep(10 * time.Millisecond) // let the listen loop block in RxWait
+
+	const frames = 20
+	latencies := make([]time.Duration, frames)
+	for i := range latencies {
+		sent := time.Now()
+		d.InjectRx(proto.EncodeFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeControl, Seq: uint32(i)}))
+		select {
+		case at := <-heard:
+			latencies[i] = at.Sub(sent)
+		case <-time.After(time.Second):
+			t.Fatalf("frame %d not handled", i)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if median := latencies[frames/2]; median >= time.Millisecond {
+		t.Errorf("median delivery latency = %v, want under 1ms", median)
+	}
+}
+
+func TestRxWaitCancel(t *testing.T) {
+	d := New().(*Driver)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := d.RxWait(ctx); err != context.Canceled {
+		t.Errorf("RxWait() error = %v, want context.Canceled", err)
+	}
+	if _, err := d.Rx(time.Millisecond); err != proto.ErrTimeout {
+		t.Errorf("Rx() error = %v, want ErrTimeout", err)
+	}
+}
+
+func TestCallbackMeta(t *testing.T) {
+	d := New().(*Driver)
+	rx := transport.NewReceiverWithDriver(0xBEEF, d)
+	var mu sync.Mutex
+	var metas []transport.FrameMeta
+	plain := 0
+	rx.RegisterCallbackMeta(proto.FrameTypeData, func(f *proto.Frame, m transport.FrameMeta) {
+		mu.Lock()
+		metas = append(metas, m)
+		mu.Unlock()
+	})
+	rx.RegisterCallback(proto.FrameTypeData, func(*proto.Frame) {
+		mu.Lock()
+		plain++
+		mu.Unlock()
+	})
+	rx.Listen()
+	defer rx.StopListening()
+	pairInjected(t, d, rx)
+
+	data := proto.EncodeFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: 1, Payload: []byte{1}})
+	sent := time.Now()
+	d.InjectRxRSSI(data, -61)
+	d.InjectRx(data) // the repeat after a lost ACK
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if plain != 1 {
+		t.Errorf("plain callback called %d times, want once", plain)
+	}
+	if len(metas) != 2 {
+		t.Fatalf("meta callback called %d times, want 2", len(metas))
+	}
+	first, repeat := metas[0], metas[1]
+	if first.RSSI != -61 || first.Channel != proto.DefaultChannel || first.Duplicate || first.Received.Before(sent) {
+		t.Errorf("meta = %+v, want RSSI -61 on channel %d, received after %v", first, proto.DefaultChannel, sent)
+	}
+	if !repeat.Duplicate || repeat.RSSI != 0 {
+		t.Errorf("meta of the repeat = %+v, want a duplicate without RSSI", repeat)
+	}
+}
+
+// pairInjected pairs transmitter 0xCAFE with rx, listening on d, by
+// injecting its pairing request.
+func pairInjected(t *testing.T, d *Driver, rx *transport.Receiver) {
+	t.Helper()
+	request := make([]byte, 8)
+	request[0] = 0x42
+	binary.LittleEndian.PutUint32(request[4:], 0xBEEF)
+	d.InjectRx(proto.EncodeFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypePairing, Payload: request}))
+	for deadline := time.Now().Add(time.Second); !rx.IsPaired(0xCAFE); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("transmitter not paired")
+		}
+	}
+}
+
+func TestPipes(t *testing.T) {
+	d := New().(*Driver)
+	d.InjectRxPipe(1, []byte{1})
+	if _, err := d.Rx(time.Millisecond); err != proto.ErrTimeout {
+		t.Errorf("Rx() of a frame on a disabled pipe error = %v, want ErrTimeout", err)
+	}
+	if err := d.ConfigurePipe(8, 0, 0); err != proto.ErrInvalidPipe {
+		t.Errorf("ConfigurePipe(8) error = %v, want ErrInvalidPipe", err)
+	}
+
+	rx := transport.NewReceiverWithDriver(0xBEEF, d)
+	rx.Initialise()
+	rx.SetPrivateAddress(true)
+	pipes := make(chan uint8, 4)
+	rx.RegisterCallbackMeta(proto.FrameTypeData, func(f *proto.Frame, m transport.FrameMeta) { pipes <- m.Pipe })
+	pairingAddress, pairingPrefix := d.PipeAddress(0)
+	rx.Listen()
+	defer rx.StopListening()
+	pairInjected(t, d, rx)
+
+	// While pairing is open, the receiver listens for the private address
+	// on pipe 1 instead of alternating between the addresses.
+	for deadline := time.Now().Add(time.Second); d.Pipes() != 0b11; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pipes() = %#b, want pipes 0 and 1", d.Pipes())
+		}
+	}
+	address, prefix := proto.PrivateAddress(0xBEEF)
+	if a, p := d.PipeAddress(1); a != address || p != prefix {
+		t.Errorf("pipe 1 address = %#x/%#x, want the private %#x/%#x", a, p, address, prefix)
+	}
+	d.InjectRxPipe(1, proto.EncodeFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: 1, Payload: []byte{1}}))
+	select {
+	case pipe := <-pipes:
+		if pipe != 1 {
+			t.Errorf("FrameMeta.Pipe = %d, want 1", pipe)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame on pipe 1 not delivered")
+	}
+	if a, p := d.PipeAddress(0); a != pairingAddress || p != pairingPrefix {
+		t.Errorf("pipe 0 moved to %#x/%#x while pairing is open", a, p)
+	}
+
+	// Once pairing is closed, the private address is all it needs.
+	rx.DisablePairing()
+	for deadline := time.Now().Add(time.Second); d.Pipes() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pipes() = %#b after DisablePairing, want pipe 0 alone", d.Pipes())
+		}
+	}
+	if a, p := d.PipeAddress(0); a != address || p != prefix {
+		t.Errorf("pipe 0 address = %#x/%#x, want the private %#x/%#x", a, p, address, prefix)
+	}
+}
+
+func TestRSSI(t *testing.T) {
+	d := New().(*Driver)
+	rx := transport.NewReceiverWithDriver(0xBEEF, d)
+	rssi := make(chan int8, 4)
+	rx.RegisterCallbackMeta(proto.FrameTypeData, func(f *proto.Frame, m transport.FrameMeta) { rssi <- m.RSSI })
+	rx.Listen()
+	defer rx.StopListening()
+	pairInjected(t, d, rx)
+	if _, err := d.RSSI(); err != proto.ErrNoRSSI {
+		t.Errorf("RSSI() before SetRSSI error = %v, want ErrNoRSSI", err)
+	}
+
+	d.SetRSSI(-72)
+	for seq := uint32(1); seq <= 2; seq++ {
+		d.InjectRx(proto.EncodeFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: seq, Payload: []byte{1}}))
+		if seq == 1 {
+			d.SetRSSI(-55) // the strength the next frame arrives at
+		}
+	}
+	for _, want := range []int8{-72, -55} {
+		select {
+		case got := <-rssi:
+			if got != want {
+				t.Errorf("FrameMeta.RSSI = %d, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("frame not delivered")
+		}
+	}
+	if s, _ := rx.DeviceStats(0xCAFE); s.RSSI != -55 {
+		t.Errorf("DeviceStats().RSSI = %d, want the last frame's -55", s.RSSI)
+	}
+	if got, err := d.RSSI(); err != nil || got != -55 {
+		t.Errorf("RSSI() = %d, %v, want -55", got, err)
+	}
+}
+
+func TestNoHWCRC(t *testing.T) {
+	good := proto.EncodeFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeHeartbeat, Payload: []byte{1}})
+	bad := append([]byte(nil), good...)
+	bad[len(bad)-1] ^= 0xFF
+
+	for _, tc := range []struct {
+		name           string
+		cfg            Config
+		received       int
+		hwErrs, swErrs uint64
+	}{
+		// The radio drops the frames that fail its CRC before decoding.
+		{"hardware CRC", Config{}, 0, 2, 0},
+		// Without it, the good frame gets through and the frame CRC
+		// catches the bad one.
+		{"no hardware CRC", Config{NoHWCRC: true}, 1, 0, 1},
+	} {
+		d := NewWithConfig(tc.cfg).(*Driver)
+		rx := transport.NewReceiverWithDriver(0xBEEF, d)
+		d.InjectRxPacket(transport.RxPacket{Data: good})
+		d.InjectRxPacket(transport.RxPacket{Data: bad})
+		received := 0
+		for i := 0; i < 2; i++ {
+			if rx.ReceiveFrame(10*time.Millisecond) != nil {
+				received++
+			}
+		}
+		s := rx.Stats()
+		if received != tc.received || s.HWCRCErrors != tc.hwErrs || s.FrameCRCErrors != tc.swErrs {
+			t.Errorf("%s: %d frames received, HWCRCErrors = %d, FrameCRCErrors = %d, want %d, %d, %d",
+				tc.name, received, s.HWCRCErrors, s.FrameCRCErrors, tc.received, tc.hwErrs, tc.swErrs)
+		}
+	}
+}
+
+func TestRxPacket(t *testing.T) {
+	d := New().(*Driver)
+	rx := transport.NewReceiverWithDriver(0xBEEF, d)
+	metas := make(chan transport.FrameMeta, 4)
+	rx.RegisterCallbackMeta(proto.FrameTypeData, func(f *proto.Frame, m transport.FrameMeta) { metas <- m })
+	rx.Listen()
+	defer rx.StopListening()
+	pairInjected(t, d, rx)
+
+	data := func(seq uint32) []byte {
+		return proto.EncodeFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: seq, Payload: []byte{1}})
+	}
+	at := time.Now().Add(-time.Second)
+	d.InjectRxPacket(transport.RxPacket{Data: data(1), HWCRCOK: false})
+	d.InjectRxPacket(transport.RxPacket{Data: data(2), RSSI: -40, Timestamp: at, HWCRCOK: true})
+	select {
+	case m := <-metas:
+		if m.RSSI != -40 || !m.Received.Equal(at) {
+			t.Errorf("meta = %+v, want RSSI -40 received at %v", m, at)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame not delivered")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(metas) != 0 {
+		t.Error("frame that failed the hardware CRC delivered")
+	}
+	if s := rx.Stats(); s.CRCErrors != 1 || s.HWCRCErrors != 1 {
+		t.Errorf("CRCErrors = %d, HWCRCErrors = %d, want 1, 1", s.CRCErrors, s.HWCRCErrors)
+	}
+
+	rx.StopListening()
+	d.InjectRxPacket(transport.RxPacket{Data: []byte{1, 2}, RSSI: -90, Timestamp: at})
+	p, err := d.RxMeta(time.Millisecond)
+	if err != nil || p.RSSI != -90 || !p.Timestamp.Equal(at) || p.HWCRCOK || !bytes.Equal(p.Data, []byte{1, 2}) {
+		t.Errorf("RxMeta() = %+v, %v, want the packet injected", p, err)
+	}
+}
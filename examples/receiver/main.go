@@ -29,7 +29,7 @@ func main() {
 	})
 
 	receiver.Listen()
-	receiver.StartCleanupTask()
+	receiver.StartMaintenance(0)
 
 	for {
 		time.Sleep(time.Hour)
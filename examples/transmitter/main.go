@@ -44,7 +44,7 @@ func main() {
 			byte((counter >> 24) & 0xFF),
 		}
 
-		err := transmitter.SendData(payload)
+		_, err := transmitter.SendData(payload)
 		if err != nil {
 			println("Failed to send data:", err.Error())
 		} else {
@@ -15,16 +15,38 @@ type (
 	DeviceID    = protocol.DeviceID
 	DeviceType  = protocol.DeviceType
 	Frame       = protocol.Frame
+	Config      = protocol.Config
+	Priority    = protocol.Priority
+	DeviceInfo  = protocol.DeviceInfo
+	Capability  = protocol.Capability
+	Option      = transport.Option
 	Transmitter = transport.Transmitter
 	Receiver    = transport.Receiver
+	Bond        = transport.Bond
+	BondStore   = transport.BondStore
 )
 
 // Error constants exposed in the public API
 var (
-	ErrInvalidPayload = protocol.ErrInvalidPayload
-	ErrNotPaired      = protocol.ErrNotPaired
-	ErrTimeout        = protocol.ErrTimeout
-	ErrInvalidChannel = protocol.ErrInvalidChannel
+	ErrInvalidPayload  = protocol.ErrInvalidPayload
+	ErrNotPaired       = protocol.ErrNotPaired
+	ErrTimeout         = protocol.ErrTimeout
+	ErrInvalidChannel  = protocol.ErrInvalidChannel
+	ErrInvalidConfig   = protocol.ErrInvalidConfig
+	ErrInvalidPriority = protocol.ErrInvalidPriority
+	ErrPairingRejected = protocol.ErrPairingRejected
+	ErrUnsupported     = protocol.ErrUnsupported
+)
+
+// Options and helpers exposed in the public API
+var (
+	DefaultConfig      = protocol.DefaultConfig
+	WithConfig         = transport.WithConfig
+	WithNetworkID      = transport.WithNetworkID
+	WithPairingTimeout = transport.WithPairingTimeout
+	WithBondStore      = transport.WithBondStore
+
+	NewMemoryBondStore = transport.NewMemoryBondStore
 )
 
 // Constants exposed in the public API
@@ -36,4 +58,12 @@ const (
 	FrameTypeData      = protocol.FrameTypeData
 	FrameTypeHeartbeat = protocol.FrameTypeHeartbeat
 	FrameTypeAck       = protocol.FrameTypeAck
+	FrameTypeBatch     = protocol.FrameTypeBatch
+	FrameTypeControl   = protocol.FrameTypeControl
+	FrameTypeFragment  = protocol.FrameTypeFragment
+
+	PriorityNormal   = protocol.PriorityNormal
+	PriorityHigh     = protocol.PriorityHigh
+	PriorityUrgent   = protocol.PriorityUrgent
+	PriorityCritical = protocol.PriorityCritical
 )
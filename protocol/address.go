@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// PrivateAddress derives the radio address a receiver moves its paired
+// transmitters to, so that its radio stops processing the traffic of other
+// links in range. The address depends only on the receiver's ID: a radio
+// listens on one address at a time, so every transmitter paired with the
+// receiver shares it.
+func PrivateAddress(receiver DeviceID) (address uint32, prefix byte) {
+	var buf [len("nrfcomm address") + 5]byte
+	n := copy(buf[:], "nrfcomm address")
+	binary.LittleEndian.PutUint32(buf[n:], uint32(receiver))
+	for i := 0; ; i++ {
+		buf[n+4] = byte(i)
+		sum := sha256.Sum256(buf[:])
+		address = binary.LittleEndian.Uint32(sum[:4])
+		prefix = sum[4]
+		if usableAddress(address, prefix) {
+			return address, prefix
+		}
+	}
+}
+
+// usableAddress rejects the pairing address and addresses with too few bit
+// transitions for the radio to tell them from noise reliably.
+func usableAddress(address uint32, prefix byte) bool {
+	if address == DefaultAddress || prefix == DefaultPrefix {
+		return false
+	}
+	switch prefix {
+	case 0x00, 0xFF, 0x55, 0xAA:
+		return false
+	}
+	b := byte(address)
+	return address != uint32(b)*0x01010101
+}
@@ -0,0 +1,26 @@
+package protocol
+
+import "encoding/binary"
+
+// Data frames sent by a receiver and FrameTypeDirected frames carry
+// Target(4) | Data. As with control frames, Target names the device the data
+// is meant for and every other device ignores it.
+
+// AddressOverhead is the framing cost of an addressed data payload.
+const AddressOverhead = 4
+
+// EncodeAddressed builds the payload of a data frame addressed to target.
+func EncodeAddressed(target DeviceID, data []byte) []byte {
+	buf := make([]byte, AddressOverhead, AddressOverhead+len(data))
+	binary.LittleEndian.PutUint32(buf, uint32(target))
+	return append(buf, data...)
+}
+
+// DecodeAddressed splits an addressed data payload. It reports false if the
+// payload is too short.
+func DecodeAddressed(payload []byte) (target DeviceID, data []byte, ok bool) {
+	if len(payload) < AddressOverhead {
+		return 0, nil, false
+	}
+	return DeviceID(binary.LittleEndian.Uint32(payload)), payload[AddressOverhead:], true
+}
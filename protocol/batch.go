@@ -0,0 +1,29 @@
+package protocol
+
+// A FrameTypeBatch payload is a sequence of Len(1) | Sample(Len) records,
+// each delivered to the receiving application as a separate data sample.
+
+// BatchOverhead is the framing cost of one sample inside a batch.
+const BatchOverhead = 1
+
+// AppendBatchSample appends one sample record to a batch payload. Samples
+// longer than 255 bytes cannot be batched; callers must check the length.
+func AppendBatchSample(dst, sample []byte) []byte {
+	dst = append(dst, byte(len(sample)))
+	return append(dst, sample...)
+}
+
+// SplitBatch returns the samples of a batch payload. It reports false if
+// the payload is truncated.
+func SplitBatch(payload []byte) ([][]byte, bool) {
+	var samples [][]byte
+	for len(payload) > 0 {
+		n := int(payload[0])
+		if len(payload) < BatchOverhead+n {
+			return nil, false
+		}
+		samples = append(samples, payload[BatchOverhead:BatchOverhead+n])
+		payload = payload[BatchOverhead+n:]
+	}
+	return samples, true
+}
@@ -0,0 +1,21 @@
+package protocol
+
+// A FrameTypeBeacon payload is Channel(1) | TLV extensions. Receivers in
+// pairing mode broadcast beacons on the pairing link so that transmitters
+// can discover them; the extensions carry the receiver's DeviceInfo and
+// Channel is the one it takes pairing requests on.
+
+// EncodeBeacon builds a beacon payload of at most limit bytes, leaving out
+// or truncating info records that do not fit as AppendInfoTLV does.
+func EncodeBeacon(channel uint8, info DeviceInfo, limit int) []byte {
+	return AppendInfoTLV([]byte{channel}, info, limit)
+}
+
+// DecodeBeacon splits a beacon payload. It reports false if the payload is
+// empty or names an invalid channel.
+func DecodeBeacon(payload []byte) (channel uint8, info DeviceInfo, ok bool) {
+	if len(payload) < 1 || payload[0] > 125 {
+		return 0, info, false
+	}
+	return payload[0], ParseDeviceInfo(payload[1:]), true
+}
@@ -0,0 +1,143 @@
+package protocol
+
+import "encoding/binary"
+
+// A blob transfer moves an object too large to resend from scratch, such as
+// a firmware image, in chunks the receiver keeps across interruptions. The
+// transmitter offers the blob with ControlBlobOffer, asks which chunks the
+// receiver already holds with ControlBlobStatus, sends the others in
+// FrameTypeBlob frames and finishes with ControlBlobEnd, upon which the
+// receiver checks the CRC32 of the whole blob. The receiver answers each
+// command in a TagBlob extension of its ACK.
+
+// BlobOfferSize is the length of ControlBlobOffer arguments:
+// BlobID(4) | Size(4) | CRC32(4) | ChunkSize(2).
+const BlobOfferSize = 14
+
+// BlobChunkHeaderSize is the header of a FrameTypeBlob payload:
+// BlobID(4) | Index(4), followed by chunk Index of the blob.
+const BlobChunkHeaderSize = 8
+
+// Answers to ControlBlobOffer and ControlBlobEnd
+const (
+	BlobOK         = 0x00
+	BlobRejected   = 0x01 // the receiver takes no blobs, or none this large
+	BlobIncomplete = 0x02 // chunks are missing
+	BlobCorrupt    = 0x03 // the CRC32 did not match and the blob was discarded
+)
+
+// BlobOffer describes a blob. A transfer resumes where it stopped if the
+// receiver is offered the same ID, size, CRC32 and chunk size again.
+type BlobOffer struct {
+	ID        uint32
+	Size      uint32
+	CRC       uint32 // CRC32 (IEEE) of the whole blob
+	ChunkSize uint16
+}
+
+// Chunks returns how many chunks the blob is split into.
+func (o BlobOffer) Chunks() uint32 {
+	if o.ChunkSize == 0 {
+		return 0
+	}
+	return (o.Size + uint32(o.ChunkSize) - 1) / uint32(o.ChunkSize)
+}
+
+// ChunkLen returns the length of chunk index, which is shorter than
+// ChunkSize for the last one.
+func (o BlobOffer) ChunkLen(index uint32) int {
+	start := index * uint32(o.ChunkSize)
+	if start+uint32(o.ChunkSize) > o.Size {
+		return int(o.Size - start)
+	}
+	return int(o.ChunkSize)
+}
+
+// EncodeBlobOffer builds the arguments of a ControlBlobOffer.
+func EncodeBlobOffer(o BlobOffer) []byte {
+	args := make([]byte, BlobOfferSize)
+	binary.LittleEndian.PutUint32(args[0:], o.ID)
+	binary.LittleEndian.PutUint32(args[4:], o.Size)
+	binary.LittleEndian.PutUint32(args[8:], o.CRC)
+	binary.LittleEndian.PutUint16(args[12:], o.ChunkSize)
+	return args
+}
+
+// DecodeBlobOffer parses the arguments of a ControlBlobOffer. It reports
+// false if they are truncated or the chunk size is zero.
+func DecodeBlobOffer(args []byte) (BlobOffer, bool) {
+	if len(args) < BlobOfferSize {
+		return BlobOffer{}, false
+	}
+	o := BlobOffer{
+		ID:        binary.LittleEndian.Uint32(args[0:]),
+		Size:      binary.LittleEndian.Uint32(args[4:]),
+		CRC:       binary.LittleEndian.Uint32(args[8:]),
+		ChunkSize: binary.LittleEndian.Uint16(args[12:]),
+	}
+	return o, o.ChunkSize != 0
+}
+
+// EncodeBlobChunk builds a FrameTypeBlob payload.
+func EncodeBlobChunk(id, index uint32, data []byte) []byte {
+	payload := make([]byte, BlobChunkHeaderSize, BlobChunkHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(payload[0:], id)
+	binary.LittleEndian.PutUint32(payload[4:], index)
+	return append(payload, data...)
+}
+
+// DecodeBlobChunk splits a FrameTypeBlob payload. It reports false if the
+// header is truncated.
+func DecodeBlobChunk(payload []byte) (id, index uint32, data []byte, ok bool) {
+	if len(payload) < BlobChunkHeaderSize {
+		return 0, 0, nil, false
+	}
+	return binary.LittleEndian.Uint32(payload[0:]), binary.LittleEndian.Uint32(payload[4:]), payload[BlobChunkHeaderSize:], true
+}
+
+// EncodeBlobStatus builds the arguments of a ControlBlobStatus asking which
+// chunks from first on the receiver holds: BlobID(4) | First(4). The answer
+// is First(4) | Bitmap, see EncodeBlobBitmap.
+func EncodeBlobStatus(id, first uint32) []byte {
+	args := make([]byte, 8)
+	binary.LittleEndian.PutUint32(args[0:], id)
+	binary.LittleEndian.PutUint32(args[4:], first)
+	return args
+}
+
+// DecodeBlobStatus parses the arguments of a ControlBlobStatus.
+func DecodeBlobStatus(args []byte) (id, first uint32, ok bool) {
+	if len(args) < 8 {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(args[0:]), binary.LittleEndian.Uint32(args[4:]), true
+}
+
+// EncodeBlobEnd builds the arguments of a ControlBlobEnd.
+func EncodeBlobEnd(id uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, id)
+}
+
+// DecodeBlobEnd parses the arguments of a ControlBlobEnd.
+func DecodeBlobEnd(args []byte) (id uint32, ok bool) {
+	if len(args) < 4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(args), true
+}
+
+// EncodeBlobBitmap builds the answer to a ControlBlobStatus: First(4) |
+// Bitmap, where bit i%8 of byte i/8 is set if chunk first+i is held.
+func EncodeBlobBitmap(first uint32, bitmap []byte) []byte {
+	answer := make([]byte, 4, 4+len(bitmap))
+	binary.LittleEndian.PutUint32(answer, first)
+	return append(answer, bitmap...)
+}
+
+// DecodeBlobBitmap splits the answer to a ControlBlobStatus.
+func DecodeBlobBitmap(answer []byte) (first uint32, bitmap []byte, ok bool) {
+	if len(answer) < 4 {
+		return 0, nil, false
+	}
+	return binary.LittleEndian.Uint32(answer), answer[4:], true
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import "time"
+
+// Config carries the tunable protocol limits and timings of an endpoint.
+// Zero fields fall back to the package defaults, so a partially filled Config
+// is valid; see DefaultConfig.
+type Config struct {
+	// MaxFrameSize is the largest frame put on (or accepted from) the air,
+	// including length, CRC and terminal bytes. Normalize clamps it to
+	// between MinFrameSize+1 and MaxFrameSize.
+	MaxFrameSize int
+
+	HeartbeatInterval time.Duration
+	PairingTimeout    time.Duration
+	DeviceTimeout     time.Duration
+
+	// RekeyOverlap is how long the previous session key stays valid after
+	// a rotation.
+	RekeyOverlap time.Duration
+
+	// ConfirmTimeout bounds how long pairing waits for the user to confirm
+	// a comparison code.
+	ConfirmTimeout time.Duration
+
+	// NetworkID is XORed into every frame CRC so that frames from a
+	// deployment with a different ID fail validation. Zero leaves the CRC
+	// unchanged.
+	NetworkID uint32
+}
+
+// MinFrameSize is the size of a frame carrying an empty payload.
+const MinFrameSize = FrameHeaderSize + CRCSize + TerminalSize
+
+// DefaultConfig returns the configuration matching the package constants.
+func DefaultConfig() Config {
+	return Config{
+		MaxFrameSize:      MaxFrameSize,
+		HeartbeatInterval: HeartbeatInterval * time.Millisecond,
+		PairingTimeout:    PairingTimeout * time.Millisecond,
+		DeviceTimeout:     DeviceTimeout * time.Millisecond,
+		RekeyOverlap:      RekeyOverlap * time.Millisecond,
+		ConfirmTimeout:    ConfirmTimeout * time.Millisecond,
+	}
+}
+
+// Validate reports whether every explicitly set field is within range,
+// returning ErrInvalidConfig if not. The transport constructors log the
+// error and go on with the Normalize'd config.
+func (c Config) Validate() error {
+	if c.MaxFrameSize != 0 && (c.MaxFrameSize <= MinFrameSize || c.MaxFrameSize > MaxFrameSize) {
+		return ErrInvalidConfig
+	}
+	if c.HeartbeatInterval < 0 || c.PairingTimeout < 0 || c.DeviceTimeout < 0 ||
+		c.RekeyOverlap < 0 || c.ConfirmTimeout < 0 {
+		return ErrInvalidConfig
+	}
+	return nil
+}
+
+// Normalize fills zero fields with defaults and clamps the frame size into
+// the supported range, to the nearest size that carries a payload byte or
+// to MaxFrameSize.
+func (c Config) Normalize() Config {
+	d := DefaultConfig()
+	switch {
+	case c.MaxFrameSize <= 0:
+		c.MaxFrameSize = d.MaxFrameSize
+	case c.MaxFrameSize <= MinFrameSize:
+		c.MaxFrameSize = MinFrameSize + 1
+	case c.MaxFrameSize > MaxFrameSize:
+		c.MaxFrameSize = MaxFrameSize
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = d.HeartbeatInterval
+	}
+	if c.PairingTimeout <= 0 {
+		c.PairingTimeout = d.PairingTimeout
+	}
+	if c.DeviceTimeout <= 0 {
+		c.DeviceTimeout = d.DeviceTimeout
+	}
+	if c.RekeyOverlap <= 0 {
+		c.RekeyOverlap = d.RekeyOverlap
+	}
+	if c.ConfirmTimeout <= 0 {
+		c.ConfirmTimeout = d.ConfirmTimeout
+	}
+	return c
+}
+
+// MaxPayloadSize returns the application payload allowance for this config.
+func (c Config) MaxPayloadSize() int {
+	return c.Normalize().MaxFrameSize - MinFrameSize
+}
@@ -3,15 +3,19 @@ package protocol
 // Generic radio & protocol constants (platform independent). All higher layers should depend on this file.
 const (
 	// Frame sizing
-	// Layout:
-	//   Length (1 byte)  | SenderID (4) | Type (1) | Reserved (2)  | Payload (0-242) | CRC32 (4) | Terminal (1)
+	// Layout (the single authoritative description of the on-air format):
+	//   Length (1 byte)  | SenderID (4) | Type (1) | Seq (4) | [Timestamp (4)] | Payload (0-MaxPayloadSize) | CRC32 (4) | Terminal (1)
 	// Length counts everything after the length byte, i.e., total Frame size minus 1.
+	// The low nibble of the Type byte is the frame type, the high nibble holds flags;
+	// optional fields are present only when their flag is set, so a frame without
+	// flags has exactly the layout above without them.
 
 	// Sizes of individual components
-	LengthFieldSize   = 1
-	SequenceFieldSize = 4
-	CRCSize           = 4 // CRC32, little-endian
-	TerminalSize      = 1
+	LengthFieldSize    = 1
+	SequenceFieldSize  = 4
+	TimestampFieldSize = 4
+	CRCSize            = 4 // CRC32, little-endian
+	TerminalSize       = 1
 
 	// Header consists of: SenderID(4)+Type(1)+Seq(4) = 9 plus Length field = 10 bytes before payload
 	FrameHeaderSize = LengthFieldSize + 4 + 1 + SequenceFieldSize // 10 bytes
@@ -24,21 +28,92 @@ const (
 
 	// RF defaults (can be overridden per device)
 	DefaultChannel = 7
+	DefaultAddress = 0xE7E7E7E7 // base address every device pairs on
+	DefaultPrefix  = 0xE7
+	PairingChannel = 1 // well-known channel to pair on, see transport.WithPairingChannel
 
 	// Frame types
 	FrameTypePairing   = 0x01
 	FrameTypeData      = 0x02
 	FrameTypeHeartbeat = 0x03
 	FrameTypeAck       = 0x04
+	FrameTypeBatch     = 0x05 // several data samples, see batch.go
+	FrameTypeControl   = 0x06 // addressed link management command, see control.go
+	FrameTypeFragment  = 0x07 // one piece of a large message, see fragment.go
+	FrameTypeBeacon    = 0x08 // receiver discovery broadcast, see beacon.go
+	FrameTypeDirected  = 0x09 // data for one of several receivers, see addressed.go
+	FrameTypeStream    = 0x0A // a chunk of a byte stream, see stream.go
+	FrameTypeBlob      = 0x0B // a chunk of a blob transfer, see blob.go
+
+	// Frame flags (high nibble of the Type byte)
+	FrameTypeMask  = 0x0F
+	FrameFlagMask  = 0xF0
+	FlagTimestamp  = 0x80 // a 4-byte millisecond timestamp follows Seq
+	FlagPriority   = 0x30 // two-bit Priority, see priority.go
+	FlagAckRequest = 0x40 // ask for an ACK: of a heartbeat, or of a frame sent reliably
+
+	priorityShift = 4
+
+	// TLV tags used in pairing and ACK payload extensions (see tlv.go)
+	TagMaxFrameSize = 0x01
+	TagReply        = 0x02 // application reply piggybacked on a data ACK
+	TagPublicKey    = 0x03 // X25519 public key offered for secure pairing
+	TagDeviceName   = 0x04 // UTF-8 device name, see DeviceInfo
+	TagDeviceClass  = 0x05
+	TagFirmware     = 0x06 // firmware version, little endian uint32
+	TagCapabilities = 0x07 // Capability bitmask, little endian uint32
+	TagDataChannel  = 0x08 // ACK: channel to move to after pairing; request: NoDataChannel
+	TagLinkAddress  = 0x09 // ACK: private base address (little endian uint32) and prefix to move to after pairing
+	TagRollingCode  = 0x0A // heartbeat: rotation counter (little endian uint32) and RollingCode
+	TagResync       = 0x0B // data ACK, empty: the sender's rolling code was out of sync, see ControlResync
+	TagPairingKey   = 0x0C // request: the whole PairingKey when wider than the 4-byte key field
+	TagHeartbeat    = 0x0D // request: the transmitter's heartbeat interval in milliseconds, little endian uint32; ACK, empty: heartbeats are ACKed
+	TagHealth       = 0x0E // heartbeat: HealthReport
+	TagEpoch        = 0x0F // request and heartbeat: the transmitter's boot epoch, little endian uint32
+	TagBlob         = 0x10 // ACK: answer to a blob transfer command, see blob.go
+	TagBackpressure = 0x11 // data ACK: the receiver's load, one byte from 0 (none) to 255 (overwhelmed)
+	TagDataRate     = 0x12 // request and pairing ACK: the sender's radio data rate, one byte; absent: 1 Mbit
+
+	// NoDataChannel in a pairing request asks the receiver to keep the link
+	// on the pairing channel and address.
+	NoDataChannel = 0xFF
 
 	// Timeouts / intervals (milliseconds)
 	HeartbeatInterval = 5000
 	PairingTimeout    = 30000
 	DeviceTimeout     = 15000
-
-	// internal helper (bytes in header after length byte)
-	headerWithoutLen = FrameHeaderSize - LengthFieldSize
+	RekeyOverlap      = 2000
+	ConfirmTimeout    = 30000
 
 	// Terminal byte value appended to the end of every Frame
 	FrameTerminal = 0x55
 )
+
+// The length byte and the TagMaxFrameSize TLV carry frame sizes in one byte,
+// so a larger MaxFrameSize would not build.
+var _ [0xFF - MaxFrameSize]struct{}
+
+// Capability is a bitmask of optional protocol features. Both ends announce
+// theirs when pairing and keep the intersection on the peer's Device. Only
+// features added after capability negotiation are gated on it; the others
+// are listed for information, and peers that announce nothing are treated as
+// supporting none.
+type Capability uint32
+
+const (
+	CapSecurePairing  Capability = 1 << iota // X25519 key exchange
+	CapRekey                                 // session key rotation
+	CapBatch                                 // FrameTypeBatch
+	CapTimestamp                             // FlagTimestamp
+	CapFragmentation                         // FrameTypeFragment
+	CapRollingKey                            // rolling codes in heartbeats, see RollingCode
+	CapLongPairingKey                        // pairing keys wider than 4 bytes, see PairingKey
+	CapDirected                              // FrameTypeDirected
+	CapChannelSwitch                         // ControlChannelSwitch
+	CapStream                                // FrameTypeStream
+	CapBlob                                  // blob transfers, see blob.go
+
+	// AllCapabilities is everything this implementation supports.
+	AllCapabilities = CapSecurePairing | CapRekey | CapBatch | CapTimestamp | CapFragmentation | CapRollingKey |
+		CapLongPairingKey | CapDirected | CapChannelSwitch | CapStream | CapBlob
+)
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+)
+
+// A FrameTypeControl payload is Cmd(1) | Target(4) | Args. Frames carry no
+// destination address, so Target names the device the command is meant for;
+// every other device ignores it.
+
+// Control commands
+const (
+	ControlPairChallenge = 0x01 // Args: challenge nonce (ChallengeSize)
+	ControlPairResponse  = 0x02 // Args: challenge response (ChallengeSize)
+	ControlPairReject    = 0x03 // Args: optional reject reason
+	ControlKeyConfirm    = 0x04 // Args: KeyConfirmation (ChallengeSize)
+	ControlRekey         = 0x05 // Args: see EncodeRekey
+	ControlUnpair        = 0x06 // no Args; the sender forgets the target
+	ControlResync        = 0x07 // no Args from a transmitter; from a receiver: nonce (ChallengeSize) | counter (4)
+	ControlResyncAnswer  = 0x08 // Args: ResyncResponse (ChallengeSize)
+	ControlGoodbye       = 0x09 // no Args; the sender is shutting down but stays paired
+	ControlChannelSwitch = 0x0A // Args: channel (1); the link moves there once ACKed
+	ControlBlobOffer     = 0x0B // Args: see EncodeBlobOffer
+	ControlBlobStatus    = 0x0C // Args: see EncodeBlobStatus
+	ControlBlobEnd       = 0x0D // Args: see EncodeBlobEnd
+	ControlPause         = 0x0E // Args: safety timeout in milliseconds, little endian uint32; from a receiver only
+	ControlResume        = 0x0F // no Args; ends a ControlPause
+)
+
+// Pairing reject reasons
+const (
+	RejectBadResponse      = 0x01
+	RejectSecurityMismatch = 0x02
+	RejectKeyConfirm       = 0x03
+	RejectNotConfirmed     = 0x04 // the user did not confirm the comparison code
+	RejectNotApproved      = 0x05 // the receiver's pairing handler refused
+	RejectDeviceLimit      = 0x06 // the receiver is paired with as many devices as it may be
+	RejectDataRate         = 0x07 // the transmitter uses another data rate
+)
+
+const controlHeaderSize = 1 + 4
+
+// EncodeControl builds a control frame payload.
+func EncodeControl(cmd byte, target DeviceID, args []byte) []byte {
+	buf := make([]byte, controlHeaderSize, controlHeaderSize+len(args))
+	buf[0] = cmd
+	binary.LittleEndian.PutUint32(buf[1:5], uint32(target))
+	return append(buf, args...)
+}
+
+// DecodeControl splits a control frame payload. It reports false if the
+// payload is too short.
+func DecodeControl(payload []byte) (cmd byte, target DeviceID, args []byte, ok bool) {
+	if len(payload) < controlHeaderSize {
+		return 0, 0, nil, false
+	}
+	return payload[0], DeviceID(binary.LittleEndian.Uint32(payload[1:5])), payload[controlHeaderSize:], true
+}
+
+// RekeyArgsSize is the length of ControlRekey arguments:
+// Index(1) | SwitchSeq(4) | Nonce(RekeyNonceSize) | Tag(ChallengeSize).
+const RekeyArgsSize = 1 + 4 + RekeyNonceSize + ChallengeSize
+
+// EncodeRekey builds the arguments of a request to rotate the session key
+// from current to rotation index, switching at frame switchSeq. The request
+// is authenticated with current so that only the peer can trigger it.
+func EncodeRekey(current []byte, index uint8, switchSeq uint32, nonce []byte) []byte {
+	args := make([]byte, RekeyArgsSize-ChallengeSize, RekeyArgsSize)
+	args[0] = index
+	binary.LittleEndian.PutUint32(args[1:5], switchSeq)
+	copy(args[5:], nonce)
+	tag := rekeyTag(current, args)
+	return append(args, tag[:]...)
+}
+
+// DecodeRekey splits rekey arguments authenticated with key. It reports false
+// if the arguments are malformed or were not produced with key.
+func DecodeRekey(key []byte, args []byte) (index uint8, switchSeq uint32, nonce []byte, ok bool) {
+	if key == nil || len(args) < RekeyArgsSize {
+		return 0, 0, nil, false
+	}
+	body := args[:RekeyArgsSize-ChallengeSize]
+	want := rekeyTag(key, body)
+	if !hmac.Equal(args[len(body):RekeyArgsSize], want[:]) {
+		return 0, 0, nil, false
+	}
+	return body[0], binary.LittleEndian.Uint32(body[1:5]), body[5:], true
+}
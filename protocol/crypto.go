@@ -1,19 +1,198 @@
 package protocol
 
 import (
-	crand "crypto/rand"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
-	mrand "math/rand"
-	"time"
+	"io"
 )
 
-// GeneratePairingKey returns a cryptographically random 32-bit key.
-// If crypto/rand fails, falls back to math/rand.
-func GeneratePairingKey() uint32 {
-	var b [4]byte
-	if _, err := crand.Read(b[:]); err == nil {
-		return binary.LittleEndian.Uint32(b[:])
+const (
+	// ChallengeSize is the length of pairing challenges and responses.
+	ChallengeSize = 8
+
+	// PublicKeySize is the length of an X25519 public key.
+	PublicKeySize = 32
+
+	// SessionKeySize is the length of the session secret derived by KeyExchange.
+	SessionKeySize = 32
+
+	// RekeyNonceSize is the length of the fresh key material in a rekey
+	// request.
+	RekeyNonceSize = 16
+
+	// RollingWindow is how many rotations ahead of the last one it accepted
+	// a receiver still accepts a rolling code, so that a few heartbeats lost
+	// on the air do not break the schedule.
+	RollingWindow = 8
+)
+
+// GenerateChallenge returns a random pairing challenge nonce read from src,
+// or from the package-wide source if src is nil.
+func GenerateChallenge(src RandSource) ([ChallengeSize]byte, error) {
+	var c [ChallengeSize]byte
+	err := ReadRand(src, c[:])
+	return c, err
+}
+
+// ChallengeResponse proves knowledge of key for a pairing challenge between
+// transmitter tx and receiver rx: HMAC-SHA256(key, challenge | tx | rx),
+// truncated to ChallengeSize bytes.
+func ChallengeResponse(key PairingKey, challenge []byte, tx, rx DeviceID) [ChallengeSize]byte {
+	mac := hmac.New(sha256.New, key.Bytes())
+	mac.Write(challenge)
+	var ids [8]byte
+	binary.LittleEndian.PutUint32(ids[0:4], uint32(tx))
+	binary.LittleEndian.PutUint32(ids[4:8], uint32(rx))
+	mac.Write(ids[:])
+
+	var out [ChallengeSize]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// KeyExchange is one side of an X25519 key agreement performed during
+// secure pairing.
+type KeyExchange struct {
+	priv *ecdh.PrivateKey
+}
+
+// NewKeyExchange generates an ephemeral key pair from rand, or from the
+// package-wide RandSource when rand is nil. Targets without crypto/rand
+// support can pass a reader backed by their hardware RNG.
+func NewKeyExchange(rand io.Reader) (*KeyExchange, error) {
+	if rand == nil {
+		rand = RandReader(nil)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyExchange{priv: priv}, nil
+}
+
+// PublicKey returns the public key to send to the peer.
+func (k *KeyExchange) PublicKey() []byte { return k.priv.PublicKey().Bytes() }
+
+// SessionKey derives the session secret shared with the peer owning
+// peerPublic, bound to the transmitter and receiver IDs of the link.
+func (k *KeyExchange) SessionKey(peerPublic []byte, tx, rx DeviceID) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, ErrInvalidKey
 	}
-	src := mrand.NewSource(time.Now().UnixNano())
-	return mrand.New(src).Uint32()
+	shared, err := k.priv.ECDH(pub)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	h := sha256.New()
+	h.Write([]byte("nrfcomm session"))
+	h.Write(shared)
+	var ids [8]byte
+	binary.LittleEndian.PutUint32(ids[0:4], uint32(tx))
+	binary.LittleEndian.PutUint32(ids[4:8], uint32(rx))
+	h.Write(ids[:])
+	return h.Sum(nil), nil
+}
+
+// KeyConfirmation proves to the receiver that the transmitter derived the
+// same session key.
+func KeyConfirmation(sessionKey []byte, tx, rx DeviceID) [ChallengeSize]byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("confirm"))
+	var ids [8]byte
+	binary.LittleEndian.PutUint32(ids[0:4], uint32(tx))
+	binary.LittleEndian.PutUint32(ids[4:8], uint32(rx))
+	mac.Write(ids[:])
+
+	var out [ChallengeSize]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// ComparisonCodeModulus bounds comparison codes to six decimal digits.
+const ComparisonCodeModulus = 1000000
+
+// ComparisonCode derives the numeric code both users compare during secure
+// pairing from the public keys of transmitter tx and receiver rx. A man in
+// the middle holds different keys towards each side, so the codes shown on
+// the two devices are unlikely to match.
+func ComparisonCode(txPublic, rxPublic []byte, tx, rx DeviceID) uint32 {
+	h := sha256.New()
+	h.Write([]byte("nrfcomm compare"))
+	h.Write(txPublic)
+	h.Write(rxPublic)
+	var ids [8]byte
+	binary.LittleEndian.PutUint32(ids[0:4], uint32(tx))
+	binary.LittleEndian.PutUint32(ids[4:8], uint32(rx))
+	h.Write(ids[:])
+	return binary.LittleEndian.Uint32(h.Sum(nil)) % ComparisonCodeModulus
+}
+
+// NextSessionKey derives the session key that replaces current at rotation
+// index, mixing in the nonce carried by the rekey request.
+func NextSessionKey(current []byte, index uint8, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, current)
+	mac.Write([]byte("rekey"))
+	mac.Write([]byte{index})
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// rekeyTag authenticates the body of a rekey request.
+func rekeyTag(key []byte, body []byte) [ChallengeSize]byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("rekey request"))
+	mac.Write(body)
+
+	var out [ChallengeSize]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// RollingKey derives the key of rotation counter in the rolling schedule
+// seeded by a link's session key. Knowing one rolling key reveals neither
+// the session key nor the keys of other rotations.
+func RollingKey(sessionKey []byte, counter uint32) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("roll"))
+	var c [4]byte
+	binary.LittleEndian.PutUint32(c[:], counter)
+	mac.Write(c[:])
+	return mac.Sum(nil)
+}
+
+// RollingCode proves that transmitter tx holds the rolling key of rotation
+// counter, bound to the frame numbered seq that carries it.
+func RollingCode(sessionKey []byte, counter uint32, tx DeviceID, seq uint32) [ChallengeSize]byte {
+	mac := hmac.New(sha256.New, RollingKey(sessionKey, counter))
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(tx))
+	binary.LittleEndian.PutUint32(b[4:8], seq)
+	mac.Write(b[:])
+
+	var out [ChallengeSize]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// ResyncResponse answers a receiver's resync challenge, agreeing to continue
+// the rolling schedule from counter. It is keyed with the session key
+// itself rather than a rolling key, so it works however far apart the two
+// ends have drifted.
+func ResyncResponse(sessionKey []byte, nonce []byte, counter uint32, tx, rx DeviceID) [ChallengeSize]byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("resync"))
+	mac.Write(nonce)
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[0:4], counter)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(tx))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(rx))
+	mac.Write(b[:])
+
+	var out [ChallengeSize]byte
+	copy(out[:], mac.Sum(nil))
+	return out
 }
@@ -0,0 +1,263 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestChallengeResponse(t *testing.T) {
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	a := ChallengeResponse(PairingKeyFromUint32(0x1234), challenge, 0xCAFE, 0xBEEF)
+	if b := ChallengeResponse(PairingKeyFromUint32(0x1234), challenge, 0xCAFE, 0xBEEF); a != b {
+		t.Error("ChallengeResponse() is not deterministic")
+	}
+	if b := ChallengeResponse(PairingKeyFromUint32(0x1235), challenge, 0xCAFE, 0xBEEF); a == b {
+		t.Error("different keys produced the same response")
+	}
+	if b := ChallengeResponse(PairingKeyFromUint32(0x1234), challenge, 0xBEEF, 0xCAFE); a == b {
+		t.Error("swapped device IDs produced the same response")
+	}
+	c1, _ := GenerateChallenge(nil)
+	if c2, _ := GenerateChallenge(nil); c1 == c2 {
+		t.Error("GenerateChallenge() repeated a nonce")
+	}
+}
+
+func TestSeededRand(t *testing.T) {
+	a, b := NewSeededRand(7), NewSeededRand(7)
+	ka, _ := GeneratePairingKey(a, 16)
+	kb, _ := GeneratePairingKey(b, 16)
+	if ka != kb {
+		t.Errorf("same seed produced keys %v and %v", ka, kb)
+	}
+	ca, _ := GenerateChallenge(a)
+	if cb, _ := GenerateChallenge(b); ca != cb {
+		t.Errorf("same seed produced challenges %x and %x", ca, cb)
+	}
+	if k, _ := GeneratePairingKey(NewSeededRand(8), 16); k == ka {
+		t.Error("different seeds produced the same key")
+	}
+
+	SetRandSource(NewSeededRand(7))
+	defer SetRandSource(nil)
+	if k, _ := GeneratePairingKey(nil, 16); k != ka {
+		t.Errorf("package-wide source produced %v, want %v", k, ka)
+	}
+}
+
+func TestPairingKey_Wire(t *testing.T) {
+	for _, size := range []int{4, 8, 16} {
+		key, err := GeneratePairingKey(nil, size)
+		if err != nil || key.Len() != size {
+			t.Fatalf("GeneratePairingKey(%d) = %v (%d bytes), %v", size, key, key.Len(), err)
+		}
+		payload := make([]byte, 8)
+		binary.LittleEndian.PutUint32(payload[:4], key.Uint32())
+		if size > 4 {
+			payload = AppendPairingKeyTLV(payload, key)
+			if want := 8 + 2 + size; len(payload) != want {
+				t.Errorf("%d-byte key: request is %d bytes, want %d", size, len(payload), want)
+			}
+		}
+		if got := ParsePairingKey(payload, true); got != key {
+			t.Errorf("%d-byte key: ParsePairingKey() = %v, want %v", size, got, key)
+		}
+		// A peer without long keys reads the key field only.
+		if got := ParsePairingKey(payload, false); got != key.Truncate(4) || got.Len() != 4 {
+			t.Errorf("%d-byte key: short ParsePairingKey() = %v, want %v", size, got, key.Truncate(4))
+		}
+
+		text, _ := key.MarshalText()
+		var back PairingKey
+		if err := back.UnmarshalText(text); err != nil || back != key {
+			t.Errorf("%d-byte key: text round trip = %v, %v", size, back, err)
+		}
+	}
+
+	// An extension disagreeing with the key field is ignored.
+	payload := make([]byte, 8)
+	payload[0] = 1
+	payload = AppendPairingKeyTLV(payload, PairingKey{b: [MaxPairingKeySize]byte{2}, n: 8})
+	if got := ParsePairingKey(payload, true); got != PairingKeyFromUint32(1) {
+		t.Errorf("ParsePairingKey() = %v, want the key field", got)
+	}
+	if _, err := GeneratePairingKey(nil, 5); err != ErrInvalidKeySize {
+		t.Errorf("GeneratePairingKey(nil, 5) error = %v, want %v", err, ErrInvalidKeySize)
+	}
+}
+
+func TestSealPairing(t *testing.T) {
+	psk := []byte("deployment secret")
+	payload := []byte("pairing key and receiver id, more than one keystream block of it")
+	frame := &Frame{SenderID: 0xCAFE, Type: FrameTypePairing, Seq: 3, Payload: payload}
+	sealed := SealPairing(psk, [SealNonceSize]byte{1}, frame)
+	if len(sealed) != len(payload)+SealOverhead {
+		t.Fatalf("sealed length = %d, want %d", len(sealed), len(payload)+SealOverhead)
+	}
+	if bytes.Contains(sealed, payload[:8]) {
+		t.Error("sealed payload contains the plaintext")
+	}
+
+	on := *frame
+	on.Payload = sealed
+	if got, ok := OpenPairing(psk, &on); !ok || !bytes.Equal(got, payload) {
+		t.Errorf("OpenPairing() = %q, %v", got, ok)
+	}
+	if _, ok := OpenPairing([]byte("other secret"), &on); ok {
+		t.Error("OpenPairing() accepted another key")
+	}
+	moved := on
+	moved.Seq++
+	if _, ok := OpenPairing(psk, &moved); ok {
+		t.Error("OpenPairing() accepted the payload in another frame")
+	}
+	on.Payload = append([]byte(nil), sealed...)
+	on.Payload[SealNonceSize] ^= 1
+	if _, ok := OpenPairing(psk, &on); ok {
+		t.Error("OpenPairing() accepted a tampered payload")
+	}
+}
+
+func TestControlPayload(t *testing.T) {
+	payload := EncodeControl(ControlPairChallenge, 0xCAFE, []byte{9, 8})
+	cmd, target, args, ok := DecodeControl(payload)
+	if !ok || cmd != ControlPairChallenge || target != 0xCAFE || !bytes.Equal(args, []byte{9, 8}) {
+		t.Errorf("DecodeControl() = %v, %v, %v, %v", cmd, target, args, ok)
+	}
+	if _, _, _, ok := DecodeControl(payload[:4]); ok {
+		t.Error("DecodeControl() accepted a truncated payload")
+	}
+}
+
+func TestKeyExchange(t *testing.T) {
+	tx, err := NewKeyExchange(nil)
+	if err != nil {
+		t.Fatalf("NewKeyExchange() error = %v", err)
+	}
+	rx, err := NewKeyExchange(nil)
+	if err != nil {
+		t.Fatalf("NewKeyExchange() error = %v", err)
+	}
+	if len(tx.PublicKey()) != PublicKeySize {
+		t.Fatalf("PublicKey() size = %v, want %v", len(tx.PublicKey()), PublicKeySize)
+	}
+
+	k1, err := tx.SessionKey(rx.PublicKey(), 0xCAFE, 0xBEEF)
+	if err != nil {
+		t.Fatalf("SessionKey() error = %v", err)
+	}
+	k2, err := rx.SessionKey(tx.PublicKey(), 0xCAFE, 0xBEEF)
+	if err != nil {
+		t.Fatalf("SessionKey() error = %v", err)
+	}
+	if !bytes.Equal(k1, k2) || len(k1) != SessionKeySize {
+		t.Errorf("session keys differ: %x vs %x", k1, k2)
+	}
+	if KeyConfirmation(k1, 0xCAFE, 0xBEEF) != KeyConfirmation(k2, 0xCAFE, 0xBEEF) {
+		t.Error("key confirmations differ for equal session keys")
+	}
+
+	if _, err := tx.SessionKey([]byte{1, 2, 3}, 0xCAFE, 0xBEEF); err != ErrInvalidKey {
+		t.Errorf("SessionKey(short key) error = %v, want %v", err, ErrInvalidKey)
+	}
+}
+
+func TestKeyExchangeRandSource(t *testing.T) {
+	// A caller-supplied reader (e.g. a hardware RNG) makes keys reproducible.
+	a, err := NewKeyExchange(bytes.NewReader(bytes.Repeat([]byte{7}, 64)))
+	if err != nil {
+		t.Fatalf("NewKeyExchange() error = %v", err)
+	}
+	b, err := NewKeyExchange(bytes.NewReader(bytes.Repeat([]byte{7}, 64)))
+	if err != nil {
+		t.Fatalf("NewKeyExchange() error = %v", err)
+	}
+	if !bytes.Equal(a.PublicKey(), b.PublicKey()) {
+		t.Error("same random input produced different public keys")
+	}
+}
+
+func TestRekeyArgs(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, SessionKeySize)
+	nonce := bytes.Repeat([]byte{2}, RekeyNonceSize)
+
+	args := EncodeRekey(key, 3, 1000, nonce)
+	index, switchSeq, gotNonce, ok := DecodeRekey(key, args)
+	if !ok || index != 3 || switchSeq != 1000 || !bytes.Equal(gotNonce, nonce) {
+		t.Errorf("DecodeRekey() = %d, %d, %x, %v", index, switchSeq, gotNonce, ok)
+	}
+	if _, _, _, ok := DecodeRekey(bytes.Repeat([]byte{9}, SessionKeySize), args); ok {
+		t.Error("DecodeRekey() accepted a request authenticated with another key")
+	}
+	if _, _, _, ok := DecodeRekey(key, args[:RekeyArgsSize-1]); ok {
+		t.Error("DecodeRekey() accepted truncated arguments")
+	}
+	if bytes.Equal(NextSessionKey(key, 3, nonce), key) || bytes.Equal(NextSessionKey(key, 3, nonce), NextSessionKey(key, 4, nonce)) {
+		t.Error("NextSessionKey() does not depend on the rotation index")
+	}
+}
+
+func TestDeviceKeyOverlap(t *testing.T) {
+	d := NewTransmitter(1)
+	d.ResetSessionKey([]byte{1})
+	d.RotateSessionKey([]byte{2}, 1, 100, 50*time.Millisecond)
+
+	if got := d.KeyForSeq(99); !bytes.Equal(got, []byte{1}) {
+		t.Errorf("KeyForSeq(99) = %x, want previous key", got)
+	}
+	if got := d.KeyForSeq(100); !bytes.Equal(got, []byte{2}) {
+		t.Errorf("KeyForSeq(100) = %x, want new key", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := d.KeyForSeq(99); got != nil {
+		t.Errorf("KeyForSeq(99) after overlap = %x, want nil", got)
+	}
+}
+
+func TestComparisonCodeVectors(t *testing.T) {
+	a := bytes.Repeat([]byte{1}, PublicKeySize)
+	b := bytes.Repeat([]byte{2}, PublicKeySize)
+
+	tests := []struct {
+		txPub, rxPub []byte
+		tx, rx       DeviceID
+		want         uint32
+	}{
+		{a, b, 0xCAFE, 0xBEEF, 31773},
+		{b, a, 0xCAFE, 0xBEEF, 340969},
+		{a, b, 0xCAFF, 0xBEEF, 106672},
+	}
+	for _, tt := range tests {
+		if got := ComparisonCode(tt.txPub, tt.rxPub, tt.tx, tt.rx); got != tt.want {
+			t.Errorf("ComparisonCode(%x.., %x.., %#x, %#x) = %06d, want %06d",
+				tt.txPub[0], tt.rxPub[0], tt.tx, tt.rx, got, tt.want)
+		}
+	}
+}
+
+func TestRollingCode(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, SessionKeySize)
+	c1 := RollingCode(key, 1, 0xCAFE, 10)
+	if c1 != RollingCode(key, 1, 0xCAFE, 10) {
+		t.Fatal("RollingCode is not deterministic")
+	}
+	if c1 == RollingCode(key, 2, 0xCAFE, 10) || c1 == RollingCode(key, 1, 0xCAFE, 11) {
+		t.Error("rolling code does not depend on the counter and sequence number")
+	}
+	if bytes.Equal(RollingKey(key, 1), RollingKey(key, 2)) {
+		t.Error("consecutive rolling keys are equal")
+	}
+
+	ext := AppendRollingTLV(nil, 7, c1)
+	if counter, code, ok := ParseRollingCode(ext); !ok || counter != 7 || code != c1 {
+		t.Errorf("ParseRollingCode() = %d, %x, %v", counter, code, ok)
+	}
+
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if ResyncResponse(key, nonce, 5, 0xCAFE, 0xBEEF) == ResyncResponse(key, nonce, 6, 0xCAFE, 0xBEEF) {
+		t.Error("resync response does not depend on the counter")
+	}
+}
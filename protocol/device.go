@@ -18,16 +18,53 @@ type Device struct {
 	Prefix  byte
 	Channel uint8
 
-	PairingKey uint32
+	PairingKey PairingKey
 	IsPaired   bool
 	LastSeen   int64 // unix milli
+
+	// MaxFrameSize is the frame limit agreed with the peer during pairing;
+	// zero means the MaxFrameSize default.
+	MaxFrameSize int
+
+	// Capabilities are the features both ends of the link support.
+	Capabilities Capability
+
+	// Info is the metadata the peer announced when pairing.
+	Info DeviceInfo
+
+	// HeartbeatInterval is the heartbeat period a transmitter announced
+	// when pairing; zero means the receiver's configured interval.
+	HeartbeatInterval time.Duration
+
+	// SessionKey is the secret derived by secure pairing, nil otherwise.
+	SessionKey []byte
+
+	// KeyIndex counts session key rotations. Frames numbered below
+	// KeySwitchSeq were sent under PrevSessionKey, which stays valid until
+	// PrevKeyExpires (unix milli) to absorb frames in flight at the switch.
+	KeyIndex       uint8
+	KeySwitchSeq   uint32
+	PrevSessionKey []byte
+	PrevKeyExpires int64
+
+	// Health is the report carried by the transmitter's last heartbeat,
+	// nil until one arrives.
+	Health *HealthReport
+
+	// RollCounter is the rotation of the rolling key schedule last used by
+	// a transmitter, or last accepted by a receiver.
+	RollCounter uint32
+
+	// Epoch is the boot epoch a transmitter announced, counting its
+	// restarts; zero if it announced none.
+	Epoch uint32
 }
 
 func newDevice(id DeviceID) *Device {
 	return &Device{
 		ID:       id,
-		Address:  0xE7E7E7E7,
-		Prefix:   0xE7,
+		Address:  DefaultAddress,
+		Prefix:   DefaultPrefix,
 		Channel:  DefaultChannel,
 		LastSeen: time.Now().UnixMilli(),
 	}
@@ -37,6 +74,52 @@ func NewTransmitter(id DeviceID) *Device { return newDevice(id) }
 
 func NewReceiver(id DeviceID) *Device { return newDevice(id) }
 
+// HasCapability reports whether both ends of the link support every feature
+// in c.
+func (d *Device) HasCapability(c Capability) bool { return d.Capabilities&c == c }
+
 func (d *Device) UpdateLastSeen() { d.LastSeen = time.Now().UnixMilli() }
 
-func (d *Device) IsAlive() bool { return (time.Now().UnixMilli() - d.LastSeen) < DeviceTimeout }
+func (d *Device) IsAlive() bool { return d.IsAliveWithin(DeviceTimeout * time.Millisecond) }
+
+// IsAliveWithin reports whether the device was seen within timeout.
+func (d *Device) IsAliveWithin(timeout time.Duration) bool {
+	return (time.Now().UnixMilli() - d.LastSeen) < timeout.Milliseconds()
+}
+
+// RotateSessionKey makes next the session key for frames numbered switchSeq
+// and later, keeping the current key for earlier frames during overlap.
+func (d *Device) RotateSessionKey(next []byte, index uint8, switchSeq uint32, overlap time.Duration) {
+	d.PrevSessionKey = d.SessionKey
+	d.PrevKeyExpires = time.Now().Add(overlap).UnixMilli()
+	d.SessionKey = next
+	d.KeyIndex = index
+	d.KeySwitchSeq = switchSeq
+}
+
+// ResetSessionKey installs the key of a fresh pairing, forgetting rotations.
+func (d *Device) ResetSessionKey(key []byte) {
+	d.SessionKey = key
+	d.KeyIndex = 0
+	d.KeySwitchSeq = 0
+	d.PrevSessionKey = nil
+	d.PrevKeyExpires = 0
+	d.RollCounter = 0
+}
+
+// Rolling reports whether heartbeats on the link carry rolling codes.
+func (d *Device) Rolling() bool { return d.SessionKey != nil && d.HasCapability(CapRollingKey) }
+
+// KeyForSeq returns the session key protecting the frame numbered seq: the
+// previous key for frames sent before the last rotation while the overlap
+// window lasts, the current key otherwise. It returns nil for pre-rotation
+// frames once the window has closed.
+func (d *Device) KeyForSeq(seq uint32) []byte {
+	if d.PrevSessionKey == nil || int32(seq-d.KeySwitchSeq) >= 0 {
+		return d.SessionKey
+	}
+	if time.Now().UnixMilli() >= d.PrevKeyExpires {
+		return nil
+	}
+	return d.PrevSessionKey
+}
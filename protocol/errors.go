@@ -3,8 +3,34 @@ package protocol
 import "errors"
 
 var (
-	ErrInvalidPayload = errors.New("invalid payload size")
-	ErrNotPaired      = errors.New("device not paired")
-	ErrTimeout        = errors.New("operation timed out")
-	ErrInvalidChannel = errors.New("invalid channel (valid range: 0-125)")
+	ErrInvalidPayload   = errors.New("invalid payload size")
+	ErrNotPaired        = errors.New("device not paired")
+	ErrTimeout          = errors.New("operation timed out")
+	ErrInvalidChannel   = errors.New("invalid channel (valid range: 0-125)")
+	ErrInvalidPipe      = errors.New("invalid pipe (valid range: 0-7)")
+	ErrInvalidConfig    = errors.New("invalid protocol configuration")
+	ErrInvalidPriority  = errors.New("invalid frame priority")
+	ErrPairingRejected  = errors.New("pairing rejected by peer")
+	ErrSecurityMismatch = errors.New("peer does not match the secure pairing mode")
+	ErrInvalidKey       = errors.New("invalid public key")
+	ErrNoSessionKey     = errors.New("link has no session key")
+	ErrUnsupported      = errors.New("feature not supported by peer")
+	ErrInvalidKeySize   = errors.New("pairing key must be 4, 8 or 16 bytes long")
+	ErrQueueFull        = errors.New("transmit queue full")
+	ErrClosed           = errors.New("endpoint closed")
+	ErrSeveralReceivers = errors.New("several receivers paired, name one")
+	ErrDutyCycle        = errors.New("airtime budget exhausted")
+	ErrInvalidTxPower   = errors.New("output power not supported by the radio")
+	ErrBlobRejected     = errors.New("blob rejected by peer")
+	ErrBlobIncomplete   = errors.New("blob incomplete at the peer")
+	ErrBlobCorrupt      = errors.New("blob checksum mismatch")
+	ErrChannelBusy      = errors.New("channel busy")
+	ErrExpired          = errors.New("message expired in the transmit queue")
+	ErrOverflow         = errors.New("receive buffer overflowed")
+	ErrStateVersion     = errors.New("unsupported state snapshot version")
+	ErrStateCorrupt     = errors.New("corrupt state snapshot")
+	ErrNoRSSI           = errors.New("no signal strength measured")
+	ErrAsleep           = errors.New("radio asleep")
+	ErrInvalidDataRate  = errors.New("data rate not supported by the radio")
+	ErrDataRateMismatch = errors.New("peer uses another data rate")
 )
@@ -0,0 +1,46 @@
+package protocol
+
+// A FrameTypeFragment payload is MsgID(1) | Index(1) | Count(1) | Chunk.
+// Messages too large for one frame are split into up to MaxFragments chunks
+// sharing a message ID; the receiver delivers them once all have arrived.
+const (
+	FragmentHeaderSize = 3
+	MaxFragments       = 0xFF
+)
+
+// SplitMessage cuts msg into fragment payloads of at most maxPayload bytes.
+// It reports false if msg needs more than MaxFragments fragments or
+// maxPayload leaves no room for data.
+func SplitMessage(msg []byte, msgID byte, maxPayload int) ([][]byte, bool) {
+	chunk := maxPayload - FragmentHeaderSize
+	if chunk <= 0 {
+		return nil, false
+	}
+	count := (len(msg) + chunk - 1) / chunk
+	if count == 0 {
+		count = 1
+	}
+	if count > MaxFragments {
+		return nil, false
+	}
+	frags := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunk
+		if end > len(msg) {
+			end = len(msg)
+		}
+		frag := make([]byte, FragmentHeaderSize, FragmentHeaderSize+end-i*chunk)
+		frag[0], frag[1], frag[2] = msgID, byte(i), byte(count)
+		frags = append(frags, append(frag, msg[i*chunk:end]...))
+	}
+	return frags, true
+}
+
+// DecodeFragment splits a fragment payload. It reports false if the header
+// is truncated or inconsistent.
+func DecodeFragment(payload []byte) (msgID, index, count byte, chunk []byte, ok bool) {
+	if len(payload) < FragmentHeaderSize || payload[2] == 0 || payload[1] >= payload[2] {
+		return 0, 0, 0, nil, false
+	}
+	return payload[0], payload[1], payload[2], payload[FragmentHeaderSize:], true
+}
@@ -3,55 +3,100 @@ package protocol
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"time"
 )
 
 // Frame represents a frame of data transferred over the radio link.
-// Layout: Length(1) | SenderID(4) | Type(1) | Seq(4) | Reserved(2) | Payload(0-242) | CRC32(4) | Terminal(1)
-// Length counts everything AFTER the length byte (so full Frame minus 1).
-// Total size max 255 bytes.
+// See constants.go for the on-air layout; EncodeFrame and DecodeFrame are the
+// only codec for it, used by every transport and driver.
+// Total size max MaxFrameSize bytes.
 
 type DeviceID uint32
 
 type Frame struct {
-	Length   byte
-	SenderID DeviceID
-	Type     byte
-	Seq      uint32
-	Payload  []byte
-	CRC      uint32 // decoded Frames only; ignored by encoder
+	Length    byte
+	SenderID  DeviceID
+	Type      byte
+	Flags     byte // high nibble of the on-air type byte, see FrameFlagMask
+	Seq       uint32
+	Timestamp uint32 // milliseconds; only on the wire when FlagTimestamp is set
+	Payload   []byte
+	CRC       uint32 // decoded Frames only; ignored by encoder
+
+	// Received is when the frame was taken from the radio, or handed to a
+	// receiver's ProcessFrame; zero for frames built locally. RSSI is the
+	// signal strength the radio measured for the frame, in dBm, or 0 if the
+	// driver does not report it, and Channel the channel the frame was
+	// heard on. Pipe is the radio address the frame matched, 0 unless the
+	// receiver listens on several. Ignored by encoder.
+	Received time.Time
+	RSSI     int8
+	Channel  uint8
+	Pipe     uint8
 }
 
-func EncodeFrame(p *Frame) []byte {
+// HasTimestamp reports whether the frame carries a sender timestamp.
+func (f *Frame) HasTimestamp() bool { return f.Flags&FlagTimestamp != 0 }
+
+// Age returns how long ago the frame was stamped, given the current reading
+// of a clock synchronised with the sender's (wraparound safe). It returns 0
+// for frames without a timestamp.
+func (f *Frame) Age(now uint32) time.Duration {
+	if !f.HasTimestamp() {
+		return 0
+	}
+	return time.Duration(now-f.Timestamp) * time.Millisecond
+}
+
+// headerSize returns the size of the header for a frame with the given flags.
+func headerSize(flags byte) int {
+	if flags&FlagTimestamp != 0 {
+		return FrameHeaderSize + TimestampFieldSize
+	}
+	return FrameHeaderSize
+}
+
+// EncodeFrame encodes p using the default configuration.
+func EncodeFrame(p *Frame) []byte { return DefaultConfig().EncodeFrame(p) }
+
+// DecodeFrame decodes data using the default configuration.
+func DecodeFrame(data []byte) *Frame { return DefaultConfig().DecodeFrame(data) }
+
+// EncodeFrame encodes p, truncating the payload to the configured limit.
+func (c Config) EncodeFrame(p *Frame) []byte {
 	if p == nil {
 		return make([]byte, 0)
 	}
+	c = c.Normalize()
+	flags := p.Flags & FrameFlagMask
+	header := headerSize(flags)
+	maxPayload := c.MaxFrameSize - header - CRCSize - TerminalSize
+	if maxPayload < 0 {
+		maxPayload = 0
+	}
 
 	payloadLen := 0
 	if p.Payload != nil {
-		if len(p.Payload) > MaxPayloadSize {
-			p.Payload = p.Payload[:MaxPayloadSize]
+		if len(p.Payload) > maxPayload {
+			p.Payload = p.Payload[:maxPayload]
 		}
 		payloadLen = len(p.Payload)
 	}
 
-	bodyLen := headerWithoutLen + payloadLen + CRCSize + TerminalSize // bytes AFTER Length field
-	if bodyLen > (MaxFrameSize - LengthFieldSize) {
-		bodyLen = MaxFrameSize - LengthFieldSize
-		if bodyLen >= headerWithoutLen+CRCSize+TerminalSize {
-			payloadLen = bodyLen - headerWithoutLen - CRCSize - TerminalSize
-		}
-	}
-
+	bodyLen := header - LengthFieldSize + payloadLen + CRCSize + TerminalSize // bytes AFTER Length field
 	totalLen := int(LengthFieldSize) + bodyLen
 
 	data := make([]byte, totalLen)
 	data[0] = byte(bodyLen)
 	binary.LittleEndian.PutUint32(data[1:5], uint32(p.SenderID))
-	data[5] = p.Type
+	data[5] = p.Type&FrameTypeMask | flags
 	binary.LittleEndian.PutUint32(data[6:10], p.Seq)
+	if flags&FlagTimestamp != 0 {
+		binary.LittleEndian.PutUint32(data[FrameHeaderSize:header], p.Timestamp)
+	}
 
 	if payloadLen > 0 {
-		copy(data[FrameHeaderSize:], p.Payload[:payloadLen])
+		copy(data[header:], p.Payload[:payloadLen])
 	}
 
 	// Compute CRC32 of payload
@@ -61,7 +106,8 @@ func EncodeFrame(p *Frame) []byte {
 	} else {
 		crc = 0
 	}
-	crcPos := FrameHeaderSize + payloadLen
+	crc ^= c.NetworkID
+	crcPos := header + payloadLen
 	binary.LittleEndian.PutUint32(data[crcPos:crcPos+CRCSize], crc)
 
 	// Terminal byte
@@ -72,7 +118,10 @@ func EncodeFrame(p *Frame) []byte {
 	return data
 }
 
-func DecodeFrame(data []byte) *Frame {
+// DecodeFrame decodes data, rejecting frames that exceed the configured limit.
+func (c Config) DecodeFrame(data []byte) *Frame {
+	c = c.Normalize()
+
 	// Must at least fit header + CRC + Terminal
 	minLen := FrameHeaderSize + CRCSize + TerminalSize
 	if len(data) < minLen {
@@ -89,13 +138,16 @@ func DecodeFrame(data []byte) *Frame {
 		return nil
 	}
 
+	flags := data[5] & FrameFlagMask
+	header := headerSize(flags)
+
 	// Determine payload length
-	payloadLen := bodyLen - headerWithoutLen - (CRCSize + TerminalSize)
-	if payloadLen < 0 || payloadLen > MaxPayloadSize {
+	payloadLen := bodyLen + LengthFieldSize - header - (CRCSize + TerminalSize)
+	if payloadLen < 0 || payloadLen > c.MaxFrameSize-header-CRCSize-TerminalSize {
 		return nil
 	}
 
-	payloadOffset := FrameHeaderSize
+	payloadOffset := header
 	crcOffset := payloadOffset + payloadLen
 
 	if crcOffset+CRCSize > len(data) {
@@ -104,7 +156,7 @@ func DecodeFrame(data []byte) *Frame {
 
 	recvCRC := binary.LittleEndian.Uint32(data[crcOffset : crcOffset+CRCSize])
 
-	calcCRC := crc32.ChecksumIEEE(data[payloadOffset:crcOffset])
+	calcCRC := crc32.ChecksumIEEE(data[payloadOffset:crcOffset]) ^ c.NetworkID
 	if recvCRC != calcCRC {
 		return nil
 	}
@@ -114,10 +166,14 @@ func DecodeFrame(data []byte) *Frame {
 	p := &Frame{
 		Length:   byte(bodyLen),
 		SenderID: DeviceID(binary.LittleEndian.Uint32(data[1:5])),
-		Type:     data[5],
+		Type:     data[5] & FrameTypeMask,
+		Flags:    flags,
 		Seq:      seqVal,
 		CRC:      recvCRC,
 	}
+	if flags&FlagTimestamp != 0 {
+		p.Timestamp = binary.LittleEndian.Uint32(data[FrameHeaderSize:header])
+	}
 
 	if payloadLen > 0 {
 		p.Payload = make([]byte, payloadLen)
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"testing"
+	"time"
 )
 
 func TestFrameEncoding(t *testing.T) {
@@ -283,3 +284,331 @@ func TestFrameSizeLimit(t *testing.T) {
 		t.Errorf("Decoded payload size = %v, want <= %v", len(decoded.Payload), MaxPayloadSize)
 	}
 }
+
+func TestFrameLayoutConstants(t *testing.T) {
+	// Guards the documented layout in constants.go against drift.
+	if FrameHeaderSize != 10 {
+		t.Errorf("FrameHeaderSize = %v, want 10", FrameHeaderSize)
+	}
+	if MaxPayloadSize != MaxFrameSize-FrameHeaderSize-CRCSize-TerminalSize {
+		t.Errorf("MaxPayloadSize = %v, inconsistent with MaxFrameSize %v", MaxPayloadSize, MaxFrameSize)
+	}
+
+	encoded := EncodeFrame(&Frame{SenderID: 1, Type: FrameTypeData, Payload: bytes.Repeat([]byte{1}, MaxPayloadSize)})
+	if len(encoded) != MaxFrameSize {
+		t.Errorf("max payload frame size = %v, want %v", len(encoded), MaxFrameSize)
+	}
+}
+
+func TestFrameLengthByte(t *testing.T) {
+	// The radio sends as many bytes as the length byte counts, so it must
+	// match the encoded frame for every size and optional field.
+	for _, cfg := range []Config{DefaultConfig(), {MaxFrameSize: 32}} {
+		for _, flags := range []byte{0, FlagTimestamp, FlagTimestamp | FlagPriority | FlagAckRequest} {
+			for _, n := range []int{0, cfg.MaxPayloadSize(), 2 * MaxFrameSize} {
+				f := &Frame{SenderID: 1, Type: FrameTypeData, Flags: flags, Payload: bytes.Repeat([]byte{1}, n)}
+				encoded := cfg.EncodeFrame(f)
+				if len(encoded) > cfg.Normalize().MaxFrameSize {
+					t.Errorf("%d-byte frames, flags %#02x, %d bytes: encoded %d bytes", cfg.MaxFrameSize, flags, n, len(encoded))
+				}
+				if int(encoded[0]) != len(encoded)-LengthFieldSize {
+					t.Errorf("%d-byte frames, flags %#02x, %d bytes: length byte %d for %d bytes", cfg.MaxFrameSize, flags, n, encoded[0], len(encoded))
+				}
+			}
+		}
+	}
+}
+
+func TestConfigDefaultsAndValidation(t *testing.T) {
+	if got := (Config{}).Normalize(); got != DefaultConfig() {
+		t.Errorf("Config{}.Normalize() = %+v, want %+v", got, DefaultConfig())
+	}
+	if got := (Config{}).MaxPayloadSize(); got != MaxPayloadSize {
+		t.Errorf("MaxPayloadSize() = %v, want %v", got, MaxPayloadSize)
+	}
+
+	invalid := []Config{
+		{MaxFrameSize: MinFrameSize},
+		{MaxFrameSize: MaxFrameSize + 1},
+		{DeviceTimeout: -1},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err != ErrInvalidConfig {
+			t.Errorf("Validate(%+v) = %v, want %v", cfg, err, ErrInvalidConfig)
+		}
+	}
+	if err := (Config{MaxFrameSize: 32}).Validate(); err != nil {
+		t.Errorf("Validate(32-byte frames) = %v, want nil", err)
+	}
+
+	// Out-of-range frame sizes go to the nearest bound, not the default.
+	for size, want := range map[int]int{0: MaxFrameSize, 12: MinFrameSize + 1, 32: 32, 200: MaxFrameSize} {
+		if got := (Config{MaxFrameSize: size}).Normalize().MaxFrameSize; got != want {
+			t.Errorf("Normalize() of %d-byte frames = %d, want %d", size, got, want)
+		}
+	}
+}
+
+func TestConfigFrameSizeLimit(t *testing.T) {
+	small := Config{MaxFrameSize: 32}
+	frame := &Frame{SenderID: 1, Type: FrameTypeData, Payload: bytes.Repeat([]byte{0xAA}, 64)}
+
+	encoded := small.EncodeFrame(frame)
+	if len(encoded) != 32 {
+		t.Fatalf("EncodeFrame() size = %v, want 32", len(encoded))
+	}
+	decoded := small.DecodeFrame(encoded)
+	if decoded == nil || len(decoded.Payload) != small.MaxPayloadSize() {
+		t.Fatalf("DecodeFrame() = %v, want payload of %v bytes", decoded, small.MaxPayloadSize())
+	}
+
+	// A full-size frame exceeds the small limit and must be rejected.
+	large := EncodeFrame(&Frame{SenderID: 1, Type: FrameTypeData, Payload: bytes.Repeat([]byte{1}, 64)})
+	if small.DecodeFrame(large) != nil {
+		t.Error("DecodeFrame() accepted a frame larger than the configured limit")
+	}
+}
+
+func TestTLV(t *testing.T) {
+	data := AppendTLV(nil, 0x01, []byte{1, 2})
+	data = AppendTLV(data, 0x07, []byte("abc"))
+
+	if v, ok := FindTLV(data, 0x07); !ok || string(v) != "abc" {
+		t.Errorf("FindTLV(0x07) = %v, %v", v, ok)
+	}
+	if _, ok := FindTLV(data, 0x09); ok {
+		t.Error("FindTLV() found a missing tag")
+	}
+	if _, ok := FindTLV(data[:len(data)-1], 0x07); ok {
+		t.Error("FindTLV() returned a truncated record")
+	}
+}
+
+func TestNetworkID(t *testing.T) {
+	frame := &Frame{SenderID: 0xBEEF, Type: FrameTypeData, Seq: 7, Payload: []byte{1, 2, 3}}
+
+	// The zero network ID must keep today's encoding byte for byte.
+	if !bytes.Equal(Config{}.EncodeFrame(frame), EncodeFrame(frame)) {
+		t.Error("NetworkID 0 changed the encoded frame")
+	}
+
+	netA := Config{NetworkID: 0x11111111}
+	netB := Config{NetworkID: 0x22222222}
+
+	for _, payload := range [][]byte{{1, 2, 3}, {}} {
+		frame.Payload = payload
+		encoded := netA.EncodeFrame(frame)
+		if netA.DecodeFrame(encoded) == nil {
+			t.Errorf("payload %v: same network failed to decode", payload)
+		}
+		if netB.DecodeFrame(encoded) != nil {
+			t.Errorf("payload %v: decoded a frame from another network", payload)
+		}
+		if DecodeFrame(encoded) != nil {
+			t.Errorf("payload %v: default network decoded a frame from network A", payload)
+		}
+	}
+}
+
+func TestFrameTimestamp(t *testing.T) {
+	plain := &Frame{SenderID: 0xBEEF, Type: FrameTypeData, Seq: 9, Payload: []byte{1, 2}}
+	stamped := &Frame{SenderID: 0xBEEF, Type: FrameTypeData, Seq: 9, Payload: []byte{1, 2},
+		Flags: FlagTimestamp, Timestamp: 0xDEADBEEF}
+
+	plainData := EncodeFrame(plain)
+	if plainData[5] != FrameTypeData || len(plainData) != FrameHeaderSize+2+CRCSize+TerminalSize {
+		t.Fatalf("frame without flags changed on the wire: % X", plainData)
+	}
+	if got := DecodeFrame(plainData); got.HasTimestamp() || got.Timestamp != 0 {
+		t.Errorf("decoded plain frame has timestamp %v", got.Timestamp)
+	}
+
+	stampedData := EncodeFrame(stamped)
+	if len(stampedData) != len(plainData)+TimestampFieldSize {
+		t.Errorf("stamped frame size = %v, want %v", len(stampedData), len(plainData)+TimestampFieldSize)
+	}
+	got := DecodeFrame(stampedData)
+	if got == nil {
+		t.Fatal("DecodeFrame() returned nil for stamped frame")
+	}
+	if got.Type != FrameTypeData || !got.HasTimestamp() || got.Timestamp != 0xDEADBEEF {
+		t.Errorf("decoded Type=%v Flags=%#x Timestamp=%#x", got.Type, got.Flags, got.Timestamp)
+	}
+	if !bytes.Equal(got.Payload, stamped.Payload) {
+		t.Errorf("Payload = %v, want %v", got.Payload, stamped.Payload)
+	}
+
+	// A stamped frame still honours the overall size limit.
+	stamped.Payload = bytes.Repeat([]byte{1}, MaxPayloadSize)
+	if n := len(EncodeFrame(stamped)); n != MaxFrameSize {
+		t.Errorf("stamped max frame size = %v, want %v", n, MaxFrameSize)
+	}
+}
+
+func TestFrameAge(t *testing.T) {
+	f := &Frame{Flags: FlagTimestamp, Timestamp: 0xFFFFFFF0}
+	if got := f.Age(0x10); got != 32*time.Millisecond {
+		t.Errorf("Age() across wraparound = %v, want 32ms", got)
+	}
+	if got := (&Frame{Timestamp: 5}).Age(10); got != 0 {
+		t.Errorf("Age() without timestamp = %v, want 0", got)
+	}
+}
+
+func TestFramePriority(t *testing.T) {
+	for p := PriorityNormal; int(p) < NumPriorities; p++ {
+		f := &Frame{SenderID: 1, Type: FrameTypeData, Flags: p.Flags(), Payload: []byte{1}}
+		got := DecodeFrame(EncodeFrame(f))
+		if got == nil || got.Priority() != p || got.Type != FrameTypeData {
+			t.Errorf("priority %v round trip = %+v", p, got)
+		}
+	}
+	if EncodeFrame(&Frame{Type: FrameTypeData})[5] != FrameTypeData {
+		t.Error("PriorityNormal frame changed the type byte")
+	}
+}
+
+func TestBatchSplit(t *testing.T) {
+	var payload []byte
+	payload = AppendBatchSample(payload, []byte{1, 2, 3, 4})
+	payload = AppendBatchSample(payload, []byte{})
+	payload = AppendBatchSample(payload, []byte{5})
+
+	samples, ok := SplitBatch(payload)
+	if !ok || len(samples) != 3 {
+		t.Fatalf("SplitBatch() = %v, %v", samples, ok)
+	}
+	if !bytes.Equal(samples[0], []byte{1, 2, 3, 4}) || len(samples[1]) != 0 || !bytes.Equal(samples[2], []byte{5}) {
+		t.Errorf("SplitBatch() = %v", samples)
+	}
+	if _, ok := SplitBatch(payload[:len(payload)-1]); ok {
+		t.Error("SplitBatch() accepted a truncated batch")
+	}
+}
+
+func TestDeviceInfoTLV(t *testing.T) {
+	info := DeviceInfo{Name: "kitchen", Class: 3, Firmware: 0x010203}
+	ext := AppendInfoTLV(nil, info, 64)
+	if got := ParseDeviceInfo(ext); got != info {
+		t.Errorf("ParseDeviceInfo() = %+v, want %+v", got, info)
+	}
+
+	// The name is cut at a rune boundary to the space left: 16 bytes minus
+	// class (3), firmware (6) and the name header (2) leaves 5, which holds
+	// two 2-byte runes.
+	long := DeviceInfo{Name: "ééééé", Class: 3, Firmware: 1}
+	ext = AppendInfoTLV(nil, long, 16)
+	if got := ParseDeviceInfo(ext); got.Name != "éé" || len(ext) > 16 {
+		t.Errorf("truncated name = %q (%d bytes total), want %q", got.Name, len(ext), "éé")
+	}
+	if !bytes.Equal(ext, AppendInfoTLV(nil, long, 16)) {
+		t.Error("truncation is not deterministic")
+	}
+
+	if ext := AppendInfoTLV(nil, long, 4); len(ext) != 3 {
+		t.Errorf("AppendInfoTLV(limit 4) = %x, want only the class record", ext)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	msg := make([]byte, 250)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	frags, ok := SplitMessage(msg, 9, 103) // 100-byte chunks
+	if !ok || len(frags) != 3 || len(frags[2]) != FragmentHeaderSize+50 {
+		t.Fatalf("SplitMessage() = %d fragments, %v", len(frags), ok)
+	}
+	var joined []byte
+	for i, f := range frags {
+		id, index, count, chunk, ok := DecodeFragment(f)
+		if !ok || id != 9 || int(index) != i || count != 3 {
+			t.Errorf("fragment %d header = %d/%d/%d, %v", i, id, index, count, ok)
+		}
+		joined = append(joined, chunk...)
+	}
+	if !bytes.Equal(joined, msg) {
+		t.Error("fragments do not reassemble to the message")
+	}
+
+	if _, ok := SplitMessage(make([]byte, MaxFragments*10+1), 1, 13); ok {
+		t.Error("SplitMessage() accepted a message needing too many fragments")
+	}
+	if _, _, _, _, ok := DecodeFragment([]byte{1, 3, 3}); ok {
+		t.Error("DecodeFragment() accepted an index beyond the count")
+	}
+}
+
+func TestPrivateAddress(t *testing.T) {
+	a1, p1 := PrivateAddress(0xBEEF)
+	a2, p2 := PrivateAddress(0xBEEF)
+	if a1 != a2 || p1 != p2 {
+		t.Fatal("PrivateAddress is not deterministic")
+	}
+	if a1 == DefaultAddress || p1 == DefaultPrefix {
+		t.Errorf("PrivateAddress(0xBEEF) = %#x/%#x, collides with the pairing address", a1, p1)
+	}
+	if a3, _ := PrivateAddress(0xBEF0); a3 == a1 {
+		t.Error("different receivers got the same address")
+	}
+
+	ext := AppendAddressTLV(nil, a1, p1)
+	if a, p, ok := ParseAddress(ext); !ok || a != a1 || p != p1 {
+		t.Errorf("ParseAddress() = %#x, %#x, %v", a, p, ok)
+	}
+	if _, _, ok := ParseAddress(AppendTLV(nil, TagLinkAddress, []byte{1})); ok {
+		t.Error("ParseAddress() accepted a short record")
+	}
+}
+
+func TestBeacon(t *testing.T) {
+	info := DeviceInfo{Name: "hallway hub", Class: 2}
+	payload := EncodeBeacon(42, info, MaxPayloadSize)
+	ch, got, ok := DecodeBeacon(payload)
+	if !ok || ch != 42 || got != info {
+		t.Errorf("DecodeBeacon() = %d, %+v, %v, want 42, %+v", ch, got, ok, info)
+	}
+	if short := EncodeBeacon(42, info, 8); len(short) > 8 {
+		t.Errorf("EncodeBeacon() with limit 8 gave %d bytes", len(short))
+	}
+	if _, _, ok := DecodeBeacon([]byte{126}); ok {
+		t.Error("DecodeBeacon() accepted channel 126")
+	}
+}
+
+func TestHealthTLV(t *testing.T) {
+	h := HealthReport{BatteryMillivolts: 2950, Uptime: 86400, TxFrames: 1234, Retries: 7}
+	ext := AppendHealthTLV(AppendHeartbeatTLV(nil, 0), h)
+	if len(ext) != 6+HealthTLVSize {
+		t.Fatalf("health record is %d bytes, want %d", len(ext)-6, HealthTLVSize)
+	}
+	if got, ok := ParseHealth(ext); !ok || got != h {
+		t.Errorf("ParseHealth() = %+v, %v, want %+v", got, ok, h)
+	}
+	if _, ok := ParseHealth(AppendTLV(nil, TagHealth, []byte{1, 2})); ok {
+		t.Error("ParseHealth() accepted a short record")
+	}
+}
+
+func TestBlobOffer(t *testing.T) {
+	o := BlobOffer{ID: 7, Size: 250, CRC: 0xDEADBEEF, ChunkSize: 100}
+	got, ok := DecodeBlobOffer(EncodeBlobOffer(o))
+	if !ok || got != o {
+		t.Fatalf("DecodeBlobOffer() = %+v, %v, want %+v", got, ok, o)
+	}
+	if o.Chunks() != 3 || o.ChunkLen(1) != 100 || o.ChunkLen(2) != 50 {
+		t.Errorf("250 bytes in %d chunks, the last of %d bytes", o.Chunks(), o.ChunkLen(2))
+	}
+	if _, ok := DecodeBlobOffer(EncodeBlobOffer(BlobOffer{ID: 7, Size: 250})); ok {
+		t.Error("DecodeBlobOffer() accepted a zero chunk size")
+	}
+
+	id, index, data, ok := DecodeBlobChunk(EncodeBlobChunk(7, 2, []byte{1, 2}))
+	if !ok || id != 7 || index != 2 || !bytes.Equal(data, []byte{1, 2}) {
+		t.Errorf("DecodeBlobChunk() = %d, %d, %v, %v", id, index, data, ok)
+	}
+	first, bitmap, ok := DecodeBlobBitmap(EncodeBlobBitmap(16, []byte{0x05}))
+	if !ok || first != 16 || !bytes.Equal(bitmap, []byte{0x05}) {
+		t.Errorf("DecodeBlobBitmap() = %d, %v, %v", first, bitmap, ok)
+	}
+}
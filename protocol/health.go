@@ -0,0 +1,47 @@
+package protocol
+
+import "encoding/binary"
+
+// HealthReport is the device health a transmitter attaches to its
+// heartbeats. All fields are application-defined readings.
+type HealthReport struct {
+	BatteryMillivolts uint16
+	Uptime            uint32 // seconds
+	TxFrames          uint32
+	Retries           uint32
+}
+
+// healthSize is the encoded size of a HealthReport.
+const healthSize = 14
+
+// HealthTLVSize is the number of payload bytes a health report adds to a
+// heartbeat.
+const HealthTLVSize = 2 + healthSize
+
+// RollingTLVSize is the number of payload bytes a rolling code adds to a
+// heartbeat.
+const RollingTLVSize = 2 + 4 + ChallengeSize
+
+// AppendHealthTLV appends a health report record to dst.
+func AppendHealthTLV(dst []byte, h HealthReport) []byte {
+	var v [healthSize]byte
+	binary.LittleEndian.PutUint16(v[0:2], h.BatteryMillivolts)
+	binary.LittleEndian.PutUint32(v[2:6], h.Uptime)
+	binary.LittleEndian.PutUint32(v[6:10], h.TxFrames)
+	binary.LittleEndian.PutUint32(v[10:14], h.Retries)
+	return AppendTLV(dst, TagHealth, v[:])
+}
+
+// ParseHealth returns the health report carried in a TLV section.
+func ParseHealth(ext []byte) (HealthReport, bool) {
+	v, ok := FindTLV(ext, TagHealth)
+	if !ok || len(v) != healthSize {
+		return HealthReport{}, false
+	}
+	return HealthReport{
+		BatteryMillivolts: binary.LittleEndian.Uint16(v[0:2]),
+		Uptime:            binary.LittleEndian.Uint32(v[2:6]),
+		TxFrames:          binary.LittleEndian.Uint32(v[6:10]),
+		Retries:           binary.LittleEndian.Uint32(v[10:14]),
+	}, true
+}
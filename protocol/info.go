@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"unicode/utf8"
+)
+
+// DeviceInfo is the metadata a transmitter announces when pairing.
+type DeviceInfo struct {
+	Name     string // UTF-8, truncated to fit the pairing request
+	Class    uint8  // application-defined device class
+	Firmware uint32 // application-defined firmware version
+}
+
+// IsZero reports whether no metadata is set.
+func (i DeviceInfo) IsZero() bool { return i == DeviceInfo{} }
+
+// AppendInfoTLV appends the class, firmware and name records of info to dst
+// without letting dst grow beyond limit bytes. The name goes last and is cut
+// at a rune boundary to the space left, so the same info and limit always
+// give the same bytes; records that do not fit at all are left out.
+func AppendInfoTLV(dst []byte, info DeviceInfo, limit int) []byte {
+	if info.Class != 0 && len(dst)+3 <= limit {
+		dst = AppendTLV(dst, TagDeviceClass, []byte{info.Class})
+	}
+	if info.Firmware != 0 && len(dst)+6 <= limit {
+		var fw [4]byte
+		binary.LittleEndian.PutUint32(fw[:], info.Firmware)
+		dst = AppendTLV(dst, TagFirmware, fw[:])
+	}
+	if room := limit - len(dst) - 2; info.Name != "" && room > 0 {
+		if room > 0xFF {
+			room = 0xFF
+		}
+		if name := truncateUTF8(info.Name, room); name != "" {
+			dst = AppendTLV(dst, TagDeviceName, []byte(name))
+		}
+	}
+	return dst
+}
+
+// ParseDeviceInfo extracts the metadata records from a TLV section.
+func ParseDeviceInfo(ext []byte) DeviceInfo {
+	var info DeviceInfo
+	if v, ok := FindTLV(ext, TagDeviceName); ok {
+		info.Name = string(v)
+	}
+	if v, ok := FindTLV(ext, TagDeviceClass); ok && len(v) == 1 {
+		info.Class = v[0]
+	}
+	if v, ok := FindTLV(ext, TagFirmware); ok && len(v) == 4 {
+		info.Firmware = binary.LittleEndian.Uint32(v)
+	}
+	return info
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+)
+
+const (
+	// MaxPairingKeySize is the widest pairing key. Keys are 4, 8 or 16
+	// bytes long; 4-byte keys are the only width peers without
+	// CapLongPairingKey understand.
+	MaxPairingKeySize = 16
+
+	// DefaultPairingKeySize is the width of the keys transmitters generate
+	// unless told otherwise. Wider keys make pairing requests up to 18 bytes
+	// longer, which receivers limited to small frames may not accept.
+	DefaultPairingKeySize = 4
+)
+
+// PairingKey is the credential a transmitter pairs with. Its first four
+// bytes, read as a little endian uint32, are the key field of the pairing
+// request understood by every peer; longer keys travel in full in a
+// TagPairingKey extension. The zero value is the empty key. PairingKeys are
+// comparable with ==.
+type PairingKey struct {
+	b [MaxPairingKeySize]byte
+	n uint8
+}
+
+func validPairingKeySize(n int) bool { return n == 4 || n == 8 || n == 16 }
+
+// NewPairingKey returns the key made of b, which must be 4, 8 or 16 bytes
+// long.
+func NewPairingKey(b []byte) (PairingKey, error) {
+	var k PairingKey
+	if !validPairingKeySize(len(b)) {
+		return k, ErrInvalidKeySize
+	}
+	k.n = uint8(copy(k.b[:], b))
+	return k, nil
+}
+
+// PairingKeyFromUint32 returns the 4-byte key v, as used before wider keys.
+func PairingKeyFromUint32(v uint32) PairingKey {
+	k := PairingKey{n: 4}
+	binary.LittleEndian.PutUint32(k.b[:4], v)
+	return k
+}
+
+// GeneratePairingKey returns a random key of size bytes read from src, or
+// from the package-wide source if src is nil.
+func GeneratePairingKey(src RandSource, size int) (PairingKey, error) {
+	k := PairingKey{n: uint8(size)}
+	if !validPairingKeySize(size) {
+		return PairingKey{}, ErrInvalidKeySize
+	}
+	if err := ReadRand(src, k.b[:size]); err != nil {
+		return PairingKey{}, err
+	}
+	return k, nil
+}
+
+// Len returns the width of the key in bytes, zero for the empty key.
+func (k PairingKey) Len() int { return int(k.n) }
+
+// Bytes returns a copy of the key.
+func (k PairingKey) Bytes() []byte { return append([]byte(nil), k.b[:k.n]...) }
+
+// Uint32 returns the first four bytes of the key, little endian: the key
+// field of a pairing request.
+func (k PairingKey) Uint32() uint32 { return binary.LittleEndian.Uint32(k.b[:4]) }
+
+// IsZero reports whether every byte of the key is zero, which is how a
+// pairing request says that it carries no key.
+func (k PairingKey) IsZero() bool { return k.b == [MaxPairingKeySize]byte{} }
+
+// Truncate returns the first size bytes of k, or k if it is not longer.
+func (k PairingKey) Truncate(size int) PairingKey {
+	if !validPairingKeySize(size) || size >= int(k.n) {
+		return k
+	}
+	t := PairingKey{n: uint8(size)}
+	copy(t.b[:], k.b[:size])
+	return t
+}
+
+// String returns the key in hexadecimal.
+func (k PairingKey) String() string { return hex.EncodeToString(k.b[:k.n]) }
+
+// MarshalText encodes the key in hexadecimal.
+func (k PairingKey) MarshalText() ([]byte, error) { return []byte(k.String()), nil }
+
+// UnmarshalText decodes a key encoded by MarshalText. An empty text is the
+// empty key.
+func (k *PairingKey) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*k = PairingKey{}
+		return nil
+	}
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	key, err := NewPairingKey(b)
+	if err != nil {
+		return err
+	}
+	*k = key
+	return nil
+}
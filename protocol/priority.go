@@ -0,0 +1,21 @@
+package protocol
+
+// Priority is the urgency of a frame, carried in the FlagPriority bits.
+// Higher values are transmitted first; frames without priority bits are
+// PriorityNormal.
+type Priority uint8
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	PriorityUrgent
+	PriorityCritical
+
+	NumPriorities = int(PriorityCritical) + 1
+)
+
+// Flags returns the frame flag bits encoding p.
+func (p Priority) Flags() byte { return byte(p&3) << priorityShift }
+
+// Priority returns the priority encoded in the frame flags.
+func (f *Frame) Priority() Priority { return Priority((f.Flags & FlagPriority) >> priorityShift) }
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	crand "crypto/rand"
+	"io"
+	mrand "math/rand"
+	"sync"
+	"time"
+)
+
+// RandSource supplies the randomness for pairing keys, challenges, key
+// exchanges and timing jitter. TinyGo targets can back it with the
+// hardware RNG peripheral.
+type RandSource interface {
+	Read(b []byte) error
+}
+
+// SystemRand reads crypto/rand, falling back to time-seeded math/rand where
+// crypto/rand fails. It is the package-wide source unless SetRandSource
+// replaces it.
+var SystemRand RandSource = systemRand{}
+
+type systemRand struct{}
+
+func (systemRand) Read(b []byte) error {
+	if _, err := crand.Read(b); err != nil {
+		mrand.New(mrand.NewSource(time.Now().UnixNano())).Read(b)
+	}
+	return nil
+}
+
+var (
+	randMu      sync.Mutex
+	defaultRand = SystemRand
+)
+
+// SetRandSource replaces the package-wide source used wherever no source is
+// given explicitly. Nil restores SystemRand.
+func SetRandSource(src RandSource) {
+	if src == nil {
+		src = SystemRand
+	}
+	randMu.Lock()
+	defaultRand = src
+	randMu.Unlock()
+}
+
+// ReadRand fills b from src, or from the package-wide source if src is nil.
+func ReadRand(src RandSource, b []byte) error {
+	if src == nil {
+		randMu.Lock()
+		src = defaultRand
+		randMu.Unlock()
+	}
+	return src.Read(b)
+}
+
+// RandReader returns src, or the package-wide source if src is nil, as an
+// io.Reader.
+func RandReader(src RandSource) io.Reader { return randReader{src} }
+
+type randReader struct{ src RandSource }
+
+func (r randReader) Read(b []byte) (int, error) {
+	if err := ReadRand(r.src, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// NewSeededRand returns a deterministic source: sources with the same seed
+// produce the same bytes. It is meant for tests and must not generate real
+// keys.
+func NewSeededRand(seed int64) RandSource {
+	return &seededRand{r: mrand.New(mrand.NewSource(seed))}
+}
+
+type seededRand struct {
+	mu sync.Mutex
+	r  *mrand.Rand
+}
+
+func (s *seededRand) Read(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.r.Read(b)
+	return nil
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+const (
+	// SealNonceSize is the length of the random nonce opening a sealed
+	// payload.
+	SealNonceSize = 8
+
+	// SealOverhead is how much longer SealPairing makes a payload: the nonce
+	// and a ChallengeSize authentication tag.
+	SealOverhead = SealNonceSize + ChallengeSize
+)
+
+// SealPairing encrypts the payload of pairing frame f under the
+// deployment-wide pre-shared key psk, so that listeners without it learn
+// neither the pairing key nor the peer it is addressed to. The result is
+// nonce | ciphertext | tag: the ciphertext is the payload XORed with an
+// HMAC-SHA256 keystream, and the tag authenticates it together with the
+// sender, type and sequence number of f, so that it cannot be replayed in
+// another frame.
+func SealPairing(psk []byte, nonce [SealNonceSize]byte, f *Frame) []byte {
+	out := make([]byte, SealNonceSize, SealOverhead+len(f.Payload))
+	copy(out, nonce[:])
+	out = append(out, f.Payload...)
+	sealStream(psk, f, out[:SealNonceSize], out[SealNonceSize:])
+	tag := sealTag(psk, f, out)
+	return append(out, tag[:]...)
+}
+
+// OpenPairing decrypts a payload sealed by SealPairing for frame f. It
+// reports false if the payload was not sealed under psk for f.
+func OpenPairing(psk []byte, f *Frame) ([]byte, bool) {
+	if len(f.Payload) < SealOverhead {
+		return nil, false
+	}
+	body := f.Payload[:len(f.Payload)-ChallengeSize]
+	want := sealTag(psk, f, body)
+	if !hmac.Equal(f.Payload[len(body):], want[:]) {
+		return nil, false
+	}
+	plain := append([]byte(nil), body[SealNonceSize:]...)
+	sealStream(psk, f, body[:SealNonceSize], plain)
+	return plain, true
+}
+
+// sealHeader binds a seal to the frame carrying it.
+func sealHeader(f *Frame) []byte {
+	var h [9]byte
+	binary.LittleEndian.PutUint32(h[0:4], uint32(f.SenderID))
+	h[4] = f.Type
+	binary.LittleEndian.PutUint32(h[5:9], f.Seq)
+	return h[:]
+}
+
+// sealStream XORs data with the keystream of nonce.
+func sealStream(psk []byte, f *Frame, nonce, data []byte) {
+	var block [sha256.Size]byte
+	for i := 0; i < len(data); i += sha256.Size {
+		mac := hmac.New(sha256.New, psk)
+		mac.Write([]byte("pairing seal"))
+		mac.Write(nonce)
+		mac.Write(sealHeader(f))
+		mac.Write([]byte{byte(i / sha256.Size)})
+		mac.Sum(block[:0])
+		for j := i; j < len(data) && j < i+sha256.Size; j++ {
+			data[j] ^= block[j-i]
+		}
+	}
+}
+
+// sealTag authenticates the nonce and ciphertext in sealed.
+func sealTag(psk []byte, f *Frame, sealed []byte) [ChallengeSize]byte {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte("pairing tag"))
+	mac.Write(sealHeader(f))
+	mac.Write(sealed)
+
+	var out [ChallengeSize]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
@@ -0,0 +1,25 @@
+package protocol
+
+import "encoding/binary"
+
+// A FrameTypeStream payload is StreamID(1) | Offset(4) | Data, the offset
+// little endian. Offset is the position of Data in the stream StreamID
+// carries; a chunk without data ends the stream at Offset.
+const StreamHeaderSize = 5
+
+// EncodeStreamChunk builds a stream chunk payload.
+func EncodeStreamChunk(id byte, offset uint32, data []byte) []byte {
+	payload := make([]byte, StreamHeaderSize, StreamHeaderSize+len(data))
+	payload[0] = id
+	binary.LittleEndian.PutUint32(payload[1:], offset)
+	return append(payload, data...)
+}
+
+// DecodeStreamChunk splits a stream chunk payload. It reports false if the
+// header is truncated.
+func DecodeStreamChunk(payload []byte) (id byte, offset uint32, data []byte, ok bool) {
+	if len(payload) < StreamHeaderSize {
+		return 0, 0, nil, false
+	}
+	return payload[0], binary.LittleEndian.Uint32(payload[1:]), payload[StreamHeaderSize:], true
+}
@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Optional extensions in pairing and ACK payloads are carried as a sequence
+// of Tag(1) | Len(1) | Value(Len) records after the fixed fields. Unknown tags
+// are skipped, so older peers ignore extensions they do not understand.
+
+// AppendTLV appends one record to dst. Values longer than 255 bytes are
+// truncated.
+func AppendTLV(dst []byte, tag byte, value []byte) []byte {
+	if len(value) > 0xFF {
+		value = value[:0xFF]
+	}
+	dst = append(dst, tag, byte(len(value)))
+	return append(dst, value...)
+}
+
+// FindTLV returns the value of the first record with the given tag. Parsing
+// stops at the first truncated record.
+func FindTLV(data []byte, tag byte) ([]byte, bool) {
+	for len(data) >= 2 {
+		n := int(data[1])
+		if len(data) < 2+n {
+			return nil, false
+		}
+		if data[0] == tag {
+			return data[2 : 2+n], true
+		}
+		data = data[2+n:]
+	}
+	return nil, false
+}
+
+// AppendCapabilityTLV appends a capabilities record to dst.
+func AppendCapabilityTLV(dst []byte, c Capability) []byte {
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], uint32(c))
+	return AppendTLV(dst, TagCapabilities, v[:])
+}
+
+// AppendHeartbeatTLV appends a record announcing the heartbeat interval d,
+// in whole milliseconds, to dst.
+func AppendHeartbeatTLV(dst []byte, d time.Duration) []byte {
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], uint32(d.Milliseconds()))
+	return AppendTLV(dst, TagHeartbeat, v[:])
+}
+
+// ParseHeartbeat returns the heartbeat interval announced in a TLV section,
+// or zero if the peer did not announce one.
+func ParseHeartbeat(ext []byte) time.Duration {
+	if v, ok := FindTLV(ext, TagHeartbeat); ok && len(v) == 4 {
+		return time.Duration(binary.LittleEndian.Uint32(v)) * time.Millisecond
+	}
+	return 0
+}
+
+// EpochTLVSize is the number of payload bytes a boot epoch adds to a
+// heartbeat.
+const EpochTLVSize = 2 + 4
+
+// AppendEpochTLV appends a record announcing the sender's boot epoch to
+// dst.
+func AppendEpochTLV(dst []byte, epoch uint32) []byte {
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], epoch)
+	return AppendTLV(dst, TagEpoch, v[:])
+}
+
+// ParseEpoch returns the boot epoch announced in a TLV section, or zero if
+// the peer did not announce one.
+func ParseEpoch(ext []byte) uint32 {
+	if v, ok := FindTLV(ext, TagEpoch); ok && len(v) == 4 {
+		return binary.LittleEndian.Uint32(v)
+	}
+	return 0
+}
+
+// ParseCapabilities returns the capabilities announced in a TLV section,
+// or none if the peer did not announce any.
+func ParseCapabilities(ext []byte) Capability {
+	if v, ok := FindTLV(ext, TagCapabilities); ok && len(v) == 4 {
+		return Capability(binary.LittleEndian.Uint32(v))
+	}
+	return 0
+}
+
+// AppendAddressTLV appends a link address record to dst.
+func AppendAddressTLV(dst []byte, address uint32, prefix byte) []byte {
+	var v [5]byte
+	binary.LittleEndian.PutUint32(v[:4], address)
+	v[4] = prefix
+	return AppendTLV(dst, TagLinkAddress, v[:])
+}
+
+// ParseAddress returns the link address carried in a TLV section.
+func ParseAddress(ext []byte) (address uint32, prefix byte, ok bool) {
+	v, ok := FindTLV(ext, TagLinkAddress)
+	if !ok || len(v) != 5 {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(v[:4]), v[4], true
+}
+
+// AppendRollingTLV appends a rolling code record to dst.
+func AppendRollingTLV(dst []byte, counter uint32, code [ChallengeSize]byte) []byte {
+	var v [4 + ChallengeSize]byte
+	binary.LittleEndian.PutUint32(v[:4], counter)
+	copy(v[4:], code[:])
+	return AppendTLV(dst, TagRollingCode, v[:])
+}
+
+// ParseRollingCode returns the rolling code carried in a TLV section.
+func ParseRollingCode(ext []byte) (counter uint32, code [ChallengeSize]byte, ok bool) {
+	v, ok := FindTLV(ext, TagRollingCode)
+	if !ok || len(v) != 4+ChallengeSize {
+		return 0, code, false
+	}
+	copy(code[:], v[4:])
+	return binary.LittleEndian.Uint32(v[:4]), code, true
+}
+
+// AppendPairingKeyTLV appends key to dst as a TagPairingKey record.
+func AppendPairingKeyTLV(dst []byte, key PairingKey) []byte {
+	return AppendTLV(dst, TagPairingKey, key.Bytes())
+}
+
+// ParsePairingKey returns the key advertised by a pairing request payload,
+// which must be at least 8 bytes long. If long is set, a TagPairingKey
+// extension agreeing with the 4-byte key field supplies the whole key;
+// otherwise, or without one, the key field is the key.
+func ParsePairingKey(payload []byte, long bool) PairingKey {
+	key := PairingKeyFromUint32(binary.LittleEndian.Uint32(payload[:4]))
+	if !long {
+		return key
+	}
+	if v, ok := FindTLV(payload[8:], TagPairingKey); ok {
+		if k, err := NewPairingKey(v); err == nil && k.Uint32() == key.Uint32() {
+			return k
+		}
+	}
+	return key
+}
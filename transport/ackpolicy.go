@@ -0,0 +1,70 @@
+package transport
+
+import (
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// AckMode says which data frames a receiver acknowledges, see AckPolicy.
+type AckMode uint8
+
+const (
+	AckAlways    AckMode = iota // every data and batch frame
+	AckNever                    // none, not even those asking for an ACK
+	AckEveryN                   // every Nth frame of each transmitter, and those asking for an ACK
+	AckOnRequest                // only those asking for an ACK, as reliable sends do
+)
+
+// AckPolicy decides which data and batch frames a receiver acknowledges.
+// Fragments, stream and blob chunks, heartbeats asking for an ACK and
+// control frames are acknowledged regardless, since their senders wait for
+// the ACKs.
+type AckPolicy struct {
+	Mode AckMode
+	N    int // for AckEveryN; below 2 acknowledges every frame
+}
+
+// SetAckPolicy changes which data frames the receiver acknowledges, by
+// default all of them. Fire-and-forget telemetry sent with SendData needs
+// no ACKs, and leaving them out saves airtime; SendDataReliable and the
+// other reliable sends ask for an ACK on each frame, so they keep working
+// under AckOnRequest and AckEveryN. The reply handler only runs for frames
+// that are acknowledged.
+func (r *Receiver) SetAckPolicy(p AckPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ackPolicy = p
+	r.ackCounts = nil
+}
+
+// AckPolicy returns the policy set with SetAckPolicy.
+func (r *Receiver) AckPolicy() AckPolicy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ackPolicy
+}
+
+// ackDueLocked reports whether the data or batch frame is to be
+// acknowledged. dup is set for a frame seen before, which does not count
+// towards AckEveryN.
+func (r *Receiver) ackDueLocked(frame *proto.Frame, dup bool) bool {
+	requested := frame.Flags&proto.FlagAckRequest != 0
+	switch r.ackPolicy.Mode {
+	case AckNever:
+		return false
+	case AckOnRequest:
+		return requested
+	case AckEveryN:
+		if requested || dup || r.ackPolicy.N < 2 {
+			return requested || r.ackPolicy.N < 2
+		}
+		if r.ackCounts == nil {
+			r.ackCounts = make(map[proto.DeviceID]int)
+		}
+		r.ackCounts[frame.SenderID]++
+		if r.ackCounts[frame.SenderID] < r.ackPolicy.N {
+			return false
+		}
+		r.ackCounts[frame.SenderID] = 0
+	}
+	return true
+}
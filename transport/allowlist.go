@@ -0,0 +1,64 @@
+package transport
+
+import proto "github.com/ystepanoff/nrfcomm/protocol"
+
+// SetAllowedDevices restricts the receiver to the given transmitters: frames
+// from any other sender, pairing requests included, are dropped and counted
+// in DroppedFrames. A nil or empty list lifts the restriction.
+func (r *Receiver) SetAllowedDevices(ids []proto.DeviceID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(ids) == 0 {
+		r.allowed = nil
+		return
+	}
+	r.allowed = make(map[proto.DeviceID]struct{}, len(ids))
+	for _, id := range ids {
+		r.allowed[id] = struct{}{}
+	}
+}
+
+// AddAllowedDevice adds id to the allowed transmitters, restricting the
+// receiver to id alone if no list was set.
+func (r *Receiver) AddAllowedDevice(id proto.DeviceID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.allowed == nil {
+		r.allowed = make(map[proto.DeviceID]struct{})
+	}
+	r.allowed[id] = struct{}{}
+}
+
+// RemoveAllowedDevice removes id from the allowed transmitters. Removing the
+// last one leaves the list empty, so every sender is dropped; use
+// SetAllowedDevices(nil) to lift the restriction.
+func (r *Receiver) RemoveAllowedDevice(id proto.DeviceID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.allowed != nil {
+		delete(r.allowed, id)
+	}
+}
+
+// DroppedFrames returns how many frames were dropped because their sender is
+// not allowed.
+func (r *Receiver) DroppedFrames() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropped
+}
+
+// allowedSender reports whether frames from id may be processed, counting
+// the ones that may not.
+func (r *Receiver) allowedSender(id proto.DeviceID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.allowed == nil {
+		return true
+	}
+	if _, ok := r.allowed[id]; ok {
+		return true
+	}
+	r.dropped++
+	return false
+}
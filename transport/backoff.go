@@ -0,0 +1,28 @@
+package transport
+
+import (
+	"encoding/binary"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// randDuration draws a duration uniformly from [0, max) from src, or from
+// the package-wide source if src is nil.
+func randDuration(src proto.RandSource, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	var b [8]byte
+	_ = proto.ReadRand(src, b[:])
+	return time.Duration(binary.LittleEndian.Uint64(b[:]) % uint64(max))
+}
+
+// retryBackoff returns how long a reliable send waits before transmitting
+// again after attempt went unanswered. The wait is drawn from a window
+// around 20+10·attempt ms, half of that wide on either side, so that two
+// transmitters whose frames collided do not retry in step.
+func retryBackoff(src proto.RandSource, attempt int) time.Duration {
+	mean := time.Duration(20+10*attempt) * time.Millisecond
+	return mean/2 + randDuration(src, mean)
+}
@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// maxBackpressureDelay is how long a transmitter waits before each data
+// frame while the receiver reports itself overwhelmed, a backpressure of
+// 255. Lower levels wait in proportion.
+const maxBackpressureDelay = 50 * time.Millisecond
+
+// backpressureHold is how long a level reported in an ACK is acted on; a
+// transmitter that hears no ACKs for longer stops easing off.
+const backpressureHold = time.Second
+
+// backpressure is the load the paired receiver last reported.
+type backpressure struct {
+	mu    sync.Mutex
+	level uint8
+	at    time.Time
+}
+
+// backpressureLevel returns how full the receiver's dispatch queue is, see
+// WithDispatchPool, from 0 for empty or no pool to 255 for full.
+func (r *Receiver) backpressureLevel() uint8 {
+	p := &r.pool
+	if p.jobs == nil {
+		return 0
+	}
+	return uint8(len(p.jobs) * 255 / cap(p.jobs))
+}
+
+// backpressureExt appends to ext the receiver's backpressure, unless it is
+// 0, which is what transmitters assume when the ACK carries none.
+func (r *Receiver) backpressureExt(ext []byte) []byte {
+	if level := r.backpressureLevel(); level > 0 {
+		ext = proto.AppendTLV(ext, proto.TagBackpressure, []byte{level})
+	}
+	return ext
+}
+
+// Backpressure returns the load the receiver reported in the last ACK of a
+// reliable send, from 0 for none to 255 for overwhelmed, or 0 once that is
+// over a second old. While it is above 0, reliable and queued data sends
+// wait up to 50 ms, in proportion, before each frame.
+func (t *Transmitter) Backpressure() uint8 {
+	b := &t.backpressure
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Since(b.at) > backpressureHold {
+		return 0
+	}
+	return b.level
+}
+
+// noteBackpressure records the load reported in ack, the ACK of a reliable
+// send.
+func (t *Transmitter) noteBackpressure(ack *proto.Frame) {
+	var level uint8
+	if len(ack.Payload) > 4 {
+		if v, ok := proto.FindTLV(ack.Payload[4:], proto.TagBackpressure); ok && len(v) == 1 {
+			level = v[0]
+		}
+	}
+	b := &t.backpressure
+	b.mu.Lock()
+	b.level, b.at = level, time.Now()
+	b.mu.Unlock()
+}
+
+// easeOff waits before a data frame as long as the receiver's backpressure
+// asks for.
+func (t *Transmitter) easeOff(ctx context.Context) error {
+	delay := backpressureDelay(t.Backpressure())
+	if delay == 0 {
+		return nil
+	}
+	return t.sleepCtx(ctx, delay)
+}
+
+// backpressureDelay returns how long to wait before a data frame at the
+// given backpressure level.
+func backpressureDelay(level uint8) time.Duration {
+	return maxBackpressureDelay * time.Duration(level) / 255
+}
@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DefaultBatchDelay is how long a batched sample may wait for company before
+// its frame is flushed.
+const DefaultBatchDelay = 20 * time.Millisecond
+
+// batcher accumulates samples for SendDataBatched.
+type batcher struct {
+	mu       sync.Mutex
+	buf      []byte
+	maxBytes int // 0 means the link payload limit
+	maxDelay time.Duration
+	timer    *time.Timer
+	closed   bool // see closeBatching
+}
+
+// SetBatching configures SendDataBatched: a batch frame is flushed once its
+// payload reaches maxBytes (0 means as much as fits in a frame) or its
+// oldest sample has waited maxDelay (0 means DefaultBatchDelay).
+func (t *Transmitter) SetBatching(maxBytes int, maxDelay time.Duration) {
+	t.batch.mu.Lock()
+	t.batch.maxBytes = maxBytes
+	t.batch.maxDelay = maxDelay
+	t.batch.mu.Unlock()
+}
+
+// SendDataBatched buffers sample and sends it together with other samples in
+// a single FrameTypeBatch frame. The receiver delivers each sample to its
+// data callback separately. Call Flush to send buffered samples immediately;
+// Close does too.
+func (t *Transmitter) SendDataBatched(sample []byte) error {
+	if err := t.soleReceiver(); err != nil {
+		return err
+	}
+	if !t.device.IsPaired {
+		return proto.ErrNotPaired
+	}
+
+	t.batch.mu.Lock()
+	defer t.batch.mu.Unlock()
+	if t.batch.closed {
+		return proto.ErrClosed
+	}
+
+	limit := t.maxPayload()
+	if t.batch.maxBytes > 0 && t.batch.maxBytes < limit {
+		limit = t.batch.maxBytes
+	}
+	if len(sample) > 0xFF || proto.BatchOverhead+len(sample) > t.maxPayload() {
+		return proto.ErrInvalidPayload
+	}
+
+	if len(t.batch.buf)+proto.BatchOverhead+len(sample) > limit {
+		if err := t.flushLocked(); err != nil {
+			return err
+		}
+	}
+	t.batch.buf = proto.AppendBatchSample(t.batch.buf, sample)
+	if len(t.batch.buf) >= limit {
+		return t.flushLocked()
+	}
+
+	if t.batch.timer == nil {
+		delay := t.batch.maxDelay
+		if delay <= 0 {
+			delay = DefaultBatchDelay
+		}
+		t.batch.timer = time.AfterFunc(delay, func() { _ = t.Flush() })
+	}
+	return nil
+}
+
+// Flush sends any samples buffered by SendDataBatched.
+func (t *Transmitter) Flush() error {
+	t.batch.mu.Lock()
+	defer t.batch.mu.Unlock()
+	return t.flushLocked()
+}
+
+func (t *Transmitter) flushLocked() error {
+	if t.batch.timer != nil {
+		t.batch.timer.Stop()
+		t.batch.timer = nil
+	}
+	if len(t.batch.buf) == 0 {
+		return nil
+	}
+	if err := t.soleReceiver(); err != nil {
+		return err
+	}
+	payload := t.batch.buf
+	t.batch.buf = nil
+	return t.sendFrame(proto.FrameTypeBatch, payload, proto.PriorityNormal)
+}
+
+// closeBatching sends the samples still buffered, stopping the delay timer,
+// and makes SendDataBatched fail with ErrClosed from then on.
+func (t *Transmitter) closeBatching() {
+	t.batch.mu.Lock()
+	defer t.batch.mu.Unlock()
+	t.batch.closed = true
+	if err := t.flushLocked(); err != nil {
+		log.Printf("[Transmitter] Flushing batched samples failed: %v\r\n", err)
+	}
+}
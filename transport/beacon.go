@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DefaultBeaconInterval is how often a receiver beacons unless told
+// otherwise.
+const DefaultBeaconInterval = 500 * time.Millisecond
+
+// beaconing is the discovery broadcast state of a receiver.
+type beaconing struct {
+	enabled  bool
+	interval time.Duration
+	info     proto.DeviceInfo
+	next     time.Time
+	seq      uint32
+}
+
+// ReceiverInfo describes a receiver heard by Scan.
+type ReceiverInfo struct {
+	ID      proto.DeviceID
+	Channel uint8 // the channel it takes pairing requests on
+	Info    proto.DeviceInfo
+}
+
+// EnableBeacons makes the listening receiver broadcast its ID, pairing
+// channel and info on the pairing link every interval, or every
+// DefaultBeaconInterval if interval is not positive, while pairing is open.
+// Receivers never given a pairing window with EnablePairing or
+// DisablePairing are always open and beacon for as long as they listen.
+func (r *Receiver) EnableBeacons(info proto.DeviceInfo, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultBeaconInterval
+	}
+	r.mu.Lock()
+	r.beacons.enabled = true
+	r.beacons.interval = interval
+	r.beacons.info = info
+	r.beacons.next = time.Time{}
+	r.mu.Unlock()
+}
+
+// DisableBeacons stops the broadcasts started by EnableBeacons.
+func (r *Receiver) DisableBeacons() {
+	r.mu.Lock()
+	r.beacons.enabled = false
+	r.mu.Unlock()
+}
+
+// beaconLocked broadcasts a beacon if one is due. The radio must be on the
+// pairing link.
+func (r *Receiver) beaconLocked(now time.Time) {
+	b := &r.beacons
+	if !b.enabled || !r.pairingOpenLocked() || now.Before(b.next) {
+		return
+	}
+	b.next = now.Add(b.interval)
+	frame := &proto.Frame{
+		SenderID: r.device.ID,
+		Type:     proto.FrameTypeBeacon,
+		Seq:      b.seq,
+		Payload:  proto.EncodeBeacon(r.device.Channel, b.info, r.config.MaxPayloadSize()),
+	}
+	b.seq++
+	_ = r.tx(r.config.EncodeFrame(frame))
+}
+
+// Scan listens on the transmitter's link for timeout and returns the
+// receivers whose beacons it heard, in the order they were first heard, so
+// that the application can pick one to pass to StartPairing. It returns
+// ErrTimeout if it heard none.
+func (t *Transmitter) Scan(timeout time.Duration) ([]ReceiverInfo, error) {
+	var found []ReceiverInfo
+	seen := make(map[proto.DeviceID]int)
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		frame := t.ReceiveFrame(time.Until(deadline))
+		if frame == nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if frame.Type != proto.FrameTypeBeacon {
+			continue
+		}
+		channel, info, ok := proto.DecodeBeacon(frame.Payload)
+		if !ok {
+			continue
+		}
+		ri := ReceiverInfo{ID: frame.SenderID, Channel: channel, Info: info}
+		if i, ok := seen[ri.ID]; ok {
+			found[i] = ri
+			continue
+		}
+		seen[ri.ID] = len(found)
+		found = append(found, ri)
+	}
+	if len(found) == 0 {
+		return nil, proto.ErrTimeout
+	}
+	return found, nil
+}
@@ -0,0 +1,317 @@
+package transport
+
+import (
+	"context"
+	"hash/crc32"
+	"io"
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// blobRetries is how many times each frame of a blob transfer is sent
+// before SendBlob gives up, unless BlobOptions say otherwise.
+const blobRetries = 5
+
+// DefaultMaxBlobSize is the largest blob a BlobReceiver accepts unless its
+// options say otherwise.
+const DefaultMaxBlobSize = 1 << 20
+
+// BlobInfo describes a blob being transferred.
+type BlobInfo struct {
+	ID   uint32
+	Size int64
+	CRC  uint32 // CRC32 (IEEE) of the whole blob
+}
+
+func blobInfo(o proto.BlobOffer) BlobInfo {
+	return BlobInfo{ID: o.ID, Size: int64(o.Size), CRC: o.CRC}
+}
+
+// BlobOptions configures SendBlob.
+type BlobOptions struct {
+	// ID identifies the blob so that a later SendBlob of the same blob
+	// resumes the transfer. It defaults to the blob's CRC32.
+	ID uint32
+
+	// ChunkSize is the number of blob bytes per frame, by default as many
+	// as a frame holds.
+	ChunkSize int
+
+	// Retries is how many times each frame is sent before the transfer
+	// fails, 5 by default.
+	Retries int
+
+	// OnProgress is called as chunks reach the receiver with the number of
+	// bytes it holds, including those it had from an earlier attempt.
+	OnProgress func(held, size int64)
+}
+
+// SendBlob transfers the size bytes of r to the paired receiver, which
+// collects them with a BlobReceiver. Each chunk is sent reliably; once all
+// arrived the receiver checks the CRC32 of the whole blob. A transfer that
+// fails part way, for instance because the link went down, resumes where it
+// stopped when SendBlob is called again for the same blob: the receiver
+// reports the chunks it holds and only the others are sent.
+//
+// SendBlob fails with ErrBlobRejected if the receiver takes no blobs or none
+// this large, and with ErrBlobCorrupt if the checksum did not match, in
+// which case the receiver discarded what it had. The receiver must announce
+// CapBlob.
+func SendBlob(t *Transmitter, r io.ReaderAt, size int64, opts BlobOptions) error {
+	if err := t.soleReceiver(); err != nil {
+		return err
+	}
+	if !t.device.IsPaired {
+		return proto.ErrNotPaired
+	}
+	if !t.device.HasCapability(proto.CapBlob) {
+		return proto.ErrUnsupported
+	}
+	maxChunk := t.maxPayload() - proto.BlobChunkHeaderSize
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = maxChunk
+	}
+	if size < 0 || size > 0xFFFFFFFF || opts.ChunkSize > maxChunk {
+		return proto.ErrInvalidPayload
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = blobRetries
+	}
+
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(r, 0, size)); err != nil {
+		return err
+	}
+	offer := proto.BlobOffer{ID: opts.ID, Size: uint32(size), CRC: crc.Sum32(), ChunkSize: uint16(opts.ChunkSize)}
+	if offer.ID == 0 {
+		offer.ID = offer.CRC
+	}
+
+	answer, err := t.blobCommand(proto.ControlBlobOffer, proto.EncodeBlobOffer(offer), opts.Retries)
+	if err != nil {
+		return err
+	}
+	if len(answer) != 1 || answer[0] != proto.BlobOK {
+		return proto.ErrBlobRejected
+	}
+
+	var held int64
+	buf := make([]byte, offer.ChunkSize)
+	for index, chunks := uint32(0), offer.Chunks(); index < chunks; {
+		answer, err := t.blobCommand(proto.ControlBlobStatus, proto.EncodeBlobStatus(offer.ID, index), opts.Retries)
+		if err != nil {
+			return err
+		}
+		first, bitmap, ok := proto.DecodeBlobBitmap(answer)
+		if !ok || first != index || len(bitmap) == 0 {
+			return proto.ErrBlobRejected
+		}
+		for i := 0; i < 8*len(bitmap) && index < chunks; i, index = i+1, index+1 {
+			chunk := buf[:offer.ChunkLen(index)]
+			if bitmap[i/8]&(1<<(i%8)) == 0 {
+				if n, err := r.ReadAt(chunk, int64(index)*int64(offer.ChunkSize)); n < len(chunk) {
+					return err
+				}
+				payload := proto.EncodeBlobChunk(offer.ID, index, chunk)
+				if _, _, err := t.sendReliable(context.Background(), proto.FrameTypeBlob, payload, opts.Retries); err != nil {
+					return err
+				}
+			}
+			held += int64(len(chunk))
+			if opts.OnProgress != nil {
+				opts.OnProgress(held, size)
+			}
+		}
+	}
+
+	answer, err = t.blobCommand(proto.ControlBlobEnd, proto.EncodeBlobEnd(offer.ID), opts.Retries)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(answer) != 1:
+		return proto.ErrBlobRejected
+	case answer[0] == proto.BlobOK:
+		return nil
+	case answer[0] == proto.BlobIncomplete:
+		return proto.ErrBlobIncomplete
+	case answer[0] == proto.BlobCorrupt:
+		return proto.ErrBlobCorrupt
+	}
+	return proto.ErrBlobRejected
+}
+
+// blobCommand sends a blob transfer command reliably and returns the
+// receiver's answer, nil if its ACK carried none.
+func (t *Transmitter) blobCommand(cmd byte, args []byte, retries int) ([]byte, error) {
+	payload := proto.EncodeControl(cmd, t.receiver, args)
+	ack, _, err := t.sendReliable(context.Background(), proto.FrameTypeControl, payload, retries)
+	if err != nil {
+		return nil, err
+	}
+	if len(ack.Payload) > 4 {
+		if answer, ok := proto.FindTLV(ack.Payload[4:], proto.TagBlob); ok {
+			return answer, nil
+		}
+	}
+	return nil, nil
+}
+
+// BlobReceiverOptions configures a BlobReceiver.
+type BlobReceiverOptions struct {
+	// MaxSize is the largest blob accepted, DefaultMaxBlobSize by default.
+	MaxSize int64
+
+	// OnProgress is called as chunks arrive with the number of bytes held
+	// of the blob from.
+	OnProgress func(from proto.DeviceID, info BlobInfo, held int64)
+
+	// OnComplete is handed each blob whose checksum matched.
+	OnComplete func(from proto.DeviceID, info BlobInfo, data []byte)
+}
+
+// BlobReceiver collects the blobs paired transmitters send with SendBlob,
+// one per transmitter at a time, in memory. A transfer interrupted part way
+// is kept until the transmitter resumes it or offers another blob. The
+// callbacks run on the goroutine processing frames.
+type BlobReceiver struct {
+	opts      BlobReceiverOptions
+	transfers map[proto.DeviceID]*blobTransfer // guarded by the receiver's mutex
+}
+
+// blobTransfer is a blob being received.
+type blobTransfer struct {
+	offer proto.BlobOffer
+	data  []byte
+	have  []byte // bitmap of the chunks held
+	held  int64  // bytes held
+	done  bool   // checked and handed to OnComplete
+}
+
+func (b *blobTransfer) has(index uint32) bool { return b.have[index/8]&(1<<(index%8)) != 0 }
+
+// NewBlobReceiver makes r accept blob transfers. Until it is called r
+// rejects them.
+func NewBlobReceiver(r *Receiver, opts BlobReceiverOptions) *BlobReceiver {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxBlobSize
+	}
+	b := &BlobReceiver{opts: opts, transfers: make(map[proto.DeviceID]*blobTransfer)}
+	r.mu.Lock()
+	r.blobs = b
+	r.mu.Unlock()
+	return b
+}
+
+// blobControlLocked answers a blob transfer command from dev in the TagBlob
+// extension of its ACK.
+func (r *Receiver) blobControlLocked(frame *proto.Frame, dev *proto.Device, cmd byte, args []byte) {
+	if dev == nil {
+		return
+	}
+	var answer []byte
+	if b := r.blobs; b == nil {
+		answer = []byte{proto.BlobRejected}
+	} else {
+		switch cmd {
+		case proto.ControlBlobOffer:
+			answer = b.offer(dev.ID, args)
+		case proto.ControlBlobStatus:
+			answer = b.status(dev.ID, args, r.maxReplySize(dev)-4)
+		case proto.ControlBlobEnd:
+			answer = b.end(dev.ID, args)
+		}
+	}
+	var ext []byte
+	if answer != nil {
+		ext = proto.AppendTLV(nil, proto.TagBlob, answer)
+	}
+	_ = r.sendAck(frame.Seq, ext)
+}
+
+// offer starts a transfer, or keeps the one in progress if it is of the
+// same blob.
+func (b *BlobReceiver) offer(from proto.DeviceID, args []byte) []byte {
+	o, ok := proto.DecodeBlobOffer(args)
+	if !ok || int64(o.Size) > b.opts.MaxSize {
+		return []byte{proto.BlobRejected}
+	}
+	if t := b.transfers[from]; t == nil || t.offer != o {
+		log.Printf("[Receiver] Blob %08x of %d bytes offered by %d\r\n", o.ID, o.Size, from)
+		b.transfers[from] = &blobTransfer{
+			offer: o,
+			data:  make([]byte, o.Size),
+			have:  make([]byte, (o.Chunks()+7)/8),
+		}
+	} else {
+		log.Printf("[Receiver] Blob %08x from %d resumed at %d of %d bytes\r\n", o.ID, from, t.held, o.Size)
+	}
+	return []byte{proto.BlobOK}
+}
+
+// status returns which chunks of the transfer from are held, as a bitmap of
+// at most room bytes with its first chunk.
+func (b *BlobReceiver) status(from proto.DeviceID, args []byte, room int) []byte {
+	id, first, ok := proto.DecodeBlobStatus(args)
+	t := b.transfers[from]
+	if !ok || t == nil || t.offer.ID != id || first >= t.offer.Chunks() {
+		return nil
+	}
+	if room > 0xFF-4 {
+		room = 0xFF - 4
+	}
+	n := int((t.offer.Chunks() - first + 7) / 8)
+	if n > room {
+		n = room
+	}
+	bitmap := make([]byte, n)
+	for i := 0; i < 8*n && first+uint32(i) < t.offer.Chunks(); i++ {
+		if t.done || t.has(first+uint32(i)) {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	return proto.EncodeBlobBitmap(first, bitmap)
+}
+
+// end checks the transfer from once its sender sent every chunk and hands
+// the blob to OnComplete.
+func (b *BlobReceiver) end(from proto.DeviceID, args []byte) []byte {
+	id, ok := proto.DecodeBlobEnd(args)
+	t := b.transfers[from]
+	switch {
+	case !ok || t == nil || t.offer.ID != id:
+		return []byte{proto.BlobIncomplete}
+	case t.done:
+		return []byte{proto.BlobOK}
+	case t.held < int64(t.offer.Size):
+		return []byte{proto.BlobIncomplete}
+	case crc32.ChecksumIEEE(t.data) != t.offer.CRC:
+		log.Printf("[Receiver] Blob %08x from %d corrupt, discarded\r\n", id, from)
+		delete(b.transfers, from)
+		return []byte{proto.BlobCorrupt}
+	}
+	log.Printf("[Receiver] Blob %08x of %d bytes received from %d\r\n", id, t.offer.Size, from)
+	data := t.data
+	t.data, t.done = nil, true
+	if b.opts.OnComplete != nil {
+		b.opts.OnComplete(from, blobInfo(t.offer), data)
+	}
+	return []byte{proto.BlobOK}
+}
+
+// chunk stores a chunk of the transfer from.
+func (b *BlobReceiver) chunk(from proto.DeviceID, payload []byte) {
+	id, index, data, ok := proto.DecodeBlobChunk(payload)
+	t := b.transfers[from]
+	if !ok || t == nil || t.done || t.offer.ID != id || index >= t.offer.Chunks() ||
+		len(data) != t.offer.ChunkLen(index) || t.has(index) {
+		return
+	}
+	copy(t.data[int(index)*int(t.offer.ChunkSize):], data)
+	t.have[index/8] |= 1 << (index % 8)
+	t.held += int64(len(data))
+	if b.opts.OnProgress != nil {
+		b.opts.OnProgress(from, blobInfo(t.offer), t.held)
+	}
+}
@@ -0,0 +1,224 @@
+package transport
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// Bond is the persistent state of one pairing: everything needed to resume
+// the link after a restart without a new pairing exchange.
+type Bond struct {
+	ID           proto.DeviceID // the peer
+	PairingKey   proto.PairingKey
+	MaxFrameSize int
+	SessionKey   []byte
+	KeyIndex     uint8
+	RollCounter  uint32 // saved at pairing and resync only; a stale one is resynced
+	Info         proto.DeviceInfo
+	Capabilities proto.Capability
+	Heartbeat    time.Duration // announced heartbeat interval, see Device.HeartbeatInterval
+	Channel      uint8
+	Address      uint32 // zero for bonds saved before private addresses
+	Prefix       byte
+
+	// Seq and Epoch are the transmitter's SeqState. Receivers keep only
+	// the epoch.
+	Seq   uint32
+	Epoch uint32
+}
+
+// BondStore persists bonds across restarts. Receivers save a bond for every
+// paired transmitter and delete it on unpairing; transmitters keep the bond
+// of each receiver. Bonds survive device timeouts so that a transmitter
+// that slept through one is recognised after the next restart. The
+// endpoint holds its lock while it saves, so a store cannot use it.
+type BondStore interface {
+	Save(id proto.DeviceID, bond Bond) error
+	Load() ([]Bond, error)
+	Delete(id proto.DeviceID) error
+}
+
+// WithBondStore persists pairings in store and restores the ones it holds
+// when the endpoint is constructed.
+func WithBondStore(store BondStore) Option {
+	return func(o *options) { o.bonds = store }
+}
+
+// bondOf captures the persistent state of a paired device.
+func bondOf(dev *proto.Device) Bond {
+	return Bond{
+		ID:           dev.ID,
+		PairingKey:   dev.PairingKey,
+		MaxFrameSize: dev.MaxFrameSize,
+		SessionKey:   append([]byte(nil), dev.SessionKey...),
+		KeyIndex:     dev.KeyIndex,
+		RollCounter:  dev.RollCounter,
+		Info:         dev.Info,
+		Capabilities: dev.Capabilities,
+		Heartbeat:    dev.HeartbeatInterval,
+		Channel:      dev.Channel,
+		Address:      dev.Address,
+		Prefix:       dev.Prefix,
+		Epoch:        dev.Epoch,
+	}
+}
+
+// restore applies b to dev, marking it paired.
+func (b Bond) restore(dev *proto.Device) {
+	dev.PairingKey = b.PairingKey
+	dev.MaxFrameSize = b.MaxFrameSize
+	var session []byte
+	if len(b.SessionKey) > 0 {
+		session = append([]byte(nil), b.SessionKey...)
+	}
+	dev.ResetSessionKey(session)
+	dev.KeyIndex = b.KeyIndex
+	dev.RollCounter = b.RollCounter
+	dev.Info = b.Info
+	dev.Capabilities = b.Capabilities
+	dev.HeartbeatInterval = b.Heartbeat
+	dev.Channel = b.Channel
+	if b.Address != 0 {
+		dev.Address, dev.Prefix = b.Address, b.Prefix
+	}
+	dev.Epoch = b.Epoch
+	dev.IsPaired = true
+	dev.UpdateLastSeen()
+}
+
+// loadBonds restores the paired devices held by the receiver's store.
+func (r *Receiver) loadBonds() {
+	bonds, err := r.bonds.Load()
+	if err != nil {
+		log.Printf("[Receiver] Loading bonds failed: %v\r\n", err)
+		return
+	}
+	for _, b := range bonds {
+		dev := proto.NewTransmitter(b.ID)
+		b.restore(dev)
+		r.pairedDevices[b.ID] = dev
+	}
+}
+
+func (r *Receiver) saveBondLocked(dev *proto.Device) {
+	if r.bonds == nil {
+		return
+	}
+	if err := r.bonds.Save(dev.ID, bondOf(dev)); err != nil {
+		log.Printf("[Receiver] Saving bond for %d failed: %v\r\n", dev.ID, err)
+	}
+}
+
+func (r *Receiver) deleteBondLocked(id proto.DeviceID) {
+	if r.bonds == nil {
+		return
+	}
+	if err := r.bonds.Delete(id); err != nil {
+		log.Printf("[Receiver] Deleting bond for %d failed: %v\r\n", id, err)
+	}
+}
+
+// loadBond restores the transmitter's pairings from its store. A single
+// bond becomes the selected receiver. Several are all restored as peers
+// and none is selected: untargeted sends fail with ErrSeveralReceivers as
+// before the restart, and SendDataTo picks the receiver, see
+// StartPairingWith.
+func (t *Transmitter) loadBond() {
+	bonds, err := t.bonds.Load()
+	if err != nil {
+		log.Printf("[Transmitter] Loading bond failed: %v\r\n", err)
+		return
+	}
+	if len(bonds) == 0 {
+		return
+	}
+	sort.Slice(bonds, func(i, j int) bool { return bonds[i].ID < bonds[j].ID })
+	for _, b := range bonds {
+		if b.Seq != 0 || b.Epoch != 0 {
+			t.restoreSeq(SeqState{Seq: b.Seq, Epoch: b.Epoch})
+		}
+	}
+	t.pairingKey = bonds[0].PairingKey
+	if len(bonds) == 1 {
+		t.receiver = bonds[0].ID
+		bonds[0].restore(t.device)
+		t.pairingChanged()
+		return
+	}
+	t.peers.links = make(map[proto.DeviceID]*peerLink)
+	for _, b := range bonds {
+		dev := *t.device
+		b.restore(&dev)
+		t.peers.links[b.ID] = &peerLink{device: dev}
+	}
+	t.pairingChanged()
+}
+
+func (t *Transmitter) saveBond() {
+	t.saveBondState(t.SeqState())
+}
+
+// saveBondState saves the bond of the selected receiver with the sequence
+// state given.
+func (t *Transmitter) saveBondState(state SeqState) {
+	if t.bonds == nil {
+		return
+	}
+	b := bondOf(t.device)
+	b.ID = t.receiver
+	b.Seq, b.Epoch = state.Seq, state.Epoch
+	if err := t.bonds.Save(t.receiver, b); err != nil {
+		log.Printf("[Transmitter] Saving bond failed: %v\r\n", err)
+	}
+}
+
+func (t *Transmitter) deleteBond(id proto.DeviceID) {
+	if t.bonds == nil {
+		return
+	}
+	if err := t.bonds.Delete(id); err != nil {
+		log.Printf("[Transmitter] Deleting bond failed: %v\r\n", err)
+	}
+}
+
+// MemoryBondStore is a BondStore kept in memory, for tests and for devices
+// that persist bonds by other means.
+type MemoryBondStore struct {
+	mu    sync.Mutex
+	bonds map[proto.DeviceID]Bond
+}
+
+// NewMemoryBondStore returns an empty MemoryBondStore.
+func NewMemoryBondStore() *MemoryBondStore {
+	return &MemoryBondStore{bonds: make(map[proto.DeviceID]Bond)}
+}
+
+func (s *MemoryBondStore) Save(id proto.DeviceID, bond Bond) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bond.SessionKey = append([]byte(nil), bond.SessionKey...)
+	s.bonds[id] = bond
+	return nil
+}
+
+func (s *MemoryBondStore) Load() ([]Bond, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bonds := make([]Bond, 0, len(s.bonds))
+	for _, b := range s.bonds {
+		b.SessionKey = append([]byte(nil), b.SessionKey...)
+		bonds = append(bonds, b)
+	}
+	return bonds, nil
+}
+
+func (s *MemoryBondStore) Delete(id proto.DeviceID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bonds, id)
+	return nil
+}
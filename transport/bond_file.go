@@ -0,0 +1,104 @@
+//go:build !tinygo && !baremetal
+
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// FileBondStore is a BondStore keeping all bonds in one JSON file. The file
+// is replaced atomically on every change.
+type FileBondStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileBondStore returns a store backed by the file at path, which is
+// created on the first Save.
+func NewFileBondStore(path string) *FileBondStore {
+	return &FileBondStore{path: path}
+}
+
+func (s *FileBondStore) Save(id proto.DeviceID, bond Bond) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bonds, err := s.read()
+	if err != nil {
+		return err
+	}
+	bond.ID = id
+	for i := range bonds {
+		if bonds[i].ID == id {
+			bonds[i] = bond
+			return s.write(bonds)
+		}
+	}
+	return s.write(append(bonds, bond))
+}
+
+func (s *FileBondStore) Load() ([]Bond, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+func (s *FileBondStore) Delete(id proto.DeviceID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bonds, err := s.read()
+	if err != nil {
+		return err
+	}
+	kept := bonds[:0]
+	for _, b := range bonds {
+		if b.ID != id {
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) == len(bonds) {
+		return nil
+	}
+	return s.write(kept)
+}
+
+func (s *FileBondStore) read() ([]Bond, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bonds []Bond
+	if err := json.Unmarshal(data, &bonds); err != nil {
+		return nil, err
+	}
+	return bonds, nil
+}
+
+func (s *FileBondStore) write(bonds []Bond) error {
+	data, err := json.Marshal(bonds)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
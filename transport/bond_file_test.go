@@ -0,0 +1,45 @@
+//go:build !tinygo && !baremetal
+
+package transport
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+func TestFileBondStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bonds.json")
+
+	s := NewFileBondStore(path)
+	if bonds, err := s.Load(); err != nil || len(bonds) != 0 {
+		t.Fatalf("Load() on a missing file = %v, %v", bonds, err)
+	}
+	if err := s.Save(1, Bond{PairingKey: proto.PairingKeyFromUint32(0x1234), MaxFrameSize: 64, SessionKey: []byte{1, 2, 3}, KeyIndex: 2}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if err := s.Save(2, Bond{PairingKey: proto.PairingKeyFromUint32(0x5678)}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if err := s.Save(1, Bond{PairingKey: proto.PairingKeyFromUint32(0x4321), SessionKey: []byte{9}}); err != nil {
+		t.Fatalf("Save() replacing a bond error = %v", err)
+	}
+
+	// A new instance sees the same bonds.
+	bonds, err := NewFileBondStore(path).Load()
+	if err != nil || len(bonds) != 2 {
+		t.Fatalf("Load() = %v, %v", bonds, err)
+	}
+	if bonds[0].ID != 1 || bonds[0].PairingKey != proto.PairingKeyFromUint32(0x4321) || !bytes.Equal(bonds[0].SessionKey, []byte{9}) {
+		t.Errorf("bond 1 = %+v", bonds[0])
+	}
+
+	if err := s.Delete(1); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if bonds, _ := s.Load(); len(bonds) != 1 || bonds[0].ID != 2 {
+		t.Errorf("Load() after Delete = %+v", bonds)
+	}
+}
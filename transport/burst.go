@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// SendBurst sends each payload as a data frame, back to back and without
+// waiting for ACKs. Every payload is checked before anything is sent, so an
+// oversized one fails the burst with ErrInvalidPayload and nothing on the
+// air. The frames carry consecutive sequence numbers in payload order, with
+// no other frame in between. Drivers implementing RadioBurster transmit
+// them in a single radio session; others get one Tx per frame.
+func (t *Transmitter) SendBurst(payloads [][]byte) error {
+	if t.isClosed() {
+		return proto.ErrClosed
+	}
+	if err := t.soleReceiver(); err != nil {
+		return err
+	}
+	if !t.device.IsPaired {
+		return proto.ErrNotPaired
+	}
+	limit := t.maxPayload()
+	for _, p := range payloads {
+		if len(p) > limit {
+			return proto.ErrInvalidPayload
+		}
+	}
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	cfg := t.linkConfig()
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	defer t.awake()()
+	frames := make([][]byte, len(payloads))
+	for i, p := range payloads {
+		frames[i] = cfg.EncodeFrame(t.newFrame(proto.FrameTypeData, t.seq, p))
+		t.seq++
+	}
+	b, ok := t.driver.(RadioBurster)
+	if !ok {
+		for _, f := range frames {
+			if err := t.txLocked(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var cost time.Duration
+	for _, f := range frames {
+		cost += t.dutyCycle.airtime(len(f))
+	}
+	if err := t.listenBeforeTalk(); err != nil {
+		t.seq -= uint32(len(frames))
+		return err
+	}
+	if err := t.takeAirtime(cost, false); err != nil {
+		t.seq -= uint32(len(frames))
+		return err
+	}
+	if err := b.TxBurst(frames); err != nil {
+		return err
+	}
+	for _, f := range frames {
+		t.recordTx(f)
+	}
+	t.maybeCheckpointLocked()
+	return nil
+}
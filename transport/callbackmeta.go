@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// FrameMeta is how a frame handed to a callback of RegisterCallbackMeta was
+// received.
+type FrameMeta struct {
+	Received time.Time // when the frame was read, see Frame.Received
+	RSSI     int8      // signal strength in dBm, 0 if the driver does not report it
+	Channel  uint8     // channel the frame was heard on
+	Pipe     uint8     // address the frame matched, see RadioMultiPipe
+
+	// Duplicate is set on a frame already delivered, sent again because
+	// its ACK was lost. Only these callbacks are handed such repeats.
+	Duplicate bool
+}
+
+// frameMeta returns the metadata of f, a duplicate if dup.
+func frameMeta(f *proto.Frame, dup bool) FrameMeta {
+	return FrameMeta{Received: f.Received, RSSI: f.RSSI, Channel: f.Channel, Pipe: f.Pipe, Duplicate: dup}
+}
+
+// RegisterCallbackMeta is RegisterCallback for a callback that is also told
+// how each frame was received: when, how strong and on which channel. It
+// is handed the repeats of data frames as well, with Duplicate set, which
+// makes it suited to watching the quality of the link. Unlike the frames,
+// the metadata is the callback's own.
+func (r *Receiver) RegisterCallbackMeta(ptype byte, cb func(*proto.Frame, FrameMeta)) CallbackHandle {
+	if cb == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addCallbackLocked(r.callbacks, ptype, &frameCallback{meta: cb})
+}
+
+// deliverDuplicateLocked arranges for a repeat of frame, a data or batch
+// frame already delivered whose batch held samples, to be handed to the
+// callbacks of RegisterCallbackMeta again.
+func (r *Receiver) deliverDuplicateLocked(res *frameResult, frame *proto.Frame, samples [][]byte) {
+	cbs := r.dataCallbacksLocked(frame.SenderID)
+	for _, cb := range cbs {
+		if cb.meta == nil {
+			continue
+		}
+		res.callbacks, res.onError = cbs, r.callbackErr
+		if frame.Type == proto.FrameTypeData {
+			res.deliver = append(res.deliver, frame)
+		}
+		for _, sample := range samples {
+			res.deliver = append(res.deliver, sampleFrame(frame, sample))
+		}
+		return
+	}
+}
+
+// heard counts p, read from the radio, and stamps frame, decoded from it
+// unless nil, with the channel it was heard on.
+func (r *Receiver) heard(p RxPacket, frame *proto.Frame) {
+	r.recordRx(p, frame)
+	if frame == nil {
+		return
+	}
+	r.mu.Lock()
+	frame.Channel = r.tuned.channel
+	r.mu.Unlock()
+}
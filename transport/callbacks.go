@@ -0,0 +1,212 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// CallbackHandle identifies a callback registered with
+// Receiver.RegisterCallback.
+type CallbackHandle uint64
+
+// frameCallback is a callback of RegisterCallback.
+type frameCallback struct {
+	handle  CallbackHandle
+	fn      func(*proto.Frame)
+	meta    func(*proto.Frame, FrameMeta) // in place of fn, see RegisterCallbackMeta
+	removed atomic.Bool                   // set by UnregisterCallback, checked before each call
+}
+
+// CallbackPanicError reports a callback that panicked on a frame. The
+// receiver recovers the panic and goes on with the next callback.
+type CallbackPanicError struct {
+	Handle CallbackHandle
+	Frame  *proto.Frame
+	Value  interface{} // the value passed to panic
+}
+
+func (e *CallbackPanicError) Error() string {
+	return fmt.Sprintf("callback %d panicked on frame seq=%d from %d: %v", e.Handle, e.Frame.Seq, e.Frame.SenderID, e.Value)
+}
+
+// RegisterCallback adds cb to the callbacks for frames of type ptype, of
+// which only FrameTypeData has any. They are handed every data frame from a
+// paired transmitter, each sample of a batch and each reassembled message,
+// once the frame has been acknowledged, one after the other in the order
+// they were registered. They run on the goroutine processing frames without
+// the receiver locked, so they may call the receiver's methods. The frame
+// is shared by all of them: they may keep it but must not modify it. A
+// callback that panics is reported to the OnCallbackError handler and does
+// not keep the others from running. A nil cb is ignored. The handle
+// returned removes cb again, see UnregisterCallback.
+func (r *Receiver) RegisterCallback(ptype byte, cb func(*proto.Frame)) CallbackHandle {
+	if cb == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addCallbackLocked(r.callbacks, ptype, &frameCallback{fn: cb})
+}
+
+// RegisterDeviceCallback is RegisterCallback for the frames sent by the
+// device id alone. Once a device has callbacks for a frame type, its frames
+// of that type are handed to them instead of to the callbacks registered
+// with RegisterCallback, which see them again once the device's callbacks
+// are removed. The callbacks outlive the pairing, so they also serve the
+// device when it pairs again. UnregisterCallback removes them.
+func (r *Receiver) RegisterDeviceCallback(id proto.DeviceID, ptype byte, cb func(*proto.Frame)) CallbackHandle {
+	if cb == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.deviceCallbacks == nil {
+		r.deviceCallbacks = make(map[proto.DeviceID]map[byte][]*frameCallback)
+	}
+	if r.deviceCallbacks[id] == nil {
+		r.deviceCallbacks[id] = make(map[byte][]*frameCallback)
+	}
+	return r.addCallbackLocked(r.deviceCallbacks[id], ptype, &frameCallback{fn: cb})
+}
+
+// addCallbackLocked gives cb a handle and appends it to the callbacks of
+// ptype in m.
+func (r *Receiver) addCallbackLocked(m map[byte][]*frameCallback, ptype byte, cb *frameCallback) CallbackHandle {
+	r.nextCallback++
+	cb.handle = r.nextCallback
+	cbs := m[ptype]
+	// Frames being delivered hold the old list; never append in place.
+	m[ptype] = append(cbs[:len(cbs):len(cbs)], cb)
+	return r.nextCallback
+}
+
+// UnregisterCallback removes the callback RegisterCallback or
+// RegisterDeviceCallback returned h for. It may be called from any
+// goroutine, the callback itself included. Once it returns the callback is
+// not called again, unless it is running on a frame right now. Unknown
+// handles are ignored.
+func (r *Receiver) UnregisterCallback(h CallbackHandle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if removeCallback(r.callbacks, h) {
+		return
+	}
+	for id, m := range r.deviceCallbacks {
+		if removeCallback(m, h) {
+			if len(m) == 0 {
+				delete(r.deviceCallbacks, id)
+			}
+			return
+		}
+	}
+}
+
+// removeCallback removes the callback with handle h from m and reports
+// whether it was there.
+func removeCallback(m map[byte][]*frameCallback, h CallbackHandle) bool {
+	for ptype, cbs := range m {
+		for i, cb := range cbs {
+			if cb.handle != h {
+				continue
+			}
+			cb.removed.Store(true)
+			if len(cbs) == 1 {
+				delete(m, ptype)
+				return true
+			}
+			kept := make([]*frameCallback, 0, len(cbs)-1)
+			m[ptype] = append(append(kept, cbs[:i]...), cbs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ClearCallbacks removes all callbacks for frames of type ptype, with the
+// same guarantees as UnregisterCallback.
+func (r *Receiver) ClearCallbacks(ptype byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cb := range r.callbacks[ptype] {
+		cb.removed.Store(true)
+	}
+	delete(r.callbacks, ptype)
+}
+
+// ClearDeviceCallbacks removes all callbacks RegisterDeviceCallback
+// registered for the device id, with the same guarantees as
+// UnregisterCallback.
+func (r *Receiver) ClearDeviceCallbacks(id proto.DeviceID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cbs := range r.deviceCallbacks[id] {
+		for _, cb := range cbs {
+			cb.removed.Store(true)
+		}
+	}
+	delete(r.deviceCallbacks, id)
+}
+
+// OnCallbackError registers a handler for the panics of callbacks, each
+// reported as a *CallbackPanicError. Without one they are logged. The
+// handler runs on the goroutine processing frames. Pass nil to remove it.
+func (r *Receiver) OnCallbackError(h func(error)) {
+	r.mu.Lock()
+	r.callbackErr = h
+	r.mu.Unlock()
+}
+
+// deliverLocked arranges for f to be handed to the data callbacks of its
+// sender or, if it has none, to the type-wide ones. ReceiveDataFrom and
+// Reader get it at once.
+func (r *Receiver) deliverLocked(res *frameResult, f *proto.Frame) {
+	r.offerLocked(f)
+	r.feedReaderLocked(f)
+	if cbs := r.dataCallbacksLocked(f.SenderID); len(cbs) > 0 {
+		res.callbacks, res.onError = cbs, r.callbackErr
+		res.deliver = append(res.deliver, f)
+	}
+}
+
+// dataCallbacksLocked returns the data callbacks of the device id or, if it
+// has none, the type-wide ones.
+func (r *Receiver) dataCallbacksLocked(id proto.DeviceID) []*frameCallback {
+	if cbs := r.deviceCallbacks[id][proto.FrameTypeData]; len(cbs) > 0 {
+		return cbs
+	}
+	return r.callbacks[proto.FrameTypeData]
+}
+
+// dispatch hands f to each of cbs in turn, skipping those unregistered
+// since cbs was taken. A duplicate goes only to the callbacks of
+// RegisterCallbackMeta.
+func dispatch(cbs []*frameCallback, f *proto.Frame, dup bool, onError func(error)) {
+	meta := frameMeta(f, dup)
+	for _, cb := range cbs {
+		if !cb.removed.Load() && (cb.meta != nil || !dup) {
+			runCallback(cb, f, meta, onError)
+		}
+	}
+}
+
+// runCallback calls cb with f and reports a panic to onError.
+func runCallback(cb *frameCallback, f *proto.Frame, meta FrameMeta, onError func(error)) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := &CallbackPanicError{Handle: cb.handle, Frame: f, Value: v}
+			if onError != nil {
+				onError(err)
+			} else {
+				log.Printf("[Receiver] %v\r\n", err)
+			}
+		}
+	}()
+	if cb.meta != nil {
+		cb.meta(f, meta)
+		return
+	}
+	cb.fn(f)
+}
@@ -0,0 +1,320 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+const (
+	// channelGracePeriod is how long a receiver keeps listening on the
+	// pairing link after directing a transmitter to the data link, and how
+	// long it waits to hear the transmitter there before assuming the switch
+	// failed.
+	channelGracePeriod = time.Second
+
+	// channelDwell is how long a receiver listens on each link while it
+	// needs both.
+	channelDwell = 20 * time.Millisecond
+)
+
+// link is the radio address and channel an endpoint talks on.
+type link struct {
+	address uint32
+	prefix  byte
+	channel uint8
+}
+
+func linkOf(dev *proto.Device) link { return link{dev.Address, dev.Prefix, dev.Channel} }
+
+func (l link) apply(dev *proto.Device) {
+	dev.Address, dev.Prefix, dev.Channel = l.address, l.prefix, l.channel
+}
+
+// retune moves a radio tuned to from over to to, reconfiguring the address
+// only if it changes.
+func retune(d RadioDriver, from, to link) error {
+	if from.address != to.address || from.prefix != to.prefix {
+		return d.Configure(to.address, to.prefix, to.channel)
+	}
+	if from.channel != to.channel {
+		return d.SetChannel(to.channel)
+	}
+	return nil
+}
+
+// SetDataChannel makes the receiver direct transmitters to ch once paired,
+// keeping the channel set by SetChannel for pairing. The receiver listens on
+// the pairing channel too while pairing is possible or a transmitter has not
+// completed the switch; call DisablePairing to have it stay on ch.
+func (r *Receiver) SetDataChannel(ch uint8) error {
+	if ch > 125 {
+		return proto.ErrInvalidChannel
+	}
+	r.mu.Lock()
+	r.dataChannel = ch
+	r.hasDataChannel = true
+	r.mu.Unlock()
+	return nil
+}
+
+// ClearDataChannel keeps future pairings on the pairing channel.
+func (r *Receiver) ClearDataChannel() {
+	r.mu.Lock()
+	r.hasDataChannel = false
+	r.mu.Unlock()
+}
+
+// SetPrivateAddress makes the receiver move transmitters paired from now on
+// off the shared pairing address to its own (see protocol.PrivateAddress),
+// so that once pairing is closed its radio no longer processes the traffic
+// of other links in range. As with SetDataChannel, the receiver alternates
+// between the two addresses while it still needs the pairing one.
+func (r *Receiver) SetPrivateAddress(enabled bool) {
+	r.mu.Lock()
+	r.privateAddress = enabled
+	r.mu.Unlock()
+}
+
+// dataLinkLocked returns the link paired transmitters are directed to, which
+// is the pairing link if neither a data channel nor a private address is set.
+func (r *Receiver) dataLinkLocked() link {
+	l := linkOf(r.device)
+	if r.hasDataChannel {
+		l.channel = r.dataChannel
+	}
+	if r.privateAddress {
+		l.address, l.prefix = r.private.address, r.private.prefix
+	}
+	return l
+}
+
+// dataLinkDirectiveLocked returns the ACK extension moving a newly paired
+// transmitter to the data link, or nil if it stays on the pairing link.
+// A directed device is marked as switching, to start once pairing completes.
+func (r *Receiver) dataLinkDirectiveLocked(dev *proto.Device, ext []byte) []byte {
+	pairing, data := linkOf(r.device), r.dataLinkLocked()
+	pairing.apply(dev)
+	delete(r.switching, dev.ID)
+	if data == pairing {
+		return nil
+	}
+	if v, ok := proto.FindTLV(ext, proto.TagDataChannel); ok && len(v) == 1 && v[0] == proto.NoDataChannel {
+		return nil
+	}
+	data.apply(dev)
+	r.switching[dev.ID] = time.Time{}
+	var directive []byte
+	if data.channel != pairing.channel {
+		directive = proto.AppendTLV(directive, proto.TagDataChannel, []byte{data.channel})
+	}
+	if data.address != pairing.address || data.prefix != pairing.prefix {
+		directive = proto.AppendAddressTLV(directive, data.address, data.prefix)
+	}
+	return directive
+}
+
+// startSwitchLocked starts the grace period of a directed device that has
+// completed pairing: the receiver listens on both links until it hears the
+// device on the data link.
+func (r *Receiver) startSwitchLocked(id proto.DeviceID) {
+	if deadline, ok := r.switching[id]; ok && deadline.IsZero() {
+		r.switching[id] = time.Now().Add(channelGracePeriod)
+	}
+}
+
+// heardLocked notes that frame arrived from a paired transmitter on the
+// tuned link.
+func (r *Receiver) heardLocked(frame *proto.Frame) {
+	id := frame.SenderID
+	if deadline, ok := r.switching[id]; ok && !deadline.IsZero() && r.onDataLinkLocked(frame) {
+		delete(r.switching, id)
+	}
+	r.lockOnLocked()
+	r.hopHeardLocked(id)
+}
+
+// tune points the radio at the link to listen on next and returns how long
+// to listen there.
+func (r *Receiver) tune() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.expireHopsLocked(now)
+	dwell, scanning := r.scanLocked(now)
+	for id, deadline := range r.switching {
+		_, paired := r.pairedDevices[id]
+		_, confirming := r.confirmations[id]
+		switch {
+		case !paired && !confirming:
+			delete(r.switching, id)
+		case !deadline.IsZero() && now.After(deadline):
+			log.Printf("[Receiver] Device %d did not move to the data link, unpaired\r\n", id)
+			delete(r.switching, id)
+			delete(r.pairedDevices, id)
+			delete(r.devStats, id)
+			r.deleteBondLocked(id)
+		}
+	}
+
+	pairing, data := linkOf(r.device), r.dataLinkLocked()
+	needPairing := data == pairing || r.pairingOpenLocked() || len(r.challenges) > 0 || len(r.confirmations) > 0
+	needData := false
+	for id, dev := range r.pairedDevices {
+		deadline, switching := r.switching[id]
+		switch {
+		case switching && deadline.IsZero():
+			needPairing = true
+		case switching:
+			needPairing, needData = true, true
+		case data != pairing && linkOf(dev) == data:
+			needData = true
+		default:
+			needPairing = true
+		}
+	}
+
+	l, timeout := pairing, r.rxPollInterval()
+	piped := false
+	switch {
+	case needPairing && needData && r.canPipeLocked(pairing, data):
+		piped = true
+	case needPairing && needData:
+		timeout = channelDwell
+		if now.UnixNano()/int64(channelDwell)%2 == 1 {
+			l = data
+		}
+	case needData:
+		l = data
+	}
+	if scanning && dwell < timeout {
+		timeout = dwell
+	}
+	if l != r.tuned {
+		if l.address != r.tuned.address || l.prefix != r.tuned.prefix {
+			r.piped = false // Configure listens on pipe 0 alone
+		}
+		_ = retune(r.driver, r.tuned, l)
+		r.tuned = l
+	}
+	r.setDataPipeLocked(piped, data)
+	if l == pairing {
+		r.beaconLocked(now)
+	}
+	return timeout
+}
+
+// pollFrame tunes the radio and waits for the next frame.
+func (r *Receiver) pollFrame() *proto.Frame {
+	return r.ReceiveFrame(r.tune())
+}
+
+// pollFrameCtx is pollFrame giving up once ctx is done.
+func (r *Receiver) pollFrameCtx(ctx context.Context) *proto.Frame {
+	return r.ReceiveFrameCtx(ctx, r.tune())
+}
+
+// followDataLink moves a freshly paired transmitter to the data link the
+// receiver directed it to in the pairing ACK extension ext, and checks that
+// the link works there. If it does not, the transmitter returns to the
+// pairing link and pairs again, asking to stay there.
+func (t *Transmitter) followDataLink(ctx context.Context, receiverID proto.DeviceID, ext []byte, opts PairingOptions) error {
+	data, ok := parseDataLink(ext, linkOf(t.device))
+	if !ok || t.noDataChannel {
+		return nil
+	}
+	pairing := linkOf(t.device)
+	if err := t.tuneLink(data); err != nil {
+		return err
+	}
+	t.pairingLink, t.onDataLink = pairing, true
+	if t.checkLink() == nil {
+		log.Printf("[Transmitter] Moved to data channel %d\r\n", data.channel)
+		t.saveBond()
+		return nil
+	}
+
+	log.Printf("[Transmitter] No answer on the data link, falling back to channel %d\r\n", pairing.channel)
+	t.unpairLocal()
+	if err := t.leaveDataLink(); err != nil {
+		return err
+	}
+
+	t.noDataChannel = true
+	defer func() { t.noDataChannel = false }()
+	return t.pair(ctx, receiverID, opts)
+}
+
+// tuneLink moves the transmitter's radio to l.
+func (t *Transmitter) tuneLink(l link) error {
+	if l.channel > 125 {
+		return proto.ErrInvalidChannel
+	}
+	if err := retune(t.driver, linkOf(t.device), l); err != nil {
+		return err
+	}
+	l.apply(t.device)
+	return nil
+}
+
+// leaveDataLink returns the transmitter to the link it paired on, if it
+// followed the receiver to another one.
+func (t *Transmitter) leaveDataLink() error {
+	if !t.onDataLink {
+		return nil
+	}
+	t.onDataLink = false
+	return t.tuneLink(t.pairingLink)
+}
+
+// parseDataLink returns the data link directed by a pairing ACK extension,
+// starting from the pairing link, and whether it differs from it.
+func parseDataLink(ext []byte, pairing link) (link, bool) {
+	l := pairing
+	if v, ok := proto.FindTLV(ext, proto.TagDataChannel); ok && len(v) == 1 && v[0] <= 125 {
+		l.channel = v[0]
+	}
+	if address, prefix, ok := proto.ParseAddress(ext); ok {
+		l.address, l.prefix = address, prefix
+	}
+	return l, l != pairing
+}
+
+// checkLink sends a heartbeat asking for an ACK and reports whether one came
+// within the receiver's grace period. The heartbeat is repeated every few
+// dwell periods so that a copy arrives while the receiver, which alternates
+// between the links, listens on the data link.
+func (t *Transmitter) checkLink() error {
+	t.txMu.Lock()
+	seq := t.seq
+	t.seq++
+	payload := t.heartbeatPayload(seq)
+	t.txMu.Unlock()
+	frame := t.newFrame(proto.FrameTypeHeartbeat, seq, payload)
+	frame.Flags |= proto.FlagAckRequest
+	encoded := t.linkConfig().EncodeFrame(frame)
+
+	deadline := time.Now().Add(channelGracePeriod)
+	for time.Now().Before(deadline) {
+		if err := t.tx(encoded); err != nil {
+			return err
+		}
+		for next := time.Now().Add(3 * channelDwell); time.Now().Before(next); {
+			reply := t.ReceiveFrame(channelDwell / 4)
+			if reply == nil {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			if reply.Type == proto.FrameTypeAck && reply.Seq == seq && reply.SenderID == t.receiver {
+				return nil
+			}
+			if t.handleUnpair(reply) {
+				return proto.ErrNotPaired
+			}
+		}
+	}
+	return proto.ErrTimeout
+}
@@ -0,0 +1,11 @@
+package transport
+
+import "time"
+
+// NewMillisClock returns a clock reporting the milliseconds elapsed since the
+// call, suitable for SetTimestampClock when sender and receiver share a board
+// or when only relative ages matter.
+func NewMillisClock() func() uint32 {
+	start := time.Now()
+	return func() uint32 { return uint32(time.Since(start).Milliseconds()) }
+}
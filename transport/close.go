@@ -0,0 +1,153 @@
+package transport
+
+import (
+	"context"
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// WithGoodbye makes Transmitter.Close tell the paired receiver that the
+// transmitter is going away, so that the receiver treats it as timed out at
+// once instead of after DeviceTimeout. Unlike Unpair, bonds are kept.
+// Receiver.Close likewise tells every paired transmitter, whose link
+// monitor then reports the link down at once.
+func WithGoodbye() Option {
+	return func(o *options) { o.goodbye = true }
+}
+
+// Close shuts the transmitter down. It sends the samples buffered by
+// SendDataBatched, closes the transmit queue, as configured by
+// TxQueueConfig.FlushOnClose, stops the heartbeat task, the listen loop and
+// automatic re-pairing, and makes reliable sends and pairing in progress on
+// other goroutines give up with ErrClosed. With WithGoodbye it then tells
+// the paired receiver it is going away. Finally it calls the driver's Close
+// method if the driver implements RadioCloser, returning its error.
+//
+// Every send and pairing call fails with ErrClosed afterwards. Calling
+// Close again does nothing.
+func (t *Transmitter) Close() error {
+	var err error
+	t.closeOnce.Do(func() { err = t.close() })
+	return err
+}
+
+func (t *Transmitter) close() error {
+	t.closeBatching()
+	flush := t.sendQueue.cfg.FlushOnClose
+	if flush {
+		t.closeQueue()
+	}
+	close(t.closing)
+	if !flush {
+		t.closeQueue()
+	}
+	t.Stop()
+	t.StopHeartbeatTask()
+	if t.repair.enabled {
+		t.StopAutoRepair()
+	}
+
+	if t.goodbye && t.device.IsPaired {
+		t.sayGoodbye()
+	}
+	log.Printf("[Transmitter] Closed\r\n")
+	if c, ok := t.driver.(RadioCloser); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// sayGoodbye sends the ControlGoodbye notice of WithGoodbye.
+func (t *Transmitter) sayGoodbye() {
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	seq := t.seq
+	t.seq++
+	frame := t.newFrame(proto.FrameTypeControl, seq, proto.EncodeControl(proto.ControlGoodbye, t.receiver, nil))
+	if err := t.txLocked(t.linkConfig().EncodeFrame(frame)); err != nil {
+		log.Printf("[Transmitter] Goodbye to %d failed: %v\r\n", t.receiver, err)
+	}
+}
+
+// isClosed reports whether Close has been called.
+func (t *Transmitter) isClosed() bool {
+	select {
+	case <-t.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// ctxErr returns ErrClosed once the transmitter is closed and ctx.Err()
+// otherwise.
+func (t *Transmitter) ctxErr(ctx context.Context) error {
+	if t.isClosed() {
+		return proto.ErrClosed
+	}
+	return ctx.Err()
+}
+
+// Close shuts the receiver down. It stops the listen loop, the cleanup task
+// and the pairing window, with WithGoodbye tells every paired transmitter
+// it is going away, and closes the channels returned by Frames. Finally it
+// calls the driver's Close method if the driver implements RadioCloser,
+// returning its error.
+//
+// ReceiveData, SendAck and the other calls that transmit fail with
+// ErrClosed afterwards. Calling Close again does nothing.
+func (r *Receiver) Close() error {
+	var err error
+	r.closeOnce.Do(func() { err = r.close() })
+	return err
+}
+
+func (r *Receiver) close() error {
+	r.StopListening()
+	r.StopMaintenance()
+	r.mu.Lock()
+	if w := &r.window; w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	r.beacons.enabled = false
+	var paired []proto.DeviceID
+	for id := range r.pairedDevices {
+		paired = append(paired, id)
+	}
+	r.mu.Unlock()
+
+	if r.goodbye {
+		for _, id := range paired {
+			if err := r.sendControl(0, proto.ControlGoodbye, id, nil); err != nil {
+				log.Printf("[Receiver] Goodbye to %d failed: %v\r\n", id, err)
+			}
+		}
+	}
+	close(r.closing)
+	r.closeSubscriptions()
+	log.Printf("[Receiver] Closed\r\n")
+	if c, ok := r.driver.(RadioCloser); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// isClosed reports whether Close has been called.
+func (r *Receiver) isClosed() bool {
+	select {
+	case <-r.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// tx transmits a frame unless the receiver is closed.
+func (r *Receiver) tx(data []byte) error {
+	if r.isClosed() {
+		return proto.ErrClosed
+	}
+	return r.driver.Tx(data)
+}
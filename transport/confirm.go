@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// confirmWithin runs confirm in its own goroutine and returns its answer, or
+// ErrTimeout if it does not answer within timeout.
+func confirmWithin(ctx context.Context, confirm func() bool, timeout time.Duration) (bool, error) {
+	answer := make(chan bool, 1)
+	go func() { answer <- confirm() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-answer:
+		return ok, nil
+	case <-timer.C:
+		return false, proto.ErrTimeout
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// pendingConfirm is a secure pairing waiting for the user to confirm the
+// comparison code and for the transmitter to confirm the session key.
+type pendingConfirm struct {
+	dev           *proto.Device
+	seq           uint32 // sequence number of the pairing request
+	keySeq        uint32 // sequence number of the key confirmation
+	keyConfirmed  bool
+	userConfirmed bool
+}
+
+// SetPairingConfirm registers a handler that must confirm the six-digit
+// comparison code of every secure pairing before the transmitter is paired.
+// It runs in its own goroutine, so it may prompt the user; if it does not
+// answer within Config.ConfirmTimeout, or answers false, the pairing is
+// rejected. Pairing requests without a key exchange are not affected. Pass
+// nil to remove the handler.
+func (r *Receiver) SetPairingConfirm(confirm func(id proto.DeviceID, code uint32) bool) {
+	r.mu.Lock()
+	r.confirmHandler = confirm
+	r.mu.Unlock()
+}
+
+// awaitConfirmLocked sets dev aside until the user confirms code.
+func (r *Receiver) awaitConfirmLocked(id proto.DeviceID, dev *proto.Device, seq uint32, code uint32) {
+	c := &pendingConfirm{dev: dev, seq: seq}
+	r.confirmations[id] = c
+	confirm := r.confirmHandler
+
+	go func() {
+		ok, err := confirmWithin(context.Background(), func() bool { return confirm(id, code) }, r.config.ConfirmTimeout)
+
+		var res frameResult
+		defer res.runEvents()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.confirmations[id] != c {
+			return // superseded or abandoned meanwhile
+		}
+		if err != nil || !ok {
+			log.Printf("[Receiver] Pairing with %d not confirmed\r\n", id)
+			delete(r.confirmations, id)
+			_ = r.sendControl(c.seq, proto.ControlPairReject, id, []byte{proto.RejectNotConfirmed})
+			return
+		}
+		c.userConfirmed = true
+		r.completeConfirmLocked(&res, id, c)
+	}()
+}
+
+// completeConfirmLocked pairs the device once both confirmations are in.
+func (r *Receiver) completeConfirmLocked(res *frameResult, id proto.DeviceID, c *pendingConfirm) {
+	if !c.keyConfirmed || !c.userConfirmed {
+		return
+	}
+	delete(r.confirmations, id)
+	c.dev.UpdateLastSeen()
+	var oldKey proto.PairingKey
+	var oldSession []byte
+	old := r.pairedDevices[id]
+	if old != nil {
+		oldKey, oldSession = old.PairingKey, old.SessionKey
+	}
+	r.pairedLocked(res, c.dev, old, oldKey, oldSession)
+	_ = r.sendPairingAck(c.keySeq, nil)
+	r.startSwitchLocked(id)
+}
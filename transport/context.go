@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// SendDataReliableCtx behaves like SendDataReliable but gives up with
+// ctx.Err() as soon as ctx is cancelled or its deadline passes, within one
+// 20 ms receive poll.
+func (t *Transmitter) SendDataReliableCtx(ctx context.Context, data []byte, maxRetries int) error {
+	_, _, err := t.sendReliable(ctx, proto.FrameTypeData, data, maxRetries)
+	return err
+}
+
+// StartPairingCtx behaves like StartPairing but gives up with ctx.Err() as
+// soon as ctx is done, within one 100 ms receive poll. The pairing timeout
+// still applies. A half-finished secure pairing is rejected towards the
+// receiver as on a timeout.
+func (t *Transmitter) StartPairingCtx(ctx context.Context, receiverID proto.DeviceID) error {
+	return t.startPairing(ctx, receiverID, PairingOptions{})
+}
+
+// ReceiveDataCtx behaves like ReceiveData but waits until data arrives or
+// ctx is done instead of for five seconds, returning ctx.Err() in the latter
+// case.
+func (r *Receiver) ReceiveDataCtx(ctx context.Context) ([]byte, error) {
+	return r.receiveData(ctx, time.Time{})
+}
+
+// rxSlice is the longest a receive waits for the radio before looking at its
+// context again.
+const rxSlice = 10 * time.Millisecond
+
+// ReceiveFrameCtx behaves like ReceiveFrame but gives up and returns nil as
+// soon as ctx is done, within one 10 ms slice of the wait, or at once with
+// a driver that implements RadioRxWaiter.
+func (r *Receiver) ReceiveFrameCtx(ctx context.Context, timeout time.Duration) *proto.Frame {
+	if frame, ok := r.waitFrame(ctx, timeout); ok {
+		return frame
+	}
+	if ctx.Done() == nil {
+		return r.decodeRx(timeout)
+	}
+	for deadline := time.Now().Add(timeout); ctx.Err() == nil; {
+		wait := time.Until(deadline)
+		if wait > rxSlice {
+			wait = rxSlice
+		}
+		start := time.Now()
+		// Drivers that return at once when nothing is pending do not wait.
+		if frame := r.decodeRx(wait); frame != nil || wait < rxSlice || time.Since(start) < wait {
+			return frame
+		}
+	}
+	return nil
+}
+
+// decodeRx waits up to timeout for a frame from the radio.
+func (r *Receiver) decodeRx(timeout time.Duration) *proto.Frame {
+	return decodeOthers(readRx(r.driver), r.config, r.device.ID, &r.echoes, r.heard, timeout)
+}
+
+// sleepCtx sleeps for d or until ctx is done or the transmitter closed,
+// returning ctx.Err() or ErrClosed in the latter cases.
+func (t *Transmitter) sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.closing:
+		return proto.ErrClosed
+	}
+}
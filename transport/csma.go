@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// Defaults of CSMAConfig.
+const (
+	defaultCSMAThreshold = -70
+	defaultCSMABackoff   = time.Millisecond
+	defaultCSMARetries   = 4
+)
+
+// CSMAConfig configures listen-before-talk: before every transmission the
+// transmitter samples the energy on the channel and, while another radio
+// is heard, waits a random backoff before sampling again.
+type CSMAConfig struct {
+	// Threshold is the energy in dBm at or above which the channel is
+	// busy, -70 dBm by default.
+	Threshold int8
+
+	// Backoff bounds the random wait after the channel was first found
+	// busy. The bound doubles after each further busy sample. 1 ms by
+	// default.
+	Backoff time.Duration
+
+	// Retries is how many busy samples a frame waits out before the send
+	// fails with ErrChannelBusy, 4 by default.
+	Retries int
+}
+
+// WithCSMA makes a Transmitter listen before it talks, so that several
+// transmitters sharing a channel collide less. It needs a driver that
+// implements RadioEnergySampler and does nothing otherwise.
+func WithCSMA(cfg CSMAConfig) Option {
+	return func(o *options) { o.csma = &cfg }
+}
+
+// csma is the state of WithCSMA.
+type csma struct {
+	cfg     CSMAConfig
+	sampler RadioEnergySampler // nil when disabled
+}
+
+func (c *csma) init(cfg *CSMAConfig, d RadioDriver) {
+	if cfg == nil {
+		return
+	}
+	sampler, ok := d.(RadioEnergySampler)
+	if !ok {
+		log.Printf("[Transmitter] Driver cannot sample the channel, CSMA disabled\r\n")
+		return
+	}
+	c.cfg = *cfg
+	if c.cfg.Threshold == 0 {
+		c.cfg.Threshold = defaultCSMAThreshold
+	}
+	if c.cfg.Backoff <= 0 {
+		c.cfg.Backoff = defaultCSMABackoff
+	}
+	if c.cfg.Retries <= 0 {
+		c.cfg.Retries = defaultCSMARetries
+	}
+	c.sampler = sampler
+}
+
+// listenBeforeTalk returns once the channel is clear, or ErrChannelBusy if
+// it stayed busy through every backoff. txMu must be held.
+func (t *Transmitter) listenBeforeTalk() error {
+	c := &t.csma
+	if c.sampler == nil {
+		return nil
+	}
+	window := c.cfg.Backoff
+	for attempt := 0; ; attempt++ {
+		rssi, err := c.sampler.SampleRSSI()
+		if err != nil {
+			return err
+		}
+		if rssi < c.cfg.Threshold {
+			return nil
+		}
+		if attempt == c.cfg.Retries {
+			log.Printf("[Transmitter] Channel busy (%d dBm), frame not sent\r\n", rssi)
+			return proto.ErrChannelBusy
+		}
+		time.Sleep(randDuration(t.rand, window))
+		window *= 2
+	}
+}
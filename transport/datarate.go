@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DataRate is the on-air bit rate of the radio. Both ends of a link must
+// use the same one: a radio cannot hear frames sent at another rate.
+type DataRate uint8
+
+const (
+	// DataRate1Mbit is the default, and what a peer that announces no
+	// rate in pairing is assumed to use.
+	DataRate1Mbit DataRate = iota
+	// DataRate2Mbit halves the airtime of each frame, at some cost in
+	// range.
+	DataRate2Mbit
+	// DataRate250Kbit gains sensitivity for long range. The nRF52 series
+	// does not support it.
+	DataRate250Kbit
+)
+
+func (r DataRate) String() string {
+	switch r {
+	case DataRate1Mbit:
+		return "1 Mbit"
+	case DataRate2Mbit:
+		return "2 Mbit"
+	case DataRate250Kbit:
+		return "250 kbit"
+	}
+	return "unknown"
+}
+
+// BitRate returns the rate in bits per second, 0 for an unknown one.
+func (r DataRate) BitRate() int {
+	switch r {
+	case DataRate1Mbit:
+		return 1000000
+	case DataRate2Mbit:
+		return 2000000
+	case DataRate250Kbit:
+		return 250000
+	}
+	return 0
+}
+
+// checkDataRate rejects values that name no data rate.
+func checkDataRate(rate DataRate) error {
+	if rate > DataRate250Kbit {
+		return proto.ErrInvalidDataRate
+	}
+	return nil
+}
+
+// appendDataRateTLV appends a record announcing rate to a pairing request
+// or ACK, unless it is the default a peer assumes without one.
+func appendDataRateTLV(ext []byte, rate DataRate) []byte {
+	if rate == DataRate1Mbit {
+		return ext
+	}
+	return proto.AppendTLV(ext, proto.TagDataRate, []byte{byte(rate)})
+}
+
+// parseDataRate returns the data rate a peer announced in a pairing TLV
+// section, DataRate1Mbit if it announced none.
+func parseDataRate(ext []byte) DataRate {
+	if v, ok := proto.FindTLV(ext, proto.TagDataRate); ok && len(v) == 1 {
+		return DataRate(v[0])
+	}
+	return DataRate1Mbit
+}
+
+// SetDataRate sets the radio's data rate, DataRate1Mbit by default. The
+// rate is announced when pairing, and a receiver using another one rejects
+// the pairing, which then fails with ErrDataRateMismatch. It fails with
+// ErrInvalidDataRate if the radio does not support the rate.
+func (t *Transmitter) SetDataRate(rate DataRate) error {
+	if err := checkDataRate(rate); err != nil {
+		return err
+	}
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	if err := t.driver.SetDataRate(rate); err != nil {
+		return err
+	}
+	t.dataRate = rate
+	return nil
+}
+
+// DataRate returns the data rate set with SetDataRate.
+func (t *Transmitter) DataRate() DataRate {
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	return t.dataRate
+}
+
+// SetDataRate sets the radio's data rate, as Transmitter.SetDataRate does.
+// Pairing requests announcing another rate are rejected.
+func (r *Receiver) SetDataRate(rate DataRate) error {
+	if err := checkDataRate(rate); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.driver.SetDataRate(rate); err != nil {
+		return err
+	}
+	r.dataRate = rate
+	return nil
+}
+
+// DataRate returns the data rate set with SetDataRate.
+func (r *Receiver) DataRate() DataRate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dataRate
+}
+
+// dataRateMatchesLocked reports whether the pairing request extensions ext
+// of transmitter id announce the receiver's data rate, rejecting the
+// pairing with seq otherwise.
+func (r *Receiver) dataRateMatchesLocked(id proto.DeviceID, seq uint32, ext []byte) bool {
+	rate := parseDataRate(ext)
+	if rate == r.dataRate {
+		return true
+	}
+	log.Printf("[Receiver] Device %d uses %v, not %v, pairing rejected\r\n", id, rate, r.dataRate)
+	_ = r.sendControl(seq, proto.ControlPairReject, id, []byte{proto.RejectDataRate})
+	return false
+}
@@ -0,0 +1,128 @@
+package transport
+
+import (
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// dedupWindow is how many sequence numbers back from the highest seen the
+// receiver remembers data frames, to recognise retransmissions.
+const dedupWindow = 64
+
+// ackCacheSize is how many of the latest ACKs to a transmitter's data
+// frames the receiver keeps, encoded, to send again verbatim when a frame
+// is retransmitted.
+const ackCacheSize = 8
+
+// seqWindow tracks the sequence numbers of the data frames of a paired
+// transmitter, so that a frame retransmitted after a lost ACK is
+// acknowledged again but not delivered twice.
+type seqWindow struct {
+	valid   bool
+	highest uint32
+	seen    uint64 // bit i set: frame highest-i seen
+	acks    [ackCacheSize]cachedAck
+	next    int    // slot of acks to fill next
+	dups    uint64 // duplicates suppressed, kept across resets
+}
+
+// cachedAck is an ACK sent for a data frame, see ackedLocked.
+type cachedAck struct {
+	seq  uint32
+	data []byte // encoded; nil for an empty slot
+}
+
+// ack returns the ACK cached for seq, or nil.
+func (w *seqWindow) ack(seq uint32) []byte {
+	for _, a := range w.acks {
+		if a.data != nil && a.seq == seq {
+			return a.data
+		}
+	}
+	return nil
+}
+
+// expireAcks forgets the ACKs of frames that fell out of the window, or all
+// of them if the window is no longer valid.
+func (w *seqWindow) expireAcks() {
+	for i, a := range w.acks {
+		if !w.valid || uint32(w.highest-a.seq) >= dedupWindow {
+			w.acks[i] = cachedAck{}
+		}
+	}
+}
+
+// DuplicateFrames returns how many retransmitted data frames of the
+// transmitter id the receiver acknowledged again without delivering them.
+func (r *Receiver) DuplicateFrames(id proto.DeviceID) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if w := r.seqs[id]; w != nil {
+		return w.dups
+	}
+	return 0
+}
+
+// duplicateLocked records the data frame frame and reports whether it was
+// seen before, along with the encoded ACK sent for it, if still cached, to
+// repeat.
+func (r *Receiver) duplicateLocked(frame *proto.Frame) ([]byte, bool) {
+	if r.seqs == nil {
+		r.seqs = make(map[proto.DeviceID]*seqWindow)
+	}
+	w := r.seqs[frame.SenderID]
+	if w == nil {
+		w = &seqWindow{}
+		r.seqs[frame.SenderID] = w
+	}
+	if !w.valid {
+		w.valid, w.highest, w.seen = true, frame.Seq, 1
+		w.expireAcks()
+		return nil, false
+	}
+	switch d := int32(frame.Seq - w.highest); {
+	case d > 0:
+		if d >= dedupWindow {
+			w.seen = 1
+		} else {
+			w.seen = w.seen<<uint(d) | 1
+		}
+		w.highest = frame.Seq
+		w.expireAcks()
+	case -d >= dedupWindow:
+		// Too far back to be a retransmission: the transmitter started over
+		// without announcing it.
+		w.highest, w.seen = frame.Seq, 1
+		w.expireAcks()
+	default:
+		bit := uint64(1) << uint(-d)
+		if w.seen&bit != 0 {
+			w.dups++
+			return w.ack(frame.Seq), true
+		}
+		w.seen |= bit
+	}
+	return nil, false
+}
+
+// ackedLocked encodes the ACK with extensions ext for the data frame frame
+// and caches it, to repeat the very same ACK if frame is retransmitted.
+func (r *Receiver) ackedLocked(frame *proto.Frame, ext []byte) []byte {
+	data := r.config.EncodeFrame(r.ackFrame(frame.Seq, ext))
+	if w := r.seqs[frame.SenderID]; w != nil && w.valid {
+		w.acks[w.next] = cachedAck{frame.Seq, data}
+		w.next = (w.next + 1) % ackCacheSize
+	}
+	return data
+}
+
+// resetSeqLocked forgets the sequence numbers seen from id, once it has
+// restarted or paired anew.
+func (r *Receiver) resetSeqLocked(id proto.DeviceID) {
+	if w := r.seqs[id]; w != nil {
+		w.valid = false
+		w.expireAcks()
+	}
+	if l := r.losses[id]; l != nil {
+		l.valid = false
+	}
+}
@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DeviceEventType says what happened to a transmitter, see DeviceEvent.
+type DeviceEventType uint8
+
+const (
+	DevicePaired   DeviceEventType = iota + 1 // a transmitter paired that was not paired
+	DeviceLost                                // it timed out and was dropped by CleanupTimedOutDevices
+	DeviceUnpaired                            // it was unpaired by Unpair, by itself or to make room
+	DeviceReturned                            // a lost transmitter was heard again and is paired once more
+	DeviceRebooted                            // it restarted and is still paired, its frames tracked afresh
+)
+
+// DeviceEvent reports a change in the set of transmitters paired with a
+// receiver.
+type DeviceEvent struct {
+	Type DeviceEventType
+	ID   proto.DeviceID
+	Time time.Time // when the receiver noticed
+}
+
+// deviceEventQueue is how many device events wait for the handler before
+// further ones are dropped.
+const deviceEventQueue = 32
+
+// deviceEvents is the state of SetDeviceEventHandler, guarded by the
+// receiver's mutex.
+type deviceEvents struct {
+	handler func(DeviceEvent)
+	queue   chan DeviceEvent // nil until a handler is first set
+	dropped uint64
+	lost    map[proto.DeviceID]*proto.Device // timed out, kept for DeviceReturned
+}
+
+// SetDeviceEventHandler registers a handler told when a transmitter pairs,
+// times out, is unpaired, returns after timing out or restarts. A lost
+// transmitter returns when the receiver hears data or a heartbeat from it
+// and has room for it; if it pairs again instead, that is reported as
+// DevicePaired. A restart is noticed from a new boot epoch, see
+// WithSeqState, or from sequence numbers that start over.
+//
+// The events are queued and handed to h in order on a goroutine of its own,
+// so h may call the receiver and never holds up the processing of frames.
+// While h falls behind by more than 32 events, further ones are dropped and
+// counted by DroppedDeviceEvents. Pass nil to remove the handler.
+func (r *Receiver) SetDeviceEventHandler(h func(ev DeviceEvent)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devEvents.handler = h
+	if h != nil && r.devEvents.queue == nil {
+		r.devEvents.queue = make(chan DeviceEvent, deviceEventQueue)
+		go r.deliverDeviceEvents(r.devEvents.queue)
+	}
+}
+
+// DroppedDeviceEvents returns how many device events were dropped because
+// the handler fell behind.
+func (r *Receiver) DroppedDeviceEvents() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.devEvents.dropped
+}
+
+// deviceEventLocked queues an event of type typ for id.
+func (r *Receiver) deviceEventLocked(typ DeviceEventType, id proto.DeviceID) {
+	if r.devEvents.handler == nil {
+		return
+	}
+	select {
+	case r.devEvents.queue <- DeviceEvent{Type: typ, ID: id, Time: time.Now()}:
+	default:
+		r.devEvents.dropped++
+		log.Printf("[Receiver] Device event %d for %d dropped\r\n", typ, id)
+	}
+}
+
+// deliverDeviceEvents hands the events in q to the handler until the
+// receiver is closed.
+func (r *Receiver) deliverDeviceEvents(q chan DeviceEvent) {
+	for {
+		select {
+		case ev := <-q:
+			r.mu.Lock()
+			h := r.devEvents.handler
+			r.mu.Unlock()
+			if h != nil {
+				h(ev)
+			}
+		case <-r.closing:
+			return
+		}
+	}
+}
+
+// lostLocked remembers dev, which timed out, in case it returns.
+func (r *Receiver) lostLocked(dev *proto.Device) {
+	if r.devEvents.lost == nil {
+		r.devEvents.lost = make(map[proto.DeviceID]*proto.Device)
+	}
+	r.devEvents.lost[dev.ID] = dev
+	r.deviceEventLocked(DeviceLost, dev.ID)
+}
+
+// returnedLocked pairs the sender of frame again if it timed out and frame
+// shows it is still there, and returns it; nil if it does not return.
+func (r *Receiver) returnedLocked(frame *proto.Frame) *proto.Device {
+	dev := r.devEvents.lost[frame.SenderID]
+	if dev == nil || frame.Type != proto.FrameTypeHeartbeat && !keepsAlive(frame.Type) {
+		return nil
+	}
+	if r.maxDevices > 0 && len(r.pairedDevices)+len(r.confirmations) >= r.maxDevices || r.singlePairTakenLocked(dev.ID) {
+		return nil
+	}
+	delete(r.devEvents.lost, dev.ID)
+	dev.IsPaired = true
+	dev.UpdateLastSeen()
+	r.pairedDevices[dev.ID] = dev
+	log.Printf("[Receiver] Device %d returned\r\n", dev.ID)
+	r.deviceEventLocked(DeviceReturned, dev.ID)
+	return dev
+}
@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// RxDeviceStats are the traffic counters the receiver keeps for one paired
+// transmitter, from the first frame it took from it after pairing.
+type RxDeviceStats struct {
+	Frames     uint64    `json:"frames"`      // frames of every type taken from the transmitter
+	DataFrames uint64    `json:"data_frames"` // data and batch frames delivered, duplicates left out
+	Heartbeats uint64    `json:"heartbeats"`
+	Bytes      uint64    `json:"bytes"`      // payload bytes of the data and batch frames delivered
+	Duplicates uint64    `json:"duplicates"` // data frames repeated after a lost ACK, see DuplicateFrames
+	Lost       uint64    `json:"lost"`       // frames missing from the sequence numbers, see OnFrameLoss
+	LastSeq    uint32    `json:"last_seq"`   // sequence number of the last frame
+	LastSeen   time.Time `json:"last_seen"`
+
+	// RSSI is the signal strength of the last frame measured, in dBm, or 0
+	// if the driver measures none, see RadioRSSIReader.
+	RSSI int8 `json:"rssi"`
+}
+
+// DeviceStats returns the counters of the transmitter id. They are kept
+// while it is paired, or has timed out and may return, and dropped when it
+// is unpaired or evicted.
+func (r *Receiver) DeviceStats(id proto.DeviceID) (RxDeviceStats, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.devStats[id]; s != nil {
+		return *s, true
+	}
+	return RxDeviceStats{}, false
+}
+
+// AllDeviceStats returns the counters of every transmitter that has any.
+func (r *Receiver) AllDeviceStats() map[proto.DeviceID]RxDeviceStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := make(map[proto.DeviceID]RxDeviceStats, len(r.devStats))
+	for id, s := range r.devStats {
+		all[id] = *s
+	}
+	return all
+}
+
+// statsLocked counts frame, from a paired transmitter, and returns the
+// counters of its sender for the caller to add to.
+func (r *Receiver) statsLocked(frame *proto.Frame) *RxDeviceStats {
+	if r.devStats == nil {
+		r.devStats = make(map[proto.DeviceID]*RxDeviceStats)
+	}
+	s := r.devStats[frame.SenderID]
+	if s == nil {
+		s = &RxDeviceStats{}
+		r.devStats[frame.SenderID] = s
+	}
+	s.Frames++
+	s.LastSeq = frame.Seq
+	s.LastSeen = time.Now()
+	if frame.RSSI != 0 {
+		s.RSSI = frame.RSSI
+	}
+	return s
+}
@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"log"
+	"sync"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// defaultDispatchQueue is the default DispatchPoolConfig.Queue.
+const defaultDispatchQueue = 16
+
+// DispatchPolicy decides what happens to a frame for the callbacks while
+// the queue of WithDispatchPool is full.
+type DispatchPolicy uint8
+
+const (
+	DispatchDropNewest DispatchPolicy = iota // drop the frame
+	DispatchDropOldest                       // drop the frame that waited longest to make room
+	DispatchBlock                            // hold up the processing of frames until there is room
+)
+
+// DispatchPoolConfig configures the goroutines that run a receiver's data
+// callbacks, see WithDispatchPool.
+type DispatchPoolConfig struct {
+	// Workers is how many goroutines run callbacks. Zero runs them on the
+	// goroutine processing frames, after the frame's ACK.
+	Workers int
+
+	// Queue bounds the frames waiting for a worker, 16 by default.
+	Queue int
+
+	// Policy decides which frame is dropped while the queue is full;
+	// DispatchDropNewest by default. DispatchBlock drops none but delays
+	// the ACKs of the frames behind.
+	Policy DispatchPolicy
+
+	// OnOverflow, if set, is called with each frame dropped because the
+	// queue is full. It runs on the goroutine processing frames.
+	OnOverflow func(*proto.Frame)
+
+	// OnFirstDrop, if set, is called once, when the queue drops its first
+	// frame, as a warning that callbacks do not keep up. It runs on the
+	// goroutine processing frames.
+	OnFirstDrop func()
+}
+
+// WithDispatchPool makes a Receiver hand the frames for its callbacks, and
+// for the channels of Frames, to a pool of workers, so that a slow callback
+// does not hold up decoding and acknowledging further frames. Each frame is
+// still ACKed before it is queued; a frame arriving while the queue is full
+// is dropped, counted by DroppedDispatchFrames and reported to
+// cfg.OnOverflow. With several workers, callbacks for different frames may
+// run at the same time and out of order. Frames still queued when the
+// receiver is closed are dropped. cfg.Policy chooses another frame to drop,
+// or none; Stats counts the drops by policy and by frame type.
+func WithDispatchPool(cfg DispatchPoolConfig) Option {
+	return func(o *options) { o.dispatch = cfg }
+}
+
+// dispatchJob is a frame waiting for its callbacks.
+type dispatchJob struct {
+	callbacks []*frameCallback
+	frame     *proto.Frame
+	dup       bool // see FrameMeta.Duplicate
+	onError   func(error)
+}
+
+// dispatchPool is the state of WithDispatchPool.
+type dispatchPool struct {
+	cfg     DispatchPoolConfig
+	jobs    chan dispatchJob // nil: callbacks run inline
+	start   sync.Once
+	dropped uint64 // guarded by the receiver's mutex
+}
+
+func (p *dispatchPool) init(cfg DispatchPoolConfig) {
+	if cfg.Policy > DispatchBlock {
+		cfg.Policy = DispatchDropNewest
+	}
+	p.cfg = cfg
+	if cfg.Workers > 0 {
+		if cfg.Queue <= 0 {
+			cfg.Queue = defaultDispatchQueue
+		}
+		p.jobs = make(chan dispatchJob, cfg.Queue)
+	}
+}
+
+// DroppedDispatchFrames returns how many frames were not handed to the
+// callbacks because the queue of WithDispatchPool was full.
+func (r *Receiver) DroppedDispatchFrames() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pool.dropped
+}
+
+// dispatchFrame hands f to cbs, inline or through the worker pool.
+func (r *Receiver) dispatchFrame(cbs []*frameCallback, f *proto.Frame, dup bool, onError func(error)) {
+	p := &r.pool
+	if p.jobs == nil {
+		r.dispatchFresh(cbs, f, dup, onError)
+		return
+	}
+	p.start.Do(func() {
+		for i := 0; i < p.cfg.Workers; i++ {
+			go r.dispatchWorker()
+		}
+	})
+	job := dispatchJob{cbs, f, dup, onError}
+	switch p.cfg.Policy {
+	case DispatchBlock:
+		select {
+		case p.jobs <- job:
+		case <-r.closing:
+		}
+		return
+	case DispatchDropOldest:
+		for {
+			select {
+			case p.jobs <- job:
+				return
+			default:
+			}
+			select {
+			case old := <-p.jobs:
+				r.dispatchDropped(old.frame)
+			default:
+			}
+		}
+	}
+	select {
+	case p.jobs <- job:
+	default:
+		r.dispatchDropped(f)
+	}
+}
+
+// dispatchDropped counts f, dropped because the queue was full, and tells
+// the handlers of the pool about it.
+func (r *Receiver) dispatchDropped(f *proto.Frame) {
+	p := &r.pool
+	r.mu.Lock()
+	p.dropped++
+	first := p.dropped == 1
+	r.mu.Unlock()
+	r.recordDispatchDrop(p.cfg.Policy, f.Type)
+	log.Printf("[Receiver] Dispatch queue full, frame seq=%d from %d dropped\r\n", f.Seq, f.SenderID)
+	if first && p.cfg.OnFirstDrop != nil {
+		p.cfg.OnFirstDrop()
+	}
+	if p.cfg.OnOverflow != nil {
+		p.cfg.OnOverflow(f)
+	}
+}
+
+// dispatchWorker runs the callbacks of queued frames until the receiver is
+// closed.
+func (r *Receiver) dispatchWorker() {
+	for {
+		select {
+		case job := <-r.pool.jobs:
+			r.dispatchFresh(job.callbacks, job.frame, job.dup, job.onError)
+		case <-r.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package transport
+
+import (
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// downlinkRetries is how often SendDataTo transmits a frame before giving
+// up, waiting downlinkAckWait for the ACK after each attempt.
+const (
+	downlinkRetries = 3
+	downlinkAckWait = 200 * time.Millisecond
+)
+
+// downlinkKey identifies a downlink frame awaiting its ACK.
+type downlinkKey struct {
+	id  proto.DeviceID
+	seq uint32
+}
+
+// SendDataTo sends data to the paired transmitter id and waits for it to
+// acknowledge the frame, transmitting it up to three times. Transmitters
+// receive only while they wait for a reply or run Transmitter.Listen, so
+// the data is best sent in answer to an uplink frame or to a listening
+// transmitter. The ACK is picked up by the Listen loop if it runs and by
+// SendDataTo itself otherwise.
+//
+// It returns ErrNotPaired for an unknown id, ErrInvalidPayload if data does
+// not fit the frame size agreed with id and ErrTimeout if no ACK arrives.
+func (r *Receiver) SendDataTo(id proto.DeviceID, data []byte) error {
+	return r.sendDownlink(id, proto.FrameTypeData, func(dev *proto.Device) []byte {
+		if len(data) > r.maxDownlinkSize(dev) {
+			return nil
+		}
+		return proto.EncodeAddressed(id, data)
+	})
+}
+
+// sendDownlink transmits a frame of type frameType to the paired
+// transmitter id until it is acknowledged, as SendDataTo describes. The
+// payload is built by payload with the receiver locked, which returns nil
+// if it does not fit the frame size agreed with id.
+func (r *Receiver) sendDownlink(id proto.DeviceID, frameType byte, payload func(dev *proto.Device) []byte) error {
+	r.mu.Lock()
+	dev, paired := r.pairedDevices[id]
+	if !paired {
+		r.mu.Unlock()
+		return proto.ErrNotPaired
+	}
+	buf := payload(dev)
+	if buf == nil {
+		r.mu.Unlock()
+		return proto.ErrInvalidPayload
+	}
+	key := downlinkKey{id, r.seq}
+	r.seq++
+	acked := make(chan struct{})
+	if r.downlinkAcks == nil {
+		r.downlinkAcks = make(map[downlinkKey]chan struct{})
+	}
+	r.downlinkAcks[key] = acked
+	encoded := r.config.EncodeFrame(&proto.Frame{
+		SenderID: r.device.ID,
+		Type:     frameType,
+		Seq:      key.seq,
+		Payload:  buf,
+	})
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.downlinkAcks, key)
+		r.mu.Unlock()
+	}()
+	for attempt := 0; attempt < downlinkRetries; attempt++ {
+		if attempt > 0 {
+			r.recordDownlinkRetry()
+		}
+		if err := r.tx(encoded); err != nil {
+			return err
+		}
+		if r.awaitDownlinkAck(acked) {
+			log.Printf("[Receiver] Frame to %d acknowledged (seq=%d)\r\n", id, key.seq)
+			return nil
+		}
+	}
+	return proto.ErrTimeout
+}
+
+// maxDownlinkSize returns how many data bytes SendDataTo fits in a frame to
+// dev: the negotiated payload limit minus the target ID.
+func (r *Receiver) maxDownlinkSize(dev *proto.Device) int {
+	return proto.Config{MaxFrameSize: dev.MaxFrameSize}.MaxPayloadSize() - proto.AddressOverhead
+}
+
+// awaitDownlinkAck waits up to downlinkAckWait for acked to be closed,
+// receiving frames itself unless the Listen loop does.
+func (r *Receiver) awaitDownlinkAck(acked chan struct{}) bool {
+	deadline := time.Now().Add(downlinkAckWait)
+	for time.Now().Before(deadline) {
+		listening := r.listening()
+		if !listening {
+			if frame := r.ReceiveFrame(20 * time.Millisecond); frame != nil {
+				r.ProcessFrame(frame)
+			}
+		}
+		select {
+		case <-acked:
+			return true
+		default:
+		}
+		if listening {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return false
+}
+
+// downlinkAckLocked completes the SendDataTo waiting for ack, if any.
+func (r *Receiver) downlinkAckLocked(ack *proto.Frame) {
+	key := downlinkKey{ack.SenderID, ack.Seq}
+	if acked, ok := r.downlinkAcks[key]; ok {
+		close(acked)
+		delete(r.downlinkAcks, key)
+	}
+}
+
+// RegisterCallback registers a callback for frames of the given type that
+// the paired receiver addresses to the transmitter. Only FrameTypeData is
+// delivered, with the payload stripped of its target ID, once per frame
+// however often the receiver repeats it. Callbacks run on the goroutine
+// that received the frame, which is the listen loop while Listen is active.
+func (t *Transmitter) RegisterCallback(ptype byte, cb func(*proto.Frame)) {
+	t.downlink.mu.Lock()
+	if t.downlink.callbacks == nil {
+		t.downlink.callbacks = make(map[byte]func(*proto.Frame))
+	}
+	t.downlink.callbacks[ptype] = cb
+	t.downlink.mu.Unlock()
+}
+
+// handleDownlink acknowledges and delivers a data frame from the paired
+// receiver addressed to the transmitter.
+func (t *Transmitter) handleDownlink(frame *proto.Frame) {
+	if !t.device.IsPaired || frame.SenderID != t.receiver {
+		return
+	}
+	target, data, ok := proto.DecodeAddressed(frame.Payload)
+	if !ok || target != t.device.ID {
+		return
+	}
+	ack := t.newFrame(proto.FrameTypeAck, frame.Seq, proto.EncodeAddressed(t.device.ID, nil))
+	if err := t.tx(t.linkConfig().EncodeFrame(ack)); err != nil {
+		log.Printf("[Transmitter] ACK for downlink seq=%d failed: %v\r\n", frame.Seq, err)
+	}
+
+	d := &t.downlink
+	d.mu.Lock()
+	if d.delivered && d.lastSeq == frame.Seq {
+		d.mu.Unlock()
+		return // a repeat after a lost ACK
+	}
+	d.delivered, d.lastSeq = true, frame.Seq
+	cb := d.callbacks[proto.FrameTypeData]
+	d.mu.Unlock()
+	log.Printf("[Transmitter] Data received from %d (seq=%d)\r\n", frame.SenderID, frame.Seq)
+	if cb != nil {
+		f := *frame
+		f.Payload = data
+		cb(&f)
+	}
+}
@@ -1,12 +1,144 @@
 package transport
 
-import "time"
+import (
+	"context"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// The output power range, in dBm, of the nRF5 radios. A driver may support
+// only some of the levels in between.
+const (
+	MinTxPower = -40
+	MaxTxPower = 8
+)
+
+// checkTxPower rejects output powers no radio supports.
+func checkTxPower(dbm int8) error {
+	if dbm < MinTxPower || dbm > MaxTxPower {
+		return proto.ErrInvalidTxPower
+	}
+	return nil
+}
 
 // RadioDriver is the interface that wraps the basic radio operations.
 type RadioDriver interface {
 	StartHFCLK()
+
+	// Configure sets the address and channel. It may be called again at
+	// any time, also to reopen a driver closed by RadioCloser: the driver
+	// waits for a frame on the air and stops a receive before it
+	// reprograms the radio. A sleeping driver stays asleep and applies the
+	// configuration when it wakes.
 	Configure(address uint32, prefix byte, channel uint8) error
+
 	SetChannel(channel uint8) error
 	Tx(data []byte) error
 	Rx(timeout time.Duration) ([]byte, error)
+
+	// SetTxPower sets the output power in dBm, which stays in effect when
+	// Configure is called again. It fails with ErrInvalidTxPower for a
+	// level the radio does not support.
+	SetTxPower(dbm int8) error
+
+	// SetDataRate sets the on-air data rate, DataRate1Mbit until it is
+	// called, which stays in effect when Configure is called again. It
+	// fails with ErrInvalidDataRate for a rate the radio does not support.
+	SetDataRate(rate DataRate) error
+}
+
+// RadioBurster is implemented by drivers that can transmit several frames
+// in one go, keeping the radio enabled between them. Transmitter.SendBurst
+// uses it and falls back to one Tx per frame otherwise.
+type RadioBurster interface {
+	TxBurst(frames [][]byte) error
+}
+
+// RadioAsyncTx is implemented by drivers that can transmit without
+// waiting for the frame to leave the radio. TxAsync starts sending data,
+// which it copies, and returns; done is called with the outcome once the
+// frame is sent, on a goroutine of the driver. A TxAsync, Tx or TxBurst
+// made while a frame is on the air waits until it is sent, so frames never
+// overlap and go out in the order they were started. If TxAsync returns an
+// error the frame was not started and done is not called. The transmit
+// queue of Transmitter.Enqueue uses it, preparing the next frame while the
+// last one is on the air.
+type RadioAsyncTx interface {
+	TxAsync(data []byte, done func(error)) error
+}
+
+// RadioEnergySampler is implemented by drivers that can measure the energy
+// on the channel they are tuned to, in dBm. WithCSMA uses it to hold back
+// transmissions while another radio is on the air.
+type RadioEnergySampler interface {
+	SampleRSSI() (int8, error)
+}
+
+// RadioSleeper is implemented by drivers that can power the radio down
+// while it is not needed. Wake restores the state before Sleep, including
+// the configuration. SetIdlePolicy uses it.
+type RadioSleeper interface {
+	Sleep() error
+	Wake() error
+}
+
+// RadioCloser is implemented by drivers that can release the radio, for
+// instance by powering it down. Closing an endpoint calls it once, after
+// the endpoint's last transmission. The driver then fails its calls with
+// ErrClosed until Configure is called again.
+type RadioCloser interface {
+	Close() error
+}
+
+// RadioRSSIReader is implemented by drivers that measure the signal
+// strength of each frame they receive. RSSI returns it, in dBm, for the
+// frame Rx or RxWait returned last, and ErrNoRSSI if the radio took no
+// sample. The receiver records it in Frame.RSSI, from where it reaches
+// FrameMeta and RxDeviceStats. For the energy on an idle channel, see
+// RadioEnergySampler.
+type RadioRSSIReader interface {
+	RSSI() (int8, error)
+}
+
+// RxPacket is a frame as the radio received it, with what the hardware
+// knew about its reception.
+type RxPacket struct {
+	Data      []byte    // the encoded frame
+	RSSI      int8      // signal strength in dBm, 0 if not measured
+	Timestamp time.Time // when the frame was received, zero if unknown
+	HWCRCOK   bool      // the radio's own CRC check passed, or it made none
+	Pipe      uint8     // the receive address matched, see RadioMultiPipe
+}
+
+// RadioRxMeta is implemented by drivers that can tell how a frame was
+// received. Endpoints read the radio with RxMeta in place of Rx when the
+// driver has it: the RSSI and timestamp go to Frame.RSSI and
+// Frame.Received, and a packet that failed the hardware CRC is counted as
+// a CRC error without being decoded.
+type RadioRxMeta interface {
+	RxMeta(timeout time.Duration) (RxPacket, error)
+}
+
+// RadioMultiPipe is implemented by drivers that can listen on several
+// addresses at once. Pipe 0 is the address set by Configure; ConfigurePipe
+// sets that of pipe 1 to 7, which share the address but not the prefix on
+// the nRF radios, and fails with ErrInvalidPipe for any other. EnablePipes
+// selects the pipes to listen on, one bit each; Configure enables pipe 0
+// alone. RxPacket.Pipe tells which one a frame matched. The receiver uses
+// it to listen on the pairing and the data link at once, see
+// SetPrivateAddress.
+type RadioMultiPipe interface {
+	ConfigurePipe(pipe uint8, address uint32, prefix byte) error
+	EnablePipes(mask uint8)
+}
+
+// RadioRxWaiter is implemented by drivers that can block until a frame
+// arrives, for instance on the radio's END interrupt, instead of being
+// polled. RxWait returns ctx.Err() once ctx is done. The receiver reads
+// the radio with it when the driver has it, so frames are handled as soon
+// as they arrive rather than at the next poll. The packet is used as that
+// of RadioRxMeta.
+type RadioRxWaiter interface {
+	RxWait(ctx context.Context) (RxPacket, error)
 }
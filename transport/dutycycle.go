@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// defaultBitRate is the default DutyCycleConfig.BitRate, the 1 Mbit/s mode
+// the nRF driver configures.
+const defaultBitRate = 1000000
+
+// radioOverhead is what the radio adds on the air around every frame: a
+// preamble byte, the 4-byte address and a CRC byte.
+const radioOverhead = 6
+
+// DutyCycleMode decides what a send does when the airtime budget is spent.
+type DutyCycleMode uint8
+
+const (
+	DutyCycleBlock  DutyCycleMode = iota // wait until enough airtime has accrued
+	DutyCycleReject                      // fail with ErrDutyCycle
+)
+
+// DutyCycleConfig configures the airtime limiter of a Transmitter, a token
+// bucket holding at most one second's worth of Airtime and refilled at
+// Airtime per second.
+type DutyCycleConfig struct {
+	// Airtime is how long the radio may transmit per second. Zero
+	// disables the limiter.
+	Airtime time.Duration
+
+	// BitRate is the on-air data rate airtime is estimated from, 1 Mbit/s
+	// by default.
+	BitRate int
+
+	// Mode decides what happens to a frame the budget does not cover;
+	// DutyCycleBlock by default.
+	Mode DutyCycleMode
+
+	// ExemptHeartbeats sends heartbeats even when the budget is spent.
+	// Their airtime is still charged.
+	ExemptHeartbeats bool
+}
+
+// WithDutyCycle limits how much a Transmitter transmits per second. Every
+// frame is charged, including pairing frames and retransmissions.
+func WithDutyCycle(cfg DutyCycleConfig) Option {
+	return func(o *options) { o.dutyCycle = cfg }
+}
+
+// dutyCycle is the state of WithDutyCycle.
+type dutyCycle struct {
+	mu     sync.Mutex
+	cfg    DutyCycleConfig
+	tokens time.Duration // airtime available
+	last   time.Time     // when tokens was brought up to date
+	now    func() time.Time
+}
+
+func (d *dutyCycle) init(cfg DutyCycleConfig) {
+	if cfg.BitRate <= 0 {
+		cfg.BitRate = defaultBitRate
+	}
+	d.cfg = cfg
+	d.tokens = cfg.Airtime
+	d.now = time.Now
+	d.last = d.now()
+}
+
+// airtime estimates how long an encoded frame of n bytes is on the air.
+func (d *dutyCycle) airtime(n int) time.Duration {
+	return time.Duration(n+radioOverhead) * 8 * time.Second / time.Duration(d.cfg.BitRate)
+}
+
+// refillLocked adds the airtime accrued since the last refill.
+func (d *dutyCycle) refillLocked() {
+	now := d.now()
+	elapsed := now.Sub(d.last)
+	d.last = now
+	if elapsed >= time.Second {
+		d.tokens = d.cfg.Airtime
+		return
+	}
+	d.tokens += elapsed * d.cfg.Airtime / time.Second
+	if d.tokens > d.cfg.Airtime {
+		d.tokens = d.cfg.Airtime
+	}
+}
+
+// available returns the airtime the limiter allows right now, or 0 if it is
+// disabled.
+func (d *dutyCycle) available() time.Duration {
+	if d.cfg.Airtime <= 0 {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refillLocked()
+	if d.tokens < 0 {
+		return 0
+	}
+	return d.tokens
+}
+
+// takeAirtime charges cost to the airtime budget. A frame the budget does
+// not cover waits for it or fails with ErrDutyCycle, unless exempt; one
+// longer than the whole budget waits for a full bucket.
+func (t *Transmitter) takeAirtime(cost time.Duration, exempt bool) error {
+	d := &t.dutyCycle
+	if d.cfg.Airtime <= 0 {
+		return nil
+	}
+	need := cost
+	if need > d.cfg.Airtime {
+		need = d.cfg.Airtime
+	}
+	waited := false
+	for {
+		d.mu.Lock()
+		d.refillLocked()
+		if exempt || d.tokens >= need {
+			d.tokens -= cost
+			d.mu.Unlock()
+			if waited {
+				t.recordDutyCycle(false)
+			}
+			return nil
+		}
+		if d.cfg.Mode == DutyCycleReject {
+			d.mu.Unlock()
+			t.recordDutyCycle(true)
+			return proto.ErrDutyCycle
+		}
+		wait := (need - d.tokens) * time.Second / d.cfg.Airtime
+		d.mu.Unlock()
+		waited = true
+		time.Sleep(wait)
+	}
+}
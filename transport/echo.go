@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"sync/atomic"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// rxFunc reads one frame from the radio, as RadioRxMeta.RxMeta does.
+type rxFunc func(timeout time.Duration) (RxPacket, error)
+
+// readRx returns the rxFunc reading from d: its RxMeta if it has one, and
+// otherwise its Rx, with the strength of RadioRSSIReader if it has that.
+func readRx(d RadioDriver) rxFunc {
+	if m, ok := d.(RadioRxMeta); ok {
+		return m.RxMeta
+	}
+	return func(timeout time.Duration) (RxPacket, error) {
+		data, err := d.Rx(timeout)
+		if err != nil {
+			return RxPacket{}, err
+		}
+		p := RxPacket{Data: data, HWCRCOK: true}
+		if s, ok := d.(RadioRSSIReader); ok {
+			p.RSSI, _ = s.RSSI()
+		}
+		return p, nil
+	}
+}
+
+// decodeOthers reads and decodes frames with rx until one arrives that was not
+// sent by self, or timeout passes. Frames from self are heard on drivers
+// and setups that loop transmissions back; they are dropped and counted in
+// echoes. Every packet read is passed to heard, with nil for a frame that
+// did not decode or failed the hardware CRC. Frames are stamped with the RSSI and
+// time of their packet.
+func decodeOthers(rx rxFunc, cfg proto.Config, self proto.DeviceID, echoes *atomic.Uint64, heard func(RxPacket, *proto.Frame), timeout time.Duration) *proto.Frame {
+	deadline := time.Now().Add(timeout)
+	for {
+		p, err := rx(timeout)
+		if err != nil {
+			return nil
+		}
+		var frame *proto.Frame
+		if p.HWCRCOK {
+			frame = cfg.DecodeFrame(p.Data)
+		}
+		if frame != nil {
+			frame.Received, frame.RSSI, frame.Pipe = p.Timestamp, p.RSSI, p.Pipe
+			if frame.Received.IsZero() {
+				frame.Received = time.Now()
+			}
+		}
+		heard(p, frame)
+		if frame == nil || frame.SenderID != self {
+			return frame
+		}
+		echoes.Add(1)
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return nil
+		}
+	}
+}
+
+// EchoedFrames returns how many of its own frames the receiver heard back
+// from the radio, or was handed by ProcessFrame, and dropped.
+func (r *Receiver) EchoedFrames() uint64 {
+	return r.echoes.Load()
+}
+
+// EchoedFrames returns how many of its own frames the transmitter heard
+// back from the radio and dropped.
+func (t *Transmitter) EchoedFrames() uint64 {
+	return t.echoes.Load()
+}
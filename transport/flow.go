@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DefaultPauseTimeout is how long PauseDevice holds a transmitter's data
+// back if ResumeDevice never gets through.
+const DefaultPauseTimeout = 30 * time.Second
+
+// flowWindow is how many downlink sequence numbers back a pause or resume
+// is taken for a retransmission of one already acted on.
+const flowWindow = 64
+
+// flowControl is the pause state of a transmitter, see PauseDevice.
+type flowControl struct {
+	mu    sync.Mutex
+	until time.Time // paused before this time
+	valid bool      // seq holds the last pause or resume acted on
+	seq   uint32
+}
+
+// PauseDevice asks the paired transmitter id to hold back its data frames,
+// for instance while the sink the receiver writes them to catches up. The
+// transmitter keeps heartbeating. The command is repeated until the
+// transmitter ACKs it, as SendDataTo does; the transmitter resumes by
+// itself after DefaultPauseTimeout in case ResumeDevice never reaches it.
+func (r *Receiver) PauseDevice(id proto.DeviceID) error {
+	return r.PauseDeviceFor(id, DefaultPauseTimeout)
+}
+
+// PauseDeviceFor is PauseDevice with a safety timeout other than
+// DefaultPauseTimeout.
+func (r *Receiver) PauseDeviceFor(id proto.DeviceID, timeout time.Duration) error {
+	var args [4]byte
+	binary.LittleEndian.PutUint32(args[:], uint32(timeout.Milliseconds()))
+	until := time.Now().Add(timeout)
+	if err := r.sendDownlink(id, proto.FrameTypeControl, func(*proto.Device) []byte {
+		return proto.EncodeControl(proto.ControlPause, id, args[:])
+	}); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if r.paused == nil {
+		r.paused = make(map[proto.DeviceID]time.Time)
+	}
+	r.paused[id] = until
+	r.mu.Unlock()
+	log.Printf("[Receiver] Device %d paused\r\n", id)
+	return nil
+}
+
+// ResumeDevice lets a transmitter paused by PauseDevice send data again.
+func (r *Receiver) ResumeDevice(id proto.DeviceID) error {
+	if err := r.sendDownlink(id, proto.FrameTypeControl, func(*proto.Device) []byte {
+		return proto.EncodeControl(proto.ControlResume, id, nil)
+	}); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	delete(r.paused, id)
+	r.mu.Unlock()
+	log.Printf("[Receiver] Device %d resumed\r\n", id)
+	return nil
+}
+
+// DevicePaused reports whether the transmitter id acknowledged a pause that
+// has neither been resumed nor timed out.
+func (r *Receiver) DevicePaused(id proto.DeviceID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok := r.paused[id]
+	return ok && time.Now().Before(until)
+}
+
+// Paused reports whether the receiver has paused the transmitter's data
+// frames, see Receiver.PauseDevice.
+func (t *Transmitter) Paused() bool {
+	t.flow.mu.Lock()
+	defer t.flow.mu.Unlock()
+	return time.Now().Before(t.flow.until)
+}
+
+// handleFlowControl acknowledges and acts on a pause or resume from the
+// paired receiver.
+func (t *Transmitter) handleFlowControl(frame *proto.Frame) {
+	if frame.Type != proto.FrameTypeControl || !t.device.IsPaired || frame.SenderID != t.receiver {
+		return
+	}
+	cmd, target, args, ok := proto.DecodeControl(frame.Payload)
+	if !ok || target != t.device.ID || (cmd != proto.ControlPause && cmd != proto.ControlResume) {
+		return
+	}
+	ack := t.newFrame(proto.FrameTypeAck, frame.Seq, proto.EncodeAddressed(t.device.ID, nil))
+	if err := t.tx(t.linkConfig().EncodeFrame(ack)); err != nil {
+		log.Printf("[Transmitter] ACK for control seq=%d failed: %v\r\n", frame.Seq, err)
+	}
+
+	f := &t.flow
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d := int32(frame.Seq - f.seq); f.valid && d <= 0 && -d < flowWindow {
+		return // a repeat after a lost ACK, or overtaken by a later command
+	}
+	f.valid, f.seq = true, frame.Seq
+	if cmd == proto.ControlResume {
+		f.until = time.Time{}
+		log.Printf("[Transmitter] Resumed by receiver %d\r\n", frame.SenderID)
+		return
+	}
+	timeout := DefaultPauseTimeout
+	if len(args) >= 4 {
+		timeout = time.Duration(binary.LittleEndian.Uint32(args)) * time.Millisecond
+	}
+	f.until = time.Now().Add(timeout)
+	log.Printf("[Transmitter] Paused by receiver %d for up to %v\r\n", frame.SenderID, timeout)
+}
+
+// awaitResume holds a data send while the receiver has the transmitter
+// paused, receiving frames itself unless the listen loop does, so that the
+// resume is heard.
+func (t *Transmitter) awaitResume(ctx context.Context) error {
+	for t.Paused() {
+		if t.isClosed() {
+			return proto.ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if t.listening() != nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if frame := t.ReceiveFrame(20 * time.Millisecond); frame != nil {
+			t.handleUnpair(frame)
+		}
+	}
+	return nil
+}
+
+// resetFlow forgets a pause, once the transmitter is unpaired.
+func (t *Transmitter) resetFlow() {
+	t.flow.mu.Lock()
+	t.flow.until, t.flow.valid = time.Time{}, false
+	t.flow.mu.Unlock()
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"context"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// fragmentRetries is how many times each fragment is sent before
+// SendDataLarge gives up.
+const fragmentRetries = 5
+
+// SendDataLarge sends a message of any size up to MaxFragments frames.
+// Messages that fit in one frame are sent like SendData; larger ones are
+// split into fragments, each sent reliably, and reassembled by the receiver,
+// which delivers them as a single data frame. Splitting requires a receiver
+// with CapFragmentation and returns ErrUnsupported otherwise.
+func (t *Transmitter) SendDataLarge(data []byte) error {
+	if err := t.soleReceiver(); err != nil {
+		return err
+	}
+	if !t.device.IsPaired {
+		return proto.ErrNotPaired
+	}
+	if len(data) <= t.maxPayload() {
+		_, err := t.SendData(data)
+		return err
+	}
+	if !t.device.HasCapability(proto.CapFragmentation) {
+		return proto.ErrUnsupported
+	}
+
+	t.msgID++
+	frags, ok := proto.SplitMessage(data, t.msgID, t.maxPayload())
+	if !ok {
+		return proto.ErrInvalidPayload
+	}
+	for _, frag := range frags {
+		if _, _, err := t.sendReliable(context.Background(), proto.FrameTypeFragment, frag, fragmentRetries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reassembly collects the fragments of one message.
+type reassembly struct {
+	msgID byte
+	parts [][]byte
+	got   int
+}
+
+// fragmentLocked stores a fragment from a paired device and returns the
+// whole message once its last fragment has arrived. Fragments of a new
+// message discard an unfinished one.
+func (r *Receiver) fragmentLocked(frame *proto.Frame) []byte {
+	msgID, index, count, chunk, ok := proto.DecodeFragment(frame.Payload)
+	if !ok {
+		return nil
+	}
+	a := r.assembly[frame.SenderID]
+	if a == nil || a.msgID != msgID || len(a.parts) != int(count) {
+		a = &reassembly{msgID: msgID, parts: make([][]byte, count)}
+		r.assembly[frame.SenderID] = a
+	}
+	if a.parts[index] != nil {
+		return nil // retransmission of a fragment whose ACK was lost
+	}
+	a.parts[index] = append([]byte{}, chunk...)
+	a.got++
+	if a.got < len(a.parts) {
+		return nil
+	}
+
+	delete(r.assembly, frame.SenderID)
+	var msg []byte
+	for _, p := range a.parts {
+		msg = append(msg, p...)
+	}
+	return msg
+}
@@ -0,0 +1,38 @@
+package transport
+
+import (
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// SetMaxFrameAge makes the receiver drop frames whose callbacks would run
+// more than d after the frame was received, see Frame.Received, for
+// instance because the queue of WithDispatchPool backed up behind a slow
+// callback. Dropped frames are counted by StaleFrames; their ACKs have
+// already been sent. Zero, the default, delivers frames however old.
+func (r *Receiver) SetMaxFrameAge(d time.Duration) {
+	r.maxFrameAge.Store(int64(d))
+}
+
+// StaleFrames returns how many frames were dropped because they were older
+// than SetMaxFrameAge allows when their callbacks were due.
+func (r *Receiver) StaleFrames() uint64 {
+	r.stats.mu.Lock()
+	defer r.stats.mu.Unlock()
+	return r.stats.s.StaleFrames
+}
+
+// dispatchFresh hands f to cbs unless it is too old.
+func (r *Receiver) dispatchFresh(cbs []*frameCallback, f *proto.Frame, dup bool, onError func(error)) {
+	limit := time.Duration(r.maxFrameAge.Load())
+	if limit > 0 && !f.Received.IsZero() {
+		if age := time.Since(f.Received); age > limit {
+			r.recordStale()
+			log.Printf("[Receiver] Frame seq=%d from %d dropped, %v old\r\n", f.Seq, f.SenderID, age)
+			return
+		}
+	}
+	dispatch(cbs, f, dup, onError)
+}
@@ -0,0 +1,56 @@
+package transport
+
+import proto "github.com/ystepanoff/nrfcomm/protocol"
+
+// SetHealthProvider attaches a health report to every heartbeat, read from
+// provider just before the heartbeat is sent. The provider is called while
+// the heartbeat frame is built, so it must not send on the transmitter
+// itself. ErrInvalidPayload is returned if frames are too small to
+// carry a report next to a rolling code. Pass nil to send empty heartbeats
+// again.
+func (t *Transmitter) SetHealthProvider(provider func() proto.HealthReport) error {
+	if provider != nil && proto.RollingTLVSize+proto.HealthTLVSize > t.maxPayload() {
+		return proto.ErrInvalidPayload
+	}
+	t.txMu.Lock()
+	t.health = provider
+	t.txMu.Unlock()
+	return nil
+}
+
+// OnHealthReport registers a handler called with every health report a
+// paired transmitter sends in a heartbeat. The handler runs without the
+// receiver locked, after the heartbeat's ACK if one is sent. Pass nil to
+// remove the handler.
+func (r *Receiver) OnHealthReport(h func(id proto.DeviceID, report proto.HealthReport)) {
+	r.mu.Lock()
+	r.healthHandler = h
+	r.mu.Unlock()
+}
+
+// Health returns the health report of the given transmitter's last
+// heartbeat. It reports false if the transmitter is not paired or has not
+// sent a report yet.
+func (r *Receiver) Health(id proto.DeviceID) (proto.HealthReport, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dev, ok := r.pairedDevices[id]
+	if !ok || dev.Health == nil {
+		return proto.HealthReport{}, false
+	}
+	return *dev.Health, true
+}
+
+// healthLocked records the health report carried by a heartbeat of dev.
+func (r *Receiver) healthLocked(res *frameResult, frame *proto.Frame, dev *proto.Device) {
+	report, ok := proto.ParseHealth(frame.Payload)
+	if !ok {
+		return
+	}
+	dev.Health = &report
+	if h := r.healthHandler; h != nil {
+		id := dev.ID
+		res.events = append(res.events, func() { h(id, report) })
+	}
+}
@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// startPairing pairs with receiverID, on the fixed pairing channel if the
+// transmitter has one. It stays wherever the exchange leaves it, normally
+// the receiver's operating channel, and returns to the link it was on if
+// pairing fails.
+func (t *Transmitter) startPairing(ctx context.Context, receiverID proto.DeviceID, opts PairingOptions) error {
+	if t.isClosed() {
+		return proto.ErrClosed
+	}
+	if !t.hop {
+		return t.pair(ctx, receiverID, opts)
+	}
+	prev := linkOf(t.device)
+	if err := t.leaveDataLink(); err != nil {
+		return err
+	}
+	l := linkOf(t.device)
+	l.channel = t.pairingChannel
+	err := t.tuneLink(l)
+	if err == nil {
+		err = t.pair(ctx, receiverID, opts)
+	}
+	if err != nil {
+		t.onDataLink = false
+		_ = t.tuneLink(prev)
+	}
+	return err
+}
+
+// hopToPairingChannel moves the receiver's pairing link to its fixed
+// pairing channel, directing transmitters to the channel it operated on
+// unless a data channel is set, and returns the function moving it back.
+func (r *Receiver) hopToPairingChannel() (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	op := r.device.Channel
+	hadData, data := r.hasDataChannel, r.dataChannel
+	if !hadData {
+		r.dataChannel, r.hasDataChannel = op, true
+	}
+	if err := r.setPairingChannelLocked(r.pairingChannel); err != nil {
+		r.hasDataChannel, r.dataChannel = hadData, data
+		return nil, err
+	}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.hasDataChannel, r.dataChannel = hadData, data
+		_ = r.setPairingChannelLocked(op)
+	}, nil
+}
+
+// setPairingChannelLocked moves the pairing link to ch, retuning the radio
+// if it listens there.
+func (r *Receiver) setPairingChannelLocked(ch uint8) error {
+	if r.tuned == linkOf(r.device) {
+		l := r.tuned
+		l.channel = ch
+		if err := retune(r.driver, r.tuned, l); err != nil {
+			return err
+		}
+		r.tuned = l
+	}
+	r.device.Channel = ch
+	return nil
+}
+
+// finishPairing keeps serving the pairing link until the transmitters
+// paired on it have completed their exchange there, i.e. confirmed their
+// session key, or until deadline.
+func (r *Receiver) finishPairing(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		busy := len(r.confirmations) > 0
+		for _, d := range r.switching {
+			busy = busy || d.IsZero()
+		}
+		r.mu.Unlock()
+		if !busy {
+			return
+		}
+		if frame := r.pollFrame(); frame != nil && frame.Type == proto.FrameTypeControl {
+			r.ProcessFrame(frame)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// Defaults of ChannelHoppingConfig.
+const (
+	defaultHopWindow    = 20
+	defaultHopThreshold = 0.5
+	defaultHopRetries   = 5
+)
+
+// HopEventKind says what a HopEvent reports.
+type HopEventKind uint8
+
+const (
+	HopStarted HopEventKind = iota + 1 // the failure ratio crossed the threshold on Channel
+	HopFailed                          // the receiver could not be reached about or on Channel
+	HopMoved                           // the link moved to Channel
+	HopHome                            // no candidate worked; the link is on the home Channel
+)
+
+// HopEvent reports a step of the channel hopping supervisor.
+type HopEvent struct {
+	Kind    HopEventKind
+	Channel uint8
+}
+
+// ChannelHoppingConfig configures EnableChannelHopping.
+type ChannelHoppingConfig struct {
+	// Channels are the candidates to move to, tried in order.
+	Channels []uint8
+
+	// Window is how many of the last reliable sends the failure ratio is
+	// taken over, 20 by default.
+	Window int
+
+	// Threshold is the share of failed sends in the window that starts a
+	// hunt, 0.5 by default.
+	Threshold float64
+
+	// Retries is how often a switch is proposed before the receiver is
+	// considered unreachable, 5 times by default.
+	Retries int
+}
+
+// channelHopping is the state of EnableChannelHopping.
+type channelHopping struct {
+	mu       sync.Mutex
+	enabled  bool
+	cfg      ChannelHoppingConfig
+	failed   []bool // ring of the outcomes of the last reliable sends
+	next     int    // slot of failed to overwrite next
+	n        int    // entries of failed in use
+	failures int    // true entries of failed
+	hunting  bool
+	handler  func(HopEvent)
+}
+
+// EnableChannelHopping makes the transmitter move its link to another
+// channel when the current one degrades, for instance because a Wi-Fi
+// network started using it. Once the share of reliable sends that time out
+// over the window reaches the threshold, the transmitter walks the
+// candidate channels: it proposes each to the receiver, and if the receiver
+// ACKs, both move there and the link is checked. A candidate where the
+// receiver cannot be reached is abandoned for the next one; if none works,
+// the link returns to the channel the transmitter paired on.
+//
+// The hunt runs on the goroutine of the send that crossed the threshold,
+// after that send's outcome is known, and can take a second or more per
+// candidate. The receiver must announce CapChannelSwitch, and only a
+// transmitter paired with a single receiver hops.
+func (t *Transmitter) EnableChannelHopping(cfg ChannelHoppingConfig) error {
+	for _, ch := range cfg.Channels {
+		if ch > 125 {
+			return proto.ErrInvalidChannel
+		}
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = defaultHopWindow
+	}
+	if cfg.Threshold <= 0 || cfg.Threshold > 1 {
+		cfg.Threshold = defaultHopThreshold
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = defaultHopRetries
+	}
+	cfg.Channels = append([]uint8(nil), cfg.Channels...)
+
+	h := &t.hopping
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.enabled = true
+	h.cfg = cfg
+	h.failed = make([]bool, cfg.Window)
+	h.resetLocked()
+	return nil
+}
+
+// DisableChannelHopping stops watching the failure ratio. A hunt in
+// progress runs to completion.
+func (t *Transmitter) DisableChannelHopping() {
+	t.hopping.mu.Lock()
+	t.hopping.enabled = false
+	t.hopping.mu.Unlock()
+}
+
+// OnChannelHop registers a handler for the steps of channel hopping. It
+// runs on the goroutine doing the hunt. Pass nil to remove the handler.
+func (t *Transmitter) OnChannelHop(h func(HopEvent)) {
+	t.hopping.mu.Lock()
+	t.hopping.handler = h
+	t.hopping.mu.Unlock()
+}
+
+func (h *channelHopping) resetLocked() {
+	for i := range h.failed {
+		h.failed[i] = false
+	}
+	h.next, h.n, h.failures = 0, 0, 0
+}
+
+// noteHopping adds the outcome of a reliable send to the window and hunts
+// for another channel if too many of them failed.
+func (t *Transmitter) noteHopping(ctx context.Context, err error) {
+	if err != nil && err != proto.ErrTimeout {
+		return
+	}
+	h := &t.hopping
+	h.mu.Lock()
+	if !h.enabled || h.hunting {
+		h.mu.Unlock()
+		return
+	}
+	if h.n == len(h.failed) {
+		if h.failed[h.next] {
+			h.failures--
+		}
+	} else {
+		h.n++
+	}
+	h.failed[h.next] = err != nil
+	if err != nil {
+		h.failures++
+	}
+	h.next = (h.next + 1) % len(h.failed)
+	if h.n < len(h.failed) || float64(h.failures) < h.cfg.Threshold*float64(h.n) {
+		h.mu.Unlock()
+		return
+	}
+	h.hunting = true
+	cfg := h.cfg
+	h.mu.Unlock()
+
+	if t.device.IsPaired && !t.hasPeers() && t.device.HasCapability(proto.CapChannelSwitch) {
+		t.huntChannel(ctx, cfg)
+	}
+
+	h.mu.Lock()
+	h.resetLocked()
+	h.hunting = false
+	h.mu.Unlock()
+}
+
+// huntChannel walks the candidate channels until the link works on one,
+// returning to the home channel if none does.
+func (t *Transmitter) huntChannel(ctx context.Context, cfg ChannelHoppingConfig) {
+	from, home := t.device.Channel, t.device.Channel
+	if t.onDataLink {
+		home = t.pairingLink.channel
+	}
+	log.Printf("[Transmitter] Link on channel %d degraded, looking for another\r\n", from)
+	t.emitHop(HopStarted, from)
+
+	for _, ch := range cfg.Channels {
+		if ch == t.device.Channel {
+			continue
+		}
+		err := t.hopTo(ctx, ch, cfg.Retries)
+		if err == nil {
+			log.Printf("[Transmitter] Link moved to channel %d\r\n", ch)
+			t.emitHop(HopMoved, ch)
+			return
+		}
+		log.Printf("[Transmitter] Channel %d not usable: %v\r\n", ch, err)
+		if t.ctxErr(ctx) != nil || !t.device.IsPaired {
+			return
+		}
+		t.emitHop(HopFailed, ch)
+	}
+
+	if t.device.Channel != home {
+		if err := t.hopTo(ctx, home, cfg.Retries); err != nil {
+			log.Printf("[Transmitter] Returning to channel %d failed: %v\r\n", home, err)
+			t.emitHop(HopFailed, home)
+			return
+		}
+	}
+	log.Printf("[Transmitter] No channel better, link on channel %d\r\n", home)
+	t.emitHop(HopHome, home)
+}
+
+// hopTo proposes channel ch to the receiver and, once it agrees, moves
+// there and checks the link. If the check fails the transmitter goes back,
+// as does the receiver when it does not hear the transmitter on ch within
+// its grace period.
+func (t *Transmitter) hopTo(ctx context.Context, ch uint8, retries int) error {
+	seq := t.nextSeq()
+	frame := t.newFrame(proto.FrameTypeControl, seq, proto.EncodeControl(proto.ControlChannelSwitch, t.receiver, []byte{ch}))
+	if _, _, err := t.transmitUntilAcked(ctx, t.linkConfig().EncodeFrame(frame), seq, retries); err != nil {
+		return err
+	}
+
+	prev := linkOf(t.device)
+	to := prev
+	to.channel = ch
+	if !t.onDataLink {
+		t.pairingLink, t.onDataLink = prev, true
+	}
+	if err := t.tuneLink(to); err != nil {
+		return err
+	}
+	if err := t.checkLink(); err != nil {
+		if terr := t.tuneLink(prev); terr != nil {
+			return terr
+		}
+		return err
+	}
+	t.saveBond()
+	return nil
+}
+
+func (t *Transmitter) emitHop(kind HopEventKind, ch uint8) {
+	t.hopping.mu.Lock()
+	h := t.hopping.handler
+	t.hopping.mu.Unlock()
+	if h != nil {
+		h(HopEvent{Kind: kind, Channel: ch})
+	}
+}
+
+// pendingHop is a channel switch a transmitter asked the receiver for. It
+// is undone unless the transmitter is heard on the new channel within
+// channelGracePeriod.
+type pendingHop struct {
+	deadline       time.Time
+	prev           link // the device's link before the switch
+	dataChannel    uint8
+	hasDataChannel bool
+}
+
+// channelSwitchLocked moves the link of dev, and the receiver's data link
+// with it, to the channel a ControlChannelSwitch asks for, and ACKs. The
+// switch is refused, without an ACK, if other transmitters use the data
+// link.
+func (r *Receiver) channelSwitchLocked(frame *proto.Frame, dev *proto.Device, args []byte) {
+	if dev == nil || len(args) != 1 || args[0] > 125 {
+		return
+	}
+	ch := args[0]
+	from := linkOf(dev)
+	if from.channel != ch {
+		data := r.dataLinkLocked()
+		if from.address != data.address || from.prefix != data.prefix {
+			log.Printf("[Receiver] Channel switch from %d refused: not on the data link\r\n", dev.ID)
+			return
+		}
+		if data != linkOf(r.device) {
+			for id, other := range r.pairedDevices {
+				if id != dev.ID && linkOf(other) == data {
+					log.Printf("[Receiver] Channel switch from %d refused: channel %d shared with %d\r\n", dev.ID, data.channel, id)
+					return
+				}
+			}
+		}
+		if _, ok := r.hops[dev.ID]; !ok {
+			r.hops[dev.ID] = &pendingHop{prev: from, dataChannel: r.dataChannel, hasDataChannel: r.hasDataChannel}
+		}
+		r.hops[dev.ID].deadline = time.Now().Add(channelGracePeriod)
+		r.dataChannel, r.hasDataChannel = ch, true
+		dev.Channel = ch
+		log.Printf("[Receiver] Device %d moving to channel %d\r\n", dev.ID, ch)
+	}
+	_ = r.sendAck(frame.Seq, nil)
+}
+
+// hopHeardLocked completes the channel switch of id once a frame from it
+// arrives on its new link.
+func (r *Receiver) hopHeardLocked(id proto.DeviceID) {
+	if _, ok := r.hops[id]; !ok {
+		return
+	}
+	if dev := r.pairedDevices[id]; r.tuned == linkOf(dev) {
+		delete(r.hops, id)
+		r.saveBondLocked(dev)
+	}
+}
+
+// expireHopsLocked undoes the channel switches of transmitters not heard on
+// their new channel in time.
+func (r *Receiver) expireHopsLocked(now time.Time) {
+	for id, hop := range r.hops {
+		if now.Before(hop.deadline) {
+			continue
+		}
+		delete(r.hops, id)
+		r.dataChannel, r.hasDataChannel = hop.dataChannel, hop.hasDataChannel
+		if dev, ok := r.pairedDevices[id]; ok {
+			log.Printf("[Receiver] Device %d not heard on channel %d, back to %d\r\n", id, dev.Channel, hop.prev.channel)
+			hop.prev.apply(dev)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// IdlePolicy decides what the radio of a Transmitter does between sends.
+type IdlePolicy uint8
+
+const (
+	IdleAwake IdlePolicy = iota // the radio stays powered, the default
+	IdleSleep                   // the radio is powered down between sends
+)
+
+// idleState is the state of SetIdlePolicy.
+type idleState struct {
+	mu      sync.Mutex
+	policy  IdlePolicy
+	latency time.Duration // wait after waking before the radio is used
+	sleeper RadioSleeper  // nil if the driver cannot sleep
+	users   int           // sends and listen loops that need the radio
+	asleep  bool
+}
+
+// SetIdlePolicy sets what the radio does between sends. With IdleSleep the
+// radio is woken for each send, stays awake until the send's ACK arrived or
+// was given up on, and is put to sleep again; wakeLatency is waited after
+// waking, for drivers whose radio needs time to settle. The heartbeat task
+// and pairing follow the same policy, while Listen keeps the radio awake
+// until Stop. It needs a driver that implements RadioSleeper; with others
+// IdleSleep keeps the radio awake.
+func (t *Transmitter) SetIdlePolicy(p IdlePolicy, wakeLatency time.Duration) {
+	s := &t.idle
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p == IdleSleep && s.sleeper == nil {
+		var ok bool
+		if s.sleeper, ok = t.driver.(RadioSleeper); !ok {
+			log.Printf("[Transmitter] Driver cannot sleep, radio stays awake\r\n")
+			return
+		}
+	}
+	s.policy, s.latency = p, wakeLatency
+	switch {
+	case p == IdleSleep && s.users == 0 && !s.asleep:
+		s.sleepLocked()
+	case p == IdleAwake && s.asleep:
+		s.wakeLocked()
+	}
+}
+
+// awake makes sure the radio is powered and keeps it so until the returned
+// function is called. Calls may nest; the radio goes back to sleep when the
+// outermost one is done.
+func (t *Transmitter) awake() func() {
+	s := &t.idle
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users++
+	if s.asleep {
+		s.wakeLocked()
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.users--
+		if s.users == 0 && s.policy == IdleSleep {
+			s.sleepLocked()
+		}
+	}
+}
+
+func (s *idleState) sleepLocked() {
+	if err := s.sleeper.Sleep(); err != nil {
+		log.Printf("[Transmitter] Radio sleep failed: %v\r\n", err)
+		return
+	}
+	s.asleep = true
+}
+
+func (s *idleState) wakeLocked() {
+	if err := s.sleeper.Wake(); err != nil {
+		log.Printf("[Transmitter] Radio wake failed: %v\r\n", err)
+		return
+	}
+	s.asleep = false
+	if s.latency > 0 {
+		time.Sleep(s.latency)
+	}
+}
@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DefaultMaxPairedDevices is the number of transmitters a receiver pairs
+// with before applying its eviction policy.
+const DefaultMaxPairedDevices = 8
+
+// EvictionPolicy decides what a receiver does with a pairing request from a
+// new transmitter once it is paired with as many as it may be.
+type EvictionPolicy uint8
+
+const (
+	// RejectNewDevices answers the request with a reject; paired
+	// transmitters are kept.
+	RejectNewDevices EvictionPolicy = iota
+
+	// EvictLeastRecentlySeen unpairs the transmitter heard from least
+	// recently to make room.
+	EvictLeastRecentlySeen
+)
+
+// SetMaxPairedDevices limits the receiver to n paired transmitters, counting
+// those waiting for the user to confirm a pairing, and sets what happens to
+// pairing requests beyond it. Zero or less removes the limit. Devices
+// already paired are kept even if they exceed a lowered limit.
+func (r *Receiver) SetMaxPairedDevices(n int, policy EvictionPolicy) {
+	r.mu.Lock()
+	r.maxDevices = n
+	r.eviction = policy
+	r.mu.Unlock()
+}
+
+// MaxPairedDevices returns the limit set by SetMaxPairedDevices, zero if
+// there is none.
+func (r *Receiver) MaxPairedDevices() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxDevices < 0 {
+		return 0
+	}
+	return r.maxDevices
+}
+
+// PairedDeviceCount returns the number of paired transmitters.
+func (r *Receiver) PairedDeviceCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pairedDevices)
+}
+
+// SetEvictionHandler registers a handler called with the ID of every
+// transmitter unpaired to make room for a new one. It runs without the
+// receiver locked, once the evicted transmitter has been told. Pass nil to
+// remove the handler.
+func (r *Receiver) SetEvictionHandler(h func(id proto.DeviceID)) {
+	r.mu.Lock()
+	r.evictionHandler = h
+	r.mu.Unlock()
+}
+
+// makeRoomLocked reports whether a new transmitter may pair, evicting the
+// least recently seen one if the policy allows. The evicted transmitter is
+// told once the receiver is unlocked.
+func (r *Receiver) makeRoomLocked(res *frameResult) bool {
+	if r.maxDevices <= 0 || len(r.pairedDevices)+len(r.confirmations) < r.maxDevices {
+		return true
+	}
+	if r.eviction != EvictLeastRecentlySeen {
+		return false
+	}
+	var victim *proto.Device
+	for _, dev := range r.pairedDevices {
+		if victim == nil || dev.LastSeen < victim.LastSeen {
+			victim = dev
+		}
+	}
+	if victim == nil {
+		return false // every slot awaits a confirmation
+	}
+
+	delete(r.pairedDevices, victim.ID)
+	delete(r.pairingAcks, victim.ID)
+	delete(r.devStats, victim.ID)
+	delete(r.paused, victim.ID)
+	r.deleteBondLocked(victim.ID)
+	log.Printf("[Receiver] Device %d evicted\r\n", victim.ID)
+	r.deviceEventLocked(DeviceUnpaired, victim.ID)
+	id, h := victim.ID, r.evictionHandler
+	res.events = append(res.events, func() {
+		_ = r.sendControl(0, proto.ControlUnpair, id, nil)
+		if h != nil {
+			h(id)
+		}
+	})
+	return true
+}
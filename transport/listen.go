@@ -0,0 +1,153 @@
+package transport
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// listenBacklog bounds the frames the listen loop holds for ReceiveFrame.
+// Older frames are discarded when nobody collects them.
+const listenBacklog = 16
+
+// ackHistory is how many acknowledged sequence numbers are remembered to
+// report each one to the ACK handler only once.
+const ackHistory = 32
+
+// txListener is the state of Transmitter.Listen.
+type txListener struct {
+	mu   sync.Mutex
+	rx   chan *proto.Frame // nil when not listening
+	stop chan struct{}
+	done chan struct{}
+}
+
+// ackDispatch passes incoming ACKs to the handler set by SetAckHandler.
+type ackDispatch struct {
+	mu      sync.Mutex
+	handler func(seq uint32, payload []byte)
+	recent  [ackHistory]uint32 // ring of the sequence numbers reported last
+	n       int                // entries of recent in use
+	next    int                // slot of recent to overwrite next
+}
+
+// SetAckHandler registers a handler called with the sequence number of
+// every ACK received from the paired receiver and the TLV extensions that
+// follow the receiver ID in its payload, such as a reply. It is called
+// once per sequence number however often the ACK is repeated, on the
+// goroutine that received it, which is the listen loop while Listen is
+// active. Pass nil to remove the handler.
+func (t *Transmitter) SetAckHandler(h func(seq uint32, payload []byte)) {
+	t.acks.mu.Lock()
+	t.acks.handler = h
+	t.acks.mu.Unlock()
+}
+
+// Listen starts a goroutine that keeps the radio receiving while the
+// transmitter is otherwise idle, so that ACKs reach the SetAckHandler
+// handler and unpair notices are acted on between sends. Frames it receives
+// are handed on to ReceiveFrame, which the pairing and reliable send paths
+// keep using as before. Calling Listen again does nothing.
+func (t *Transmitter) Listen() {
+	l := &t.listener
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rx != nil {
+		return
+	}
+	l.rx = make(chan *proto.Frame, listenBacklog)
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go t.listenLoop(l.rx, l.stop, l.done)
+	log.Printf("[Transmitter] Listening\r\n")
+}
+
+// Stop ends the listen loop started by Listen and returns once it has
+// exited. The radio is only read again by calls that wait for a reply.
+func (t *Transmitter) Stop() {
+	l := &t.listener
+	l.mu.Lock()
+	stop, done := l.stop, l.done
+	l.rx, l.stop, l.done = nil, nil, nil
+	l.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	log.Printf("[Transmitter] Stopped listening\r\n")
+}
+
+// listenLoop reads the radio until stop is closed, passing frames on to rx.
+func (t *Transmitter) listenLoop(rx chan *proto.Frame, stop, done chan struct{}) {
+	defer close(done)
+	defer t.awake()()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		frame := t.readFrame(20 * time.Millisecond)
+		if frame == nil || t.handleUnpair(frame) {
+			continue
+		}
+		for {
+			select {
+			case rx <- frame:
+			default:
+				// Make room by discarding the oldest frame.
+				select {
+				case <-rx:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// listening returns the channel the listen loop delivers frames on, or nil
+// if it is not running.
+func (t *Transmitter) listening() chan *proto.Frame {
+	t.listener.mu.Lock()
+	defer t.listener.mu.Unlock()
+	return t.listener.rx
+}
+
+// dispatchAck passes ack to the ACK handler unless its sequence number was
+// reported before.
+func (t *Transmitter) dispatchAck(ack *proto.Frame) {
+	if ack.SenderID != t.receiver {
+		return
+	}
+	d := &t.acks
+	d.mu.Lock()
+	h := d.handler
+	if h == nil {
+		d.mu.Unlock()
+		return
+	}
+	for i := 0; i < d.n; i++ {
+		if d.recent[i] == ack.Seq {
+			d.mu.Unlock()
+			return
+		}
+	}
+	d.recent[d.next] = ack.Seq
+	d.next = (d.next + 1) % ackHistory
+	if d.n < ackHistory {
+		d.n++
+	}
+	d.mu.Unlock()
+
+	// The payload starts with the receiver ID; pass what follows it.
+	var payload []byte
+	if len(ack.Payload) > 4 {
+		payload = ack.Payload[4:]
+	}
+	h(ack.Seq, payload)
+}
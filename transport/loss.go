@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// maxLossGap is the smallest jump in sequence numbers taken for a restart of
+// the transmitter rather than for lost frames. A transmitter restored with
+// WithSeqState jumps at least this far past the last frame it sent, since it
+// checkpoints every seqCheckpointInterval frames and skips SeqJump.
+const maxLossGap = SeqJump - seqCheckpointInterval
+
+// lossTracker follows the sequence numbers of a paired transmitter to count
+// the frames that never arrived.
+type lossTracker struct {
+	valid bool
+	next  uint32 // sequence number expected next
+	lost  uint64 // kept across resets
+}
+
+// frameLoss is a gap reported to the OnFrameLoss handler.
+type frameLoss struct {
+	id           proto.DeviceID
+	first, count uint32
+}
+
+// OnFrameLoss registers a handler called when the frames of a paired
+// transmitter skip count sequence numbers from firstMissing on. Every frame
+// a transmitter sends takes a sequence number, so the count includes the
+// frames it sent to other receivers, if it is paired with several, and a
+// frame that arrives after the gap was reported is not taken back. The
+// handler runs on the goroutine processing frames without the receiver
+// locked. Pass nil to remove the handler.
+func (r *Receiver) OnFrameLoss(h func(id proto.DeviceID, firstMissing, count uint32)) {
+	r.mu.Lock()
+	r.lossHandler = h
+	r.mu.Unlock()
+}
+
+// LostFrames returns how many frames of the transmitter id the receiver
+// found missing from its sequence numbers, see OnFrameLoss.
+func (r *Receiver) LostFrames(id proto.DeviceID) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l := r.losses[id]; l != nil {
+		return l.lost
+	}
+	return 0
+}
+
+// lossLocked follows the sequence number of frame, from a paired
+// transmitter, and leaves a gap before it in res for the handler.
+func (r *Receiver) lossLocked(frame *proto.Frame, res *frameResult) {
+	if r.losses == nil {
+		r.losses = make(map[proto.DeviceID]*lossTracker)
+	}
+	l := r.losses[frame.SenderID]
+	if l == nil {
+		l = &lossTracker{}
+		r.losses[frame.SenderID] = l
+	}
+	d := int32(frame.Seq - l.next)
+	switch {
+	case !l.valid || d >= maxLossGap || -d >= maxLossGap:
+		// First frame, or the transmitter started over.
+		l.valid, l.next = true, frame.Seq+1
+	case d > 0:
+		log.Printf("[Receiver] Lost %d frames from %d before seq=%d\r\n", d, frame.SenderID, frame.Seq)
+		l.lost += uint64(d)
+		r.recordLoss(uint64(d))
+		if s := r.devStats[frame.SenderID]; s != nil {
+			s.Lost += uint64(d)
+		}
+		if r.lossHandler != nil {
+			res.loss = append(res.loss, frameLoss{frame.SenderID, l.next, uint32(d)})
+			res.onLoss = r.lossHandler
+		}
+		l.next = frame.Seq + 1
+	case d == 0:
+		l.next++
+	default:
+		// Late or repeated, already accounted for.
+	}
+}
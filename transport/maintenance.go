@@ -0,0 +1,69 @@
+package transport
+
+import "time"
+
+// StartMaintenance runs the receiver's periodic work every interval until
+// StopMaintenance is called: removing the devices that timed out, see
+// CleanupTimedOutDevices, and running the hook of SetStatsHook. An interval
+// of 0 or less means half of Config.DeviceTimeout. Calling it while the task
+// runs does nothing.
+func (r *Receiver) StartMaintenance(interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maintenanceStop != nil {
+		return
+	}
+	if interval <= 0 {
+		interval = r.config.DeviceTimeout / 2
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	r.maintenanceStop, r.maintenanceDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				r.maintain()
+			}
+		}
+	}()
+}
+
+// StopMaintenance stops the task started by StartMaintenance and waits for
+// it to exit. It does nothing if the task is not running.
+func (r *Receiver) StopMaintenance() {
+	r.mu.Lock()
+	stop, done := r.maintenanceStop, r.maintenanceDone
+	r.maintenanceStop, r.maintenanceDone = nil, nil
+	r.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// maintain does the periodic work of the maintenance task.
+func (r *Receiver) maintain() {
+	r.CleanupTimedOutDevices()
+	r.runStatsHook(time.Now())
+}
+
+// StartCleanupTask runs the maintenance task every half
+// Config.HeartbeatInterval.
+//
+// Deprecated: Use StartMaintenance.
+func (r *Receiver) StartCleanupTask() {
+	r.StartMaintenance(r.config.HeartbeatInterval / 2)
+}
+
+// StopCleanupTask stops the maintenance task.
+//
+// Deprecated: Use StopMaintenance.
+func (r *Receiver) StopCleanupTask() {
+	r.StopMaintenance()
+}
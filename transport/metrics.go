@@ -0,0 +1,164 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// RxStats are the counters of a receiver, accumulated since it was created.
+type RxStats struct {
+	// FramesReceived counts the frames read from the radio by frame type,
+	// indexed by the protocol.FrameType constants, whoever they were for.
+	FramesReceived  [proto.FrameTypeMask + 1]uint64 `json:"frames_received"`
+	BytesReceived   uint64                          `json:"bytes_received"`   // encoded bytes of those frames
+	CRCErrors       uint64                          `json:"crc_errors"`       // frames read that did not decode
+	HWCRCErrors     uint64                          `json:"hw_crc_errors"`    // of CRCErrors, those the radio's CRC rejected
+	FrameCRCErrors  uint64                          `json:"frame_crc_errors"` // of CRCErrors, those that failed to decode
+	Echoes          uint64                          `json:"echoes"`           // see EchoedFrames
+	Duplicates      uint64                          `json:"duplicates"`       // see DuplicateFrames
+	Lost            uint64                          `json:"lost"`             // see LostFrames
+	AcksSent        uint64                          `json:"acks_sent"`        // ACKs transmitted, repeats included
+	DownlinkRetries uint64                          `json:"downlink_retries"` // retransmissions of SendDataTo and other downlink frames
+	StaleFrames     uint64                          `json:"stale_frames"`     // see StaleFrames
+
+	// DispatchDrops counts the frames the queue of WithDispatchPool
+	// dropped, indexed by the DispatchPolicy in force, and
+	// DispatchDropsByType the same frames by frame type.
+	DispatchDrops       [DispatchBlock + 1]uint64       `json:"dispatch_drops"`
+	DispatchDropsByType [proto.FrameTypeMask + 1]uint64 `json:"dispatch_drops_by_type"`
+
+	PairedDevices int `json:"paired_devices"`
+
+	// Devices holds the counters of every transmitter that has any, see
+	// AllDeviceStats.
+	Devices map[proto.DeviceID]RxDeviceStats `json:"devices"`
+}
+
+// rxStats guards the counters so that they can be read while frames are
+// being received.
+type rxStats struct {
+	mu sync.Mutex
+	s  RxStats
+}
+
+// Stats returns a copy of the receiver's counters, with those of each
+// transmitter. It is safe to call while frames are being received.
+func (r *Receiver) Stats() RxStats {
+	r.mu.Lock()
+	paired := len(r.pairedDevices)
+	devices := make(map[proto.DeviceID]RxDeviceStats, len(r.devStats))
+	for id, s := range r.devStats {
+		devices[id] = *s
+	}
+	r.mu.Unlock()
+
+	r.stats.mu.Lock()
+	s := r.stats.s
+	r.stats.mu.Unlock()
+	s.Echoes = r.echoes.Load()
+	s.PairedDevices, s.Devices = paired, devices
+	return s
+}
+
+// Snapshot is what the hook of SetStatsHook is handed.
+type Snapshot struct {
+	Time  time.Time `json:"time"`
+	Stats RxStats   `json:"stats"`
+}
+
+// statsHook is the state of SetStatsHook, guarded by the receiver's mutex.
+type statsHook struct {
+	fn       func(Snapshot)
+	interval time.Duration
+	last     time.Time
+}
+
+// SetStatsHook registers a hook handed the receiver's Stats every interval,
+// for instance to publish them with expvar or to a Prometheus collector. It
+// runs on the maintenance task, see StartMaintenance, and so no more often
+// than the task does; an interval of 0 or less means every run. Pass nil to
+// remove the hook.
+func (r *Receiver) SetStatsHook(interval time.Duration, h func(Snapshot)) {
+	r.mu.Lock()
+	r.statsHook = statsHook{fn: h, interval: interval}
+	r.mu.Unlock()
+}
+
+// runStatsHook hands the hook a snapshot once its interval has passed.
+func (r *Receiver) runStatsHook(now time.Time) {
+	r.mu.Lock()
+	hook := &r.statsHook
+	h := hook.fn
+	due := h != nil && now.Sub(hook.last) >= hook.interval
+	if due {
+		hook.last = now
+	}
+	r.mu.Unlock()
+	if due {
+		h(Snapshot{Time: now, Stats: r.Stats()})
+	}
+}
+
+// recordRx counts a packet read from the radio, with frame nil if it
+// failed the hardware CRC or did not decode.
+func (r *Receiver) recordRx(p RxPacket, frame *proto.Frame) {
+	r.stats.mu.Lock()
+	defer r.stats.mu.Unlock()
+	if frame == nil {
+		r.stats.s.CRCErrors++
+		if p.HWCRCOK {
+			r.stats.s.FrameCRCErrors++
+		} else {
+			r.stats.s.HWCRCErrors++
+		}
+		return
+	}
+	r.stats.s.FramesReceived[frame.Type&proto.FrameTypeMask]++
+	r.stats.s.BytesReceived += uint64(len(p.Data))
+}
+
+// recordDuplicate counts a repeated data frame.
+func (r *Receiver) recordDuplicate() {
+	r.stats.mu.Lock()
+	r.stats.s.Duplicates++
+	r.stats.mu.Unlock()
+}
+
+// recordStale counts a frame dropped for its age, see SetMaxFrameAge.
+func (r *Receiver) recordStale() {
+	r.stats.mu.Lock()
+	r.stats.s.StaleFrames++
+	r.stats.mu.Unlock()
+}
+
+// recordDispatchDrop counts a frame of type typ dropped by the dispatch
+// queue under policy.
+func (r *Receiver) recordDispatchDrop(policy DispatchPolicy, typ byte) {
+	r.stats.mu.Lock()
+	r.stats.s.DispatchDrops[policy]++
+	r.stats.s.DispatchDropsByType[typ&proto.FrameTypeMask]++
+	r.stats.mu.Unlock()
+}
+
+// recordLoss counts n frames found missing.
+func (r *Receiver) recordLoss(n uint64) {
+	r.stats.mu.Lock()
+	r.stats.s.Lost += n
+	r.stats.mu.Unlock()
+}
+
+// recordAckSent counts an ACK about to be transmitted.
+func (r *Receiver) recordAckSent() {
+	r.stats.mu.Lock()
+	r.stats.s.AcksSent++
+	r.stats.mu.Unlock()
+}
+
+// recordDownlinkRetry counts a retransmission of a downlink frame.
+func (r *Receiver) recordDownlinkRetry() {
+	r.stats.mu.Lock()
+	r.stats.s.DownlinkRetries++
+	r.stats.mu.Unlock()
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// FrameHandler handles a frame received by a Receiver.
+type FrameHandler func(*proto.Frame)
+
+// Use adds mw to the middleware every received frame passes through before
+// the receiver handles it. The first middleware added is the outermost: it
+// sees the frame first and its next leads to the second, and the last one's
+// next is the receiver's own handling of pairing, heartbeats, ACKs and the
+// data callbacks. A middleware may inspect or replace the frame it passes
+// on, or drop it by not calling next, in which case the frame is neither
+// acknowledged nor delivered. next must be called before the handler
+// returns.
+//
+// mw wraps the handler of each frame anew, so a middleware keeps its state
+// outside of mw, as FrameRateLogger does. Middleware runs without the
+// receiver locked on the goroutine processing frames.
+func (r *Receiver) Use(mw func(next FrameHandler) FrameHandler) {
+	if mw == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Frames being processed hold the old list; never append in place.
+	r.middleware = append(r.middleware[:len(r.middleware):len(r.middleware)], mw)
+}
+
+// chain wraps h in mws, the first outermost.
+func chain(mws []func(FrameHandler) FrameHandler, h FrameHandler) FrameHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// FrameRateLogger returns a middleware logging how many frames the receiver
+// got, per frame type, once every interval in which any arrived.
+func FrameRateLogger(interval time.Duration) func(next FrameHandler) FrameHandler {
+	var mu sync.Mutex
+	counts := make(map[byte]int)
+	start := time.Now()
+	return func(next FrameHandler) FrameHandler {
+		return func(f *proto.Frame) {
+			mu.Lock()
+			counts[f.Type]++
+			if elapsed := time.Since(start); elapsed >= interval {
+				for ftype, n := range counts {
+					log.Printf("[Receiver] %d frames of type %d in %v (%.1f/s)\r\n", n, ftype, elapsed.Round(time.Millisecond), float64(n)/elapsed.Seconds())
+				}
+				counts = make(map[byte]int)
+				start = time.Now()
+			}
+			mu.Unlock()
+			next(f)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package transport
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// heartbeatAckWait is how long SendHeartbeat waits for the ACK of a
+// monitored heartbeat.
+const heartbeatAckWait = 200 * time.Millisecond
+
+// linkMonitor is the state of EnableLinkMonitor.
+type linkMonitor struct {
+	mu        sync.Mutex
+	threshold int    // 0: disabled
+	seq       uint32 // heartbeat awaiting its ACK
+	awaiting  bool
+	misses    int // consecutive heartbeats left unacknowledged
+	down      bool
+	onDown    func()
+	onUp      func()
+	acked     bool // the receiver ACKs every heartbeat, see WithHeartbeatAcks
+}
+
+// WithHeartbeatAcks makes a Receiver ACK every heartbeat, not only those of
+// transmitters running the link monitor, and tell transmitters so when they
+// pair. Their SendHeartbeat then waits up to 200 ms for the ACK, which
+// updates LastReceiverContact. It costs one small frame per transmitter and
+// heartbeat interval. The option has no effect on a Transmitter.
+func WithHeartbeatAcks() Option {
+	return func(o *options) { o.heartbeatAcks = true }
+}
+
+// LastReceiverContact returns when the transmitter last heard from its
+// receiver: an ACK, including that of a heartbeat, or any other frame. It
+// is zero if nothing has arrived since the transmitter was created.
+func (t *Transmitter) LastReceiverContact() time.Time {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	return t.stats.lastContact
+}
+
+// EnableLinkMonitor makes heartbeats ask the receiver for an ACK, so that
+// the transmitter learns whether anyone is listening. Once threshold
+// heartbeats in a row go unacknowledged the OnLinkDown handler is called,
+// and the OnLinkUp handler once ACKs resume. SendHeartbeat then blocks
+// until the ACK arrives, for up to 200 ms.
+func (t *Transmitter) EnableLinkMonitor(threshold int) {
+	if threshold < 1 {
+		threshold = 1
+	}
+	t.monitor.mu.Lock()
+	t.monitor.threshold = threshold
+	t.monitor.misses = 0
+	t.monitor.mu.Unlock()
+}
+
+// DisableLinkMonitor sends heartbeats without asking for ACKs again.
+func (t *Transmitter) DisableLinkMonitor() {
+	t.monitor.mu.Lock()
+	t.monitor.threshold = 0
+	t.monitor.awaiting = false
+	t.monitor.down = false
+	t.monitor.mu.Unlock()
+}
+
+// OnLinkDown registers a handler called when the link monitor gives up on
+// the receiver. It runs on the goroutine that sent the last heartbeat.
+// Pass nil to remove the handler.
+func (t *Transmitter) OnLinkDown(h func()) {
+	t.monitor.mu.Lock()
+	t.monitor.onDown = h
+	t.monitor.mu.Unlock()
+}
+
+// OnLinkUp registers a handler called when a heartbeat is acknowledged
+// after the link was reported down. It runs on the goroutine that received
+// the ACK. Pass nil to remove the handler.
+func (t *Transmitter) OnLinkUp(h func()) {
+	t.monitor.mu.Lock()
+	t.monitor.onUp = h
+	t.monitor.mu.Unlock()
+}
+
+// monitoring reports whether heartbeats ask for ACKs.
+func (t *Transmitter) monitoring() bool {
+	t.monitor.mu.Lock()
+	defer t.monitor.mu.Unlock()
+	return t.monitor.threshold > 0
+}
+
+// heartbeatAcked reports whether heartbeats are ACKed, because they ask or
+// because the receiver announced WithHeartbeatAcks.
+func (t *Transmitter) heartbeatAcked() bool {
+	t.monitor.mu.Lock()
+	defer t.monitor.mu.Unlock()
+	return t.monitor.threshold > 0 || t.monitor.acked
+}
+
+// noteHeartbeatAcks records from the extensions of a pairing ACK whether the
+// receiver ACKs every heartbeat.
+func (t *Transmitter) noteHeartbeatAcks(ext []byte) {
+	_, ok := proto.FindTLV(ext, proto.TagHeartbeat)
+	t.monitor.mu.Lock()
+	t.monitor.acked = ok
+	t.monitor.mu.Unlock()
+}
+
+// awaitHeartbeatAck waits for the ACK of the heartbeat numbered seq and
+// counts a miss if none arrives.
+func (t *Transmitter) awaitHeartbeatAck(seq uint32) {
+	m := &t.monitor
+	m.mu.Lock()
+	m.seq, m.awaiting = seq, true
+	m.mu.Unlock()
+
+	deadline := time.Now().Add(heartbeatAckWait)
+	for time.Now().Before(deadline) && !t.isClosed() {
+		m.mu.Lock()
+		acked := !m.awaiting || m.seq != seq
+		m.mu.Unlock()
+		if acked {
+			return
+		}
+		if frame := t.ReceiveFrame(20 * time.Millisecond); frame != nil {
+			t.handleUnpair(frame)
+		}
+	}
+
+	m.mu.Lock()
+	if !m.awaiting || m.seq != seq || m.threshold == 0 {
+		m.mu.Unlock()
+		return
+	}
+	m.awaiting = false
+	m.misses++
+	misses := m.misses
+	var h func()
+	if misses >= m.threshold && !m.down {
+		m.down = true
+		h = m.onDown
+	}
+	m.mu.Unlock()
+	if h != nil {
+		log.Printf("[Transmitter] Link to %d down after %d unacknowledged heartbeats\r\n", t.receiver, misses)
+		h()
+	}
+}
+
+// noteHeartbeatAck records the ACK of a monitored heartbeat, whichever
+// goroutine received it.
+func (t *Transmitter) noteHeartbeatAck(ack *proto.Frame) {
+	m := &t.monitor
+	m.mu.Lock()
+	if !m.awaiting || ack.Seq != m.seq || ack.SenderID != t.receiver {
+		m.mu.Unlock()
+		return
+	}
+	m.awaiting = false
+	m.misses = 0
+	var h func()
+	if m.down {
+		m.down = false
+		h = m.onUp
+	}
+	m.mu.Unlock()
+	if h != nil {
+		log.Printf("[Transmitter] Link to %d up\r\n", t.receiver)
+		h()
+	}
+	select {
+	case t.sendQueue.linkUp <- struct{}{}: // resumes a queue held by an outage
+	default:
+	}
+}
+
+// receiverGone reports the link down at once when the receiver said it is
+// going away, rather than after the heartbeats that would go unanswered.
+func (t *Transmitter) receiverGone() {
+	log.Printf("[Transmitter] Receiver %d going away\r\n", t.receiver)
+	m := &t.monitor
+	m.mu.Lock()
+	var h func()
+	if m.threshold > 0 && !m.down {
+		m.down, m.awaiting = true, false
+		m.misses = m.threshold
+		h = m.onDown
+	}
+	m.mu.Unlock()
+	if h != nil {
+		h()
+	}
+}
+
+// linkDown reports whether the link monitor has found the link down.
+func (t *Transmitter) linkDown() bool {
+	t.monitor.mu.Lock()
+	defer t.monitor.mu.Unlock()
+	return t.monitor.threshold > 0 && t.monitor.down
+}
@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// Option configures a Transmitter or Receiver at construction time.
+type Option func(*options)
+
+type options struct {
+	config         proto.Config
+	bonds          BondStore
+	caps           proto.Capability
+	rand           proto.RandSource
+	psk            []byte
+	hop            bool // pair on pairingChannel, see WithPairingChannel
+	pairingChannel uint8
+	txQueue        TxQueueConfig
+	goodbye        bool // see WithGoodbye
+	heartbeatAcks  bool // see WithHeartbeatAcks
+	dutyCycle      DutyCycleConfig
+	ackTimeout     AckTimeoutConfig
+	seqState       *SeqState // see WithSeqState
+	csma           *CSMAConfig
+	dispatch       DispatchPoolConfig
+	readerMark     int           // see WithReaderHighWater
+	rxPoll         time.Duration // see WithRxPollInterval
+	configErr      error         // config.Validate before Normalize
+}
+
+func newOptions(opts []Option) options {
+	o := options{config: proto.DefaultConfig(), caps: proto.AllCapabilities}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&o)
+		}
+	}
+	o.configErr = o.config.Validate()
+	o.config = o.config.Normalize()
+	return o
+}
+
+// WithConfig sets the protocol limits and timings used by the endpoint.
+// Zero fields keep their defaults. The constructor logs ErrInvalidConfig
+// for a field out of range, see Config.Validate, and clamps it as
+// Config.Normalize does.
+func WithConfig(cfg proto.Config) Option {
+	return func(o *options) { o.config = cfg }
+}
+
+// WithNetworkID sets the network ID mixed into frame CRCs. Both endpoints of
+// a link must use the same ID. Apply it after WithConfig, which replaces the
+// whole configuration.
+func WithNetworkID(id uint32) Option {
+	return func(o *options) { o.config.NetworkID = id }
+}
+
+// WithPairingTimeout bounds pairing attempts, StartPairing on either end,
+// to d instead of Config.PairingTimeout. Like WithNetworkID, apply it after
+// WithConfig.
+func WithPairingTimeout(d time.Duration) Option {
+	return func(o *options) { o.config.PairingTimeout = d }
+}
+
+// WithCapabilities limits the optional features the endpoint announces when
+// pairing; by default it announces all it supports.
+func WithCapabilities(c proto.Capability) Option {
+	return func(o *options) { o.caps = c & proto.AllCapabilities }
+}
+
+// WithRandSource makes the endpoint draw its keys, challenges and jitter
+// from src instead of the package-wide proto.RandSource.
+func WithRandSource(src proto.RandSource) Option {
+	return func(o *options) { o.rand = src }
+}
+
+// WithPairingChannel makes StartPairing move the endpoint to channel ch,
+// usually proto.PairingChannel, for the pairing exchange only, so that
+// devices configured with different operating channels still meet. The
+// receiver directs transmitters to its operating channel, the one set with
+// SetChannel, unless SetDataChannel names another, and returns to it once
+// the exchange is over; the transmitter follows. Both go back to the
+// channel they were on if pairing fails.
+func WithPairingChannel(ch uint8) Option {
+	return func(o *options) { o.hop, o.pairingChannel = ch <= 125, ch }
+}
@@ -0,0 +1,677 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// negotiateFrameSize returns the smaller of the local frame limit and the one
+// advertised by the peer in a pairing TLV section. Peers that do not
+// advertise a limit accept the protocol maximum.
+func negotiateFrameSize(local int, ext []byte) int {
+	peer := proto.MaxFrameSize
+	if v, ok := proto.FindTLV(ext, proto.TagMaxFrameSize); ok && len(v) == 1 {
+		peer = int(v[0])
+	}
+	if peer > proto.MinFrameSize && peer < local {
+		return peer
+	}
+	return local
+}
+
+// maxPendingChallenges bounds the challenge table so that a flood of pairing
+// requests cannot exhaust memory.
+const maxPendingChallenges = 8
+
+// pendingChallenge is a pairing request waiting for its challenge response.
+type pendingChallenge struct {
+	nonce   [proto.ChallengeSize]byte
+	seq     uint32 // sequence number of the pairing request, echoed in the ACK
+	request []byte // payload of the pairing request
+	expires time.Time
+}
+
+// PairingEvent reports how an accepted pairing request relates to the
+// receiver's earlier pairing with the same transmitter.
+type PairingEvent uint8
+
+const (
+	PairingNewDevice  PairingEvent = iota + 1 // the transmitter was not paired
+	PairingKeyChanged                         // it was, with another pairing or session key: it restarted
+	PairingDuplicate                          // it was, with the same key: a repeated request
+)
+
+// OnPairingEvent registers a handler called for every pairing request the
+// receiver accepts, once the transmitter is paired. Per-device state such as
+// fragment reassembly is reset before PairingKeyChanged is reported. The
+// handler runs without the receiver locked, after the request has been
+// answered. Pass nil to remove the handler.
+func (r *Receiver) OnPairingEvent(h func(id proto.DeviceID, ev PairingEvent)) {
+	r.mu.Lock()
+	r.pairingEventHandler = h
+	r.mu.Unlock()
+}
+
+// pairedLocked stores dev as paired in place of old, the device's earlier
+// pairing if any, and reports the transition.
+func (r *Receiver) pairedLocked(res *frameResult, dev *proto.Device, old *proto.Device, oldKey proto.PairingKey, oldSession []byte) {
+	ev := PairingNewDevice
+	if old == nil {
+		r.resetSeqLocked(dev.ID)
+		delete(r.devEvents.lost, dev.ID)
+	} else {
+		ev = PairingDuplicate
+		if oldKey != dev.PairingKey || !bytes.Equal(oldSession, dev.SessionKey) {
+			ev = PairingKeyChanged
+			r.resetDeviceLocked(dev.ID)
+		}
+	}
+	r.pairedDevices[dev.ID] = dev
+	r.pairings++
+	r.saveBondLocked(dev)
+	r.pairingEventLocked(res, dev.ID, ev)
+	if ev == PairingNewDevice {
+		r.deviceEventLocked(DevicePaired, dev.ID)
+	}
+}
+
+// resetDeviceLocked forgets the per-device state tied to a transmitter's
+// previous run.
+func (r *Receiver) resetDeviceLocked(id proto.DeviceID) {
+	delete(r.assembly, id)
+	delete(r.streams, id)
+	delete(r.resyncs, id)
+	r.resetSeqLocked(id)
+}
+
+// pairingEventLocked has the pairing event handler told of ev once the
+// receiver is unlocked.
+func (r *Receiver) pairingEventLocked(res *frameResult, id proto.DeviceID, ev PairingEvent) {
+	if h := r.pairingEventHandler; h != nil {
+		res.events = append(res.events, func() { h(id, ev) })
+	}
+}
+
+// pairingAck is the ACK sent for a pairing request, kept for the pairing
+// timeout so that retransmissions of the request are answered with it
+// instead of starting over.
+type pairingAck struct {
+	seq     uint32
+	request []byte // payload of the request
+	ext     []byte // TLV extensions of the ACK
+	expires time.Time
+}
+
+// repeatPairing answers a retransmitted pairing request the way the
+// original was answered: with the same ACK, or with the same challenge if
+// the response is still outstanding. It reports whether frame was such a
+// repeat.
+func (r *Receiver) repeatPairing(frame *proto.Frame) bool {
+	var res frameResult
+	defer res.runEvents()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if a, ok := r.pairingAcks[frame.SenderID]; ok {
+		if now.After(a.expires) {
+			delete(r.pairingAcks, frame.SenderID)
+		} else if a.seq == frame.Seq && bytes.Equal(a.request, frame.Payload) {
+			_ = r.sendPairingAck(a.seq, a.ext)
+			if _, ok := r.pairedDevices[frame.SenderID]; ok {
+				r.pairingEventLocked(&res, frame.SenderID, PairingDuplicate)
+			}
+			return true
+		}
+	}
+	if c, ok := r.challenges[frame.SenderID]; ok && c.seq == frame.Seq && now.Before(c.expires) &&
+		len(frame.Payload) >= 8 && bytes.Equal(c.request, frame.Payload) {
+		_ = r.sendControl(c.seq, proto.ControlPairChallenge, frame.SenderID, c.nonce[:])
+		return true
+	}
+	return false
+}
+
+// SetPairingKey requires transmitters to prove knowledge of key before they
+// are paired: pairing requests are answered with a random challenge and only
+// a correct response is ACKed. The zero key restores open pairing, where the
+// key carried in the request is trusted.
+func (r *Receiver) SetPairingKey(key proto.PairingKey) {
+	r.mu.Lock()
+	r.pairingKey = key
+	r.challenges = make(map[proto.DeviceID]*pendingChallenge)
+	r.mu.Unlock()
+}
+
+// challengeLocked answers a pairing request with a fresh challenge.
+func (r *Receiver) challengeLocked(frame *proto.Frame) {
+	now := time.Now()
+	for id, c := range r.challenges {
+		if now.After(c.expires) {
+			delete(r.challenges, id)
+		}
+	}
+	if _, ok := r.challenges[frame.SenderID]; !ok && len(r.challenges) >= maxPendingChallenges {
+		log.Printf("[Receiver] Too many pending challenges, ignoring %d\r\n", frame.SenderID)
+		return
+	}
+
+	nonce, err := proto.GenerateChallenge(r.rand)
+	if err != nil {
+		log.Printf("[Receiver] Generating a challenge failed: %v\r\n", err)
+		return
+	}
+	c := &pendingChallenge{
+		nonce:   nonce,
+		seq:     frame.Seq,
+		request: append([]byte(nil), frame.Payload...),
+		expires: now.Add(r.config.PairingTimeout),
+	}
+	r.challenges[frame.SenderID] = c
+	_ = r.sendControl(frame.Seq, proto.ControlPairChallenge, frame.SenderID, c.nonce[:])
+}
+
+// verifyResponseLocked completes a challenged pairing if resp is correct and
+// rejects the transmitter otherwise.
+func (r *Receiver) verifyResponseLocked(res *frameResult, id proto.DeviceID, resp []byte) {
+	c, ok := r.challenges[id]
+	if !ok {
+		// The ACK of an accepted response may have been lost.
+		if a, ok := r.pairingAcks[id]; ok && time.Now().Before(a.expires) {
+			_ = r.sendPairingAck(a.seq, a.ext)
+		}
+		return
+	}
+	delete(r.challenges, id)
+	if time.Now().After(c.expires) {
+		return
+	}
+
+	want := proto.ChallengeResponse(r.pairingKey, c.nonce[:], id, r.device.ID)
+	if len(resp) < proto.ChallengeSize || !hmac.Equal(resp[:proto.ChallengeSize], want[:]) {
+		log.Printf("[Receiver] Wrong challenge response from %d\r\n", id)
+		_ = r.sendControl(c.seq, proto.ControlPairReject, id, []byte{proto.RejectBadResponse})
+		return
+	}
+	r.acceptPairingLocked(res, id, r.pairingKey, c.seq, c.request)
+}
+
+// acceptPairingLocked stores id as paired and ACKs its pairing request,
+// completing the key exchange if the request offered one.
+func (r *Receiver) acceptPairingLocked(res *frameResult, id proto.DeviceID, key proto.PairingKey, seq uint32, request []byte) {
+	ext := request[8:]
+	if r.singlePairTakenLocked(id) {
+		log.Printf("[Receiver] Single-pair mode, pairing with %d ignored\r\n", id)
+		return
+	}
+	if _, known := r.pairedDevices[id]; !known && r.confirmations[id] == nil && !r.makeRoomLocked(res) {
+		log.Printf("[Receiver] Device limit reached, pairing with %d rejected\r\n", id)
+		_ = r.sendControl(seq, proto.ControlPairReject, id, []byte{proto.RejectDeviceLimit})
+		return
+	}
+	if !r.dataRateMatchesLocked(id, seq, ext) {
+		return
+	}
+	ackExt := proto.AppendTLV(nil, proto.TagMaxFrameSize, []byte{byte(r.config.MaxFrameSize)})
+	ackExt = proto.AppendCapabilityTLV(ackExt, r.caps)
+	ackExt = appendDataRateTLV(ackExt, r.dataRate)
+	if r.heartbeatAcks {
+		ackExt = proto.AppendTLV(ackExt, proto.TagHeartbeat, nil)
+	}
+
+	var session []byte
+	var code uint32
+	if peer, ok := proto.FindTLV(ext, proto.TagPublicKey); ok {
+		kx, err := proto.NewKeyExchange(proto.RandReader(r.rand))
+		if err == nil {
+			session, err = kx.SessionKey(peer, id, r.device.ID)
+		}
+		if err != nil {
+			_ = r.sendControl(seq, proto.ControlPairReject, id, []byte{proto.RejectSecurityMismatch})
+			return
+		}
+		ackExt = proto.AppendTLV(ackExt, proto.TagPublicKey, kx.PublicKey())
+		code = proto.ComparisonCode(peer, kx.PublicKey(), id, r.device.ID)
+	}
+
+	old := r.pairedDevices[id]
+	dev := old
+	var oldKey proto.PairingKey
+	var oldSession []byte
+	if old != nil {
+		oldKey, oldSession = old.PairingKey, old.SessionKey
+	} else {
+		dev = proto.NewTransmitter(id)
+	}
+	if session != nil && r.confirmHandler != nil {
+		// Keep the device aside until the user confirms the code.
+		dev = proto.NewTransmitter(id)
+		r.awaitConfirmLocked(id, dev, seq, code)
+	}
+	dev.PairingKey = key
+	dev.IsPaired = true
+	dev.MaxFrameSize = negotiateFrameSize(r.config.MaxFrameSize, ext)
+	dev.Info = proto.ParseDeviceInfo(ext)
+	dev.Capabilities = r.caps & proto.ParseCapabilities(ext)
+	dev.HeartbeatInterval = proto.ParseHeartbeat(ext)
+	dev.Epoch = proto.ParseEpoch(ext)
+	ackExt = append(ackExt, r.dataLinkDirectiveLocked(dev, ext)...)
+	dev.ResetSessionKey(session)
+	dev.UpdateLastSeen()
+	if r.confirmations[id] == nil {
+		r.pairedLocked(res, dev, old, oldKey, oldSession)
+		if session == nil {
+			r.startSwitchLocked(id)
+		}
+	}
+	r.pairingAcks[id] = &pairingAck{
+		seq:     seq,
+		request: append([]byte(nil), request...),
+		ext:     ackExt,
+		expires: time.Now().Add(r.config.PairingTimeout),
+	}
+	_ = r.sendPairingAck(seq, ackExt)
+}
+
+// SetSecurePairing enables secure pairing: the transmitter offers an X25519
+// public key in its pairing request, requires the receiver to answer with
+// its own, and confirms the derived session key in an extra round trip.
+// Pairing with a receiver that does not support it fails with
+// ErrSecurityMismatch.
+func (t *Transmitter) SetSecurePairing(enabled bool) { t.securePairing = enabled }
+
+// SessionKey returns a copy of the session key derived by secure pairing, or
+// nil if the link was not paired securely.
+func (t *Transmitter) SessionKey() []byte {
+	return append([]byte(nil), t.device.SessionKey...)
+}
+
+// StartPairing pairs with the given receiver. Receivers without a configured
+// pairing key ACK the request directly; receivers with one first send a
+// challenge that the transmitter answers with a response derived from its
+// pairing key, and only ACK a correct response. In secure mode the ACK also
+// carries the receiver's public key and the transmitter confirms the derived
+// session key before the link counts as paired.
+//
+// ErrPairingRejected is returned if the receiver rejects the exchange,
+// ErrSecurityMismatch if the two ends disagree on secure pairing,
+// ErrDataRateMismatch if they use different data rates, and ErrTimeout if
+// any step goes unanswered within the pairing timeout.
+// Unanswered messages are sent again on the default PairingOptions schedule.
+func (t *Transmitter) StartPairing(receiverID proto.DeviceID) error {
+	return t.startPairing(context.Background(), receiverID, PairingOptions{})
+}
+
+// StartPairingWithConfirm pairs securely with the given receiver, whatever
+// SetSecurePairing says, and asks the user to confirm the six-digit
+// comparison code shown on both devices before the link is established.
+// confirm runs in its own goroutine; if it does not answer within
+// Config.ConfirmTimeout pairing is aborted with ErrTimeout, and a false
+// answer aborts it with ErrPairingRejected. The receiver is told in both
+// cases.
+func (t *Transmitter) StartPairingWithConfirm(receiverID proto.DeviceID, confirm func(code uint32) bool) error {
+	return t.startPairing(context.Background(), receiverID, PairingOptions{Confirm: confirm})
+}
+
+// PairingOptions tunes StartPairingWithOptions. Zero fields keep their
+// defaults.
+type PairingOptions struct {
+	// RetryInterval is how long the transmitter waits for an answer before
+	// sending a pairing message again, 500 ms by default. Retransmissions
+	// reuse the sequence number, so an answer to any copy is accepted.
+	// Negative sends every message once.
+	RetryInterval time.Duration
+
+	// Jitter bounds a random delay added to each interval so that
+	// transmitters started together do not keep colliding, RetryInterval/5
+	// by default. Negative disables it.
+	Jitter time.Duration
+
+	// Timeout bounds the whole attempt, the transmitter's pairing timeout
+	// by default.
+	Timeout time.Duration
+
+	// Confirm, if set, makes the pairing secure and asks the user to
+	// confirm the comparison code, as StartPairingWithConfirm does.
+	Confirm func(code uint32) bool
+}
+
+// defaultPairingRetry is the default PairingOptions.RetryInterval.
+const defaultPairingRetry = 500 * time.Millisecond
+
+// retryDelay returns how long to wait before the next retransmission, or a
+// negative duration if there are none, drawing the jitter from src.
+func (o PairingOptions) retryDelay(src proto.RandSource) time.Duration {
+	interval := o.RetryInterval
+	if interval < 0 {
+		return -1
+	}
+	if interval == 0 {
+		interval = defaultPairingRetry
+	}
+	jitter := o.Jitter
+	if jitter == 0 {
+		jitter = interval / 5
+	}
+	return interval + randDuration(src, jitter)
+}
+
+// SetPairingTimeout changes how long StartPairing waits for the receiver; a
+// non-positive d restores proto.PairingTimeout.
+func (t *Transmitter) SetPairingTimeout(d time.Duration) {
+	t.config.PairingTimeout = d
+	t.config = t.config.Normalize()
+}
+
+// StartPairingWithOptions pairs with the given receiver like StartPairing,
+// using opts for retransmissions, the timeout and user confirmation.
+func (t *Transmitter) StartPairingWithOptions(receiverID proto.DeviceID, opts PairingOptions) error {
+	return t.startPairing(context.Background(), receiverID, opts)
+}
+
+// encodeNext numbers and encodes an outgoing frame for transmission, possibly
+// repeated, by the caller.
+func (t *Transmitter) encodeNext(frameType byte, payload []byte) (uint32, []byte, error) {
+	if len(payload) > t.maxPayload() {
+		return 0, nil, proto.ErrInvalidPayload
+	}
+	seq := t.nextSeq()
+	return seq, t.linkConfig().EncodeFrame(t.newFrame(frameType, seq, payload)), nil
+}
+
+func (t *Transmitter) pair(ctx context.Context, receiverID proto.DeviceID, opts PairingOptions) error {
+	defer t.awake()()
+	confirm := opts.Confirm
+	// payload: pairingKey(4) | receiverID(4) | TLV extensions
+	buf := make([]byte, 8)
+	if !t.presharedKey {
+		binary.LittleEndian.PutUint32(buf[0:4], t.pairingKey.Uint32())
+	}
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(receiverID))
+	buf = proto.AppendTLV(buf, proto.TagMaxFrameSize, []byte{byte(t.config.MaxFrameSize)})
+	if !t.presharedKey && t.pairingKey.Len() > 4 && t.caps&proto.CapLongPairingKey != 0 {
+		buf = proto.AppendPairingKeyTLV(buf, t.pairingKey)
+	}
+	buf = proto.AppendCapabilityTLV(buf, t.caps)
+	rate := t.DataRate()
+	buf = appendDataRateTLV(buf, rate)
+	if hb := t.heartbeatInterval(); hb != proto.DefaultConfig().HeartbeatInterval {
+		// Receivers time out silent peers after Config.DeviceTimeout
+		// unless told otherwise.
+		buf = proto.AppendHeartbeatTLV(buf, hb)
+	}
+	if t.noDataChannel {
+		buf = proto.AppendTLV(buf, proto.TagDataChannel, []byte{proto.NoDataChannel})
+	}
+	if t.epoch != 0 {
+		buf = proto.AppendEpochTLV(buf, t.epoch)
+	}
+
+	var kx *proto.KeyExchange
+	if t.securePairing || confirm != nil {
+		var err error
+		if kx, err = proto.NewKeyExchange(proto.RandReader(t.rand)); err != nil {
+			return err
+		}
+		buf = proto.AppendTLV(buf, proto.TagPublicKey, kx.PublicKey())
+	}
+
+	if err := t.leaveDataLink(); err != nil {
+		return err
+	}
+	if t.receiver != 0 && t.receiver != receiverID {
+		t.deleteBond(t.receiver)
+	}
+	t.receiver = receiverID
+	t.device.MaxFrameSize = t.config.MaxFrameSize
+	t.device.ResetSessionKey(nil)
+	t.device.Capabilities = 0
+	t.rekey = nil
+	if !t.info.IsZero() {
+		buf = proto.AppendInfoTLV(buf, t.info, t.maxPayload()-t.sealOverhead())
+	}
+
+	// seq is the sequence number the awaited ACK echoes, pending the
+	// message sent again until the receiver answers it
+	seq := t.nextSeq()
+	buf, err := t.sealRequest(seq, buf)
+	if err != nil {
+		return err
+	}
+	if len(buf) > t.maxPayload() {
+		return proto.ErrInvalidPayload
+	}
+	pending := t.linkConfig().EncodeFrame(t.newFrame(proto.FrameTypePairing, seq, buf))
+	var retry time.Time
+
+	confirming := false
+	var linkExt []byte // directive moving the link after pairing
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = t.config.PairingTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) && t.ctxErr(ctx) == nil {
+		if pending != nil && !time.Now().Before(retry) {
+			if err := t.tx(pending); err != nil {
+				return err
+			}
+			if delay := opts.retryDelay(t.rand); delay >= 0 {
+				retry = time.Now().Add(delay)
+			} else {
+				pending = nil
+			}
+		}
+		wait := 100 * time.Millisecond
+		if pending != nil && time.Until(retry) < wait {
+			wait = time.Until(retry)
+		}
+		frame := t.ReceiveFrame(wait)
+		if frame == nil || frame.SenderID != receiverID {
+			continue
+		}
+		switch frame.Type {
+		case proto.FrameTypeAck:
+			if frame.Seq != seq || !t.openAck(frame) || len(frame.Payload) < 4 {
+				continue
+			}
+			sid := proto.DeviceID(uint32(frame.Payload[0]) | uint32(frame.Payload[1])<<8 | uint32(frame.Payload[2])<<16 | uint32(frame.Payload[3])<<24)
+			if sid != receiverID {
+				continue
+			}
+			if !confirming && parseDataRate(frame.Payload[4:]) != rate {
+				t.rejectPairing(receiverID, proto.RejectDataRate)
+				return proto.ErrDataRateMismatch
+			}
+			if confirming || kx == nil {
+				if !confirming {
+					t.device.MaxFrameSize = negotiateFrameSize(t.config.MaxFrameSize, frame.Payload[4:])
+					t.device.Capabilities = t.caps & proto.ParseCapabilities(frame.Payload[4:])
+					t.device.PairingKey = t.linkKey()
+					linkExt = frame.Payload[4:]
+				}
+				t.device.IsPaired = true
+				t.noteHeartbeatAcks(linkExt)
+				t.saveBond()
+				err := t.followDataLink(ctx, receiverID, linkExt, opts)
+				t.pairingChanged()
+				return err
+			}
+
+			t.device.MaxFrameSize = negotiateFrameSize(t.config.MaxFrameSize, frame.Payload[4:])
+			t.device.Capabilities = t.caps & proto.ParseCapabilities(frame.Payload[4:])
+			t.device.PairingKey = t.linkKey()
+			linkExt = frame.Payload[4:]
+			peer, ok := proto.FindTLV(frame.Payload[4:], proto.TagPublicKey)
+			if !ok {
+				t.rejectPairing(receiverID, proto.RejectSecurityMismatch)
+				return proto.ErrSecurityMismatch
+			}
+			session, err := kx.SessionKey(peer, t.device.ID, receiverID)
+			if err != nil {
+				t.rejectPairing(receiverID, proto.RejectSecurityMismatch)
+				return err
+			}
+			t.device.ResetSessionKey(session)
+
+			if confirm != nil {
+				code := proto.ComparisonCode(kx.PublicKey(), peer, t.device.ID, receiverID)
+				ok, err := confirmWithin(ctx, func() bool { return confirm(code) }, t.config.ConfirmTimeout)
+				if err != nil || !ok {
+					t.rejectPairing(receiverID, proto.RejectNotConfirmed)
+					if err != nil {
+						return err
+					}
+					return proto.ErrPairingRejected
+				}
+				// The receiver may still be waiting for its own user.
+				deadline = time.Now().Add(t.config.ConfirmTimeout)
+			}
+
+			conf := proto.KeyConfirmation(session, t.device.ID, receiverID)
+			if seq, pending, err = t.encodeNext(proto.FrameTypeControl, proto.EncodeControl(proto.ControlKeyConfirm, receiverID, conf[:])); err != nil {
+				return err
+			}
+			retry = time.Time{}
+			confirming = true
+		case proto.FrameTypeControl:
+			cmd, target, args, ok := proto.DecodeControl(frame.Payload)
+			if !ok || target != t.device.ID {
+				continue
+			}
+			switch cmd {
+			case proto.ControlPairChallenge:
+				if frame.Seq != seq || len(args) < proto.ChallengeSize {
+					continue
+				}
+				resp := proto.ChallengeResponse(t.pairingKey, args[:proto.ChallengeSize], t.device.ID, receiverID)
+				if _, pending, err = t.encodeNext(proto.FrameTypeControl, proto.EncodeControl(proto.ControlPairResponse, receiverID, resp[:])); err != nil {
+					return err
+				}
+				retry = time.Time{}
+			case proto.ControlPairReject:
+				t.device.SessionKey = nil
+				if len(args) > 0 && args[0] == proto.RejectSecurityMismatch {
+					return proto.ErrSecurityMismatch
+				}
+				if len(args) > 0 && args[0] == proto.RejectDataRate {
+					return proto.ErrDataRateMismatch
+				}
+				return proto.ErrPairingRejected
+			}
+		}
+	}
+	if confirming {
+		t.rejectPairing(receiverID, proto.RejectNotConfirmed)
+	}
+	t.device.SessionKey = nil
+	if err := t.ctxErr(ctx); err != nil {
+		return err
+	}
+	return proto.ErrTimeout
+}
+
+// linkKey returns the pairing key the receiver keeps for the link: the key
+// field alone unless it is pre-shared or the receiver supports long keys.
+func (t *Transmitter) linkKey() proto.PairingKey {
+	if t.presharedKey || t.device.HasCapability(proto.CapLongPairingKey) {
+		return t.pairingKey
+	}
+	return t.pairingKey.Truncate(4)
+}
+
+// rejectPairing tells the receiver to drop a half-finished pairing.
+func (t *Transmitter) rejectPairing(receiverID proto.DeviceID, reason byte) {
+	t.device.SessionKey = nil
+	_, _ = t.SendFrame(proto.FrameTypeControl, proto.EncodeControl(proto.ControlPairReject, receiverID, []byte{reason}))
+}
+
+// SetPairingHandler registers a handler that approves pairing requests
+// addressed to this receiver, given the sender and the key it advertised
+// (zero for transmitters using a pre-shared key, and only its first four
+// bytes unless both ends support CapLongPairingKey). Requests it refuses are
+// answered with a reject. The handler runs without the receiver locked, so
+// it may prompt a user or consult other Receiver methods. Pass nil to accept
+// every request again.
+func (r *Receiver) SetPairingHandler(h func(senderID proto.DeviceID, key proto.PairingKey) bool) {
+	r.mu.Lock()
+	r.pairingHandler = h
+	r.mu.Unlock()
+}
+
+// requestKey returns the key advertised by a pairing request payload of at
+// least 8 bytes, in full only if both ends support long keys.
+func (r *Receiver) requestKey(payload []byte) proto.PairingKey {
+	return proto.ParsePairingKey(payload, r.caps&proto.CapLongPairingKey != 0)
+}
+
+// approvePairing asks the pairing handler, if any, whether frame may pair.
+// Requests for other receivers are left for ProcessFrame to ignore.
+func (r *Receiver) approvePairing(frame *proto.Frame) bool {
+	r.mu.Lock()
+	h := r.pairingHandler
+	r.mu.Unlock()
+	if h == nil || len(frame.Payload) < 8 {
+		return true
+	}
+	key := r.requestKey(frame.Payload)
+	if proto.DeviceID(binary.LittleEndian.Uint32(frame.Payload[4:8])) != r.device.ID {
+		return true
+	}
+	if h(frame.SenderID, key) {
+		return true
+	}
+	log.Printf("[Receiver] Pairing request from %d not approved\r\n", frame.SenderID)
+	_ = r.sendControl(frame.Seq, proto.ControlPairReject, frame.SenderID, []byte{proto.RejectNotApproved})
+	return false
+}
+
+// SetSecurePairing makes secure pairing mandatory: requests that do not
+// offer a public key are rejected with a security-mismatch reason. Requests
+// that do offer one are always answered with a key exchange, whatever this
+// setting.
+func (r *Receiver) SetSecurePairing(required bool) {
+	r.mu.Lock()
+	r.secureRequired = required
+	r.mu.Unlock()
+}
+
+// confirmKeyLocked checks a transmitter's session key confirmation. If the
+// user has yet to confirm the comparison code, the ACK is held back until
+// they do.
+func (r *Receiver) confirmKeyLocked(res *frameResult, frame *proto.Frame, dev *proto.Device, args []byte) {
+	c := r.confirmations[frame.SenderID]
+	if c != nil {
+		dev = c.dev
+	}
+	if dev == nil || dev.SessionKey == nil {
+		return
+	}
+	want := proto.KeyConfirmation(dev.SessionKey, frame.SenderID, r.device.ID)
+	if len(args) < proto.ChallengeSize || !hmac.Equal(args[:proto.ChallengeSize], want[:]) {
+		log.Printf("[Receiver] Session key confirmation from %d failed\r\n", frame.SenderID)
+		delete(r.pairingAcks, frame.SenderID)
+		if _, ok := r.pairedDevices[frame.SenderID]; ok {
+			delete(r.pairedDevices, frame.SenderID)
+			delete(r.devStats, frame.SenderID)
+			r.deleteBondLocked(frame.SenderID)
+		}
+		delete(r.confirmations, frame.SenderID)
+		_ = r.sendControl(frame.Seq, proto.ControlPairReject, frame.SenderID, []byte{proto.RejectKeyConfirm})
+		return
+	}
+	if c != nil {
+		c.keySeq = frame.Seq
+		c.keyConfirmed = true
+		r.completeConfirmLocked(res, frame.SenderID, c)
+		return
+	}
+	_ = r.sendPairingAck(frame.Seq, nil)
+	r.startSwitchLocked(frame.SenderID)
+}
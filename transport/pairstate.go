@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"sort"
+	"sync"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// pairingState is the transmitter's pairing as other goroutines see it. It
+// is a snapshot of the device and peer state, taken by pairingChanged
+// whenever a pairing is made or torn down or another receiver is selected.
+type pairingState struct {
+	mu       sync.Mutex
+	keys     map[proto.DeviceID]proto.PairingKey // link key of each paired receiver
+	selected proto.DeviceID                      // 0 unless paired
+	onChange func(paired bool, id proto.DeviceID)
+}
+
+// IsPaired reports whether the transmitter is paired with any receiver.
+// Unlike the other methods of the transmitter it is safe to call while
+// another goroutine pairs, sends or unpairs.
+func (t *Transmitter) IsPaired() bool {
+	t.pairing.mu.Lock()
+	defer t.pairing.mu.Unlock()
+	return len(t.pairing.keys) > 0
+}
+
+// PairedReceiver returns the ID of the receiver the transmitter is paired
+// with, or 0 if it is not. With several receivers paired it is the one
+// paired or sent to last; PairedReceivers lists them all.
+func (t *Transmitter) PairedReceiver() proto.DeviceID {
+	t.pairing.mu.Lock()
+	defer t.pairing.mu.Unlock()
+	return t.pairing.selected
+}
+
+// PairingKey returns the key of the link with the receiver PairedReceiver
+// reports, or the zero key if the transmitter is not paired. It is the key
+// the receiver knows the transmitter by, cut to four bytes unless both ends
+// support CapLongPairingKey.
+func (t *Transmitter) PairingKey() proto.PairingKey {
+	t.pairing.mu.Lock()
+	defer t.pairing.mu.Unlock()
+	return t.pairing.keys[t.pairing.selected]
+}
+
+// OnPairingStateChange registers a handler called with paired set when a
+// receiver is paired and with paired clear when it is unpaired, by Unpair
+// or by the receiver. Each receiver of a transmitter paired with several
+// is reported on its own, and pairing again with a paired receiver is not
+// reported. The handler runs on the goroutine that made or noticed the
+// change. Pass nil to remove the handler.
+func (t *Transmitter) OnPairingStateChange(h func(paired bool, id proto.DeviceID)) {
+	t.pairing.mu.Lock()
+	t.pairing.onChange = h
+	t.pairing.mu.Unlock()
+}
+
+// pairingChanged takes a new snapshot of the pairing state and reports the
+// receivers paired or unpaired since the last one.
+func (t *Transmitter) pairingChanged() {
+	keys := make(map[proto.DeviceID]proto.PairingKey)
+	t.peers.mu.Lock()
+	for id, p := range t.peers.links {
+		keys[id] = p.device.PairingKey
+	}
+	t.peers.mu.Unlock()
+	var selected proto.DeviceID
+	if t.device.IsPaired {
+		selected = t.receiver
+		keys[selected] = t.device.PairingKey
+	} else {
+		// The selected receiver was unpaired; the next send picks another.
+		for id := range keys {
+			if selected == 0 || id < selected {
+				selected = id
+			}
+		}
+	}
+
+	t.pairing.mu.Lock()
+	var changed []proto.DeviceID
+	for id := range keys {
+		if _, ok := t.pairing.keys[id]; !ok {
+			changed = append(changed, id)
+		}
+	}
+	for id := range t.pairing.keys {
+		if _, ok := keys[id]; !ok {
+			changed = append(changed, id)
+		}
+	}
+	t.pairing.keys, t.pairing.selected = keys, selected
+	h := t.pairing.onChange
+	t.pairing.mu.Unlock()
+
+	if h == nil {
+		return
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i] < changed[j] })
+	for _, id := range changed {
+		_, paired := keys[id]
+		h(paired, id)
+	}
+}
@@ -0,0 +1,233 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// sendToRetries is how often SendDataTo transmits a frame before giving up.
+const sendToRetries = 3
+
+// peerLink is the link state of a paired receiver while another one is
+// selected.
+type peerLink struct {
+	device      proto.Device
+	onDataLink  bool
+	pairingLink link
+	rekey       *pendingRekey
+}
+
+// peerSet holds the receivers a transmitter is paired with besides the
+// selected one, whose state lives in the Transmitter fields as for a single
+// receiver.
+type peerSet struct {
+	mu    sync.Mutex // guards links
+	use   sync.Mutex // held while a receiver is selected and sent to
+	links map[proto.DeviceID]*peerLink
+}
+
+// StartPairingWith pairs with receiverID like StartPairing but keeps the
+// receivers already paired, so that one transmitter can report to several.
+// Pairing again with a paired receiver replaces its pairing. If pairing
+// fails, the receivers paired before are kept as they were.
+//
+// With several receivers paired, the sends without a target fail with
+// ErrSeveralReceivers: SendData and its priority, reliable, batched, large
+// and burst variants, the queues, Stream and SendBlob. Use SendDataTo and
+// SendDataAll.
+// The heartbeat task heartbeats every receiver. Other calls, such as Unpair
+// and SendFrame, apply to the receiver paired or sent to last.
+func (t *Transmitter) StartPairingWith(receiverID proto.DeviceID) error {
+	t.peers.use.Lock()
+	defer t.peers.use.Unlock()
+	if !t.device.IsPaired || t.receiver == receiverID {
+		return t.startPairing(context.Background(), receiverID, PairingOptions{})
+	}
+
+	t.peers.mu.Lock()
+	delete(t.peers.links, receiverID)
+	t.peers.mu.Unlock()
+	prev := t.receiver
+	if err := t.stashReceiver(); err != nil {
+		return err
+	}
+	err := t.startPairing(context.Background(), receiverID, PairingOptions{})
+	if err != nil {
+		if serr := t.selectReceiver(prev); serr != nil {
+			log.Printf("[Transmitter] Returning to receiver %d failed: %v\r\n", prev, serr)
+		}
+	}
+	return err
+}
+
+// PairedReceivers returns the IDs of the receivers the transmitter is
+// paired with, in ascending order.
+func (t *Transmitter) PairedReceivers() []proto.DeviceID {
+	t.pairing.mu.Lock()
+	ids := make([]proto.DeviceID, 0, len(t.pairing.keys))
+	for id := range t.pairing.keys {
+		ids = append(ids, id)
+	}
+	t.pairing.mu.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// SendDataTo sends data to the paired receiver id and waits for its ACK,
+// transmitting the frame up to three times. With several receivers paired
+// the frame is addressed to id, so that receivers sharing its channel
+// ignore it, and data must leave room for the 4-byte target ID.
+func (t *Transmitter) SendDataTo(id proto.DeviceID, data []byte) error {
+	t.peers.use.Lock()
+	defer t.peers.use.Unlock()
+	if t.isClosed() {
+		return proto.ErrClosed
+	}
+	if err := t.selectReceiver(id); err != nil {
+		return err
+	}
+	frameType, payload := byte(proto.FrameTypeData), data
+	if t.hasPeers() && t.device.HasCapability(proto.CapDirected) {
+		frameType, payload = proto.FrameTypeDirected, proto.EncodeAddressed(id, data)
+	}
+	if len(payload) > t.maxPayload() {
+		return proto.ErrInvalidPayload
+	}
+	_, _, err := t.sendReliableSeq(context.Background(), frameType, t.nextSeq(), payload, sendToRetries)
+	return err
+}
+
+// SendDataAll sends data to every paired receiver in turn with SendDataTo.
+// It tries them all and returns the first error, or ErrNotPaired if no
+// receiver is paired.
+func (t *Transmitter) SendDataAll(data []byte) error {
+	ids := t.PairedReceivers()
+	if len(ids) == 0 {
+		return proto.ErrNotPaired
+	}
+	var first error
+	for _, id := range ids {
+		if err := t.SendDataTo(id, data); err != nil {
+			log.Printf("[Transmitter] Sending to %d failed: %v\r\n", id, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// heartbeatAll sends a heartbeat to every paired receiver. It returns
+// ErrNotPaired once none is left and ErrClosed once the transmitter is
+// closed; other failures are logged.
+func (t *Transmitter) heartbeatAll() error {
+	defer t.awake()()
+	if !t.hasPeers() {
+		_, err := t.SendHeartbeat()
+		return err
+	}
+	t.peers.use.Lock()
+	defer t.peers.use.Unlock()
+	for _, id := range t.PairedReceivers() {
+		if err := t.selectReceiver(id); err != nil {
+			continue // unpaired by an earlier heartbeat's receiver
+		}
+		if _, err := t.SendHeartbeat(); err == proto.ErrClosed {
+			return err
+		} else if err != nil {
+			log.Printf("[Transmitter] Heartbeat to %d failed: %v\r\n", id, err)
+		}
+	}
+	if !t.device.IsPaired {
+		return proto.ErrNotPaired
+	}
+	return nil
+}
+
+// hasPeers reports whether receivers other than the selected one are
+// paired.
+func (t *Transmitter) hasPeers() bool {
+	t.peers.mu.Lock()
+	defer t.peers.mu.Unlock()
+	return len(t.peers.links) > 0
+}
+
+// soleReceiver selects the receiver that sends without a target go to. It
+// fails with ErrSeveralReceivers if more than one is paired.
+func (t *Transmitter) soleReceiver() error {
+	t.peers.mu.Lock()
+	n := len(t.peers.links)
+	var id proto.DeviceID
+	for id = range t.peers.links {
+		break
+	}
+	t.peers.mu.Unlock()
+	switch {
+	case n == 0:
+		return nil
+	case n > 1 || t.device.IsPaired:
+		return proto.ErrSeveralReceivers
+	}
+	// The selected receiver was unpaired; the other one takes over.
+	t.peers.use.Lock()
+	defer t.peers.use.Unlock()
+	return t.selectReceiver(id)
+}
+
+// stashReceiver moves the state of the selected receiver into the peer set
+// and returns the transmitter to the link it pairs on, unpaired.
+func (t *Transmitter) stashReceiver() error {
+	t.peers.mu.Lock()
+	if t.peers.links == nil {
+		t.peers.links = make(map[proto.DeviceID]*peerLink)
+	}
+	t.peers.links[t.receiver] = &peerLink{
+		device:      *t.device,
+		onDataLink:  t.onDataLink,
+		pairingLink: t.pairingLink,
+		rekey:       t.rekey,
+	}
+	t.peers.mu.Unlock()
+
+	t.receiver = 0
+	t.device.IsPaired = false
+	t.device.ResetSessionKey(nil)
+	t.device.MaxFrameSize = t.config.MaxFrameSize
+	t.device.Capabilities = 0
+	t.rekey = nil
+	return t.leaveDataLink()
+}
+
+// selectReceiver makes id the selected receiver, moving the radio to its
+// link. The previously selected receiver, if paired, goes to the peer set.
+func (t *Transmitter) selectReceiver(id proto.DeviceID) error {
+	if t.device.IsPaired && t.receiver == id {
+		return nil
+	}
+	t.peers.mu.Lock()
+	p, ok := t.peers.links[id]
+	t.peers.mu.Unlock()
+	if !ok {
+		return proto.ErrNotPaired
+	}
+	if t.device.IsPaired {
+		if err := t.stashReceiver(); err != nil {
+			return err
+		}
+	}
+	if err := retune(t.driver, linkOf(t.device), linkOf(&p.device)); err != nil {
+		return err
+	}
+	t.peers.mu.Lock()
+	delete(t.peers.links, id)
+	t.peers.mu.Unlock()
+	*t.device = p.device
+	t.onDataLink, t.pairingLink, t.rekey = p.onDataLink, p.pairingLink, p.rekey
+	t.receiver = id
+	t.pairingChanged()
+	return nil
+}
@@ -0,0 +1,43 @@
+package transport
+
+import proto "github.com/ystepanoff/nrfcomm/protocol"
+
+// dataPipe is the pipe a receiver listens for the data link on while it
+// needs the pairing link as well, see RadioMultiPipe.
+const dataPipe = 1
+
+// canPipeLocked reports whether the radio can listen on the pairing and the
+// data link at once, on pipe 0 and dataPipe, instead of alternating between
+// them: the driver supports pipes and the links share a channel.
+func (r *Receiver) canPipeLocked(pairing, data link) bool {
+	_, ok := r.driver.(RadioMultiPipe)
+	return ok && pairing.channel == data.channel
+}
+
+// setDataPipeLocked starts or stops listening for the data link on
+// dataPipe, next to the tuned link on pipe 0.
+func (r *Receiver) setDataPipeLocked(on bool, data link) {
+	if on == r.piped && (!on || r.pipe == data) {
+		return
+	}
+	mp, ok := r.driver.(RadioMultiPipe)
+	if !ok {
+		return
+	}
+	if !on {
+		mp.EnablePipes(1)
+		r.piped = false
+		return
+	}
+	if err := mp.ConfigurePipe(dataPipe, data.address, data.prefix); err != nil {
+		return
+	}
+	mp.EnablePipes(1 | 1<<dataPipe)
+	r.piped, r.pipe = true, data
+}
+
+// onDataLinkLocked reports whether frame arrived on the data link: the
+// radio is tuned to it, or the frame matched dataPipe.
+func (r *Receiver) onDataLinkLocked(frame *proto.Frame) bool {
+	return r.tuned == r.dataLinkLocked() || (r.piped && frame.Pipe == dataPipe)
+}
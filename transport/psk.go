@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"encoding/binary"
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// WithPairingPSK seals pairing requests and their ACKs under psk, a key
+// shared by every device of the deployment, so that listeners without it
+// cannot read pairing keys, public keys or receiver IDs off the air (see
+// proto.SealPairing). A receiver with a PSK rejects unsealed requests and
+// ignores requests sealed under another key; pairing stays open, without
+// sealing, on endpoints without one.
+func WithPairingPSK(psk []byte) Option {
+	return func(o *options) { o.psk = append([]byte(nil), psk...) }
+}
+
+// sealOverhead is how much sealing adds to pairing payloads.
+func (t *Transmitter) sealOverhead() int {
+	if t.psk == nil {
+		return 0
+	}
+	return proto.SealOverhead
+}
+
+// sealRequest seals the payload of the pairing request to be numbered seq,
+// if the transmitter has a PSK.
+func (t *Transmitter) sealRequest(seq uint32, payload []byte) ([]byte, error) {
+	if t.psk == nil {
+		return payload, nil
+	}
+	var nonce [proto.SealNonceSize]byte
+	if err := proto.ReadRand(t.rand, nonce[:]); err != nil {
+		return nil, err
+	}
+	frame := &proto.Frame{SenderID: t.device.ID, Type: proto.FrameTypePairing, Seq: seq, Payload: payload}
+	return proto.SealPairing(t.psk, nonce, frame), nil
+}
+
+// openAck replaces the payload of a pairing ACK by its opened form, if the
+// transmitter has a PSK, and reports false if it was not sealed under it.
+func (t *Transmitter) openAck(frame *proto.Frame) bool {
+	if t.psk == nil {
+		return true
+	}
+	payload, ok := proto.OpenPairing(t.psk, frame)
+	if ok {
+		frame.Payload = payload
+	}
+	return ok
+}
+
+// openPairing returns frame with its payload opened, if the receiver has a
+// PSK, or nil if it was not sealed under it. Unsealed requests addressed to
+// the receiver are rejected.
+func (r *Receiver) openPairing(frame *proto.Frame) *proto.Frame {
+	if r.psk == nil {
+		return frame
+	}
+	if payload, ok := proto.OpenPairing(r.psk, frame); ok {
+		opened := *frame
+		opened.Payload = payload
+		return &opened
+	}
+	if len(frame.Payload) >= 8 && proto.DeviceID(binary.LittleEndian.Uint32(frame.Payload[4:8])) == r.device.ID {
+		log.Printf("[Receiver] Unsealed pairing request from %d rejected\r\n", frame.SenderID)
+		_ = r.sendControl(frame.Seq, proto.ControlPairReject, frame.SenderID, []byte{proto.RejectSecurityMismatch})
+	}
+	return nil
+}
+
+// sendPairingAck transmits the ACK of a pairing request or key confirmation
+// like sendAck, sealed if the receiver has a PSK.
+func (r *Receiver) sendPairingAck(seq uint32, ext []byte) error {
+	frame := r.ackFrame(seq, ext)
+	if r.psk != nil {
+		var nonce [proto.SealNonceSize]byte
+		if err := proto.ReadRand(r.rand, nonce[:]); err != nil {
+			return err
+		}
+		frame.Payload = proto.SealPairing(r.psk, nonce, frame)
+	}
+	r.recordAckSent()
+	return r.tx(r.config.EncodeFrame(frame))
+}
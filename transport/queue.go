@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"sync"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// txItem is a data frame waiting in the transmit queue.
+type txItem struct {
+	payload []byte
+	prio    proto.Priority
+}
+
+// txQueue holds pending frames in one FIFO per priority level and releases
+// them in strict priority order, so a higher priority frame overtakes every
+// lower priority frame queued before it.
+type txQueue struct {
+	mu     sync.Mutex
+	levels [proto.NumPriorities][]txItem
+	count  int
+}
+
+func (q *txQueue) push(it txItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.levels[it.prio] = append(q.levels[it.prio], it)
+	q.count++
+}
+
+func (q *txQueue) pop() (txItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p := len(q.levels) - 1; p >= 0; p-- {
+		if len(q.levels[p]) > 0 {
+			it := q.levels[p][0]
+			q.levels[p][0] = txItem{}
+			q.levels[p] = q.levels[p][1:]
+			q.count--
+			return it, true
+		}
+	}
+	return txItem{}, false
+}
+
+func (q *txQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
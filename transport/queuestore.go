@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"sync"
+	"time"
+)
+
+// StoredMessage is a message of the transmit queue kept in a QueueStore.
+type StoredMessage struct {
+	Seq    uint32    // sequence number reserved by Enqueue
+	Queued time.Time // when it was enqueued, for TxQueueConfig.TTL
+	Data   []byte
+}
+
+// QueueStore keeps the messages the transmit queue spills out of memory,
+// oldest first, see TxQueueConfig.Store. Host builds can back it with a
+// file, embedded ones with flash. Only the queue's worker and Enqueue use
+// it, never at the same time.
+type QueueStore interface {
+	// Append adds m after the messages held.
+	Append(m StoredMessage) error
+
+	// Iterate calls fn with the messages held, oldest first, until fn
+	// returns false.
+	Iterate(fn func(StoredMessage) bool) error
+
+	// Truncate removes the n oldest messages.
+	Truncate(n int) error
+}
+
+// MemoryQueueStore is a QueueStore kept in memory. It lifts the capacity
+// limit of the transmit queue but does not survive a restart.
+type MemoryQueueStore struct {
+	mu   sync.Mutex
+	msgs []StoredMessage
+}
+
+// NewMemoryQueueStore returns an empty MemoryQueueStore.
+func NewMemoryQueueStore() *MemoryQueueStore {
+	return &MemoryQueueStore{}
+}
+
+func (s *MemoryQueueStore) Append(m StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.Data = append([]byte(nil), m.Data...)
+	s.msgs = append(s.msgs, m)
+	return nil
+}
+
+func (s *MemoryQueueStore) Iterate(fn func(StoredMessage) bool) error {
+	s.mu.Lock()
+	msgs := s.msgs
+	s.mu.Unlock()
+	for _, m := range msgs {
+		if !fn(m) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryQueueStore) Truncate(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > len(s.msgs) {
+		n = len(s.msgs)
+	}
+	s.msgs = append([]StoredMessage(nil), s.msgs[n:]...)
+	return nil
+}
+
+// Len returns the number of messages held.
+func (s *MemoryQueueStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.msgs)
+}
@@ -0,0 +1,113 @@
+//go:build !tinygo && !baremetal
+
+package transport
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileQueueStore is a QueueStore keeping the messages in a file, one JSON
+// object per line. Append adds a line; Truncate replaces the file
+// atomically with the lines kept.
+type FileQueueStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileQueueStore returns a store backed by the file at path, which is
+// created on the first Append.
+func NewFileQueueStore(path string) *FileQueueStore {
+	return &FileQueueStore{path: path}
+}
+
+func (s *FileQueueStore) Append(m StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *FileQueueStore) Iterate(fn func(StoredMessage) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var m StoredMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			return err
+		}
+		if !fn(m) {
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+func (s *FileQueueStore) Truncate(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	r, w := bufio.NewReader(f), bufio.NewWriter(tmp)
+	var rerr error
+	for rerr == nil {
+		var line []byte
+		line, rerr = r.ReadBytes('\n')
+		if len(line) > 0 && n > 0 {
+			n--
+		} else if len(line) > 0 {
+			w.Write(line) // errors surface in Flush
+		}
+	}
+	if rerr != io.EOF {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return rerr
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,60 @@
+//go:build !tinygo && !baremetal
+
+package transport
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileQueueStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+
+	s := NewFileQueueStore(path)
+	contents := func(s QueueStore) string {
+		t.Helper()
+		var got []string
+		err := s.Iterate(func(m StoredMessage) bool {
+			got = append(got, fmt.Sprint(m.Seq, m.Data))
+			return true
+		})
+		if err != nil {
+			t.Fatalf("Iterate() error = %v", err)
+		}
+		return fmt.Sprint(got)
+	}
+	if got := contents(s); got != "[]" {
+		t.Fatalf("missing file holds %s", got)
+	}
+	now := time.Now()
+	for i := 1; i <= 4; i++ {
+		if err := s.Append(StoredMessage{Seq: uint32(i), Queued: now, Data: []byte{byte(i), 0xFF}}); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	if err := s.Truncate(1); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+
+	// A new instance sees the same messages.
+	s = NewFileQueueStore(path)
+	if got, want := contents(s), "[2 [2 255] 3 [3 255] 4 [4 255]]"; got != want {
+		t.Errorf("store holds %s, want %s", got, want)
+	}
+	var first StoredMessage
+	_ = s.Iterate(func(m StoredMessage) bool {
+		first = m
+		return false
+	})
+	if !first.Queued.Equal(now) {
+		t.Errorf("Queued = %v, want %v", first.Queued, now)
+	}
+	if err := s.Truncate(5); err != nil {
+		t.Fatalf("Truncate() past the end error = %v", err)
+	}
+	if got := contents(s); got != "[]" {
+		t.Errorf("store holds %s after truncating everything", got)
+	}
+}
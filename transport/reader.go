@@ -0,0 +1,174 @@
+package transport
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DefaultReaderHighWater is how many bytes a Reader holds before the
+// receiver pauses the transmitter, unless WithReaderHighWater sets another
+// mark.
+const DefaultReaderHighWater = 4096
+
+// WithReaderHighWater sets how many unread bytes a Reader holds before the
+// receiver pauses the transmitter, see Receiver.Reader. A mark of 0 or less
+// means DefaultReaderHighWater.
+func WithReaderHighWater(n int) Option {
+	return func(o *options) { o.readerMark = n }
+}
+
+// rxReader is the reader returned by Receiver.Reader. Its buffer and state
+// are guarded by the receiver's mutex.
+type rxReader struct {
+	r        *Receiver
+	id       proto.DeviceID
+	buf      []byte // received, not yet read
+	pause    bool   // the transmitter should be paused
+	overflow bool   // data was dropped, the stream has a gap after buf
+	closed   bool
+
+	flow   sync.Mutex // serialises the pause and resume commands
+	paused bool       // the transmitter acknowledged a pause, guarded by flow
+}
+
+// Reader returns a reader of the data the paired transmitter id sends, the
+// payloads of its data messages joined in the order they arrive, so that the
+// link can be handed to encoding/json or bufio. Reads block until data
+// arrives and return io.EOF once everything was read and id is unpaired or
+// timed out. Unless the receiver is listening, reads receive frames
+// themselves. The data is also delivered to callbacks as before.
+//
+// Once more than the high-water mark of WithReaderHighWater is unread, the
+// receiver pauses the transmitter as PauseDevice does, and resumes it when
+// reads have taken the buffer below half the mark. Data arriving while
+// twice the mark is unread is dropped, and reads fail with ErrOverflow once
+// they reach the gap. Close stops the buffering; a later Reader for id
+// replaces this one, whose reads then fail with ErrClosed.
+func (r *Receiver) Reader(id proto.DeviceID) io.ReadCloser {
+	rd := &rxReader{r: r, id: id}
+	r.mu.Lock()
+	if r.readers == nil {
+		r.readers = make(map[proto.DeviceID]*rxReader)
+	}
+	if old := r.readers[id]; old != nil {
+		old.closed = true
+	}
+	r.readers[id] = rd
+	r.mu.Unlock()
+	return rd
+}
+
+// highWater returns the mark of WithReaderHighWater.
+func (r *Receiver) highWater() int {
+	if r.readerMark > 0 {
+		return r.readerMark
+	}
+	return DefaultReaderHighWater
+}
+
+// feedReaderLocked adds the data message f to the reader of its sender, if
+// any.
+func (r *Receiver) feedReaderLocked(f *proto.Frame) {
+	rd := r.readers[f.SenderID]
+	if rd == nil || rd.overflow {
+		return
+	}
+	mark := r.highWater()
+	if len(rd.buf)+len(f.Payload) > 2*mark {
+		log.Printf("[Receiver] Reader of %d overflowed, data dropped\r\n", f.SenderID)
+		rd.overflow = true
+		return
+	}
+	rd.buf = append(rd.buf, f.Payload...)
+	if len(rd.buf) > mark && !rd.pause {
+		rd.pause = true
+		go rd.syncFlow()
+	}
+}
+
+func (rd *rxReader) Read(p []byte) (int, error) {
+	r := rd.r
+	for {
+		if r.isClosed() {
+			return 0, proto.ErrClosed
+		}
+		r.mu.Lock()
+		if rd.closed {
+			r.mu.Unlock()
+			return 0, proto.ErrClosed
+		}
+		if len(rd.buf) > 0 {
+			n := copy(p, rd.buf)
+			rd.buf = rd.buf[n:]
+			resume := rd.pause && len(rd.buf) < r.highWater()/2
+			if resume {
+				rd.pause = false
+			}
+			r.mu.Unlock()
+			if resume {
+				go rd.syncFlow()
+			}
+			return n, nil
+		}
+		if rd.overflow {
+			r.mu.Unlock()
+			return 0, proto.ErrOverflow
+		}
+		dev, paired := r.pairedDevices[rd.id]
+		alive := paired && dev.IsAliveWithin(r.deviceTimeout(dev))
+		r.mu.Unlock()
+
+		if !alive {
+			return 0, io.EOF
+		}
+		if r.listening() {
+			time.Sleep(time.Millisecond)
+		} else if frame := r.pollFrame(); frame != nil {
+			r.processFrame(frame)
+		}
+	}
+}
+
+// Close detaches the reader from the transmitter's data, resuming the
+// transmitter if the reader paused it.
+func (rd *rxReader) Close() error {
+	r := rd.r
+	r.mu.Lock()
+	if r.readers[rd.id] == rd {
+		delete(r.readers, rd.id)
+	}
+	rd.closed, rd.pause, rd.buf = true, false, nil
+	r.mu.Unlock()
+	rd.syncFlow()
+	return nil
+}
+
+// syncFlow pauses or resumes the transmitter until its state matches what
+// the reader wants, one command at a time.
+func (rd *rxReader) syncFlow() {
+	rd.flow.Lock()
+	defer rd.flow.Unlock()
+	for {
+		rd.r.mu.Lock()
+		want := rd.pause
+		rd.r.mu.Unlock()
+		if want == rd.paused {
+			return
+		}
+		var err error
+		if want {
+			err = rd.r.PauseDevice(rd.id)
+		} else {
+			err = rd.r.ResumeDevice(rd.id)
+		}
+		if err != nil {
+			log.Printf("[Receiver] Flow control of %d for its reader failed: %v\r\n", rd.id, err)
+			return
+		}
+		rd.paused = want
+	}
+}
@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// ReceiveDataFrom waits up to timeout for the next data message from the
+// transmitter id and returns it: a data frame, a sample of a batch or a
+// reassembled message. Frames from other transmitters are processed, ACKed
+// and handed to the callbacks as usual while it waits, and so is the
+// message returned. If the receiver is listening, ReceiveDataFrom waits for
+// the listen loop to process the message instead of reading the radio
+// itself. It returns ErrNotPaired if id is not paired and ErrTimeout if no
+// message arrives in time.
+func (r *Receiver) ReceiveDataFrom(id proto.DeviceID, timeout time.Duration) ([]byte, error) {
+	if r.isClosed() {
+		return nil, proto.ErrClosed
+	}
+	ch := make(chan []byte, 1)
+	r.mu.Lock()
+	if _, ok := r.pairedDevices[id]; !ok {
+		r.mu.Unlock()
+		return nil, proto.ErrNotPaired
+	}
+	if r.receivers == nil {
+		r.receivers = make(map[proto.DeviceID][]chan []byte)
+	}
+	r.receivers[id] = append(r.receivers[id], ch)
+	r.mu.Unlock()
+	defer r.stopReceiving(id, ch)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case msg := <-ch:
+			return msg, nil
+		default:
+		}
+		if r.isClosed() {
+			return nil, proto.ErrClosed
+		}
+		if !r.IsPaired(id) {
+			return nil, proto.ErrNotPaired
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, proto.ErrTimeout
+		}
+		if r.listening() {
+			if wait > rxSlice {
+				wait = rxSlice
+			}
+			select {
+			case msg := <-ch:
+				return msg, nil
+			case <-time.After(wait):
+			}
+			continue
+		}
+		done := r.pollSelf()
+		frame := r.pollFrame()
+		done()
+		if frame != nil {
+			r.processFrame(frame)
+		}
+	}
+}
+
+// offerLocked hands the data message f to the ReceiveDataFrom calls waiting
+// for its sender.
+func (r *Receiver) offerLocked(f *proto.Frame) {
+	chs := r.receivers[f.SenderID]
+	if len(chs) == 0 {
+		return
+	}
+	for _, ch := range chs {
+		ch <- append([]byte(nil), f.Payload...)
+	}
+	delete(r.receivers, f.SenderID)
+}
+
+// stopReceiving withdraws ch, of a ReceiveDataFrom call waiting for id.
+func (r *Receiver) stopReceiving(id proto.DeviceID, ch chan []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	chs := r.receivers[id]
+	for i, c := range chs {
+		if c == ch {
+			r.receivers[id] = append(chs[:i:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(r.receivers[id]) == 0 {
+		delete(r.receivers, id)
+	}
+}
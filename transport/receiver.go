@@ -1,8 +1,10 @@
 package transport
 
 import (
+	"context"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	proto "github.com/ystepanoff/nrfcomm/protocol"
@@ -10,170 +12,604 @@ import (
 
 // Receiver encapsulates high-level logic for a radio receiver.
 type Receiver struct {
-	device        *proto.Device
-	driver        RadioDriver
-	pairedDevices map[proto.DeviceID]*proto.Device
-	mu            sync.Mutex
-	callbacks     map[byte]func(*proto.Frame)
-	isListening   bool
+	device              *proto.Device
+	driver              RadioDriver
+	config              proto.Config
+	pairedDevices       map[proto.DeviceID]*proto.Device
+	mu                  sync.Mutex
+	callbacks           map[byte][]*frameCallback                    // see RegisterCallback
+	deviceCallbacks     map[proto.DeviceID]map[byte][]*frameCallback // see RegisterDeviceCallback
+	nextCallback        CallbackHandle
+	callbackErr         func(error)
+	middleware          []func(FrameHandler) FrameHandler // see Use
+	replyHandler        func(*proto.Frame) []byte
+	rekeyHandler        func(proto.DeviceID, uint8)
+	pairingKey          proto.PairingKey
+	secureRequired      bool
+	challenges          map[proto.DeviceID]*pendingChallenge
+	confirmHandler      func(proto.DeviceID, uint32) bool
+	pairingHandler      func(proto.DeviceID, proto.PairingKey) bool
+	allowed             map[proto.DeviceID]struct{} // nil allows every sender
+	dropped             uint64
+	window              pairingWindow
+	windowHandler       func(PairingWindowEvent)
+	pairings            uint64 // completed pairings, see StartPairing
+	bonds               BondStore
+	caps                proto.Capability
+	psk                 []byte           // see WithPairingPSK
+	rand                proto.RandSource // nil: the package-wide source
+	assembly            map[proto.DeviceID]*reassembly
+	streams             map[proto.DeviceID]*rxStream
+	blobs               *BlobReceiver // see NewBlobReceiver
+	dataChannel         uint8
+	hasDataChannel      bool
+	privateAddress      bool
+	private             link                         // address of SetPrivateAddress
+	tuned               link                         // link the radio listens on
+	piped               bool                         // listening on dataPipe too, see setDataPipeLocked
+	pipe                link                         // link of dataPipe while piped
+	switching           map[proto.DeviceID]time.Time // grace deadlines, zero until pairing completes
+	hops                map[proto.DeviceID]*pendingHop
+	confirmations       map[proto.DeviceID]*pendingConfirm
+	resyncs             map[proto.DeviceID]*pendingResync
+	pairingAcks         map[proto.DeviceID]*pairingAck
+	maxDevices          int
+	eviction            EvictionPolicy
+	evictionHandler     func(proto.DeviceID)
+	pairingEventHandler func(proto.DeviceID, PairingEvent)
+	healthHandler       func(proto.DeviceID, proto.HealthReport)
+	beacons             beaconing
+	hop                 bool // see WithPairingChannel
+	pairingChannel      uint8
+	maintenanceStop     chan struct{} // see StartMaintenance
+	maintenanceDone     chan struct{}
+	seq                 uint32 // next sequence number of SendDataTo
+	downlinkAcks        map[downlinkKey]chan struct{}
+	seqs                map[proto.DeviceID]*seqWindow // see duplicateLocked
+	losses              map[proto.DeviceID]*lossTracker
+	lossHandler         func(proto.DeviceID, uint32, uint32)
+	devStats            map[proto.DeviceID]*RxDeviceStats
+	paused              map[proto.DeviceID]time.Time
+	devEvents           deviceEvents                     // see SetDeviceEventHandler
+	receivers           map[proto.DeviceID][]chan []byte // see ReceiveDataFrom
+	readers             map[proto.DeviceID]*rxReader     // see Reader
+	subscriptions       map[*subscription]struct{}       // see Frames
+	subscriptionDrops   uint64
+	pool                dispatchPool // see WithDispatchPool
+	ackPolicy           AckPolicy    // see SetAckPolicy
+	ackCounts           map[proto.DeviceID]int
+	echoes              atomic.Uint64 // see EchoedFrames
+	maxFrameAge         atomic.Int64  // see SetMaxFrameAge
+	stats               rxStats       // see Stats
+	statsHook           statsHook     // see SetStatsHook
+	scan                channelScan   // see ScanChannels
+	dataRate            DataRate      // see SetDataRate
+
+	// pendingSamples holds batch samples not yet returned by ReceiveData
+	pendingSamples [][]byte
+	listener       rxListener
+	goodbye        bool          // see WithGoodbye
+	heartbeatAcks  bool          // see WithHeartbeatAcks
+	readerMark     int           // see WithReaderHighWater
+	rxPoll         time.Duration // see WithRxPollInterval
+	singlePair     bool          // see SetSinglePairMode
+	singleFull     bool          // the single transmitter is paired, see noteSinglePair
+	closing        chan struct{} // closed by Close
+	closeOnce      sync.Once
 }
 
-func NewReceiverWithDriver(id proto.DeviceID, d RadioDriver) *Receiver {
-	return &Receiver{
-		device:        proto.NewReceiver(id),
-		driver:        d,
-		pairedDevices: make(map[proto.DeviceID]*proto.Device),
-		callbacks:     make(map[byte]func(*proto.Frame)),
+// rxListener is the state of Listen.
+type rxListener struct {
+	op     sync.Mutex // serialises Listen and StopListening
+	mu     sync.Mutex // guards the fields below
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the listen loop exits
+	polls  int           // calls reading the radio themselves, see pollSelf
+}
+
+func NewReceiverWithDriver(id proto.DeviceID, d RadioDriver, opts ...Option) *Receiver {
+	o := newOptions(opts)
+	if o.configErr != nil {
+		log.Printf("[Receiver] %v, clamped to %+v\r\n", o.configErr, o.config)
+	}
+	r := &Receiver{
+		device:         proto.NewReceiver(id),
+		driver:         d,
+		config:         o.config,
+		pairedDevices:  make(map[proto.DeviceID]*proto.Device),
+		callbacks:      make(map[byte][]*frameCallback),
+		challenges:     make(map[proto.DeviceID]*pendingChallenge),
+		confirmations:  make(map[proto.DeviceID]*pendingConfirm),
+		resyncs:        make(map[proto.DeviceID]*pendingResync),
+		pairingAcks:    make(map[proto.DeviceID]*pairingAck),
+		maxDevices:     DefaultMaxPairedDevices,
+		bonds:          o.bonds,
+		caps:           o.caps,
+		rand:           o.rand,
+		psk:            o.psk,
+		hop:            o.hop,
+		pairingChannel: o.pairingChannel,
+		assembly:       make(map[proto.DeviceID]*reassembly),
+		streams:        make(map[proto.DeviceID]*rxStream),
+		switching:      make(map[proto.DeviceID]time.Time),
+		hops:           make(map[proto.DeviceID]*pendingHop),
+		goodbye:        o.goodbye,
+		heartbeatAcks:  o.heartbeatAcks,
+		readerMark:     o.readerMark,
+		rxPoll:         o.rxPoll,
+		closing:        make(chan struct{}),
 	}
+	r.tuned = linkOf(r.device)
+	r.pool.init(o.dispatch)
+	r.private.address, r.private.prefix = proto.PrivateAddress(id)
+	if r.bonds != nil {
+		r.loadBonds()
+	}
+	return r
 }
 
+// Config returns the protocol configuration in use.
+func (r *Receiver) Config() proto.Config { return r.config }
+
 func (r *Receiver) Initialise() {
 	r.driver.StartHFCLK()
+	r.mu.Lock()
+	r.tuned = linkOf(r.device)
+	r.piped = false
+	r.mu.Unlock()
 	_ = r.driver.Configure(r.device.Address, r.device.Prefix, r.device.Channel)
 }
 
-func (r *Receiver) RegisterCallback(ptype byte, cb func(*proto.Frame)) {
+// SetReplyHandler registers a handler invoked for every accepted data frame
+// before it is acknowledged. A non-empty return value is piggybacked on the
+// ACK for that frame's sequence number; replies that do not fit in the ACK
+// are dropped. The handler runs with the receiver unlocked and may call it.
+// Pass nil to remove the handler.
+func (r *Receiver) SetReplyHandler(h func(*proto.Frame) []byte) {
 	r.mu.Lock()
-	r.callbacks[ptype] = cb
+	r.replyHandler = h
 	r.mu.Unlock()
 }
 
-func (r *Receiver) ProcessFrame(frame *proto.Frame) {
+func (r *Receiver) ProcessFrame(frame *proto.Frame) { r.processFrame(frame) }
+
+// processFrame handles frame and returns the message it completes if it is
+// the last missing fragment of one. It reports whether frame repeated a data
+// frame handled before.
+func (r *Receiver) processFrame(frame *proto.Frame) (msg []byte, dup bool) {
 	if frame == nil {
-		return
+		return nil, false
+	}
+	if frame.SenderID == r.device.ID {
+		r.echoes.Add(1)
+		return nil, false
+	}
+	if frame.Received.IsZero() {
+		frame.Received = time.Now()
+	}
+	r.mu.Lock()
+	mws := r.middleware
+	r.mu.Unlock()
+	if len(mws) == 0 {
+		return r.handleFrame(frame)
+	}
+	chain(mws, func(f *proto.Frame) {
+		if f != nil {
+			msg, dup = r.handleFrame(f)
+		}
+	})(frame)
+	return msg, dup
+}
+
+// handleFrame is processFrame past the middleware.
+func (r *Receiver) handleFrame(frame *proto.Frame) ([]byte, bool) {
+	if !r.allowedSender(frame.SenderID) {
+		return nil, false
+	}
+	if frame.Type == proto.FrameTypePairing {
+		if frame = r.openPairing(frame); frame == nil {
+			return nil, false
+		}
+	}
+	if frame.Type == proto.FrameTypePairing {
+		r.pairingRestart(frame)
+	}
+	if frame.Type == proto.FrameTypePairing && (r.repeatPairing(frame) || !r.acceptsPairing() ||
+		r.singlePairTaken(frame.SenderID) || !r.approvePairing(frame)) {
+		return nil, false
+	}
+	if frame.Type == proto.FrameTypeDirected {
+		target, data, ok := proto.DecodeAddressed(frame.Payload)
+		if !ok || target != r.device.ID {
+			return nil, false
+		}
+		frame = sampleFrame(frame, data)
 	}
 
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	var res frameResult
+	r.processFrameLocked(frame, &res)
+	r.mu.Unlock()
+	r.noteSinglePair()
 
+	if res.reply != nil {
+		r.addReply(frame, &res)
+	}
+	if res.ack {
+		if res.ackData != nil {
+			_ = r.txAck(res.ackData)
+		} else {
+			_ = r.sendAck(frame.Seq, res.ext)
+		}
+		log.Printf("[Receiver] ACK sent for seq=%d\r\n", frame.Seq)
+	}
+	res.runEvents()
+	for _, l := range res.loss {
+		res.onLoss(l.id, l.first, l.count)
+	}
+	for _, f := range res.deliver {
+		r.dispatchFrame(res.callbacks, f, res.dup, res.onError)
+	}
+	return res.msg, res.dup
+}
+
+// frameResult is what processFrameLocked leaves for processFrame to do once
+// the receiver is unlocked, so that a callback may call the receiver.
+type frameResult struct {
+	msg       []byte // message completed by a fragment
+	dup       bool   // a data frame seen before, see duplicateLocked
+	ack       bool   // answer with an ACK carrying ext
+	ext       []byte
+	ackData   []byte // the ACK encoded already, sent in place of one with ext
+	callbacks []*frameCallback
+	onError   func(error)
+	deliver   []*proto.Frame // frames for callbacks
+	loss      []frameLoss    // gaps for onLoss
+	onLoss    func(proto.DeviceID, uint32, uint32)
+	reply     func(*proto.Frame) []byte // the reply handler, run before the ACK
+	replyMax  int                       // reply bytes that fit in the ACK
+	events    []func()                  // event handlers and sends, run after the ACK
+}
+
+// runEvents runs the events queued with the receiver locked, in order.
+func (res *frameResult) runEvents() {
+	for _, ev := range res.events {
+		ev()
+	}
+}
+
+// processFrameLocked handles frame with the receiver locked.
+func (r *Receiver) processFrameLocked(frame *proto.Frame, res *frameResult) {
 	dev, paired := r.pairedDevices[frame.SenderID]
+	if !paired {
+		dev = r.returnedLocked(frame)
+		paired = dev != nil
+	}
+	var stats *RxDeviceStats
+	if paired {
+		r.heardLocked(frame)
+		if frame.Type != proto.FrameTypePairing && frame.Type != proto.FrameTypeAck {
+			if r.restartedLocked(frame) {
+				r.restartLocked(frame.SenderID)
+			}
+			stats = r.statsLocked(frame)
+			r.lossLocked(frame, res)
+		}
+	}
 
 	switch frame.Type {
 	case proto.FrameTypePairing:
 		log.Printf("[Receiver] Pairing Frame received\r\n")
 		log.Printf("[Receiver] Payload: %v\r\n", frame.Payload)
 		if len(frame.Payload) >= 8 {
-			key := uint32(frame.Payload[0]) | uint32(frame.Payload[1])<<8 | uint32(frame.Payload[2])<<16 | uint32(frame.Payload[3])<<24
+			key := r.requestKey(frame.Payload)
 			targetID := proto.DeviceID(uint32(frame.Payload[4]) | uint32(frame.Payload[5])<<8 | uint32(frame.Payload[6])<<16 | uint32(frame.Payload[7])<<24)
 			if targetID == r.device.ID {
-				if !paired {
-					dev = proto.NewTransmitter(frame.SenderID)
+				r.lockOnLocked()
+				if _, offered := proto.FindTLV(frame.Payload[8:], proto.TagPublicKey); r.secureRequired && !offered {
+					log.Printf("[Receiver] Insecure pairing request from %d rejected\r\n", frame.SenderID)
+					_ = r.sendControl(frame.Seq, proto.ControlPairReject, frame.SenderID, []byte{proto.RejectSecurityMismatch})
+					return
 				}
-				dev.PairingKey = key
-				dev.IsPaired = true
-				dev.UpdateLastSeen()
-				r.pairedDevices[frame.SenderID] = dev
-				_ = r.SendAck(frame.SenderID, frame.Seq)
+				if !r.pairingKey.IsZero() {
+					r.challengeLocked(frame)
+					return
+				}
+				r.acceptPairingLocked(res, frame.SenderID, key, frame.Seq, frame.Payload)
 			}
 		}
-	case proto.FrameTypeHeartbeat:
+	case proto.FrameTypeControl:
+		cmd, target, args, ok := proto.DecodeControl(frame.Payload)
+		if !ok || target != r.device.ID {
+			return
+		}
+		switch cmd {
+		case proto.ControlPairResponse:
+			r.verifyResponseLocked(res, frame.SenderID, args)
+		case proto.ControlKeyConfirm:
+			r.confirmKeyLocked(res, frame, dev, args)
+		case proto.ControlRekey:
+			r.rekeyLocked(res, frame, dev, args)
+		case proto.ControlResync:
+			r.resyncLocked(frame, dev)
+		case proto.ControlResyncAnswer:
+			r.resyncAnswerLocked(frame, dev, args)
+		case proto.ControlPairReject, proto.ControlUnpair:
+			delete(r.confirmations, frame.SenderID)
+			delete(r.pairingAcks, frame.SenderID)
+			delete(r.devEvents.lost, frame.SenderID)
+			if paired {
+				log.Printf("[Receiver] Device %d abandoned pairing\r\n", frame.SenderID)
+				delete(r.pairedDevices, frame.SenderID)
+				delete(r.devStats, frame.SenderID)
+				delete(r.paused, frame.SenderID)
+				r.deleteBondLocked(frame.SenderID)
+				r.deviceEventLocked(DeviceUnpaired, frame.SenderID)
+			}
+		case proto.ControlChannelSwitch:
+			r.channelSwitchLocked(frame, dev, args)
+		case proto.ControlBlobOffer, proto.ControlBlobStatus, proto.ControlBlobEnd:
+			r.blobControlLocked(frame, dev, cmd, args)
+		case proto.ControlGoodbye:
+			if paired {
+				log.Printf("[Receiver] Device %d going away\r\n", frame.SenderID)
+				dev.LastSeen = 0
+			}
+		}
+	case proto.FrameTypeAck:
 		if paired {
 			dev.UpdateLastSeen()
+			r.downlinkAckLocked(frame)
+		}
+	case proto.FrameTypeHeartbeat:
+		if paired && r.rollLocked(frame, dev) {
+			dev.UpdateLastSeen()
+			r.rebootedLocked(dev, proto.ParseEpoch(frame.Payload))
+			r.healthLocked(res, frame, dev)
+			stats.Heartbeats++
 			log.Printf("[Receiver] Heartbeat received from %d (seq=%d)\r\n", frame.SenderID, frame.Seq)
+			res.ack = r.heartbeatAcks || frame.Flags&proto.FlagAckRequest != 0
+		}
+	case proto.FrameTypeFragment:
+		if !paired {
+			return
+		}
+		dev.UpdateLastSeen()
+		res.ack = true
+		if res.msg = r.fragmentLocked(frame); res.msg != nil {
+			r.deliverLocked(res, sampleFrame(frame, res.msg))
+		}
+	case proto.FrameTypeStream:
+		if !paired {
+			return
+		}
+		dev.UpdateLastSeen()
+		r.streamLocked(frame)
+		res.ack = true
+	case proto.FrameTypeBlob:
+		if !paired {
+			return
+		}
+		dev.UpdateLastSeen()
+		if r.blobs != nil {
+			r.blobs.chunk(frame.SenderID, frame.Payload)
 		}
-	case proto.FrameTypeData:
+		res.ack = true
+	case proto.FrameTypeData, proto.FrameTypeBatch:
 		if paired && frame.Payload != nil {
+			var samples [][]byte
+			if frame.Type == proto.FrameTypeBatch {
+				var ok bool
+				if samples, ok = proto.SplitBatch(frame.Payload); !ok {
+					return
+				}
+			}
 			dev.UpdateLastSeen()
+			if ack, dup := r.duplicateLocked(frame); dup {
+				log.Printf("[Receiver] Duplicate seq=%d from %d\r\n", frame.Seq, frame.SenderID)
+				if ack == nil {
+					res.ext = r.resyncAckExtLocked(frame.SenderID)
+				}
+				res.ack, res.ackData, res.dup = r.ackDueLocked(frame, true), ack, true
+				stats.Duplicates++
+				r.recordDuplicate()
+				r.deliverDuplicateLocked(res, frame, samples)
+				return
+			}
 
-			// Send ACK immediately (no new goroutine to minimise allocations)
-			ackframe := &proto.Frame{
-				SenderID: r.device.ID,
-				Type:     proto.FrameTypeAck,
-				Seq:      frame.Seq,
+			res.ack = r.ackDueLocked(frame, false)
+			ext := r.backpressureExt(r.resyncAckExtLocked(frame.SenderID))
+			res.ext = ext
+			if res.ack && frame.Type == proto.FrameTypeData && r.replyHandler != nil {
+				// The ACK is built once the handler has run unlocked.
+				res.reply, res.replyMax = r.replyHandler, r.maxReplySize(dev)-len(ext)
+			} else if res.ack {
+				res.ackData = r.ackedLocked(frame, ext)
+			}
+			stats.DataFrames++
+			stats.Bytes += uint64(len(frame.Payload))
+			if frame.Type == proto.FrameTypeData {
+				r.deliverLocked(res, frame)
 			}
-			_ = r.driver.Tx(proto.EncodeFrame(ackframe))
+			for _, sample := range samples {
+				r.deliverLocked(res, sampleFrame(frame, sample))
+			}
+		}
+	}
+}
 
-			// Log ACK sent (use sequence number bytes for clarity)
-			log.Printf("[Receiver] ACK sent for seq=%d\r\n", frame.Seq)
+// sampleFrame returns a data frame carrying one sample of a batch frame or a
+// reassembled message in place of the payload of frame.
+func sampleFrame(batch *proto.Frame, sample []byte) *proto.Frame {
+	f := *batch
+	f.Type = proto.FrameTypeData
+	f.Payload = sample
+	return &f
+}
 
-			// Invoke callback directly using the same Frame to avoid extra allocations
-			if callback, ok := r.callbacks[proto.FrameTypeData]; ok && callback != nil {
-				callback(frame)
-			}
+// addReply runs the reply handler on frame, with the receiver unlocked, and
+// builds the ACK processFrameLocked left to it, carrying the reply if it
+// fits.
+func (r *Receiver) addReply(frame *proto.Frame, res *frameResult) {
+	ext := res.ext
+	if reply := res.reply(frame); len(reply) > 0 {
+		if len(reply) <= res.replyMax {
+			ext = proto.AppendTLV(ext, proto.TagReply, reply)
+		} else {
+			log.Printf("[Receiver] Reply of %d bytes too large, dropped\r\n", len(reply))
 		}
 	}
+	r.mu.Lock()
+	res.ext, res.ackData = ext, r.ackedLocked(frame, ext)
+	r.mu.Unlock()
+}
+
+// maxReplySize returns how many reply bytes fit in an ACK to dev: the
+// negotiated payload limit minus the receiver ID and the TLV header.
+func (r *Receiver) maxReplySize(dev *proto.Device) int {
+	return proto.Config{MaxFrameSize: dev.MaxFrameSize}.MaxPayloadSize() - 4 - 2
 }
 
+// Listen starts a goroutine that receives and processes frames until
+// StopListening. Calling Listen while it runs does nothing.
 func (r *Receiver) Listen() {
-	if r.isListening {
+	l := &r.listener
+	l.op.Lock()
+	defer l.op.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done != nil {
 		return
 	}
-	r.isListening = true
-	go func() {
-		for r.isListening {
-			frame := r.ReceiveFrame(100 * time.Millisecond)
-			if frame != nil {
-				r.ProcessFrame(frame)
-			}
-			time.Sleep(1 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel, l.done = cancel, make(chan struct{})
+	go r.listenLoop(ctx, l.done)
+}
+
+// StopListening ends the goroutine started by Listen and returns once it has
+// exited, which takes at most one slice of a receive poll, see
+// ReceiveFrameCtx. It does nothing if the receiver is not listening.
+func (r *Receiver) StopListening() {
+	l := &r.listener
+	l.op.Lock()
+	defer l.op.Unlock()
+	l.mu.Lock()
+	cancel, done := l.cancel, l.done
+	l.cancel, l.done = nil, nil
+	l.mu.Unlock()
+	if done == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// listenLoop processes the frames received until ctx is cancelled.
+func (r *Receiver) listenLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for ctx.Err() == nil {
+		if frame := r.pollFrameCtx(ctx); frame != nil {
+			r.ProcessFrame(frame)
+			continue
 		}
-	}()
+		time.Sleep(1 * time.Millisecond)
+	}
 }
 
-func (r *Receiver) StopListening() { r.isListening = false }
+// listening reports whether frames are received without the caller's help,
+// by the listen loop or by a StartPairing in progress.
+func (r *Receiver) listening() bool {
+	l := &r.listener
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.done != nil || l.polls > 0
+}
 
-func (r *Receiver) ReceiveFrame(timeout time.Duration) *proto.Frame {
-	data, err := r.driver.Rx(timeout)
-	if err != nil {
-		return nil
+// pollSelf marks the caller as reading the radio until the returned
+// function is called, so that others do not compete for frames.
+func (r *Receiver) pollSelf() func() {
+	l := &r.listener
+	l.mu.Lock()
+	l.polls++
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		l.polls--
+		l.mu.Unlock()
 	}
-	return proto.DecodeFrame(data)
+}
+
+func (r *Receiver) ReceiveFrame(timeout time.Duration) *proto.Frame {
+	return r.ReceiveFrameCtx(context.Background(), timeout)
 }
 
 func (r *Receiver) SetChannel(ch uint8) error {
 	if ch > 125 {
 		return proto.ErrInvalidChannel
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scan = channelScan{}
 	r.device.Channel = ch
+	r.tuned.channel = ch
 	return r.driver.SetChannel(ch)
 }
 
-func (r *Receiver) SendAck(to proto.DeviceID, seq uint32) error {
-	pl := make([]byte, 4)
-	for i := 0; i < 4; i++ {
-		pl[i] = byte(r.device.ID >> (i * 8))
+// SetTxPower sets the radio's output power in dBm, as
+// Transmitter.SetTxPower does. It applies to ACKs and other replies.
+func (r *Receiver) SetTxPower(dbm int8) error {
+	if err := checkTxPower(dbm); err != nil {
+		return err
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.driver.SetTxPower(dbm)
+}
 
-	ackFrame := &proto.Frame{
+// sendControl transmits a control command addressed to target.
+func (r *Receiver) sendControl(seq uint32, cmd byte, target proto.DeviceID, args []byte) error {
+	frame := &proto.Frame{
 		SenderID: r.device.ID,
-		Type:     proto.FrameTypeAck,
+		Type:     proto.FrameTypeControl,
 		Seq:      seq,
-		Payload:  pl,
+		Payload:  proto.EncodeControl(cmd, target, args),
 	}
+	return r.tx(r.config.EncodeFrame(frame))
+}
+
+func (r *Receiver) SendAck(to proto.DeviceID, seq uint32) error {
+	return r.sendAck(seq, nil)
+}
+
+// sendAck transmits an ACK carrying the receiver ID followed by the optional
+// TLV extensions in ext.
+func (r *Receiver) sendAck(seq uint32, ext []byte) error {
+	return r.txAck(r.config.EncodeFrame(r.ackFrame(seq, ext)))
+}
 
-	data := proto.EncodeFrame(ackFrame)
+// txAck transmits data, an encoded ACK.
+func (r *Receiver) txAck(data []byte) error {
 	if len(data) < proto.FrameHeaderSize {
 		return proto.ErrInvalidPayload
 	}
-
-	return r.driver.Tx(data)
+	r.recordAckSent()
+	return r.tx(data)
 }
 
-func (r *Receiver) StartPairing() error {
-	wasListening := r.isListening
-	if !r.isListening {
-		r.isListening = true
-	}
-	deadline := time.Now().Add(proto.PairingTimeout * time.Millisecond)
-	for time.Now().Before(deadline) {
-		frame := r.ReceiveFrame(100 * time.Millisecond)
-		if frame != nil && frame.Type == proto.FrameTypePairing {
-			r.ProcessFrame(frame)
-			r.mu.Lock()
-			paired := len(r.pairedDevices) > 0
-			r.mu.Unlock()
-			if paired {
-				if !wasListening {
-					r.isListening = false
-				}
-				return nil
-			}
-		}
+// ackFrame builds the ACK sent by sendAck.
+func (r *Receiver) ackFrame(seq uint32, ext []byte) *proto.Frame {
+	pl := make([]byte, 4, 4+len(ext))
+	for i := 0; i < 4; i++ {
+		pl[i] = byte(r.device.ID >> (i * 8))
 	}
-	if !wasListening {
-		r.isListening = false
+	pl = append(pl, ext...)
+
+	return &proto.Frame{
+		SenderID: r.device.ID,
+		Type:     proto.FrameTypeAck,
+		Seq:      seq,
+		Payload:  pl,
 	}
-	return proto.ErrTimeout
 }
 
 func (r *Receiver) IsPaired(deviceID proto.DeviceID) bool {
@@ -184,6 +620,19 @@ func (r *Receiver) IsPaired(deviceID proto.DeviceID) bool {
 	return ok && device.IsPaired
 }
 
+// DeviceInfo returns the metadata the given transmitter announced when it
+// paired.
+func (r *Receiver) DeviceInfo(id proto.DeviceID) (proto.DeviceInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, ok := r.pairedDevices[id]
+	if !ok {
+		return proto.DeviceInfo{}, false
+	}
+	return device.Info, true
+}
+
 func (r *Receiver) GetPairedDevices() []*proto.Device {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -198,14 +647,29 @@ func (r *Receiver) GetPairedDevices() []*proto.Device {
 	return devices
 }
 
+// deviceTimeout returns how long dev may stay silent before it times out:
+// Config.DeviceTimeout, scaled by the ratio of the heartbeat interval dev
+// announced to Config.HeartbeatInterval.
+func (r *Receiver) deviceTimeout(dev *proto.Device) time.Duration {
+	if dev.HeartbeatInterval <= 0 {
+		return r.config.DeviceTimeout
+	}
+	scale := float64(dev.HeartbeatInterval) / float64(r.config.HeartbeatInterval)
+	return time.Duration(float64(r.config.DeviceTimeout) * scale)
+}
+
 func (r *Receiver) CleanupTimedOutDevices() {
-	now := time.Now().UnixMilli()
+	defer r.noteSinglePair()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
+	now := time.Now().UnixMilli()
 	for id, device := range r.pairedDevices {
-		if (now - device.LastSeen) > proto.DeviceTimeout {
+		if (now - device.LastSeen) > r.deviceTimeout(device).Milliseconds() {
 			log.Printf("[Receiver] Device %d timed out\r\n", id)
 			device.IsPaired = false
 			delete(r.pairedDevices, id)
+			r.lostLocked(device)
 		}
 	}
 }
@@ -236,7 +700,7 @@ func (r *Receiver) IsPairedDeviceConnected() bool {
 	defer r.mu.Unlock()
 
 	for _, device := range r.pairedDevices {
-		if device.IsAlive() {
+		if device.IsAliveWithin(r.deviceTimeout(device)) {
 			return true
 		}
 	}
@@ -244,18 +708,40 @@ func (r *Receiver) IsPairedDeviceConnected() bool {
 }
 
 func (r *Receiver) ReceiveData() ([]byte, error) {
-	if len(r.pairedDevices) == 0 {
+	return r.receiveData(context.Background(), time.Now().Add(5*time.Second))
+}
+
+// receiveData waits for the next data message until deadline, or for as
+// long as ctx allows if deadline is zero.
+func (r *Receiver) receiveData(ctx context.Context, deadline time.Time) ([]byte, error) {
+	if r.isClosed() {
+		return nil, proto.ErrClosed
+	}
+	r.mu.Lock()
+	if len(r.pendingSamples) > 0 {
+		sample := r.pendingSamples[0]
+		r.pendingSamples = r.pendingSamples[1:]
+		r.mu.Unlock()
+		return sample, nil
+	}
+	paired := len(r.pairedDevices) > 0
+	r.mu.Unlock()
+	if !paired {
 		return nil, proto.ErrNotPaired
 	}
 
-	startTime := time.Now().UnixMilli()
-
 	for {
-		if time.Now().UnixMilli()-startTime > 5000 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if r.isClosed() {
+			return nil, proto.ErrClosed
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
 			return nil, proto.ErrTimeout
 		}
 
-		Frame := r.ReceiveFrame(100 * time.Millisecond)
+		Frame := r.pollFrame()
 		if Frame == nil {
 			time.Sleep(10 * time.Millisecond)
 			continue
@@ -266,7 +752,13 @@ func (r *Receiver) ReceiveData() ([]byte, error) {
 			continue
 		}
 
-		r.ProcessFrame(Frame)
+		msg, dup := r.processFrame(Frame)
+		if msg != nil {
+			return msg, nil
+		}
+		if dup {
+			continue
+		}
 
 		if Frame.Type == proto.FrameTypeData {
 			r.mu.Lock()
@@ -279,16 +771,18 @@ func (r *Receiver) ReceiveData() ([]byte, error) {
 				return dataCopy, nil
 			}
 		}
-	}
-}
 
-func (r *Receiver) StartCleanupTask() {
-	go func() {
-		ticker := time.NewTicker(proto.HeartbeatInterval * time.Millisecond / 2)
-		defer ticker.Stop()
-		for range ticker.C {
-			r.CleanupTimedOutDevices()
+		if Frame.Type == proto.FrameTypeBatch {
+			r.mu.Lock()
+			_, isPaired := r.pairedDevices[Frame.SenderID]
+			samples, ok := proto.SplitBatch(Frame.Payload)
+			if isPaired && ok && len(samples) > 0 {
+				// Samples alias the frame's own payload buffer, which nothing else retains.
+				r.pendingSamples = append(r.pendingSamples, samples[1:]...)
+				r.mu.Unlock()
+				return samples[0], nil
+			}
+			r.mu.Unlock()
 		}
-		time.Sleep(1 * time.Millisecond)
-	}()
+	}
 }
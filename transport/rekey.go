@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"context"
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// rekeyRetries is how many times a rekey request is sent before Rekey gives up.
+const rekeyRetries = 5
+
+// pendingRekey is a rekey request waiting for the receiver's ACK.
+type pendingRekey struct {
+	index     uint8
+	switchSeq uint32
+	key       []byte
+	seq       uint32
+	frame     []byte // encoded request, resent verbatim on retry
+}
+
+// Rekey rotates the session key of a securely paired link without
+// re-pairing. The transmitter sends fresh key material authenticated with the
+// current key and, once the receiver ACKs, both ends use the new key for
+// frames numbered after the request. The old key stays valid for
+// Config.RekeyOverlap so that frames in flight at the switch still verify.
+//
+// If no ACK arrives Rekey returns ErrTimeout and the next call resends the
+// same request, so a lost ACK never leaves the two ends on different keys.
+// ErrNoSessionKey is returned for links paired without secure pairing and
+// ErrUnsupported if the receiver cannot rotate keys.
+func (t *Transmitter) Rekey() error {
+	if !t.device.IsPaired {
+		return proto.ErrNotPaired
+	}
+	if t.device.SessionKey == nil {
+		return proto.ErrNoSessionKey
+	}
+	if !t.device.HasCapability(proto.CapRekey) {
+		return proto.ErrUnsupported
+	}
+
+	if t.rekey == nil {
+		nonce := make([]byte, proto.RekeyNonceSize)
+		if err := proto.ReadRand(t.rand, nonce); err != nil {
+			return err
+		}
+		p := &pendingRekey{index: t.device.KeyIndex + 1, seq: t.nextSeq()}
+		p.switchSeq = p.seq + 1
+		p.key = proto.NextSessionKey(t.device.SessionKey, p.index, nonce)
+
+		args := proto.EncodeRekey(t.device.SessionKey, p.index, p.switchSeq, nonce)
+		frame := t.newFrame(proto.FrameTypeControl, p.seq, proto.EncodeControl(proto.ControlRekey, t.receiver, args))
+		p.frame = t.linkConfig().EncodeFrame(frame)
+		t.rekey = p
+	}
+
+	p := t.rekey
+	if _, _, err := t.transmitUntilAcked(context.Background(), p.frame, p.seq, rekeyRetries); err != nil {
+		return err
+	}
+	t.rekey = nil
+	t.device.RotateSessionKey(p.key, p.index, p.switchSeq, t.config.RekeyOverlap)
+	t.saveBond()
+	log.Printf("[Transmitter] Session key rotated (index=%d)\r\n", p.index)
+	return nil
+}
+
+// SetRekeyHandler registers a handler called with the transmitter ID and the
+// new key index whenever a paired transmitter rotates its session key, for
+// auditing. It runs without the receiver locked, once the request is
+// ACKed. Pass nil to remove the handler.
+func (r *Receiver) SetRekeyHandler(h func(id proto.DeviceID, index uint8)) {
+	r.mu.Lock()
+	r.rekeyHandler = h
+	r.mu.Unlock()
+}
+
+// rekeyLocked applies a transmitter's rekey request. A repeat of the request
+// already applied, sent because the ACK was lost, is ACKed again without
+// rotating twice.
+func (r *Receiver) rekeyLocked(res *frameResult, frame *proto.Frame, dev *proto.Device, args []byte) {
+	if dev == nil || dev.SessionKey == nil {
+		return
+	}
+
+	if index, switchSeq, _, ok := proto.DecodeRekey(dev.PrevSessionKey, args); ok &&
+		index == dev.KeyIndex && switchSeq == dev.KeySwitchSeq {
+		_ = r.sendAck(frame.Seq, nil)
+		return
+	}
+
+	index, switchSeq, nonce, ok := proto.DecodeRekey(dev.SessionKey, args)
+	if !ok || index != dev.KeyIndex+1 {
+		log.Printf("[Receiver] Invalid rekey request from %d\r\n", frame.SenderID)
+		return
+	}
+	dev.RotateSessionKey(proto.NextSessionKey(dev.SessionKey, index, nonce), index, switchSeq, r.config.RekeyOverlap)
+	dev.UpdateLastSeen()
+	r.saveBondLocked(dev)
+	log.Printf("[Receiver] Session key of %d rotated (index=%d)\r\n", frame.SenderID, index)
+	_ = r.sendAck(frame.Seq, nil)
+
+	if h := r.rekeyHandler; h != nil {
+		id := frame.SenderID
+		res.events = append(res.events, func() { h(id, index) })
+	}
+}
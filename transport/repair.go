@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// maxRepairBackoff caps the delay between automatic re-pairing attempts.
+const maxRepairBackoff = time.Minute
+
+// LinkEvent reports a change of the transmitter's link found by automatic
+// re-pairing.
+type LinkEvent uint8
+
+const (
+	LinkLost     LinkEvent = iota + 1 // reliable sends kept failing; the transmitter unpaired
+	LinkRestored                      // re-pairing with the receiver succeeded
+)
+
+// autoRepair is the state of EnableAutoRepair.
+type autoRepair struct {
+	enabled     bool
+	maxFailures int
+	backoff     time.Duration
+	failures    int           // consecutive reliable sends that timed out
+	stop        chan struct{} // closed to cancel the re-pairing loop, nil if none runs
+}
+
+// EnableAutoRepair makes the transmitter recover on its own from a receiver
+// that forgot it, for instance after a reboot. Once maxFailures reliable
+// sends in a row time out, the transmitter unpairs, reports LinkLost and
+// retries StartPairing with the remembered receiver in the background,
+// waiting backoff before the first attempt and doubling the wait after each
+// failure up to a minute. Sends fail with ErrNotPaired until LinkRestored is
+// reported.
+func (t *Transmitter) EnableAutoRepair(maxFailures int, backoff time.Duration) {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	t.repair.enabled = true
+	t.repair.maxFailures = maxFailures
+	t.repair.backoff = backoff
+	t.repair.failures = 0
+}
+
+// StopAutoRepair disables automatic re-pairing and cancels a re-pairing
+// loop in progress. An attempt already under way runs to completion.
+func (t *Transmitter) StopAutoRepair() {
+	t.repair.enabled = false
+	if t.repair.stop != nil {
+		close(t.repair.stop)
+		t.repair.stop = nil
+	}
+}
+
+// SetLinkHandler registers a handler for the events of automatic
+// re-pairing. It runs on the goroutine that noticed the change. Pass nil to
+// remove the handler.
+func (t *Transmitter) SetLinkHandler(h func(LinkEvent)) { t.linkHandler = h }
+
+// noteDelivery counts the outcome of a reliable send towards the failure
+// limit of automatic re-pairing.
+func (t *Transmitter) noteDelivery(err error) {
+	if !t.repair.enabled {
+		return
+	}
+	if err != proto.ErrTimeout {
+		t.repair.failures = 0
+		return
+	}
+	t.repair.failures++
+	if t.repair.failures < t.repair.maxFailures || t.repair.stop != nil {
+		return
+	}
+
+	log.Printf("[Transmitter] Link to %d lost after %d failed sends\r\n", t.receiver, t.repair.failures)
+	t.repair.failures = 0
+	t.unpairLocal()
+	stop := make(chan struct{})
+	t.repair.stop = stop
+	if h := t.linkHandler; h != nil {
+		h(LinkLost)
+	}
+	go t.repairLoop(t.receiver, t.repair.backoff, stop)
+}
+
+// repairLoop retries pairing with receiverID until it succeeds or stop is
+// closed.
+func (t *Transmitter) repairLoop(receiverID proto.DeviceID, delay time.Duration, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			log.Printf("[Transmitter] Re-pairing cancelled\r\n")
+			return
+		case <-time.After(delay):
+		}
+		err := t.startPairing(context.Background(), receiverID, PairingOptions{})
+		if err == nil {
+			break
+		}
+		log.Printf("[Transmitter] Re-pairing with %d failed: %v\r\n", receiverID, err)
+		if delay *= 2; delay > maxRepairBackoff {
+			delay = maxRepairBackoff
+		}
+	}
+
+	select {
+	case <-stop:
+		return
+	default:
+	}
+	t.repair.stop = nil
+	log.Printf("[Transmitter] Link to %d restored\r\n", receiverID)
+	if h := t.linkHandler; h != nil {
+		h(LinkRestored)
+	}
+}
@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"encoding/binary"
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// restartedLocked reports whether frame, from a paired transmitter, shows
+// that it restarted without announcing a new boot epoch: its sequence
+// numbers went back further than a late or repeated frame could, so that
+// the receiver would take every frame it sends for a duplicate. A pairing
+// request is only taken for a restart if it is numbered below the frames
+// heard since the transmitter paired, since a repeat of the request has
+// the old number.
+func (r *Receiver) restartedLocked(frame *proto.Frame) bool {
+	l := r.losses[frame.SenderID]
+	if l == nil || !l.valid {
+		return false
+	}
+	behind := int32(l.next - frame.Seq)
+	if frame.Type == proto.FrameTypePairing {
+		return behind > 1
+	}
+	return behind > dedupWindow
+}
+
+// restartLocked forgets what the receiver tracks about the frames of the
+// transmitter id, which restarted, keeping it paired, and reports
+// DeviceRebooted.
+func (r *Receiver) restartLocked(id proto.DeviceID) {
+	log.Printf("[Receiver] Device %d restarted\r\n", id)
+	delete(r.pairingAcks, id)
+	r.resetDeviceLocked(id)
+	r.deviceEventLocked(DeviceRebooted, id)
+}
+
+// pairingRestart handles a pairing request addressed to the receiver by a
+// paired transmitter that restarted, so that it is not answered as a
+// repeat of the request the transmitter paired with before.
+func (r *Receiver) pairingRestart(frame *proto.Frame) {
+	if len(frame.Payload) < 8 || proto.DeviceID(binary.LittleEndian.Uint32(frame.Payload[4:8])) != r.device.ID {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.pairedDevices[frame.SenderID]; ok && r.restartedLocked(frame) {
+		r.restartLocked(frame.SenderID)
+	}
+}
@@ -0,0 +1,217 @@
+package transport
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// resyncRetries is how many times each step of a resync is sent before
+// ResyncKeys gives up.
+const resyncRetries = 5
+
+// pendingResync tracks a transmitter whose rolling code fell out of the
+// receiver's window, and the resync challenge sent to it, if any.
+type pendingResync struct {
+	nonce   [proto.ChallengeSize]byte
+	counter uint32 // rotation the transmitter continues from
+	seq     uint32 // sequence number of the answer, once accepted
+	asked   bool   // a challenge was sent
+	done    bool   // the answer was accepted; kept to re-ACK repeats
+	expires time.Time
+}
+
+// heartbeatPayload returns the payload of the heartbeat numbered seq: a
+// rolling code for the next rotation on links that roll their key, the boot
+// epoch of a restored transmitter and the health report, if any. It is
+// called with txMu held, which also guards RollCounter against concurrent
+// heartbeats.
+func (t *Transmitter) heartbeatPayload(seq uint32) []byte {
+	var buf []byte
+	if t.device.Rolling() {
+		t.device.RollCounter++
+		code := proto.RollingCode(t.device.SessionKey, t.device.RollCounter, t.device.ID, seq)
+		buf = proto.AppendRollingTLV(buf, t.device.RollCounter, code)
+	}
+	if t.epoch != 0 && len(buf)+proto.EpochTLVSize <= t.maxPayload() {
+		buf = proto.AppendEpochTLV(buf, t.epoch)
+	}
+	if t.health != nil && len(buf)+proto.HealthTLVSize <= t.maxPayload() {
+		buf = proto.AppendHealthTLV(buf, t.health())
+	}
+	return buf
+}
+
+// ResyncKeys realigns the transmitter's rolling key schedule with the
+// receiver's after they drifted more than protocol.RollingWindow rotations
+// apart, for instance because the transmitter was restored from an old bond
+// or sent many heartbeats out of range. The receiver answers with a
+// challenge and the rotation to continue from, and the transmitter proves it
+// holds the bond's session key. The transmitter also resyncs on its own when
+// the receiver flags the drift in the ACK of a reliable send.
+//
+// ErrNoSessionKey is returned for links paired without secure pairing and
+// ErrUnsupported if the receiver does not roll keys.
+func (t *Transmitter) ResyncKeys() error {
+	if !t.device.IsPaired {
+		return proto.ErrNotPaired
+	}
+	if t.device.SessionKey == nil {
+		return proto.ErrNoSessionKey
+	}
+	if !t.device.HasCapability(proto.CapRollingKey) {
+		return proto.ErrUnsupported
+	}
+
+	for attempt := 0; attempt < resyncRetries; attempt++ {
+		req := proto.EncodeControl(proto.ControlResync, t.receiver, nil)
+		seq, err := t.sendNext(proto.FrameTypeControl, 0, func(uint32) []byte { return req })
+		if err != nil {
+			return err
+		}
+		deadline := time.Now().Add(200 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			frame := t.ReceiveFrame(20 * time.Millisecond)
+			if frame == nil || frame.SenderID != t.receiver {
+				continue
+			}
+			if t.handleUnpair(frame) {
+				return proto.ErrNotPaired
+			}
+			if frame.Type != proto.FrameTypeControl || frame.Seq != seq {
+				continue
+			}
+			cmd, target, args, ok := proto.DecodeControl(frame.Payload)
+			if !ok || cmd != proto.ControlResync || target != t.device.ID || len(args) < proto.ChallengeSize+4 {
+				continue
+			}
+			return t.answerResync(args[:proto.ChallengeSize], binary.LittleEndian.Uint32(args[proto.ChallengeSize:]))
+		}
+	}
+	return proto.ErrTimeout
+}
+
+// answerResync answers the receiver's resync challenge and continues the
+// rolling schedule from counter once it is ACKed.
+func (t *Transmitter) answerResync(nonce []byte, counter uint32) error {
+	resp := proto.ResyncResponse(t.device.SessionKey, nonce, counter, t.device.ID, t.receiver)
+	seq := t.nextSeq()
+	frame := t.newFrame(proto.FrameTypeControl, seq, proto.EncodeControl(proto.ControlResyncAnswer, t.receiver, resp[:]))
+	if _, _, err := t.transmitUntilAcked(context.Background(), t.linkConfig().EncodeFrame(frame), seq, resyncRetries); err != nil {
+		return err
+	}
+	t.device.RollCounter = counter
+	t.saveBond()
+	log.Printf("[Transmitter] Rolling keys resynced at rotation %d\r\n", counter)
+	return nil
+}
+
+// resyncRequested reports whether an ACK flags the transmitter's rolling
+// code as out of sync.
+func resyncRequested(ack *proto.Frame) bool {
+	if len(ack.Payload) <= 4 {
+		return false
+	}
+	_, ok := proto.FindTLV(ack.Payload[4:], proto.TagResync)
+	return ok
+}
+
+// rollLocked checks the rolling code of a heartbeat from dev and advances
+// the receiver's copy of the schedule to it. Repeats of the last code are
+// ignored. Codes for earlier rotations are replays, and codes more than
+// protocol.RollingWindow rotations ahead mean the ends drifted apart; both
+// are refused and the transmitter is flagged for a resync.
+func (r *Receiver) rollLocked(frame *proto.Frame, dev *proto.Device) bool {
+	if !dev.Rolling() {
+		return true
+	}
+	counter, code, ok := proto.ParseRollingCode(frame.Payload)
+	key := dev.KeyForSeq(frame.Seq)
+	if !ok || key == nil {
+		log.Printf("[Receiver] Heartbeat from %d without a rolling code\r\n", frame.SenderID)
+		return false
+	}
+	want := proto.RollingCode(key, counter, frame.SenderID, frame.Seq)
+	if !hmac.Equal(code[:], want[:]) {
+		log.Printf("[Receiver] Invalid rolling code from %d\r\n", frame.SenderID)
+		return false
+	}
+	if counter == dev.RollCounter {
+		return false // a repeat of the last heartbeat
+	}
+	if counter < dev.RollCounter || counter-dev.RollCounter > proto.RollingWindow {
+		log.Printf("[Receiver] Rolling code of %d out of sync (rotation %d, expected %d)\r\n", frame.SenderID, counter, dev.RollCounter+1)
+		if p := r.resyncs[frame.SenderID]; p == nil || p.done {
+			r.resyncs[frame.SenderID] = &pendingResync{}
+		}
+		return false
+	}
+	dev.RollCounter = counter
+	return true
+}
+
+// resyncAckExtLocked returns the ACK extension flagging id for a resync, or
+// nil if its rolling code is in sync.
+func (r *Receiver) resyncAckExtLocked(id proto.DeviceID) []byte {
+	if p := r.resyncs[id]; p != nil && !p.done {
+		return proto.AppendTLV(nil, proto.TagResync, nil)
+	}
+	return nil
+}
+
+// resyncLocked answers a transmitter's resync request with a challenge and
+// the rotation to continue from.
+func (r *Receiver) resyncLocked(frame *proto.Frame, dev *proto.Device) {
+	if dev == nil || dev.SessionKey == nil {
+		return
+	}
+	nonce, err := proto.GenerateChallenge(r.rand)
+	if err != nil {
+		return
+	}
+	p := &pendingResync{
+		nonce:   nonce,
+		counter: dev.RollCounter,
+		asked:   true,
+		expires: time.Now().Add(r.config.PairingTimeout),
+	}
+	r.resyncs[frame.SenderID] = p
+	args := make([]byte, proto.ChallengeSize+4)
+	copy(args, p.nonce[:])
+	binary.LittleEndian.PutUint32(args[proto.ChallengeSize:], p.counter)
+	_ = r.sendControl(frame.Seq, proto.ControlResync, frame.SenderID, args)
+}
+
+// resyncAnswerLocked completes a resync if the transmitter's answer proves
+// it holds the session key. A repeat of an accepted answer, sent because
+// the ACK was lost, is ACKed again.
+func (r *Receiver) resyncAnswerLocked(frame *proto.Frame, dev *proto.Device, args []byte) {
+	p := r.resyncs[frame.SenderID]
+	if dev == nil || p == nil || !p.asked || len(args) < proto.ChallengeSize {
+		return
+	}
+	if p.done {
+		if frame.Seq == p.seq {
+			_ = r.sendAck(frame.Seq, nil)
+		}
+		return
+	}
+	if time.Now().After(p.expires) {
+		return
+	}
+	key := dev.KeyForSeq(frame.Seq)
+	want := proto.ResyncResponse(key, p.nonce[:], p.counter, frame.SenderID, r.device.ID)
+	if key == nil || !hmac.Equal(args[:proto.ChallengeSize], want[:]) {
+		log.Printf("[Receiver] Invalid resync answer from %d\r\n", frame.SenderID)
+		return
+	}
+	dev.RollCounter = p.counter
+	p.done, p.seq = true, frame.Seq
+	r.saveBondLocked(dev)
+	log.Printf("[Receiver] Rolling keys of %d resynced at rotation %d\r\n", frame.SenderID, p.counter)
+	_ = r.sendAck(frame.Seq, nil)
+}
@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults of AckTimeoutConfig. The maximum is the fixed window reliable
+// sends used before the timeout adapted to the link.
+const (
+	defaultMinAckTimeout = 5 * time.Millisecond
+	defaultMaxAckTimeout = 200 * time.Millisecond
+	defaultAckTimeoutK   = 4
+)
+
+// rttProbes is how many transmissions awaiting their ACK are timed at once.
+const rttProbes = 4
+
+// AckTimeoutConfig bounds how long reliable sends wait for an ACK before
+// transmitting again. The timeout follows the measured round-trip time like
+// TCP's retransmission timeout: the smoothed RTT plus K times its mean
+// deviation, doubled after every attempt that goes unanswered.
+type AckTimeoutConfig struct {
+	// Min and Max clamp the timeout, 5 ms and 200 ms by default.
+	Min time.Duration
+	Max time.Duration
+
+	// Initial is the timeout before the first measurement, Max by default.
+	Initial time.Duration
+
+	// K weighs the deviation of the round-trip time, 4 by default.
+	K int
+}
+
+// WithAckTimeout sets the bounds of the adaptive ACK timeout of a
+// Transmitter's reliable sends.
+func WithAckTimeout(cfg AckTimeoutConfig) Option {
+	return func(o *options) { o.ackTimeout = cfg }
+}
+
+// rttProbe is a frame transmitted once, waiting for its ACK to be timed.
+type rttProbe struct {
+	seq  uint32
+	sent time.Time // zero if the slot is free
+}
+
+// rttEstimator measures ACK round-trip times and derives the ACK timeout
+// from them.
+type rttEstimator struct {
+	mu      sync.Mutex
+	cfg     AckTimeoutConfig
+	srtt    time.Duration // smoothed round-trip time, zero before a sample
+	rttvar  time.Duration // mean deviation of the round-trip time
+	rto     time.Duration // current ACK timeout
+	pending [rttProbes]rttProbe
+	next    int // slot of pending to overwrite next
+}
+
+func (e *rttEstimator) init(cfg AckTimeoutConfig) {
+	if cfg.Min <= 0 {
+		cfg.Min = defaultMinAckTimeout
+	}
+	if cfg.Max <= 0 {
+		cfg.Max = defaultMaxAckTimeout
+	}
+	if cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+	if cfg.Initial <= 0 {
+		cfg.Initial = cfg.Max
+	}
+	if cfg.K <= 0 {
+		cfg.K = defaultAckTimeoutK
+	}
+	e.cfg = cfg
+	e.rto = e.clamp(cfg.Initial)
+}
+
+func (e *rttEstimator) clamp(d time.Duration) time.Duration {
+	if d < e.cfg.Min {
+		return e.cfg.Min
+	}
+	if d > e.cfg.Max {
+		return e.cfg.Max
+	}
+	return d
+}
+
+// timeout returns how long to wait for the ACK of a transmission.
+func (e *rttEstimator) timeout() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rto
+}
+
+// sent starts timing the first transmission of frame seq.
+func (e *rttEstimator) sent(seq uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending[e.next] = rttProbe{seq: seq, sent: time.Now()}
+	e.next = (e.next + 1) % rttProbes
+}
+
+// retransmitted stops timing frame seq: an ACK for it could answer either
+// transmission, so it says nothing about the round-trip time.
+func (e *rttEstimator) retransmitted(seq uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := range e.pending {
+		if e.pending[i].seq == seq {
+			e.pending[i] = rttProbe{}
+		}
+	}
+}
+
+// expired backs the timeout off after a transmission went unanswered. It
+// stays backed off until the next measurement.
+func (e *rttEstimator) expired() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rto = e.clamp(2 * e.rto)
+}
+
+// acked takes a round-trip sample if frame seq is being timed.
+func (e *rttEstimator) acked(seq uint32) {
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i := range e.pending {
+		p := &e.pending[i]
+		if p.sent.IsZero() || p.seq != seq {
+			continue
+		}
+		e.sampleLocked(now.Sub(p.sent))
+		*p = rttProbe{}
+		return
+	}
+}
+
+// sampleLocked folds a round-trip time into the averages as RFC 6298 does.
+func (e *rttEstimator) sampleLocked(r time.Duration) {
+	if e.srtt == 0 {
+		e.srtt, e.rttvar = r, r/2
+	} else {
+		delta := e.srtt - r
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar += (delta - e.rttvar) / 4
+		e.srtt += (r - e.srtt) / 8
+	}
+	e.rto = e.clamp(e.srtt + time.Duration(e.cfg.K)*e.rttvar)
+}
+
+// stats returns the smoothed round-trip time, its deviation and the
+// current timeout.
+func (e *rttEstimator) stats() (srtt, rttvar, rto time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt, e.rttvar, e.rto
+}
@@ -0,0 +1,43 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DefaultRxPollInterval is how long the listen loop waits for a frame on
+// one link before looking at the receiver's state again, unless
+// WithRxPollInterval sets another interval.
+const DefaultRxPollInterval = 100 * time.Millisecond
+
+// WithRxPollInterval sets how long each read of the radio in the receiver's
+// listen loop lasts. With a driver that is polled, see RadioRxWaiter, a
+// frame waits up to about that long to be handled; a shorter interval
+// lowers that latency at the cost of more wakeups. An interval of 0 or less
+// means DefaultRxPollInterval.
+func WithRxPollInterval(d time.Duration) Option {
+	return func(o *options) { o.rxPoll = d }
+}
+
+// rxPollInterval returns the interval set with WithRxPollInterval.
+func (r *Receiver) rxPollInterval() time.Duration {
+	if r.rxPoll > 0 {
+		return r.rxPoll
+	}
+	return DefaultRxPollInterval
+}
+
+// waitFrame receives a frame with the driver's RxWait, giving up once ctx
+// is done or timeout passes. ok is false if the driver has no RxWait.
+func (r *Receiver) waitFrame(ctx context.Context, timeout time.Duration) (frame *proto.Frame, ok bool) {
+	w, ok := r.driver.(RadioRxWaiter)
+	if !ok {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	rx := func(time.Duration) (RxPacket, error) { return w.RxWait(ctx) }
+	return decodeOthers(rx, r.config, r.device.ID, &r.echoes, r.heard, timeout), true
+}
@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DefaultScanDwell is how long ScanChannels listens on each channel unless
+// told otherwise.
+const DefaultScanDwell = 100 * time.Millisecond
+
+// channelScan is the state of ScanChannels, guarded by the receiver's
+// mutex.
+type channelScan struct {
+	channels []uint8 // nil when not scanning
+	dwell    time.Duration
+	next     int       // index in channels of the channel to move to next
+	until    time.Time // end of the dwell on the current channel
+}
+
+// ScanChannels makes the receiver look for its transmitters on several
+// channels, for sites where they may be set to any of a few. While the
+// receiver listens, it moves its pairing channel through channels in turn,
+// staying dwell on each, until it hears a pairing request addressed to it
+// or a frame from a paired transmitter. It then stays on the channel, as if
+// SetChannel had picked it. A dwell of 0 or less means DefaultScanDwell.
+//
+// The radio only changes channel between two reads, so a frame being
+// received is never cut short. Calling SetChannel, or ScanChannels with no
+// channels, ends the scan.
+func (r *Receiver) ScanChannels(channels []uint8, dwell time.Duration) error {
+	for _, ch := range channels {
+		if ch > 125 {
+			return proto.ErrInvalidChannel
+		}
+	}
+	if dwell <= 0 {
+		dwell = DefaultScanDwell
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(channels) == 0 {
+		r.scan = channelScan{}
+		return nil
+	}
+	r.scan = channelScan{channels: append([]uint8(nil), channels...), dwell: dwell}
+	log.Printf("[Receiver] Scanning channels %v\r\n", channels)
+	return nil
+}
+
+// Scanning reports whether the receiver is still looking for its
+// transmitters, see ScanChannels.
+func (r *Receiver) Scanning() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.scan.channels != nil
+}
+
+// scanLocked moves the pairing link to the next channel of the scan once
+// the dwell on the current one is over. It returns how long the receiver
+// may still listen on the channel, and false if it is not scanning.
+func (r *Receiver) scanLocked(now time.Time) (time.Duration, bool) {
+	s := &r.scan
+	if s.channels == nil {
+		return 0, false
+	}
+	if !now.Before(s.until) {
+		r.device.Channel = s.channels[s.next]
+		s.next = (s.next + 1) % len(s.channels)
+		s.until = now.Add(s.dwell)
+	}
+	return s.until.Sub(now), true
+}
+
+// lockOnLocked ends the scan on the channel a frame for the receiver was
+// just heard on.
+func (r *Receiver) lockOnLocked() {
+	if r.scan.channels == nil {
+		return
+	}
+	r.scan = channelScan{}
+	log.Printf("[Receiver] Locked onto channel %d\r\n", r.device.Channel)
+}
@@ -0,0 +1,418 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// defaultQueueCapacity is the default TxQueueConfig.Capacity.
+const defaultQueueCapacity = 16
+
+// QueuePolicy decides what Enqueue does when the transmit queue is full.
+type QueuePolicy uint8
+
+const (
+	QueueBlock      QueuePolicy = iota // wait until the worker makes room
+	QueueDropOldest                    // discard the oldest queued message, reporting ErrQueueFull for it
+	QueueReject                        // fail with ErrQueueFull
+)
+
+// TxQueueConfig configures the background transmit queue fed by Enqueue.
+// Zero fields keep their defaults.
+type TxQueueConfig struct {
+	// Capacity bounds the messages waiting to be sent, 16 by default.
+	Capacity int
+
+	// Policy decides what happens to a message enqueued while the queue
+	// is full; QueueBlock by default.
+	Policy QueuePolicy
+
+	// Retries makes the worker send every message reliably, trying up to
+	// Retries times. Zero sends every message once without waiting for
+	// an ACK, like SendData.
+	Retries int
+
+	// FlushOnClose makes Close send the messages still queued before it
+	// returns. By default they are abandoned and reported with ErrClosed.
+	FlushOnClose bool
+
+	// Store, if set, takes the messages enqueued while Capacity of them
+	// wait in memory, instead of Policy applying, and the queue holds its
+	// messages through a link outage. The outage is noticed by reliable
+	// sends timing out, or by the link monitor. See EnqueueFunc.
+	Store QueueStore
+
+	// TTL, if positive, is how long a message may wait in the queue. A
+	// message older than that when its turn comes is dropped and reported
+	// with ErrExpired.
+	TTL time.Duration
+}
+
+// WithTxQueue configures the background transmit queue of a Transmitter.
+func WithTxQueue(cfg TxQueueConfig) Option {
+	return func(o *options) { o.txQueue = cfg }
+}
+
+// queuedMsg is a message waiting in the transmit queue under the sequence
+// number reserved for it.
+type queuedMsg struct {
+	seq    uint32
+	queued time.Time
+	data   []byte
+	done   func(seq uint32, err error)
+	stored bool // the head of the store, removed from it once sent
+}
+
+// report passes the outcome of m to its completion callback, if any.
+func (m queuedMsg) report(err error) {
+	if m.done != nil {
+		m.done(m.seq, err)
+	}
+}
+
+// sendQueue is the bounded FIFO drained by the transmit worker, which is
+// started by the first Enqueue. With a store the messages spilled to it
+// follow those in items.
+type sendQueue struct {
+	mu        sync.Mutex
+	cond      *sync.Cond // signalled when messages are added or removed, or on close
+	cfg       TxQueueConfig
+	items     []queuedMsg
+	stored    int                                    // messages in cfg.Store
+	inherited int                                    // of those, left by an earlier run
+	callbacks map[uint32]func(seq uint32, err error) // of the stored messages
+	head      *queuedMsg                             // first stored message, once read
+	linkUp    chan struct{}                          // signalled when a monitored heartbeat is acknowledged
+	started   bool
+	closed    bool
+	done      chan struct{}  // closed when the worker exits
+	inflight  sync.WaitGroup // messages on the air, see sendQueuedAsync
+}
+
+func (q *sendQueue) init(cfg TxQueueConfig) {
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = defaultQueueCapacity
+	}
+	q.cfg = cfg
+	q.cond = sync.NewCond(&q.mu)
+	q.done = make(chan struct{})
+	q.linkUp = make(chan struct{}, 1)
+	if cfg.Store != nil {
+		q.callbacks = make(map[uint32]func(uint32, error))
+		err := cfg.Store.Iterate(func(StoredMessage) bool {
+			q.stored++
+			return true
+		})
+		if err != nil {
+			log.Printf("[Transmitter] Reading the queue store failed: %v\r\n", err)
+		}
+		q.inherited = q.stored
+	}
+}
+
+// Enqueue queues data for the background worker and returns the sequence
+// number its frame will carry. It is EnqueueFunc without a completion
+// callback.
+func (t *Transmitter) Enqueue(data []byte) (uint32, error) {
+	return t.EnqueueFunc(data, nil)
+}
+
+// EnqueueFunc queues data for the background worker, which sends it as
+// configured by WithTxQueue, and returns the sequence number its frame will
+// carry. done, if not nil, is called with that number and the outcome of
+// the send: nil, the send error, ErrQueueFull if the message was dropped to
+// make room, ErrExpired if it outlived TxQueueConfig.TTL, or ErrClosed if
+// Close abandoned it. It runs on the worker goroutine, on a goroutine of
+// the driver if that implements RadioAsyncTx and the queue sends without
+// Retries, or on the goroutine that dropped or abandoned the message.
+//
+// Reserving the number waits at most for the frame on the air at the time.
+// Frames from the queue go on the air in the order they were queued but
+// may interleave out of sequence order with frames sent directly in the
+// meantime.
+//
+// With a TxQueueConfig.Store, messages past Capacity are appended to the
+// store, and once it holds any, so are new ones until the worker has
+// drained it, which keeps them in order. A reliable send that times out
+// then leaves its message at the head of the queue: the worker waits for
+// the link monitor to report the link up again, or without the monitor for
+// a heartbeat interval, and tries again. Close leaves the stored messages
+// in the store without calling their callbacks, even with FlushOnClose; a
+// transmitter started with the store sends them, under new sequence
+// numbers, after its own first Enqueue.
+func (t *Transmitter) EnqueueFunc(data []byte, done func(seq uint32, err error)) (uint32, error) {
+	if err := t.soleReceiver(); err != nil {
+		return 0, err
+	}
+	if !t.device.IsPaired {
+		return 0, proto.ErrNotPaired
+	}
+	if len(data) > t.maxPayload() {
+		return 0, proto.ErrInvalidPayload
+	}
+	q := &t.sendQueue
+	q.mu.Lock()
+	for !q.closed && q.cfg.Store == nil && len(q.items) >= q.cfg.Capacity && q.cfg.Policy == QueueBlock {
+		q.cond.Wait()
+	}
+	if q.closed {
+		q.mu.Unlock()
+		return 0, proto.ErrClosed
+	}
+	if q.cfg.Store != nil && (q.stored > 0 || len(q.items) >= q.cfg.Capacity) {
+		seq, err := t.spillLocked(data, done)
+		q.mu.Unlock()
+		return seq, err
+	}
+	var dropped []queuedMsg
+	if len(q.items) >= q.cfg.Capacity {
+		if q.cfg.Policy == QueueReject {
+			q.mu.Unlock()
+			return 0, proto.ErrQueueFull
+		}
+		n := len(q.items) - q.cfg.Capacity + 1
+		dropped = append(dropped, q.items[:n]...)
+		q.items = append(q.items[:0], q.items[n:]...)
+	}
+	m := queuedMsg{seq: t.nextSeq(), queued: time.Now(), data: append([]byte(nil), data...), done: done}
+	q.items = append(q.items, m)
+	t.wakeWorkerLocked()
+	q.mu.Unlock()
+
+	for _, d := range dropped {
+		d.report(proto.ErrQueueFull)
+	}
+	return m.seq, nil
+}
+
+// spillLocked appends a message to the queue's store.
+func (t *Transmitter) spillLocked(data []byte, done func(uint32, error)) (uint32, error) {
+	q := &t.sendQueue
+	seq := t.nextSeq()
+	if err := q.cfg.Store.Append(StoredMessage{Seq: seq, Queued: time.Now(), Data: data}); err != nil {
+		return 0, err
+	}
+	q.stored++
+	if done != nil {
+		q.callbacks[seq] = done
+	}
+	t.wakeWorkerLocked()
+	return seq, nil
+}
+
+// wakeWorkerLocked starts the worker or tells it a message was queued.
+func (t *Transmitter) wakeWorkerLocked() {
+	q := &t.sendQueue
+	if !q.started {
+		q.started = true
+		go t.sendWorker()
+	}
+	q.cond.Broadcast()
+}
+
+// QueueLen returns the number of messages waiting in the transmit queue,
+// including those in its store but not one the worker is sending.
+func (t *Transmitter) QueueLen() int {
+	q := &t.sendQueue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.items) + q.stored
+	if q.head != nil {
+		n-- // being sent
+	}
+	return n
+}
+
+// closeQueue shuts the transmit queue down. Messages still queued are sent
+// first if TxQueueConfig.FlushOnClose is set and abandoned with ErrClosed
+// otherwise; either way closeQueue returns once the worker has exited.
+// Enqueue fails with ErrClosed afterwards.
+func (t *Transmitter) closeQueue() {
+	q := &t.sendQueue
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	var abandoned []queuedMsg
+	if !q.cfg.FlushOnClose {
+		abandoned, q.items = q.items, nil
+	}
+	started := q.started
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	for _, m := range abandoned {
+		m.report(proto.ErrClosed)
+	}
+	if started {
+		<-q.done
+	}
+}
+
+// sendWorker sends queued messages in order until the queue is closed and
+// empty, leaving any in the store there, and the last of them has left the
+// radio.
+func (t *Transmitter) sendWorker() {
+	q := &t.sendQueue
+	defer close(q.done)
+	defer q.inflight.Wait()
+	for {
+		m, ok := t.nextQueued()
+		if !ok {
+			return
+		}
+		// Hold the message while the receiver has the transmitter paused.
+		// The wait ends early only once the transmitter is closed.
+		err := t.awaitResume(context.Background())
+		switch {
+		case err != nil:
+		case q.cfg.TTL > 0 && time.Since(m.queued) > q.cfg.TTL:
+			err = proto.ErrExpired
+		case q.cfg.Store != nil && t.linkDown():
+			err = proto.ErrTimeout // not worth trying
+		default:
+			if t.sendQueuedAsync(m) {
+				continue
+			}
+			err = t.sendQueued(m)
+		}
+		if err == proto.ErrTimeout && q.cfg.Store != nil && t.holdQueued(m) {
+			t.awaitLink()
+			continue
+		}
+		t.settleQueued(m)
+		if err != nil {
+			log.Printf("[Transmitter] Queued frame %d failed: %v\r\n", m.seq, err)
+		}
+		m.report(err)
+	}
+}
+
+// nextQueued waits for the next message to send and takes it off the
+// queue, or reports false once the queue is closed and nothing in memory is
+// left to send. A message from the store stays there until settleQueued.
+func (t *Transmitter) nextQueued() (queuedMsg, bool) {
+	q := &t.sendQueue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for !q.closed && len(q.items) == 0 && q.stored == 0 {
+			q.cond.Wait()
+		}
+		if len(q.items) > 0 {
+			m := q.items[0]
+			q.items[0] = queuedMsg{}
+			q.items = q.items[1:]
+			q.cond.Broadcast()
+			return m, true
+		}
+		if q.closed {
+			return queuedMsg{}, false
+		}
+		if q.head == nil {
+			q.head = t.readStoreHeadLocked()
+			if q.head == nil {
+				continue
+			}
+		}
+		return *q.head, true
+	}
+}
+
+// readStoreHeadLocked reads the first message of the store. It gives up on
+// the store's contents if they cannot be read.
+func (t *Transmitter) readStoreHeadLocked() *queuedMsg {
+	q := &t.sendQueue
+	var head *queuedMsg
+	err := q.cfg.Store.Iterate(func(s StoredMessage) bool {
+		head = &queuedMsg{seq: s.Seq, queued: s.Queued, data: s.Data, stored: true}
+		return false
+	})
+	if err != nil || head == nil {
+		log.Printf("[Transmitter] Queue store lost %d messages: %v\r\n", q.stored, err)
+		q.stored, q.inherited = 0, 0
+		return nil
+	}
+	if q.inherited > 0 {
+		q.inherited--
+		head.seq = t.nextSeq()
+	} else {
+		head.done = q.callbacks[head.seq]
+		delete(q.callbacks, head.seq)
+	}
+	return head
+}
+
+// holdQueued puts back a message whose send timed out, to be sent again
+// first. It reports false once the queue is closed.
+func (t *Transmitter) holdQueued(m queuedMsg) bool {
+	q := &t.sendQueue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || t.isClosed() {
+		return false
+	}
+	if !m.stored { // a stored message stays q.head
+		q.items = append([]queuedMsg{m}, q.items...)
+	}
+	return true
+}
+
+// settleQueued removes a message from the store once it was sent or given
+// up on.
+func (t *Transmitter) settleQueued(m queuedMsg) {
+	if !m.stored {
+		return
+	}
+	q := &t.sendQueue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.cfg.Store.Truncate(1); err != nil {
+		log.Printf("[Transmitter] Removing frame %d from the queue store failed: %v\r\n", m.seq, err)
+	}
+	q.stored--
+	q.head = nil
+	q.cond.Broadcast()
+}
+
+// awaitLink holds the worker after a queued send timed out. It returns when
+// a monitored heartbeat is acknowledged or, unless the link monitor has
+// found the link down, after a heartbeat interval, so that the next send
+// probes the link. It returns at once when the transmitter is closed.
+func (t *Transmitter) awaitLink() {
+	var probe <-chan time.Time
+	if !t.linkDown() {
+		timer := time.NewTimer(t.heartbeatInterval())
+		defer timer.Stop()
+		probe = timer.C
+	}
+	select {
+	case <-t.sendQueue.linkUp:
+	case <-probe:
+	case <-t.closing:
+	}
+}
+
+// sendQueued transmits a message taken from the transmit queue.
+func (t *Transmitter) sendQueued(m queuedMsg) error {
+	if !t.device.IsPaired {
+		return proto.ErrNotPaired
+	}
+	if len(m.data) > t.maxPayload() {
+		return proto.ErrInvalidPayload
+	}
+	if retries := t.sendQueue.cfg.Retries; retries > 0 {
+		_, _, err := t.sendReliableSeq(context.Background(), proto.FrameTypeData, m.seq, m.data, retries)
+		return err
+	}
+	if err := t.easeOff(context.Background()); err != nil {
+		return err
+	}
+	return t.tx(t.linkConfig().EncodeFrame(t.newFrame(proto.FrameTypeData, m.seq, m.data)))
+}
@@ -0,0 +1,110 @@
+package transport
+
+import (
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// SeqJump is how far a restored transmitter skips ahead of the saved
+// sequence number, to stay clear of the frames it sent after the last
+// checkpoint.
+const SeqJump = 1000
+
+// seqCheckpointInterval is how many frames pass between checkpoints of the
+// sequence state, well within SeqJump.
+const seqCheckpointInterval = SeqJump / 2
+
+// SeqState is the part of a transmitter's state that must survive a
+// restart so that its frames keep increasing sequence numbers.
+type SeqState struct {
+	Seq   uint32 // next sequence number
+	Epoch uint32 // restarts so far, zero if never restored
+}
+
+// WithSeqState makes a Transmitter continue from a SeqState saved by an
+// OnSeqCheckpoint callback before it restarted. Its first frame is numbered
+// SeqJump past the saved number and its epoch is one higher; the epoch is
+// announced to the receiver, which then knows the transmitter restarted. A
+// transmitter with a BondStore restores the state saved with its bonds
+// without this option.
+func WithSeqState(state SeqState) Option {
+	return func(o *options) { o.seqState = &state }
+}
+
+// seqCheckpoint is the state of OnSeqCheckpoint, guarded by txMu.
+type seqCheckpoint struct {
+	fn   func(SeqState)
+	last uint32 // sequence number of the last checkpoint
+}
+
+// SeqState returns the transmitter's sequence state, for saving.
+func (t *Transmitter) SeqState() SeqState {
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	return SeqState{Seq: t.seq, Epoch: t.epoch}
+}
+
+// OnSeqCheckpoint registers fn to persist the sequence state, for instance
+// to flash. It is called at once and then every few hundred frames, on the
+// goroutine sending the frame, so it should be quick; restoring the last
+// state saved with WithSeqState is enough to keep sequence numbers
+// increasing. A transmitter with a BondStore saves the state with the bond
+// of the receiver at the same points. Pass nil to remove the callback.
+func (t *Transmitter) OnSeqCheckpoint(fn func(SeqState)) {
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	t.checkpoint.fn = fn
+	t.checkpointLocked()
+}
+
+// restoreSeq continues from state if it is ahead of the state in use.
+func (t *Transmitter) restoreSeq(state SeqState) {
+	epoch := state.Epoch + 1
+	seq := state.Seq + SeqJump
+	if epoch < t.epoch || epoch == t.epoch && int32(seq-t.seq) <= 0 {
+		return
+	}
+	t.epoch, t.seq = epoch, seq
+	log.Printf("[Transmitter] Restarting at seq=%d, epoch %d\r\n", seq, epoch)
+}
+
+// maybeCheckpointLocked takes a checkpoint if enough frames went out since
+// the last one. txMu must be held.
+func (t *Transmitter) maybeCheckpointLocked() {
+	if t.seq-t.checkpoint.last >= seqCheckpointInterval && (t.checkpoint.fn != nil || t.bonds != nil) {
+		t.checkpointLocked()
+	}
+}
+
+// checkpointLocked saves the sequence state. txMu must be held.
+func (t *Transmitter) checkpointLocked() {
+	state := SeqState{Seq: t.seq, Epoch: t.epoch}
+	t.checkpoint.last = t.seq
+	if t.checkpoint.fn != nil {
+		t.checkpoint.fn(state)
+	}
+	if t.device.IsPaired {
+		t.saveBondState(state)
+	}
+}
+
+// rebootedLocked resets what the receiver tracks about the frames of dev
+// when it announces a new boot epoch.
+func (r *Receiver) rebootedLocked(dev *proto.Device, epoch uint32) {
+	if epoch == 0 || epoch == dev.Epoch {
+		return
+	}
+	restarted := dev.Epoch != 0
+	if restarted {
+		log.Printf("[Receiver] Device %d restarted (epoch %d)\r\n", dev.ID, epoch)
+	}
+	dev.Epoch = epoch
+	delete(r.assembly, dev.ID)
+	delete(r.streams, dev.ID)
+	r.resetSeqLocked(dev.ID)
+	r.saveBondLocked(dev)
+	if restarted {
+		r.deviceEventLocked(DeviceRebooted, dev.ID)
+	}
+}
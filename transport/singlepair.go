@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// SetSinglePairMode makes the receiver serve one transmitter at a time, for
+// products built as a fixed pair. Once a transmitter pairs, pairing
+// requests from others are ignored as if the pairing window were closed,
+// until that transmitter is unpaired or times out; it may itself pair again,
+// for instance after a restart. While the window is otherwise open, the
+// pairing window handler is told PairingWindowClosed when the transmitter
+// pairs and PairingWindowOpened when it leaves.
+func (r *Receiver) SetSinglePairMode(enabled bool) {
+	r.mu.Lock()
+	r.singlePair = enabled
+	r.mu.Unlock()
+	r.noteSinglePair()
+}
+
+// singlePairTakenLocked reports whether single-pair mode turns away the
+// pairing request of id because another transmitter is paired or about to
+// be.
+func (r *Receiver) singlePairTakenLocked(id proto.DeviceID) bool {
+	if !r.singlePair {
+		return false
+	}
+	for other := range r.pairedDevices {
+		if other != id {
+			return true
+		}
+	}
+	for other := range r.confirmations {
+		if other != id {
+			return true
+		}
+	}
+	return false
+}
+
+// singlePairTaken is singlePairTakenLocked for callers without the lock.
+func (r *Receiver) singlePairTaken(id proto.DeviceID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.singlePairTakenLocked(id)
+}
+
+// noteSinglePair tells the pairing window handler when single-pair mode
+// closes pairing to further transmitters or opens it again.
+func (r *Receiver) noteSinglePair() {
+	r.mu.Lock()
+	full := r.singlePair && len(r.pairedDevices) > 0
+	changed := full != r.singleFull
+	r.singleFull = full
+	open := r.pairingOpenLocked()
+	h := r.windowHandler
+	r.mu.Unlock()
+
+	if !changed || !open {
+		return
+	}
+	ev := PairingWindowOpened
+	if full {
+		ev = PairingWindowClosed
+		log.Printf("[Receiver] Transmitter paired, pairing closed\r\n")
+	} else {
+		log.Printf("[Receiver] Transmitter gone, pairing open\r\n")
+	}
+	if h != nil {
+		h(ev)
+	}
+}
@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"sort"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// StateVersion is the version of the snapshots ExportState writes, the only
+// one ImportState reads.
+const StateVersion = 1
+
+// stateMagic starts every snapshot.
+var stateMagic = [4]byte{'N', 'R', 'F', 'S'}
+
+// stateOverhead is the size of a snapshot without devices: the magic, the
+// version, the device count and the trailing CRC-32.
+const stateOverhead = 4 + 1 + 2 + 4
+
+// ExportState returns a snapshot of the receiver's paired transmitters, with
+// what a BondStore would keep of each: keys, metadata and link settings.
+// The snapshot is a compact binary blob, versioned and checksummed, for the
+// application to keep wherever it likes and hand to ImportState after a
+// restart.
+func (r *Receiver) ExportState() ([]byte, error) {
+	r.mu.Lock()
+	bonds := make([]Bond, 0, len(r.pairedDevices))
+	for _, dev := range r.pairedDevices {
+		bonds = append(bonds, bondOf(dev))
+	}
+	r.mu.Unlock()
+	sort.Slice(bonds, func(i, j int) bool { return bonds[i].ID < bonds[j].ID })
+	return encodeState(bonds)
+}
+
+// ImportState replaces the receiver's paired transmitters with those of a
+// snapshot taken by ExportState, so that they are served without pairing
+// again. Transmitters paired before and missing from the snapshot are
+// dropped without notice. With a BondStore, the bonds are updated to match.
+//
+// It returns ErrStateVersion for a snapshot of another version and
+// ErrStateCorrupt for one that does not decode, leaving the receiver as it
+// was.
+func (r *Receiver) ImportState(data []byte) error {
+	bonds, err := decodeState(data)
+	if err != nil {
+		return err
+	}
+	devices := make(map[proto.DeviceID]*proto.Device, len(bonds))
+	for _, b := range bonds {
+		dev := proto.NewTransmitter(b.ID)
+		b.restore(dev)
+		devices[b.ID] = dev
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id := range r.pairedDevices {
+		if _, kept := devices[id]; !kept {
+			delete(r.devStats, id)
+			delete(r.paused, id)
+			r.resetDeviceLocked(id)
+			r.deleteBondLocked(id)
+		}
+	}
+	for id, dev := range devices {
+		delete(r.pairingAcks, id)
+		delete(r.devEvents.lost, id)
+		r.resetDeviceLocked(id)
+		r.saveBondLocked(dev)
+	}
+	r.pairedDevices = devices
+	log.Printf("[Receiver] Imported %d paired devices\r\n", len(devices))
+	return nil
+}
+
+// encodeState lays out bonds as a snapshot.
+func encodeState(bonds []Bond) ([]byte, error) {
+	if len(bonds) > 0xFFFF {
+		return nil, proto.ErrInvalidPayload
+	}
+	le := binary.LittleEndian
+	buf := append([]byte(nil), stateMagic[:]...)
+	buf = append(buf, StateVersion)
+	buf = le.AppendUint16(buf, uint16(len(bonds)))
+	for _, b := range bonds {
+		if len(b.SessionKey) > 0xFF || len(b.Info.Name) > 0xFF || b.MaxFrameSize < 0 || b.MaxFrameSize > 0xFFFF {
+			return nil, proto.ErrInvalidPayload
+		}
+		key := b.PairingKey.Bytes()
+		buf = le.AppendUint32(buf, uint32(b.ID))
+		buf = append(append(buf, byte(len(key))), key...)
+		buf = le.AppendUint16(buf, uint16(b.MaxFrameSize))
+		buf = append(append(buf, byte(len(b.SessionKey))), b.SessionKey...)
+		buf = append(buf, b.KeyIndex)
+		buf = le.AppendUint32(buf, b.RollCounter)
+		buf = le.AppendUint32(buf, uint32(b.Capabilities))
+		buf = le.AppendUint32(buf, uint32(b.Heartbeat/time.Millisecond))
+		buf = append(buf, b.Channel)
+		buf = le.AppendUint32(buf, b.Address)
+		buf = append(buf, b.Prefix)
+		buf = le.AppendUint32(buf, b.Epoch)
+		buf = append(buf, b.Info.Class)
+		buf = le.AppendUint32(buf, b.Info.Firmware)
+		buf = append(append(buf, byte(len(b.Info.Name))), b.Info.Name...)
+	}
+	return le.AppendUint32(buf, crc32.ChecksumIEEE(buf)), nil
+}
+
+// decodeState returns the bonds of a snapshot.
+func decodeState(data []byte) ([]Bond, error) {
+	if len(data) < stateOverhead || [4]byte(data[:4]) != stateMagic {
+		return nil, proto.ErrStateCorrupt
+	}
+	if data[4] != StateVersion {
+		return nil, proto.ErrStateVersion
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, proto.ErrStateCorrupt
+	}
+
+	s := stateReader{b: body[5:], ok: true}
+	n := int(s.u16())
+	bonds := make([]Bond, 0, n)
+	seen := make(map[proto.DeviceID]bool, n)
+	for i := 0; i < n && s.ok; i++ {
+		var b Bond
+		b.ID = proto.DeviceID(s.u32())
+		if key := s.bytes(); len(key) > 0 {
+			k, err := proto.NewPairingKey(key)
+			if err != nil {
+				return nil, proto.ErrStateCorrupt
+			}
+			b.PairingKey = k
+		}
+		b.MaxFrameSize = int(s.u16())
+		if session := s.bytes(); len(session) > 0 {
+			b.SessionKey = append([]byte(nil), session...)
+		}
+		b.KeyIndex = s.u8()
+		b.RollCounter = s.u32()
+		b.Capabilities = proto.Capability(s.u32())
+		b.Heartbeat = time.Duration(s.u32()) * time.Millisecond
+		b.Channel = s.u8()
+		b.Address = s.u32()
+		b.Prefix = s.u8()
+		b.Epoch = s.u32()
+		b.Info.Class = s.u8()
+		b.Info.Firmware = s.u32()
+		b.Info.Name = string(s.bytes())
+		if seen[b.ID] || b.Channel > 125 {
+			return nil, proto.ErrStateCorrupt
+		}
+		seen[b.ID] = true
+		bonds = append(bonds, b)
+	}
+	if !s.ok || len(s.b) != 0 {
+		return nil, proto.ErrStateCorrupt
+	}
+	return bonds, nil
+}
+
+// stateReader takes the fields of a snapshot in turn. Once one runs past the
+// end, ok is false and all read as zero.
+type stateReader struct {
+	b  []byte
+	ok bool
+}
+
+func (s *stateReader) next(n int) []byte {
+	if !s.ok || len(s.b) < n {
+		s.ok = false
+		return make([]byte, n)
+	}
+	v := s.b[:n]
+	s.b = s.b[n:]
+	return v
+}
+
+func (s *stateReader) u8() byte      { return s.next(1)[0] }
+func (s *stateReader) u16() uint16   { return binary.LittleEndian.Uint16(s.next(2)) }
+func (s *stateReader) u32() uint32   { return binary.LittleEndian.Uint32(s.next(4)) }
+func (s *stateReader) bytes() []byte { return s.next(int(s.u8())) }
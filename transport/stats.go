@@ -0,0 +1,199 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// DeliveryResult describes how a reliable send went.
+type DeliveryResult struct {
+	Attempts      int           // transmissions of the frame, including the first
+	Elapsed       time.Duration // from the first transmission to the outcome
+	Retransmitted bool          // the frame was delivered by a retransmission
+}
+
+// TxStats are the counters of a transmitter, accumulated since it was
+// created or since the last ResetStats.
+type TxStats struct {
+	// FramesSent counts transmissions by frame type, indexed by the
+	// protocol.FrameType constants. Retransmissions count again.
+	FramesSent [proto.FrameTypeMask + 1]uint64 `json:"frames_sent"`
+	BytesSent  uint64                          `json:"bytes_sent"` // encoded bytes transmitted
+
+	ReliableSends uint64        `json:"reliable_sends"` // reliable sends attempted, delivered or not
+	Delivered     uint64        `json:"delivered"`      // reliable sends that were ACKed
+	Attempts      uint64        `json:"attempts"`       // transmissions made by reliable sends
+	Retransmitted uint64        `json:"retransmitted"`  // deliveries that needed a retransmission
+	Timeouts      uint64        `json:"timeouts"`       // reliable sends that ran out of retries
+	ReliableTime  time.Duration `json:"reliable_time"`  // total time spent in reliable sends
+
+	AcksReceived uint64        `json:"acks_received"` // ACKs received from the paired receiver
+	LastAck      time.Time     `json:"last_ack"`      // when the last of them arrived; zero if none has
+	LastAckAge   time.Duration `json:"last_ack_age"`  // time since LastAck when Stats was called
+	CRCErrors    uint64        `json:"crc_errors"`    // frames read from the radio that did not decode
+
+	// HWCRCErrors and FrameCRCErrors split CRCErrors into the frames the
+	// radio's CRC rejected and those that failed to decode.
+	HWCRCErrors    uint64 `json:"hw_crc_errors"`
+	FrameCRCErrors uint64 `json:"frame_crc_errors"`
+
+	// Airtime is the estimated time on the air of the frames sent, see
+	// DutyCycleConfig.BitRate.
+	Airtime time.Duration `json:"airtime"`
+
+	// AirtimeLeft is what the WithDutyCycle limiter allows right now,
+	// zero without a limiter. It is not reset by ResetStats.
+	AirtimeLeft      time.Duration `json:"airtime_left"`
+	DutyCycleWaits   uint64        `json:"duty_cycle_waits"`   // sends that waited for the budget to refill
+	DutyCycleRejects uint64        `json:"duty_cycle_rejects"` // sends that failed with ErrDutyCycle
+
+	// HeartbeatsSkipped counts heartbeats the heartbeat task left out
+	// because data kept the link alive.
+	HeartbeatsSkipped uint64 `json:"heartbeats_skipped"`
+
+	// RTT is the smoothed round-trip time from a reliable send to its ACK
+	// and RTTVar its mean deviation, zero before the first measurement.
+	// AckTimeout is how long reliable sends currently wait for an ACK, see
+	// WithAckTimeout. None of them is reset by ResetStats.
+	RTT        time.Duration `json:"rtt"`
+	RTTVar     time.Duration `json:"rtt_var"`
+	AckTimeout time.Duration `json:"ack_timeout"`
+}
+
+// AckRatio returns the share of reliable sends that were ACKed, or 0 before
+// the first one.
+func (s TxStats) AckRatio() float64 {
+	if s.ReliableSends == 0 {
+		return 0
+	}
+	return float64(s.Delivered) / float64(s.ReliableSends)
+}
+
+// txStats guards the counters so that they can be read while sends are in
+// flight.
+type txStats struct {
+	mu          sync.Mutex
+	s           TxStats
+	lastTraffic time.Time // last frame that counts as a sign of life, see keepsAlive
+	lastContact time.Time // see LastReceiverContact
+}
+
+// Stats returns a copy of the transmitter's counters. It is safe to call
+// while sends are in flight.
+func (t *Transmitter) Stats() TxStats {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	s := t.stats.s
+	if !s.LastAck.IsZero() {
+		s.LastAckAge = time.Since(s.LastAck)
+	}
+	s.AirtimeLeft = t.dutyCycle.available()
+	s.RTT, s.RTTVar, s.AckTimeout = t.rtt.stats()
+	return s
+}
+
+// ResetStats zeroes the transmitter's counters, including LastAck.
+func (t *Transmitter) ResetStats() {
+	t.stats.mu.Lock()
+	t.stats.s = TxStats{}
+	t.stats.mu.Unlock()
+}
+
+// frameTypeOffset is where the type byte of an encoded frame sits, after
+// the length and sender ID.
+const frameTypeOffset = proto.LengthFieldSize + 4
+
+// recordTx counts an encoded frame that went on the air.
+func (t *Transmitter) recordTx(data []byte) {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	if len(data) > frameTypeOffset {
+		frameType := data[frameTypeOffset] & proto.FrameTypeMask
+		t.stats.s.FramesSent[frameType]++
+		if keepsAlive(frameType) {
+			t.stats.lastTraffic = time.Now()
+		}
+	}
+	t.stats.s.BytesSent += uint64(len(data))
+	t.stats.s.Airtime += t.dutyCycle.airtime(len(data))
+}
+
+// recordDutyCycle counts a send held up by the airtime limiter.
+func (t *Transmitter) recordDutyCycle(rejected bool) {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	if rejected {
+		t.stats.s.DutyCycleRejects++
+	} else {
+		t.stats.s.DutyCycleWaits++
+	}
+}
+
+// recordRx counts a packet read from the radio whose frame failed the
+// hardware CRC or did not decode.
+func (t *Transmitter) recordRx(p RxPacket, frame *proto.Frame) {
+	if frame != nil {
+		return
+	}
+	t.stats.mu.Lock()
+	t.stats.s.CRCErrors++
+	if p.HWCRCOK {
+		t.stats.s.FrameCRCErrors++
+	} else {
+		t.stats.s.HWCRCErrors++
+	}
+	t.stats.mu.Unlock()
+}
+
+// recordContact notes a frame from the receiver.
+func (t *Transmitter) recordContact() {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	t.stats.lastContact = time.Now()
+}
+
+// recordAck counts an ACK from the paired receiver.
+func (t *Transmitter) recordAck() {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	t.stats.s.AcksReceived++
+	t.stats.s.LastAck = time.Now()
+}
+
+// keepsAlive reports whether the receiver takes a frame of the given type
+// as a sign of life of its sender, as it does heartbeats.
+func keepsAlive(frameType byte) bool {
+	switch frameType {
+	case proto.FrameTypeData, proto.FrameTypeBatch, proto.FrameTypeFragment,
+		proto.FrameTypeDirected, proto.FrameTypeStream, proto.FrameTypeBlob:
+		return true
+	}
+	return false
+}
+
+// recordHeartbeatSkipped counts a heartbeat left out by the heartbeat task.
+func (t *Transmitter) recordHeartbeatSkipped() {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	t.stats.s.HeartbeatsSkipped++
+}
+
+// recordDelivery adds the outcome of a reliable send to the counters.
+func (t *Transmitter) recordDelivery(res DeliveryResult, err error) {
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+	t.stats.s.ReliableSends++
+	t.stats.s.Attempts += uint64(res.Attempts)
+	t.stats.s.ReliableTime += res.Elapsed
+	switch err {
+	case nil:
+		t.stats.s.Delivered++
+		if res.Retransmitted {
+			t.stats.s.Retransmitted++
+		}
+	case proto.ErrTimeout:
+		t.stats.s.Timeouts++
+	}
+}
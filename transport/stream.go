@@ -0,0 +1,225 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// streamRetries is how many times each stream chunk is sent before the
+// write fails.
+const streamRetries = fragmentRetries
+
+// txStream is the writer returned by Transmitter.Stream.
+type txStream struct {
+	t      *Transmitter
+	mu     sync.Mutex
+	id     byte
+	offset uint32 // stream position of buf[0]
+	buf    []byte // written, not yet sent
+	err    error  // first failure, or ErrClosed once closed
+}
+
+// Stream returns a writer sending a byte stream to the paired receiver,
+// which reads it with Receiver.Stream. Written bytes are collected into
+// frames as large as the link allows and each frame is sent reliably, so
+// a write blocks while the receiver is slow to ACK and the stream arrives
+// complete and in order. Close sends the last partial frame and ends the
+// stream. A write that fails ends the stream for good: the writer returns
+// the same error from then on.
+//
+// Streaming requires a receiver with CapStream; writes return
+// ErrUnsupported otherwise.
+func (t *Transmitter) Stream() io.WriteCloser {
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	t.streamID++
+	return &txStream{t: t, id: t.streamID}
+}
+
+func (s *txStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.buf = append(s.buf, p...)
+	if err := s.flushLocked(false); err != nil {
+		n := len(p) - len(s.buf)
+		if n < 0 {
+			n = 0
+		}
+		return n, err
+	}
+	return len(p), nil
+}
+
+// Close sends what is left of the stream and marks its end.
+func (s *txStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		if s.err == proto.ErrClosed {
+			return nil
+		}
+		return s.err
+	}
+	if err := s.flushLocked(true); err != nil {
+		return err
+	}
+	if err := s.sendLocked(nil); err != nil {
+		return err
+	}
+	s.err = proto.ErrClosed
+	return nil
+}
+
+// flushLocked sends the buffered bytes in full frames, and the last partial
+// one as well if all is set.
+func (s *txStream) flushLocked(all bool) error {
+	if err := s.t.soleReceiver(); err != nil {
+		s.err = err
+		return err
+	}
+	for len(s.buf) > 0 {
+		if !s.t.device.HasCapability(proto.CapStream) {
+			s.err = proto.ErrUnsupported
+			return s.err
+		}
+		size := s.t.maxPayload() - proto.StreamHeaderSize
+		if size <= 0 {
+			s.err = proto.ErrInvalidPayload
+			return s.err
+		}
+		if len(s.buf) < size {
+			if !all {
+				return nil
+			}
+			size = len(s.buf)
+		}
+		if err := s.sendLocked(s.buf[:size]); err != nil {
+			return err
+		}
+		s.buf = s.buf[size:]
+		s.offset += uint32(size)
+	}
+	return nil
+}
+
+// sendLocked sends chunk at the current offset, or the end of the stream
+// if chunk is empty.
+func (s *txStream) sendLocked(chunk []byte) error {
+	payload := proto.EncodeStreamChunk(s.id, s.offset, chunk)
+	if _, _, err := s.t.sendReliable(context.Background(), proto.FrameTypeStream, payload, streamRetries); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+// rxStream is what the receiver holds of the stream a transmitter sends.
+type rxStream struct {
+	id   byte
+	next uint32 // offset of the next chunk expected
+	buf  []byte // received, not yet read
+	done bool   // the stream ends after buf
+	read bool   // a reader got to the end
+}
+
+// streamLocked adds a stream chunk from a paired device to its stream. A
+// chunk of another stream, or the start of a new one after the end of the
+// last, replaces the stream held so far.
+func (r *Receiver) streamLocked(frame *proto.Frame) {
+	id, offset, data, ok := proto.DecodeStreamChunk(frame.Payload)
+	if !ok {
+		return
+	}
+	s := r.streams[frame.SenderID]
+	if s == nil || s.id != id || s.done && offset == 0 && len(data) > 0 {
+		s = &rxStream{id: id}
+		r.streams[frame.SenderID] = s
+	}
+	if s.done || offset != s.next {
+		return // retransmission of a chunk whose ACK was lost
+	}
+	if len(data) == 0 {
+		s.done = true
+		return
+	}
+	s.buf = append(s.buf, data...)
+	s.next += uint32(len(data))
+}
+
+// streamReader is the reader returned by Receiver.Stream.
+type streamReader struct {
+	r    *Receiver
+	from proto.DeviceID
+	s    *rxStream // stream being read, nil until it starts
+	eof  bool
+}
+
+// Stream returns a reader of the next byte stream the paired transmitter
+// from sends with Transmitter.Stream, or of the one it is sending. Reads
+// block until data arrives and return io.EOF once the transmitter closed
+// the stream and everything was read; a reader is good for one stream.
+// Unless the receiver is listening, reads receive frames themselves. The
+// transmitter sends the end of the stream again if its ACK is lost, so the
+// receiver should then go on receiving until the transmitter's Close
+// returns.
+//
+// A read fails with ErrTimeout if the transmitter times out while the
+// reader waits, with ErrNotPaired if it is not paired, and with
+// io.ErrUnexpectedEOF if the transmitter restarts or starts another stream
+// before this one ended.
+func (r *Receiver) Stream(from proto.DeviceID) io.Reader {
+	return &streamReader{r: r, from: from}
+}
+
+func (rd *streamReader) Read(p []byte) (int, error) {
+	if rd.eof {
+		return 0, io.EOF
+	}
+	r := rd.r
+	for {
+		r.mu.Lock()
+		s := r.streams[rd.from]
+		if rd.s == nil && s != nil && !s.read {
+			rd.s = s
+		}
+		if rd.s != nil && s != rd.s {
+			r.mu.Unlock()
+			return 0, io.ErrUnexpectedEOF
+		}
+		if s = rd.s; s != nil && len(s.buf) > 0 {
+			n := copy(p, s.buf)
+			s.buf = s.buf[n:]
+			r.mu.Unlock()
+			return n, nil
+		}
+		if s != nil && s.done {
+			s.read = true
+			r.mu.Unlock()
+			rd.eof = true
+			return 0, io.EOF
+		}
+		dev, paired := r.pairedDevices[rd.from]
+		alive := paired && dev.IsAliveWithin(r.deviceTimeout(dev))
+		r.mu.Unlock()
+		listening := r.listening()
+
+		if !paired {
+			return 0, proto.ErrNotPaired
+		}
+		if !alive {
+			return 0, proto.ErrTimeout
+		}
+		if listening {
+			time.Sleep(time.Millisecond)
+		} else if frame := r.pollFrame(); frame != nil {
+			r.processFrame(frame)
+		}
+	}
+}
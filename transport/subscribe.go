@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"sync"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// FramesPolicy decides what happens to a frame for a Frames channel whose
+// buffer is full.
+type FramesPolicy uint8
+
+const (
+	FramesDropNewest FramesPolicy = iota // discard the frame, counted by DroppedSubscriptionFrames
+	FramesBlock                          // wait for the reader, holding up the frames behind it
+)
+
+// subscription is a channel of Frames.
+type subscription struct {
+	ch     chan *proto.Frame
+	policy FramesPolicy
+	done   chan struct{} // closed by cancel, releases a blocked send
+	mu     sync.RWMutex  // held for reading by sends, for writing to close ch
+	closed bool
+	once   sync.Once
+	handle CallbackHandle
+}
+
+// Frames returns a channel receiving the frames of type frameType, along
+// with a function that ends the subscription and closes the channel. The
+// channel is fed like a callback registered with RegisterCallback, in
+// order with the callbacks, and shares its frames with them: they must not
+// be modified. A full channel drops the frame unless policy is FramesBlock,
+// in which case the receiver waits for the reader and frames behind it wait
+// too. Closing the receiver closes the channels of all subscriptions.
+func (r *Receiver) Frames(frameType byte, buffer int, policy ...FramesPolicy) (<-chan *proto.Frame, func()) {
+	if buffer < 0 {
+		buffer = 0
+	}
+	s := &subscription{ch: make(chan *proto.Frame, buffer), done: make(chan struct{})}
+	if len(policy) > 0 {
+		s.policy = policy[0]
+	}
+	r.mu.Lock()
+	if r.isClosed() {
+		r.mu.Unlock()
+		close(s.ch)
+		return s.ch, func() {}
+	}
+	if r.subscriptions == nil {
+		r.subscriptions = make(map[*subscription]struct{})
+	}
+	r.subscriptions[s] = struct{}{}
+	s.handle = r.addCallbackLocked(r.callbacks, frameType, &frameCallback{fn: func(f *proto.Frame) { r.feed(s, f) }})
+	r.mu.Unlock()
+
+	return s.ch, func() {
+		r.UnregisterCallback(s.handle)
+		r.mu.Lock()
+		delete(r.subscriptions, s)
+		r.mu.Unlock()
+		s.close()
+	}
+}
+
+// DroppedSubscriptionFrames returns how many frames were dropped because a
+// Frames channel was full.
+func (r *Receiver) DroppedSubscriptionFrames() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subscriptionDrops
+}
+
+// feed sends f on the channel of s according to its policy.
+func (r *Receiver) feed(s *subscription, f *proto.Frame) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	if s.policy == FramesBlock {
+		select {
+		case s.ch <- f:
+		case <-s.done:
+		}
+		return
+	}
+	select {
+	case s.ch <- f:
+	default:
+		r.mu.Lock()
+		r.subscriptionDrops++
+		r.mu.Unlock()
+	}
+}
+
+// close ends s once no send is in progress.
+func (s *subscription) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+}
+
+// closeSubscriptions closes the channels of all Frames subscriptions.
+func (r *Receiver) closeSubscriptions() {
+	r.mu.Lock()
+	subs := r.subscriptions
+	r.subscriptions = nil
+	r.mu.Unlock()
+	for s := range subs {
+		r.UnregisterCallback(s.handle)
+		s.close()
+	}
+}
@@ -1,32 +1,199 @@
 package transport
 
 import (
+	"context"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	proto "github.com/ystepanoff/nrfcomm/protocol"
 )
 
 // Transmitter encapsulates high-level logic for a radio transmitter.
+//
+// Sending is safe for concurrent use: SendFrame, SendData and the other
+// send methods may be called from several goroutines, also while the
+// heartbeat task runs, and every frame gets its own sequence number.
+// Frames sent without waiting for an ACK go on the air in sequence order.
+// Pairing, configuration and methods waiting for an answer from the
+// receiver must still not run concurrently with each other.
 type Transmitter struct {
-	device     *proto.Device
-	driver     RadioDriver
-	seq        uint32
-	receiver   proto.DeviceID
-	pairingKey uint32
+	device         *proto.Device
+	driver         RadioDriver
+	config         proto.Config
+	txMu           sync.Mutex // guards seq and driver.Tx
+	seq            uint32
+	epoch          uint32        // see SeqState
+	checkpoint     seqCheckpoint // guarded by txMu
+	receiver       proto.DeviceID
+	pairingKey     proto.PairingKey
+	presharedKey   bool
+	securePairing  bool
+	clock          func() uint32
+	queue          txQueue
+	batch          batcher
+	rekey          *pendingRekey
+	heartbeatMu    sync.Mutex // guards the heartbeat task and config.HeartbeatInterval
+	heartbeatStop  chan struct{}
+	heartbeatDone  chan struct{}
+	heartbeatReset chan time.Duration // new interval for the running task
+	bonds          BondStore
+	info           proto.DeviceInfo
+	caps           proto.Capability
+	rand           proto.RandSource // nil: the package-wide source
+	psk            []byte           // see WithPairingPSK
+	hop            bool             // see WithPairingChannel
+	pairingChannel uint8
+	msgID          byte
+	streamID       byte // guarded by txMu, see Stream
+	noDataChannel  bool // ask the receiver to keep the link on the pairing link
+	onDataLink     bool // moved to the receiver's data link, see followDataLink
+	pairingLink    link
+	repair         autoRepair
+	linkHandler    func(LinkEvent)
+	health         func() proto.HealthReport // guarded by txMu, see SetHealthProvider
+	monitor        linkMonitor
+	stats          txStats
+	sendQueue      sendQueue
+	peers          peerSet
+	pairing        pairingState // see IsPaired
+	dutyCycle      dutyCycle
+	csma           csma
+	idle           idleState
+	rtt            rttEstimator
+	hopping        channelHopping
+	listener       txListener
+	acks           ackDispatch
+	goodbye        bool          // see WithGoodbye
+	closing        chan struct{} // closed by Close
+	closeOnce      sync.Once
+	downlink       downlinkState
+	flow           flowControl // see Receiver.PauseDevice
+	backpressure   backpressure
+	echoes         atomic.Uint64 // see EchoedFrames
+	dataRate       DataRate      // guarded by txMu, see SetDataRate
 }
 
-func NewTransmitterWithDriver(id proto.DeviceID, d RadioDriver) *Transmitter {
-	pk := proto.GeneratePairingKey()
+// downlinkState holds the callbacks of RegisterCallback and the last data
+// frame they were given.
+type downlinkState struct {
+	mu        sync.Mutex
+	callbacks map[byte]func(*proto.Frame)
+	lastSeq   uint32
+	delivered bool
+}
+
+func NewTransmitterWithDriver(id proto.DeviceID, d RadioDriver, opts ...Option) *Transmitter {
+	o := newOptions(opts)
+	if o.configErr != nil {
+		log.Printf("[Transmitter] %v, clamped to %+v\r\n", o.configErr, o.config)
+	}
+	pk, _ := proto.GeneratePairingKey(o.rand, proto.DefaultPairingKeySize)
 	t := &Transmitter{
-		device:     proto.NewTransmitter(id),
-		driver:     d,
-		pairingKey: pk,
+		device:         proto.NewTransmitter(id),
+		driver:         d,
+		config:         o.config,
+		pairingKey:     pk,
+		caps:           o.caps,
+		rand:           o.rand,
+		psk:            o.psk,
+		hop:            o.hop,
+		pairingChannel: o.pairingChannel,
+		goodbye:        o.goodbye,
+		closing:        make(chan struct{}),
 	}
+	t.sendQueue.init(o.txQueue)
+	t.dutyCycle.init(o.dutyCycle)
+	t.csma.init(o.csma, d)
+	t.rtt.init(o.ackTimeout)
 	t.device.PairingKey = pk
+	t.device.MaxFrameSize = o.config.MaxFrameSize
+	if o.bonds != nil {
+		t.bonds = o.bonds
+		t.loadBond()
+	}
+	if o.seqState != nil {
+		t.restoreSeq(*o.seqState)
+	}
+	if t.epoch != 0 {
+		// Save the new epoch before the first frame goes out.
+		t.txMu.Lock()
+		t.checkpointLocked()
+		t.txMu.Unlock()
+	}
 	return t
 }
 
+// Config returns the protocol configuration in use.
+func (t *Transmitter) Config() proto.Config { return t.config }
+
+// SetPairingKey replaces the random pairing key with a pre-shared one. A
+// pre-shared key is never sent on the air: pairing requests carry a zero
+// key field and the transmitter proves knowledge of the key by answering the
+// receiver's challenge instead. Receivers without CapLongPairingKey only
+// accept 4-byte keys.
+func (t *Transmitter) SetPairingKey(key proto.PairingKey) {
+	t.pairingKey = key
+	t.presharedKey = true
+	t.device.PairingKey = key
+}
+
+// SetPairingKeySize replaces the pairing key with a fresh random one of size
+// bytes: 4 (the default), 8 or 16. Wider keys are only sent whole to
+// receivers supporting CapLongPairingKey; with others the link keeps the
+// first four bytes.
+func (t *Transmitter) SetPairingKeySize(size int) error {
+	key, err := proto.GeneratePairingKey(t.rand, size)
+	if err != nil {
+		return err
+	}
+	t.pairingKey = key
+	t.presharedKey = false
+	t.device.PairingKey = key
+	return nil
+}
+
+// SetDeviceInfo sets the name, class and firmware version announced to the
+// receiver at the next pairing. Names that do not fit in the pairing request
+// are truncated.
+func (t *Transmitter) SetDeviceInfo(info proto.DeviceInfo) { t.info = info }
+
+// maxPayload returns the payload limit agreed with the paired receiver.
+func (t *Transmitter) maxPayload() int {
+	n := proto.Config{MaxFrameSize: t.device.MaxFrameSize}.MaxPayloadSize()
+	if t.clock != nil {
+		n -= proto.TimestampFieldSize
+	}
+	return n
+}
+
+// SetTimestampClock enables stamping outgoing frames with the millisecond
+// reading of clock, which costs 4 bytes of payload per frame. Pass nil to
+// disable stamping. See NewMillisClock for a simple uptime clock.
+func (t *Transmitter) SetTimestampClock(clock func() uint32) { t.clock = clock }
+
+// newFrame builds an outgoing frame, stamping it if a clock is set.
+func (t *Transmitter) newFrame(frameType byte, seq uint32, payload []byte) *proto.Frame {
+	frame := &proto.Frame{
+		SenderID: t.device.ID,
+		Type:     frameType,
+		Seq:      seq,
+		Payload:  payload,
+	}
+	if t.clock != nil {
+		frame.Flags |= proto.FlagTimestamp
+		frame.Timestamp = t.clock()
+	}
+	return frame
+}
+
+func (t *Transmitter) linkConfig() proto.Config {
+	cfg := t.config
+	cfg.MaxFrameSize = t.device.MaxFrameSize
+	return cfg
+}
+
 func (t *Transmitter) Initialise() {
 	t.driver.StartHFCLK()
 	_ = t.driver.Configure(t.device.Address, t.device.Prefix, t.device.Channel)
@@ -40,156 +207,492 @@ func (t *Transmitter) SetChannel(ch uint8) error {
 	return t.driver.SetChannel(ch)
 }
 
-func (t *Transmitter) SendFrame(FrameType byte, payload []byte) error {
-	if !t.device.IsPaired && FrameType != proto.FrameTypePairing {
-		return proto.ErrNotPaired
+// SetTxPower sets the radio's output power in dBm, 0 dBm by default. Lower
+// levels save battery at short range. It fails with ErrInvalidTxPower if
+// the radio does not support the level.
+func (t *Transmitter) SetTxPower(dbm int8) error {
+	if err := checkTxPower(dbm); err != nil {
+		return err
 	}
-	if len(payload) > proto.MaxPayloadSize {
-		return proto.ErrInvalidPayload
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	return t.driver.SetTxPower(dbm)
+}
+
+// SendFrame sends a frame of the given type without waiting for an ACK and
+// returns the sequence number it carries.
+func (t *Transmitter) SendFrame(FrameType byte, payload []byte) (uint32, error) {
+	return t.sendNext(FrameType, 0, func(uint32) []byte { return payload })
+}
+
+func (t *Transmitter) sendFrame(FrameType byte, payload []byte, prio proto.Priority) error {
+	_, err := t.sendNext(FrameType, prio.Flags(), func(uint32) []byte { return payload })
+	return err
+}
+
+// sendNext numbers an outgoing frame and transmits it in one step, so that
+// frames of concurrent senders go on the air in sequence order. The payload
+// is built by payload for the number the frame gets, and flags are set on
+// the frame. sendNext returns that number.
+func (t *Transmitter) sendNext(frameType, flags byte, payload func(seq uint32) []byte) (uint32, error) {
+	if t.isClosed() {
+		return 0, proto.ErrClosed
+	}
+	if !t.device.IsPaired && frameType != proto.FrameTypePairing && frameType != proto.FrameTypeControl {
+		return 0, proto.ErrNotPaired
+	}
+	if keepsAlive(frameType) {
+		if err := t.awaitResume(context.Background()); err != nil {
+			return 0, err
+		}
 	}
 
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
 	seq := t.seq
+	buf := payload(seq)
+	if len(buf) > t.maxPayload() {
+		return 0, proto.ErrInvalidPayload
+	}
 	t.seq++
 
-	frame := &proto.Frame{
-		SenderID: t.device.ID,
-		Type:     FrameType,
-		Seq:      seq,
-		Payload:  payload,
-	}
+	frame := t.newFrame(frameType, seq, buf)
+	frame.Flags |= flags
 
-	return t.driver.Tx(proto.EncodeFrame(frame))
+	return seq, t.txLocked(t.linkConfig().EncodeFrame(frame))
 }
 
-func (t *Transmitter) ReceiveFrame(timeout time.Duration) *proto.Frame {
-	data, err := t.driver.Rx(timeout)
-	if err != nil {
-		return nil
-	}
-	return proto.DecodeFrame(data)
+// nextSeq reserves the next sequence number for a frame the caller encodes
+// and transmits itself.
+func (t *Transmitter) nextSeq() uint32 {
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	seq := t.seq
+	t.seq++
+	return seq
 }
 
-func (t *Transmitter) StartPairing(receiverID proto.DeviceID) error {
-	// payload: pairingKey(4) | receiverID(4)
-	buf := make([]byte, 8)
-	for i := 0; i < 4; i++ {
-		buf[i] = byte(t.pairingKey >> (i * 8))
-		buf[4+i] = byte(receiverID >> (i * 8))
-	}
-	t.receiver = receiverID
+// tx transmits an encoded frame, serialised with other senders.
+func (t *Transmitter) tx(data []byte) error {
+	t.txMu.Lock()
+	defer t.txMu.Unlock()
+	return t.txLocked(data)
+}
 
-	// remember sequence number that will be used in this pairing Frame
-	seq := t.seq
+// txLocked transmits an encoded frame and counts it. txMu must be held, so
+// a frame waiting for airtime, see WithDutyCycle, or for a clear channel,
+// see WithCSMA, holds up other senders.
+func (t *Transmitter) txLocked(data []byte) error {
+	defer t.awake()()
+	if err := t.clearToSendLocked(data); err != nil {
+		return err
+	}
+	if err := t.driver.Tx(data); err != nil {
+		return err
+	}
+	t.recordTx(data)
+	t.maybeCheckpointLocked()
+	return nil
+}
 
-	if err := t.SendFrame(proto.FrameTypePairing, buf); err != nil {
+// clearToSendLocked waits for a clear channel and for the airtime the
+// encoded frame data needs.
+func (t *Transmitter) clearToSendLocked(data []byte) error {
+	if err := t.listenBeforeTalk(); err != nil {
 		return err
 	}
+	exempt := t.dutyCycle.cfg.ExemptHeartbeats && len(data) > frameTypeOffset &&
+		data[frameTypeOffset]&proto.FrameTypeMask == proto.FrameTypeHeartbeat
+	return t.takeAirtime(t.dutyCycle.airtime(len(data)), exempt)
+}
 
-	deadline := time.Now().Add(proto.PairingTimeout * time.Millisecond)
-	for time.Now().Before(deadline) {
-		frame := t.ReceiveFrame(100 * time.Millisecond)
-		if frame == nil {
-			continue
+func (t *Transmitter) ReceiveFrame(timeout time.Duration) *proto.Frame {
+	if rx := t.listening(); rx != nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case frame := <-rx:
+			return frame
+		case <-timer.C:
+			return nil
 		}
-		if frame.Type == proto.FrameTypeAck && frame.Seq == seq && len(frame.Payload) >= 4 {
-			sid := proto.DeviceID(uint32(frame.Payload[0]) | uint32(frame.Payload[1])<<8 | uint32(frame.Payload[2])<<16 | uint32(frame.Payload[3])<<24)
-			if sid == receiverID {
-				t.device.IsPaired = true
-				return nil
-			}
+	}
+	return t.readFrame(timeout)
+}
+
+// readFrame receives a frame from the radio, noting ACKs and handling data
+// from the receiver.
+func (t *Transmitter) readFrame(timeout time.Duration) *proto.Frame {
+	release := t.awake()
+	frame := decodeOthers(readRx(t.driver), t.config, t.device.ID, &t.echoes, t.recordRx, timeout)
+	release()
+	if frame != nil && frame.SenderID == t.receiver {
+		t.recordContact()
+	}
+	if frame != nil && frame.Type == proto.FrameTypeAck {
+		if frame.SenderID == t.receiver {
+			t.recordAck()
+			t.rtt.acked(frame.Seq)
 		}
+		t.noteHeartbeatAck(frame)
+		t.dispatchAck(frame)
+	}
+	if frame != nil && frame.Type == proto.FrameTypeData {
+		t.handleDownlink(frame)
+	}
+	if frame != nil && frame.Type == proto.FrameTypeControl {
+		t.handleFlowControl(frame)
+	}
+	return frame
+}
+
+// SendHeartbeat sends one heartbeat and returns its sequence number. With
+// the link monitor enabled it asks for an ACK and waits up to 200 ms for it;
+// see EnableLinkMonitor. It also waits when the receiver ACKs every
+// heartbeat, see WithHeartbeatAcks.
+func (t *Transmitter) SendHeartbeat() (uint32, error) {
+	if !t.device.IsPaired {
+		return 0, proto.ErrNotPaired
+	}
+	defer t.awake()()
+	var flags byte
+	monitored := t.monitoring()
+	if monitored {
+		flags = proto.FlagAckRequest
+	}
+	seq, err := t.sendNext(proto.FrameTypeHeartbeat, flags, t.heartbeatPayload)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("[Transmitter] Heartbeat sent (seq=%d)\r\n", seq)
+	if t.heartbeatAcked() {
+		t.awaitHeartbeatAck(seq)
+	}
+	return seq, nil
+}
+
+// SendData sends data once without waiting for an ACK and returns the
+// sequence number of its frame, which the receiver's ACKs and logs refer
+// to.
+func (t *Transmitter) SendData(data []byte) (uint32, error) {
+	if err := t.soleReceiver(); err != nil {
+		return 0, err
 	}
-	return proto.ErrTimeout
+	if !t.device.IsPaired {
+		return 0, proto.ErrNotPaired
+	}
+	return t.SendFrame(proto.FrameTypeData, data)
 }
 
-func (t *Transmitter) SendHeartbeat() error {
+// SendDataWithPriority sends data immediately, marking the frame with prio
+// so the receiver can see it via Frame.Priority.
+func (t *Transmitter) SendDataWithPriority(data []byte, prio proto.Priority) error {
+	if err := t.soleReceiver(); err != nil {
+		return err
+	}
 	if !t.device.IsPaired {
 		return proto.ErrNotPaired
 	}
-	err := t.SendFrame(proto.FrameTypeHeartbeat, nil)
-	if err == nil {
-		log.Printf("[Transmitter] Heartbeat sent (seq=%d)\r\n", t.seq-1)
+	if int(prio) >= proto.NumPriorities {
+		return proto.ErrInvalidPriority
 	}
-	return err
+	return t.sendFrame(proto.FrameTypeData, data, prio)
 }
 
-func (t *Transmitter) SendData(data []byte) error {
+// EnqueueWithPriority queues data for transmission by FlushQueue. Queued
+// frames are sent in strict priority order, FIFO within a priority level.
+func (t *Transmitter) EnqueueWithPriority(data []byte, prio proto.Priority) error {
+	if err := t.soleReceiver(); err != nil {
+		return err
+	}
 	if !t.device.IsPaired {
 		return proto.ErrNotPaired
 	}
-	return t.SendFrame(proto.FrameTypeData, data)
+	if int(prio) >= proto.NumPriorities {
+		return proto.ErrInvalidPriority
+	}
+	if len(data) > t.maxPayload() {
+		return proto.ErrInvalidPayload
+	}
+	dataCopy := make([]byte, len(data))
+	copy(dataCopy, data)
+	t.queue.push(txItem{payload: dataCopy, prio: prio})
+	return nil
+}
+
+// FlushQueue transmits every queued frame, highest priority first. It stops
+// at the first transmission error, dropping the frame that failed.
+func (t *Transmitter) FlushQueue() error {
+	if err := t.soleReceiver(); err != nil {
+		return err
+	}
+	for {
+		it, ok := t.queue.pop()
+		if !ok {
+			return nil
+		}
+		if err := t.sendFrame(proto.FrameTypeData, it.payload, it.prio); err != nil {
+			return err
+		}
+	}
 }
 
 // SendDataReliable sends data with acknowledgment and automatic retries.
 // It will attempt to send the Frame up to maxRetries times, waiting for an ACK
-// with the matching sequence number after each attempt.
+// with the matching sequence number after each attempt and then a random
+// backoff that grows with the attempts.
 func (t *Transmitter) SendDataReliable(data []byte, maxRetries int) error {
+	_, _, err := t.sendReliable(context.Background(), proto.FrameTypeData, data, maxRetries)
+	return err
+}
+
+// SendDataReliableStats behaves like SendDataReliable and additionally
+// reports how many attempts the send took and how long. The result is
+// meaningful also when err is ErrTimeout.
+func (t *Transmitter) SendDataReliableStats(data []byte, maxRetries int) (DeliveryResult, error) {
+	_, res, err := t.sendReliable(context.Background(), proto.FrameTypeData, data, maxRetries)
+	return res, err
+}
+
+// SendDataReliableWithReply behaves like SendDataReliable and additionally
+// returns the reply the receiver piggybacked on the ACK, or nil if the ACK
+// carried none.
+func (t *Transmitter) SendDataReliableWithReply(data []byte, maxRetries int) ([]byte, error) {
+	ack, _, err := t.sendReliable(context.Background(), proto.FrameTypeData, data, maxRetries)
+	if err != nil {
+		return nil, err
+	}
+	if len(ack.Payload) > 4 {
+		if reply, ok := proto.FindTLV(ack.Payload[4:], proto.TagReply); ok {
+			return reply, nil
+		}
+	}
+	return nil, nil
+}
+
+// sendReliable transmits data in a frame of the given type until a matching
+// ACK arrives and returns it, counting the attempts in the statistics.
+func (t *Transmitter) sendReliable(ctx context.Context, frameType byte, data []byte, maxRetries int) (*proto.Frame, DeliveryResult, error) {
+	if t.isClosed() {
+		return nil, DeliveryResult{}, proto.ErrClosed
+	}
+	if err := t.soleReceiver(); err != nil {
+		return nil, DeliveryResult{}, err
+	}
 	if !t.device.IsPaired {
-		return proto.ErrNotPaired
+		return nil, DeliveryResult{}, proto.ErrNotPaired
 	}
 
-	if len(data) > proto.MaxPayloadSize {
-		return proto.ErrInvalidPayload
+	if len(data) > t.maxPayload() {
+		return nil, DeliveryResult{}, proto.ErrInvalidPayload
+	}
+
+	return t.sendReliableSeq(ctx, frameType, t.nextSeq(), data, maxRetries)
+}
+
+// sendReliableSeq is sendReliable for a frame numbered seq in advance.
+func (t *Transmitter) sendReliableSeq(ctx context.Context, frameType byte, seq uint32, data []byte, maxRetries int) (*proto.Frame, DeliveryResult, error) {
+	if err := t.awaitResume(ctx); err != nil {
+		return nil, DeliveryResult{}, err
+	}
+	if err := t.easeOff(ctx); err != nil {
+		return nil, DeliveryResult{}, err
 	}
 
 	// Make a copy of the data to prevent modification during transmission
 	dataCopy := make([]byte, len(data))
 	copy(dataCopy, data)
 
-	seq := t.seq
-	t.seq++
-
-	Frame := &proto.Frame{
-		SenderID: t.device.ID,
-		Type:     proto.FrameTypeData,
-		Seq:      seq,
-		Payload:  dataCopy,
-	}
+	Frame := t.newFrame(frameType, seq, dataCopy)
+	Frame.Flags |= proto.FlagAckRequest // kept when the receiver ACKs only on request
 
-	encodedFrame := proto.EncodeFrame(Frame)
+	encodedFrame := t.linkConfig().EncodeFrame(Frame)
 
 	if len(encodedFrame) < proto.FrameHeaderSize {
-		return proto.ErrInvalidPayload
+		return nil, DeliveryResult{}, proto.ErrInvalidPayload
 	}
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if err := t.driver.Tx(encodedFrame); err != nil {
-			return err
+	start := time.Now()
+	ack, attempts, err := t.transmitUntilAcked(ctx, encodedFrame, seq, maxRetries)
+	res := DeliveryResult{Attempts: attempts, Elapsed: time.Since(start), Retransmitted: err == nil && attempts > 1}
+	t.recordDelivery(res, err)
+	t.noteDelivery(err)
+	t.noteHopping(ctx, err)
+	if err == nil {
+		t.noteBackpressure(ack)
+	}
+	if err == nil && resyncRequested(ack) {
+		if err := t.ResyncKeys(); err != nil {
+			log.Printf("[Transmitter] Resyncing rolling keys failed: %v\r\n", err)
+		}
+	}
+	return ack, res, err
+}
+
+// transmitUntilAcked sends an encoded frame up to maxRetries times until an
+// ACK for seq arrives, and returns that ACK and the number of transmissions
+// made. Each transmission waits for the ACK timeout derived from the
+// measured round-trip time, see WithAckTimeout. It gives up with ctx.Err()
+// once ctx is done, or ErrClosed once the transmitter is closed.
+func (t *Transmitter) transmitUntilAcked(ctx context.Context, encodedFrame []byte, seq uint32, maxRetries int) (*proto.Frame, int, error) {
+	defer t.awake()()
+	attempt := 0
+	for ; attempt < maxRetries; attempt++ {
+		if err := t.tx(encodedFrame); err != nil {
+			return nil, attempt + 1, err
+		}
+		if attempt == 0 {
+			t.rtt.sent(seq)
+		} else {
+			t.rtt.retransmitted(seq)
 		}
 
-		deadline := time.Now().Add(200 * time.Millisecond)
-		for time.Now().Before(deadline) {
-			frame := t.ReceiveFrame(20 * time.Millisecond)
+		deadline := time.Now().Add(t.rtt.timeout())
+		for {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				break
+			}
+			if err := t.ctxErr(ctx); err != nil {
+				return nil, attempt + 1, err
+			}
+			if wait > 20*time.Millisecond {
+				wait = 20 * time.Millisecond
+			}
+			frame := t.ReceiveFrame(wait)
 			if frame == nil || frame.Payload == nil {
-				time.Sleep(10 * time.Millisecond)
+				// Drivers that return at once when nothing is pending
+				// would otherwise spin.
+				time.Sleep(time.Millisecond)
 				continue
 			}
 
 			if frame.Type == proto.FrameTypeAck {
-				if frame.Seq == seq {
-					return nil // Success!
+				if frame.Seq == seq && frame.SenderID == t.receiver {
+					return frame, attempt + 1, nil // Success!
 				}
 			}
-			time.Sleep(10 * time.Millisecond)
+			if t.handleUnpair(frame) {
+				return nil, attempt + 1, proto.ErrNotPaired
+			}
+			time.Sleep(time.Millisecond)
 		}
+		t.rtt.expired()
 
 		if attempt < maxRetries-1 {
-			backoff := time.Duration(20+(attempt*10)) * time.Millisecond
-			time.Sleep(backoff)
+			if err := t.sleepCtx(ctx, retryBackoff(t.rand, attempt)); err != nil {
+				return nil, attempt + 1, err
+			}
+		}
+	}
+
+	return nil, attempt, proto.ErrTimeout
+}
+
+// SetHeartbeatInterval changes the heartbeat period, restarting the period
+// of a running heartbeat task. Non-positive values restore the default. The
+// receiver learns the interval at pairing, where it scales its timeout for
+// the transmitter to match, so a paired link should be paired again after a
+// large change.
+func (t *Transmitter) SetHeartbeatInterval(d time.Duration) {
+	t.heartbeatMu.Lock()
+	defer t.heartbeatMu.Unlock()
+	t.config.HeartbeatInterval = proto.Config{HeartbeatInterval: d}.Normalize().HeartbeatInterval
+	if t.heartbeatReset != nil {
+		select {
+		case <-t.heartbeatReset: // superseded
+		default:
 		}
+		t.heartbeatReset <- t.config.HeartbeatInterval
+	}
+}
+
+// heartbeatRedundant reports whether the receiver has heard from the
+// transmitter within interval without a heartbeat: it took a data frame
+// from it or, when heartbeats are ACKed, answered one with an ACK.
+// Heartbeats carrying a health report, or going to several receivers, are
+// always sent.
+func (t *Transmitter) heartbeatRedundant(interval time.Duration) bool {
+	if t.hasPeers() {
+		return false
 	}
+	t.txMu.Lock()
+	health := t.health != nil
+	t.txMu.Unlock()
+	if health {
+		return false
+	}
+	t.stats.mu.Lock()
+	last := t.stats.lastTraffic
+	if t.heartbeatAcked() {
+		last = t.stats.s.LastAck
+	}
+	t.stats.mu.Unlock()
+	return !last.IsZero() && time.Since(last) < interval
+}
 
-	return proto.ErrTimeout
+// heartbeatInterval returns the heartbeat period in use.
+func (t *Transmitter) heartbeatInterval() time.Duration {
+	t.heartbeatMu.Lock()
+	defer t.heartbeatMu.Unlock()
+	return t.config.HeartbeatInterval
 }
 
+// StartHeartbeatTask sends a heartbeat now and then every
+// Config.HeartbeatInterval until StopHeartbeatTask is called or the
+// transmitter is unpaired. A heartbeat is left out while data frames sent
+// within the last interval already show the receiver the transmitter is
+// alive, see heartbeatRedundant. Calling it while the task runs does
+// nothing.
 func (t *Transmitter) StartHeartbeatTask() {
+	t.heartbeatMu.Lock()
+	defer t.heartbeatMu.Unlock()
+	if t.heartbeatStop != nil {
+		return
+	}
+	stop, done, reset := make(chan struct{}), make(chan struct{}), make(chan time.Duration, 1)
+	t.heartbeatStop, t.heartbeatDone, t.heartbeatReset = stop, done, reset
+	interval := t.config.HeartbeatInterval
 	go func() {
+		defer close(done)
 		log.Printf("[Transmitter] Heartbeat task started\r\n")
-		_ = t.SendHeartbeat() // send first immediately
-		ticker := time.NewTicker(proto.HeartbeatInterval * time.Millisecond)
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
-		for range ticker.C {
-			_ = t.SendHeartbeat()
+		err := t.heartbeatAll()
+		for err != proto.ErrNotPaired && err != proto.ErrClosed {
+			select {
+			case <-stop:
+				log.Printf("[Transmitter] Heartbeat task stopped\r\n")
+				return
+			case d := <-reset:
+				ticker.Reset(d)
+			case <-ticker.C:
+				if t.heartbeatRedundant(t.heartbeatInterval()) {
+					t.recordHeartbeatSkipped()
+					continue
+				}
+				err = t.heartbeatAll()
+			}
+		}
+		log.Printf("[Transmitter] Heartbeat task stopped: %v\r\n", err)
+		t.heartbeatMu.Lock()
+		if t.heartbeatStop == stop {
+			t.heartbeatStop, t.heartbeatDone, t.heartbeatReset = nil, nil, nil
 		}
+		t.heartbeatMu.Unlock()
 	}()
 }
+
+// StopHeartbeatTask stops the heartbeat task and waits for it to exit. It
+// does nothing if the task is not running.
+func (t *Transmitter) StopHeartbeatTask() {
+	t.heartbeatMu.Lock()
+	stop, done := t.heartbeatStop, t.heartbeatDone
+	t.heartbeatStop, t.heartbeatDone, t.heartbeatReset = nil, nil, nil
+	t.heartbeatMu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
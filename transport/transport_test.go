@@ -2,7 +2,18 @@ package transport
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,9 +22,11 @@ import (
 
 // MockDriver implements the RadioDriver interface for testing
 type MockDriver struct {
-	mutex  sync.Mutex
-	txLog  [][]byte
-	rxData [][]byte
+	mutex   sync.Mutex
+	txLog   [][]byte
+	rxData  [][]byte
+	txPower int8
+	rate    DataRate
 }
 
 func NewMockDriver() *MockDriver {
@@ -33,6 +46,20 @@ func (d *MockDriver) SetChannel(channel uint8) error {
 	return nil
 }
 
+func (d *MockDriver) SetTxPower(dbm int8) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.txPower = dbm
+	return nil
+}
+
+func (d *MockDriver) SetDataRate(rate DataRate) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.rate = rate
+	return nil
+}
+
 func (d *MockDriver) Tx(data []byte) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -158,7 +185,7 @@ func TestTransmitter_SendFrame(t *testing.T) {
 			driver.ClearTxLog()
 
 			// Send packet
-			err := tx.SendFrame(tt.frameType, tt.payload)
+			_, err := tx.SendFrame(tt.frameType, tt.payload)
 			if err != nil {
 				t.Fatalf("SendFrame() error = %v", err)
 			}
@@ -202,19 +229,19 @@ func TestTransmitter_NotPaired(t *testing.T) {
 	tx := NewTransmitterWithDriver(0xCAFE, driver)
 
 	// Try to send data before pairing
-	err := tx.SendData([]byte{1, 2, 3})
+	_, err := tx.SendData([]byte{1, 2, 3})
 	if err != proto.ErrNotPaired {
 		t.Errorf("SendData() error = %v, want %v", err, proto.ErrNotPaired)
 	}
 
 	// Try to send heartbeat before pairing
-	err = tx.SendHeartbeat()
+	_, err = tx.SendHeartbeat()
 	if err != proto.ErrNotPaired {
 		t.Errorf("SendHeartbeat() error = %v, want %v", err, proto.ErrNotPaired)
 	}
 
 	// Pairing should be allowed without being paired first
-	err = tx.SendFrame(proto.FrameTypePairing, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	_, err = tx.SendFrame(proto.FrameTypePairing, []byte{1, 2, 3, 4, 5, 6, 7, 8})
 	if err != nil {
 		t.Errorf("SendFrame(Pairing) error = %v, want nil", err)
 	}
@@ -250,7 +277,7 @@ func TestTransmitter_Pairing(t *testing.T) {
 	}
 
 	// Try to send data now that we're paired
-	err = tx.SendData([]byte{1, 2, 3})
+	_, err = tx.SendData([]byte{1, 2, 3})
 	if err != nil {
 		t.Errorf("SendData() after pairing error = %v", err)
 	}
@@ -271,7 +298,7 @@ func TestTransmitter_SequenceNumberIncrement(t *testing.T) {
 	for i := 0; i < 5; i++ {
 		driver.ClearTxLog()
 
-		err := tx.SendFrame(proto.FrameTypeData, []byte{byte(i)})
+		_, err := tx.SendFrame(proto.FrameTypeData, []byte{byte(i)})
 		if err != nil {
 			t.Fatalf("SendFrame() error = %v", err)
 		}
@@ -298,3 +325,6021 @@ func TestTransmitter_SequenceNumberIncrement(t *testing.T) {
 		}
 	}
 }
+
+func TestTransmitter_ConfigPayloadLimit(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver, WithConfig(proto.Config{MaxFrameSize: 32}))
+	tx.device.IsPaired = true
+
+	limit := tx.Config().MaxPayloadSize()
+	if _, err := tx.SendData(make([]byte, limit)); err != nil {
+		t.Errorf("SendData(limit) error = %v", err)
+	}
+	if _, err := tx.SendData(make([]byte, limit+1)); err != proto.ErrInvalidPayload {
+		t.Errorf("SendData(limit+1) error = %v, want %v", err, proto.ErrInvalidPayload)
+	}
+}
+
+func TestWithConfig_OutOfRange(t *testing.T) {
+	o := newOptions([]Option{WithConfig(proto.Config{MaxFrameSize: 12})})
+	if o.configErr != proto.ErrInvalidConfig {
+		t.Errorf("configErr = %v, want %v", o.configErr, proto.ErrInvalidConfig)
+	}
+	tx := NewTransmitterWithDriver(0xCAFE, NewMockDriver(), WithConfig(proto.Config{MaxFrameSize: 12}))
+	if got := tx.Config().MaxFrameSize; got != proto.MinFrameSize+1 {
+		t.Errorf("MaxFrameSize = %d, want the smallest supported, %d", got, proto.MinFrameSize+1)
+	}
+	if o := newOptions([]Option{WithConfig(proto.Config{MaxFrameSize: 32})}); o.configErr != nil {
+		t.Errorf("configErr for 32-byte frames = %v, want nil", o.configErr)
+	}
+}
+
+func TestPairing_NegotiatesFrameSize(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithConfig(proto.Config{MaxFrameSize: 40}))
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	want := proto.Config{MaxFrameSize: 40}.MaxPayloadSize()
+	if got := tx.maxPayload(); got != want {
+		t.Errorf("negotiated payload limit = %v, want %v", got, want)
+	}
+	if _, err := tx.SendData(make([]byte, want+1)); err != proto.ErrInvalidPayload {
+		t.Errorf("SendData() over negotiated limit error = %v, want %v", err, proto.ErrInvalidPayload)
+	}
+}
+
+func TestReceiver_ConfigDeviceTimeout(t *testing.T) {
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver(), WithConfig(proto.Config{DeviceTimeout: 20 * time.Millisecond}))
+
+	dev := proto.NewTransmitter(0xCAFE)
+	dev.IsPaired = true
+	rx.pairedDevices[dev.ID] = dev
+
+	rx.CleanupTimedOutDevices()
+	if !rx.IsPaired(0xCAFE) {
+		t.Fatal("device evicted before its timeout")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	rx.CleanupTimedOutDevices()
+	if rx.IsPaired(0xCAFE) {
+		t.Error("device not evicted after the configured timeout")
+	}
+}
+
+func TestPairing_DifferentNetworkIgnored(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx,
+		WithConfig(proto.Config{PairingTimeout: 200 * time.Millisecond}), WithNetworkID(1))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithNetworkID(2))
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != proto.ErrTimeout {
+		t.Errorf("StartPairing() across networks error = %v, want %v", err, proto.ErrTimeout)
+	}
+	if rx.IsPaired(0xCAFE) {
+		t.Error("receiver paired with a transmitter from another network")
+	}
+}
+
+// pairConnected pairs a fresh transmitter and a listening receiver over
+// connected mock drivers.
+func pairConnected(t *testing.T, txID, rxID proto.DeviceID) (*Transmitter, *Receiver) {
+	t.Helper()
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(txID, driverTx)
+	rx := NewReceiverWithDriver(rxID, driverRx)
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	t.Cleanup(rx.StopListening)
+
+	if err := tx.StartPairing(rxID); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	return tx, rx
+}
+
+func TestSendDataReliableWithReply(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	// Without a handler the ACK carries no reply.
+	reply, err := tx.SendDataReliableWithReply([]byte{1}, 3)
+	if err != nil || reply != nil {
+		t.Fatalf("SendDataReliableWithReply() = %v, %v, want nil, nil", reply, err)
+	}
+
+	rx.SetReplyHandler(func(f *proto.Frame) []byte {
+		return []byte{0x42, f.Payload[0]}
+	})
+
+	reply, err = tx.SendDataReliableWithReply([]byte{7}, 3)
+	if err != nil {
+		t.Fatalf("SendDataReliableWithReply() error = %v", err)
+	}
+	if !bytes.Equal(reply, []byte{0x42, 7}) {
+		t.Errorf("reply = %v, want %v", reply, []byte{0x42, 7})
+	}
+}
+
+func TestReceiver_OversizedReplyDropped(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	rx.SetReplyHandler(func(*proto.Frame) []byte {
+		return make([]byte, proto.MaxPayloadSize)
+	})
+
+	reply, err := tx.SendDataReliableWithReply([]byte{1}, 3)
+	if err != nil {
+		t.Fatalf("SendDataReliableWithReply() error = %v", err)
+	}
+	if reply != nil {
+		t.Errorf("reply = %v, want nil for an oversized reply", reply)
+	}
+}
+
+func TestReceiver_ReplyHandlerCallsReceiver(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	rx.SetReplyHandler(func(f *proto.Frame) []byte {
+		if !rx.IsPaired(f.SenderID) {
+			return nil
+		}
+		return []byte{byte(len(rx.GetPairedDevices()))}
+	})
+
+	type result struct {
+		reply []byte
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := tx.SendDataReliableWithReply([]byte{1}, 3)
+		done <- result{reply, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil || !bytes.Equal(res.reply, []byte{1}) {
+			t.Errorf("SendDataReliableWithReply() = %v, %v, want [1], nil", res.reply, res.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reply handler calling the receiver deadlocked")
+	}
+}
+
+func TestTransmitter_TimestampClock(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver)
+	tx.device.IsPaired = true
+
+	if _, err := tx.SendData([]byte{1}); err != nil {
+		t.Fatalf("SendData() error = %v", err)
+	}
+	tx.SetTimestampClock(func() uint32 { return 1234 })
+	if _, err := tx.SendData([]byte{2}); err != nil {
+		t.Fatalf("SendData() error = %v", err)
+	}
+
+	txLog := driver.GetTxLog()
+	if sent := proto.DecodeFrame(txLog[0]); sent.HasTimestamp() {
+		t.Error("frame stamped without a clock")
+	}
+	sent := proto.DecodeFrame(txLog[1])
+	if !sent.HasTimestamp() || sent.Timestamp != 1234 {
+		t.Errorf("Timestamp = %v (flag %v), want 1234", sent.Timestamp, sent.HasTimestamp())
+	}
+	if _, err := tx.SendData(make([]byte, proto.MaxPayloadSize)); err != proto.ErrInvalidPayload {
+		t.Errorf("SendData() ignoring timestamp overhead error = %v, want %v", err, proto.ErrInvalidPayload)
+	}
+}
+
+func TestTransmitter_ConcurrentSends(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver, WithConfig(proto.Config{HeartbeatInterval: time.Millisecond}))
+	tx.device.IsPaired = true
+	tx.StartHeartbeatTask()
+
+	var wg sync.WaitGroup
+	var seqs [8][50]uint32 // returned by SendData
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				seq, err := tx.SendData([]byte{byte(g), byte(i)})
+				if err != nil {
+					t.Errorf("SendData() error = %v", err)
+					return
+				}
+				seqs[g][i] = seq
+			}
+		}(g)
+	}
+	wg.Wait()
+	tx.StopHeartbeatTask()
+
+	data, heartbeats := 0, 0
+	for i, raw := range driver.GetTxLog() {
+		f := proto.DecodeFrame(raw)
+		if f == nil {
+			t.Fatalf("frame %d does not decode", i)
+		}
+		if f.Seq != uint32(i) {
+			t.Fatalf("frame %d numbered %d, want gap-free increasing numbers", i, f.Seq)
+		}
+		switch f.Type {
+		case proto.FrameTypeData:
+			data++
+			if want := seqs[f.Payload[0]][f.Payload[1]]; f.Seq != want {
+				t.Errorf("frame %v numbered %d, SendData returned %d", f.Payload, f.Seq, want)
+			}
+		case proto.FrameTypeHeartbeat:
+			heartbeats++
+		}
+	}
+	if data != 8*50 || heartbeats == 0 {
+		t.Errorf("sent %d data frames and %d heartbeats, want %d and at least one", data, heartbeats, 8*50)
+	}
+}
+
+func TestTransmitter_StopHeartbeatTask(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver, WithConfig(proto.Config{HeartbeatInterval: 5 * time.Millisecond}))
+	tx.device.IsPaired = true
+
+	tx.StartHeartbeatTask()
+	tx.StartHeartbeatTask() // no second task
+	time.Sleep(50 * time.Millisecond)
+	tx.StopHeartbeatTask()
+	tx.StopHeartbeatTask()
+
+	sent := len(driver.GetTxLog())
+	if sent == 0 || sent > 12 {
+		t.Errorf("sent %d heartbeats in 50ms at a 5ms interval, want 1 to 12", sent)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if n := len(driver.GetTxLog()); n != sent {
+		t.Errorf("%d heartbeats sent after StopHeartbeatTask", n-sent)
+	}
+
+	tx.StartHeartbeatTask()
+	defer tx.StopHeartbeatTask()
+	deadline := time.Now().Add(time.Second)
+	for len(driver.GetTxLog()) == sent && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(driver.GetTxLog()) == sent {
+		t.Error("heartbeat task did not restart")
+	}
+}
+
+func TestTransmitter_SetHeartbeatInterval(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver, WithConfig(proto.Config{HeartbeatInterval: time.Hour}))
+	tx.device.IsPaired = true
+	tx.StartHeartbeatTask()
+	defer tx.StopHeartbeatTask()
+
+	time.Sleep(20 * time.Millisecond)
+	if n := len(driver.GetTxLog()); n != 1 {
+		t.Fatalf("sent %d heartbeats at an hourly interval, want 1", n)
+	}
+	tx.SetHeartbeatInterval(5 * time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for len(driver.GetTxLog()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(driver.GetTxLog()); n < 3 {
+		t.Errorf("sent %d heartbeats after shortening the interval, want the running task to speed up", n)
+	}
+	if got := tx.Config().HeartbeatInterval; got != 5*time.Millisecond {
+		t.Errorf("HeartbeatInterval = %v, want 5ms", got)
+	}
+}
+
+func TestHeartbeat_SkippedWhileDataFlows(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver, WithConfig(proto.Config{HeartbeatInterval: 20 * time.Millisecond}))
+	tx.device.IsPaired = true
+
+	heartbeats := func() int {
+		n := 0
+		for _, raw := range driver.GetTxLog() {
+			if f := proto.DecodeFrame(raw); f != nil && f.Type == proto.FrameTypeHeartbeat {
+				n++
+			}
+		}
+		return n
+	}
+
+	tx.StartHeartbeatTask()
+	defer tx.StopHeartbeatTask()
+	for end := time.Now().Add(200 * time.Millisecond); time.Now().Before(end); {
+		if _, err := tx.SendData([]byte{1}); err != nil {
+			t.Fatalf("SendData() error = %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if n := heartbeats(); n != 1 {
+		t.Errorf("sent %d heartbeats while data flowed, want only the first", n)
+	}
+	if tx.Stats().HeartbeatsSkipped == 0 {
+		t.Error("HeartbeatsSkipped = 0, want the skipped ticks counted")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for heartbeats() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := heartbeats(); n < 3 {
+		t.Errorf("sent %d heartbeats after data stopped, want them to resume", n)
+	}
+}
+
+func TestReceiver_ScalesTimeoutToHeartbeat(t *testing.T) {
+	cfg := proto.Config{HeartbeatInterval: 10 * time.Millisecond, DeviceTimeout: 30 * time.Millisecond}
+	driverRx, driverSlow, driverFast := NewMockDriver(), NewMockDriver(), NewMockDriver()
+	shareMedium(driverRx, driverSlow, driverFast)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithConfig(cfg))
+	rx.Listen()
+	defer rx.StopListening()
+
+	slow := NewTransmitterWithDriver(0xCAFE, driverSlow, WithConfig(cfg))
+	slow.SetHeartbeatInterval(100 * time.Millisecond) // 300ms timeout
+	fast := NewTransmitterWithDriver(0xF00D, driverFast, WithConfig(cfg))
+	for _, tx := range []*Transmitter{slow, fast} {
+		if err := tx.StartPairing(0xBEEF); err != nil {
+			t.Fatalf("StartPairing(%d) error = %v", tx.device.ID, err)
+		}
+	}
+	rx.mu.Lock()
+	announced := rx.pairedDevices[0xCAFE].HeartbeatInterval
+	rx.mu.Unlock()
+	if announced != 100*time.Millisecond {
+		t.Fatalf("announced HeartbeatInterval = %v, want 100ms", announced)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	rx.CleanupTimedOutDevices()
+	if !rx.IsPaired(0xCAFE) {
+		t.Error("slow-heartbeat device evicted before its scaled timeout")
+	}
+	if rx.IsPaired(0xF00D) {
+		t.Error("device at the receiver's heartbeat kept past DeviceTimeout")
+	}
+	time.Sleep(250 * time.Millisecond)
+	rx.CleanupTimedOutDevices()
+	if rx.IsPaired(0xCAFE) {
+		t.Error("slow-heartbeat device kept after its scaled timeout")
+	}
+}
+
+func TestHeartbeat_HealthReport(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	var mu sync.Mutex
+	var reports []proto.HealthReport
+	rx.OnHealthReport(func(id proto.DeviceID, h proto.HealthReport) {
+		mu.Lock()
+		reports = append(reports, h)
+		mu.Unlock()
+	})
+	var uptime uint32
+	if err := tx.SetHealthProvider(func() proto.HealthReport {
+		uptime++
+		return proto.HealthReport{BatteryMillivolts: 3000, Uptime: uptime, TxFrames: 2 * uptime}
+	}); err != nil {
+		t.Fatalf("SetHealthProvider() error = %v", err)
+	}
+
+	for i := uint32(1); i <= 3; i++ {
+		if _, err := tx.SendHeartbeat(); err != nil {
+			t.Fatalf("SendHeartbeat() error = %v", err)
+		}
+		deadline := time.Now().Add(time.Second)
+		var got proto.HealthReport
+		for time.Now().Before(deadline) {
+			if got, _ = rx.Health(0xCAFE); got.Uptime == i {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		want := proto.HealthReport{BatteryMillivolts: 3000, Uptime: i, TxFrames: 2 * i}
+		if got != want {
+			t.Fatalf("Health() after heartbeat %d = %+v, want %+v", i, got, want)
+		}
+	}
+	mu.Lock()
+	n := len(reports)
+	mu.Unlock()
+	if n != 3 {
+		t.Errorf("OnHealthReport called %d times, want 3", n)
+	}
+
+	small := NewTransmitterWithDriver(0xF00D, NewMockDriver(), WithConfig(proto.Config{MaxFrameSize: 40}))
+	if err := small.SetHealthProvider(func() proto.HealthReport { return proto.HealthReport{} }); err != proto.ErrInvalidPayload {
+		t.Errorf("SetHealthProvider() on 40-byte frames error = %v, want %v", err, proto.ErrInvalidPayload)
+	}
+}
+
+func TestTransmitter_LinkMonitor(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	var up atomic.Bool
+	up.Store(true)
+	go func() {
+		for {
+			for _, d := range [][2]*MockDriver{{driverTx, driverRx}, {driverRx, driverTx}} {
+				from, to := d[0], d[1]
+				from.mutex.Lock()
+				sent := from.txLog
+				from.txLog = nil
+				from.mutex.Unlock()
+				for _, data := range sent {
+					if up.Load() {
+						to.InjectRx(data)
+					}
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	events := make(chan string, 4)
+	tx.OnLinkDown(func() { events <- "down" })
+	tx.OnLinkUp(func() { events <- "up" })
+	tx.EnableLinkMonitor(3)
+	tx.SetHeartbeatInterval(20 * time.Millisecond)
+	tx.StartHeartbeatTask()
+	defer tx.StopHeartbeatTask()
+
+	expect := func(want string, within time.Duration) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev != want {
+				t.Fatalf("link event = %s, want %s", ev, want)
+			}
+		case <-time.After(within):
+			t.Fatalf("no link %s event within %v", want, within)
+		}
+	}
+
+	select {
+	case ev := <-events:
+		t.Fatalf("link event %s while the receiver answers", ev)
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	// Three heartbeats go unanswered, each waiting 200ms for its ACK.
+	up.Store(false)
+	expect("down", time.Second)
+	up.Store(true)
+	expect("up", 500*time.Millisecond)
+}
+
+func TestSendDataReliable_Stats(t *testing.T) {
+	// The first send loses two transmissions, the second none and the
+	// third every one.
+	var mu sync.Mutex
+	sent := 0
+	lossy := &lossyDriver{MockDriver: NewMockDriver(), drop: func(data []byte) bool {
+		if f := proto.DecodeFrame(data); f == nil || f.Type != proto.FrameTypeData {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sent++
+		return sent <= 2 || sent > 4
+	}}
+	driverRx := NewMockDriver()
+	// Pin the ACK timeout to 200ms so that lost attempts take a known time.
+	tx := NewTransmitterWithDriver(0xCAFE, lossy, WithAckTimeout(AckTimeoutConfig{Min: 200 * time.Millisecond}))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	ConnectDrivers(lossy.MockDriver, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	res, err := tx.SendDataReliableStats([]byte{1}, 5)
+	if err != nil || res.Attempts != 3 || !res.Retransmitted {
+		t.Errorf("first send = %+v, %v, want 3 attempts and a retransmission", res, err)
+	}
+	if res.Elapsed < 400*time.Millisecond {
+		t.Errorf("first send took %v, want at least the two 200ms ACK waits", res.Elapsed)
+	}
+	res, err = tx.SendDataReliableStats([]byte{2}, 5)
+	if err != nil || res.Attempts != 1 || res.Retransmitted {
+		t.Errorf("second send = %+v, %v, want a single attempt", res, err)
+	}
+	res, err = tx.SendDataReliableStats([]byte{3}, 2)
+	if err != proto.ErrTimeout || res.Attempts != 2 || res.Retransmitted {
+		t.Errorf("third send = %+v, %v, want 2 attempts and %v", res, err, proto.ErrTimeout)
+	}
+
+	stats := tx.Stats()
+	want := TxStats{
+		FramesSent:    stats.FramesSent,
+		BytesSent:     stats.BytesSent,
+		ReliableSends: 3,
+		Delivered:     2,
+		Attempts:      6,
+		Retransmitted: 1,
+		Timeouts:      1,
+		ReliableTime:  stats.ReliableTime,
+		AcksReceived:  stats.AcksReceived,
+		LastAck:       stats.LastAck,
+		LastAckAge:    stats.LastAckAge,
+		Airtime:       stats.Airtime,
+		RTT:           stats.RTT,
+		RTTVar:        stats.RTTVar,
+		AckTimeout:    200 * time.Millisecond,
+	}
+	if stats != want {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+	if stats.ReliableTime < 800*time.Millisecond {
+		t.Errorf("ReliableTime = %v, want the time of four lost attempts", stats.ReliableTime)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	// cancelled runs op with a context cancelled after 50ms and checks that
+	// it returns context.Canceled within one poll interval of that.
+	cancelled := func(t *testing.T, poll time.Duration, op func(ctx context.Context) error) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		err := op(ctx)
+		if err != context.Canceled {
+			t.Fatalf("error = %v, want %v", err, context.Canceled)
+		}
+		if elapsed := time.Since(start); elapsed > 50*time.Millisecond+poll+20*time.Millisecond {
+			t.Errorf("returned %v after the start, want within %v of the cancellation", elapsed, poll)
+		}
+	}
+
+	t.Run("SendDataReliableCtx", func(t *testing.T) {
+		tx := NewTransmitterWithDriver(0xCAFE, NewMockDriver())
+		tx.device.IsPaired = true
+		cancelled(t, 20*time.Millisecond, func(ctx context.Context) error {
+			return tx.SendDataReliableCtx(ctx, []byte{1}, 100)
+		})
+	})
+	t.Run("StartPairingCtx", func(t *testing.T) {
+		tx := NewTransmitterWithDriver(0xCAFE, NewMockDriver())
+		cancelled(t, 100*time.Millisecond, func(ctx context.Context) error {
+			return tx.StartPairingCtx(ctx, 0xBEEF)
+		})
+		if tx.device.IsPaired {
+			t.Error("transmitter paired after cancellation")
+		}
+	})
+	t.Run("ReceiveDataCtx", func(t *testing.T) {
+		rx := NewReceiverWithDriver(0xBEEF, NewMockDriver())
+		dev := proto.NewTransmitter(0xCAFE)
+		dev.IsPaired = true
+		rx.pairedDevices[dev.ID] = dev
+		cancelled(t, 20*time.Millisecond, func(ctx context.Context) error {
+			_, err := rx.ReceiveDataCtx(ctx)
+			return err
+		})
+	})
+}
+
+func TestTransmitter_Enqueue(t *testing.T) {
+	// newQueued returns a paired transmitter whose worker is held up in
+	// the completion callback of the first of the returned sequence
+	// numbers, until release is closed, with the rest queued.
+	newQueued := func(t *testing.T, cfg TxQueueConfig, queued int, done func(uint32, error)) (*Transmitter, *MockDriver, chan struct{}, []uint32) {
+		t.Helper()
+		d := NewMockDriver()
+		tx := NewTransmitterWithDriver(0xCAFE, d, WithTxQueue(cfg))
+		tx.device.IsPaired = true
+		entered, release := make(chan struct{}), make(chan struct{})
+		seq, err := tx.EnqueueFunc([]byte{0}, func(seq uint32, err error) {
+			close(entered)
+			<-release
+			if done != nil {
+				done(seq, err)
+			}
+		})
+		if err != nil {
+			t.Fatalf("Enqueue(0) error = %v", err)
+		}
+		<-entered
+		seqs := []uint32{seq}
+		for i := 1; i <= queued; i++ {
+			seq, err := tx.EnqueueFunc([]byte{byte(i)}, done)
+			if err != nil {
+				t.Fatalf("Enqueue(%d) error = %v", i, err)
+			}
+			seqs = append(seqs, seq)
+		}
+		return tx, d, release, seqs
+	}
+	type result struct {
+		seq uint32
+		err error
+	}
+	collect := func() (func(uint32, error), func() []result) {
+		var mu sync.Mutex
+		var results []result
+		return func(seq uint32, err error) {
+				mu.Lock()
+				results = append(results, result{seq, err})
+				mu.Unlock()
+			}, func() []result {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]result(nil), results...)
+			}
+	}
+
+	t.Run("Reject", func(t *testing.T) {
+		tx, _, release, _ := newQueued(t, TxQueueConfig{Capacity: 2, Policy: QueueReject}, 2, nil)
+		if _, err := tx.Enqueue([]byte{9}); err != proto.ErrQueueFull {
+			t.Errorf("Enqueue() on a full queue error = %v, want %v", err, proto.ErrQueueFull)
+		}
+		close(release)
+		tx.Close()
+	})
+	t.Run("DropOldest", func(t *testing.T) {
+		done, results := collect()
+		tx, _, release, seqs := newQueued(t, TxQueueConfig{Capacity: 2, Policy: QueueDropOldest, FlushOnClose: true}, 2, done)
+		last, err := tx.EnqueueFunc([]byte{9}, done)
+		if err != nil {
+			t.Fatalf("Enqueue() on a full queue error = %v", err)
+		}
+		if got := results(); len(got) != 1 || got[0] != (result{seqs[1], proto.ErrQueueFull}) {
+			t.Errorf("results = %v, want seq %d dropped", got, seqs[1])
+		}
+		close(release)
+		tx.Close()
+		want := []result{{seqs[1], proto.ErrQueueFull}, {seqs[0], nil}, {seqs[2], nil}, {last, nil}}
+		if got := results(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("results = %v, want %v", got, want)
+		}
+	})
+	t.Run("Block", func(t *testing.T) {
+		tx, _, release, _ := newQueued(t, TxQueueConfig{Capacity: 1}, 1, nil)
+		enqueued := make(chan error, 1)
+		go func() {
+			_, err := tx.Enqueue([]byte{9})
+			enqueued <- err
+		}()
+		select {
+		case err := <-enqueued:
+			t.Fatalf("Enqueue() on a full queue returned %v, want it to block", err)
+		case <-time.After(30 * time.Millisecond):
+		}
+		close(release)
+		if err := <-enqueued; err != nil {
+			t.Errorf("blocked Enqueue() error = %v", err)
+		}
+		tx.Close()
+	})
+	t.Run("CloseAbandons", func(t *testing.T) {
+		done, results := collect()
+		tx, d, release, seqs := newQueued(t, TxQueueConfig{}, 3, done)
+		closed := make(chan struct{})
+		go func() {
+			tx.Close()
+			close(closed)
+		}()
+		deadline := time.Now().Add(time.Second)
+		for len(results()) < 3 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case <-closed:
+			t.Fatal("Close() returned while a send was in progress")
+		default:
+		}
+		close(release)
+		<-closed
+		want := []result{{seqs[1], proto.ErrClosed}, {seqs[2], proto.ErrClosed}, {seqs[3], proto.ErrClosed}, {seqs[0], nil}}
+		if got := results(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("results = %v, want %v", got, want)
+		}
+		if n := len(d.GetTxLog()); n != 1 {
+			t.Errorf("sent %d frames, want only the one in progress", n)
+		}
+		if _, err := tx.Enqueue([]byte{9}); err != proto.ErrClosed {
+			t.Errorf("Enqueue() after Close error = %v, want %v", err, proto.ErrClosed)
+		}
+		if err := tx.Close(); err != nil {
+			t.Errorf("second Close() error = %v", err)
+		}
+	})
+	t.Run("CloseFlushes", func(t *testing.T) {
+		tx, d, release, seqs := newQueued(t, TxQueueConfig{FlushOnClose: true}, 3, nil)
+		close(release)
+		tx.Close()
+		txLog := d.GetTxLog()
+		if len(txLog) != len(seqs) {
+			t.Fatalf("sent %d frames, want %d", len(txLog), len(seqs))
+		}
+		for i, raw := range txLog {
+			if f := proto.DecodeFrame(raw); f.Seq != seqs[i] || f.Payload[0] != byte(i) {
+				t.Errorf("frame %d = seq %d payload %v, want seq %d", i, f.Seq, f.Payload, seqs[i])
+			}
+		}
+	})
+}
+
+func TestTxQueue_SpillThroughOutage(t *testing.T) {
+	// newOutage pairs a transmitter spilling its queue to store with a
+	// receiver over a link that carries nothing while up is false, and
+	// returns the received payloads and the completion callback outcomes.
+	newOutage := func(t *testing.T, store QueueStore, ttl time.Duration) (tx *Transmitter, up *atomic.Bool, received func() []int, done func(uint32, error), results func() []error) {
+		t.Helper()
+		driverTx := NewMockDriver()
+		driverRx := NewMockDriver()
+		up = new(atomic.Bool)
+		up.Store(true)
+		stop := make(chan struct{})
+		t.Cleanup(func() { close(stop) })
+		go func() {
+			for {
+				for _, d := range [][2]*MockDriver{{driverTx, driverRx}, {driverRx, driverTx}} {
+					from, to := d[0], d[1]
+					from.mutex.Lock()
+					sent := from.txLog
+					from.txLog = nil
+					from.mutex.Unlock()
+					for _, data := range sent {
+						if up.Load() {
+							to.InjectRx(data)
+						}
+					}
+				}
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+		}()
+
+		tx = NewTransmitterWithDriver(0xCAFE, driverTx, WithTxQueue(TxQueueConfig{Capacity: 4, Retries: 2, Store: store, TTL: ttl}))
+		rx := NewReceiverWithDriver(0xBEEF, driverRx)
+		var mu sync.Mutex
+		var got []int
+		var errs []error
+		seen := make(map[uint32]bool) // a frame sent again because its ACK came late arrives twice
+		rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+			mu.Lock()
+			if !seen[f.Seq] {
+				seen[f.Seq] = true
+				got = append(got, int(binary.LittleEndian.Uint16(f.Payload)))
+			}
+			mu.Unlock()
+		})
+		rx.Listen()
+		t.Cleanup(rx.StopListening)
+		if err := tx.StartPairing(0xBEEF); err != nil {
+			t.Fatalf("StartPairing() error = %v", err)
+		}
+		tx.EnableLinkMonitor(1)
+		tx.SetHeartbeatInterval(20 * time.Millisecond)
+		tx.StartHeartbeatTask()
+		t.Cleanup(func() { tx.Close() })
+
+		received = func() []int {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]int(nil), got...)
+		}
+		done = func(_ uint32, err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}
+		results = func() []error {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]error(nil), errs...)
+		}
+		return
+	}
+	enqueue := func(t *testing.T, tx *Transmitter, from, to int, done func(uint32, error)) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if _, err := tx.EnqueueFunc(binary.LittleEndian.AppendUint16(nil, uint16(i)), done); err != nil {
+				t.Fatalf("Enqueue(%d) error = %v", i, err)
+			}
+		}
+	}
+	waitFor := func(cond func() bool) {
+		for deadline := time.Now().Add(10 * time.Second); !cond() && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	t.Run("Delivered", func(t *testing.T) {
+		store := NewMemoryQueueStore()
+		tx, up, received, done, results := newOutage(t, store, 0)
+		enqueue(t, tx, 0, 10, done)
+		waitFor(func() bool { return len(results()) == 10 })
+
+		// An outage of 30s of telemetry at 10 Hz, compressed: 300
+		// messages queue up while nothing gets through.
+		up.Store(false)
+		enqueue(t, tx, 10, 310, done)
+		time.Sleep(400 * time.Millisecond)
+		if n := store.Len(); n < 300-4 {
+			t.Errorf("store holds %d messages during the outage, want all but those in memory", n)
+		}
+		if n := len(results()); n != 10 {
+			t.Errorf("%d messages settled during the outage, want none", n-10)
+		}
+
+		up.Store(true)
+		waitFor(func() bool { return len(results()) == 310 })
+		want := make([]int, 310)
+		for i := range want {
+			want[i] = i
+		}
+		if got := received(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("received %d messages %v, want 0 to 309 in order", len(got), got)
+		}
+		for i, err := range results() {
+			if err != nil {
+				t.Errorf("message %d reported %v", i, err)
+			}
+		}
+		if store.Len() != 0 || tx.QueueLen() != 0 {
+			t.Errorf("store holds %d messages, queue %d, want both drained", store.Len(), tx.QueueLen())
+		}
+	})
+	t.Run("TTL", func(t *testing.T) {
+		store := NewMemoryQueueStore()
+		tx, up, received, done, results := newOutage(t, store, 400*time.Millisecond)
+		up.Store(false)
+		enqueue(t, tx, 0, 10, done)
+		time.Sleep(600 * time.Millisecond)
+		enqueue(t, tx, 10, 20, done)
+
+		up.Store(true)
+		waitFor(func() bool { return len(results()) == 20 })
+		if got := fmt.Sprint(received()); got != "[10 11 12 13 14 15 16 17 18 19]" {
+			t.Errorf("received %s, want only the messages queued late", got)
+		}
+		for i, err := range results() {
+			want := error(nil)
+			if i < 10 {
+				want = proto.ErrExpired
+			}
+			if err != want {
+				t.Errorf("message %d reported %v, want %v", i, err, want)
+			}
+		}
+	})
+	t.Run("NextRun", func(t *testing.T) {
+		store := NewMemoryQueueStore()
+		for i := 0; i < 3; i++ {
+			_ = store.Append(StoredMessage{Seq: 1000, Queued: time.Now(), Data: binary.LittleEndian.AppendUint16(nil, uint16(i))})
+		}
+		tx, _, received, done, results := newOutage(t, store, 0)
+		if n := tx.QueueLen(); n != 3 {
+			t.Errorf("QueueLen() = %d, want the 3 stored messages", n)
+		}
+		enqueue(t, tx, 3, 5, done)
+		waitFor(func() bool { return len(results()) == 2 })
+		if got := fmt.Sprint(received()); got != "[0 1 2 3 4]" {
+			t.Errorf("received %s, want the stored messages first", got)
+		}
+	})
+}
+
+// blockingRxDriver waits out the timeout of Rx when nothing is pending, as
+// a radio does.
+type blockingRxDriver struct{ *MockDriver }
+
+func (d blockingRxDriver) Rx(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if data, err := d.MockDriver.Rx(0); err == nil || !time.Now().Before(deadline) {
+			return data, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReceiver_ListenStop(t *testing.T) {
+	d := NewMockDriver()
+	rx := NewReceiverWithDriver(0xBEEF, blockingRxDriver{d})
+	pending := func() int {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		return len(d.rxData)
+	}
+	heartbeat := proto.EncodeFrame(&proto.Frame{Type: proto.FrameTypeHeartbeat, SenderID: 0xCAFE})
+
+	stop := make(chan struct{})
+	injected := make(chan struct{})
+	go func() {
+		defer close(injected)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				d.InjectRx(heartbeat)
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				rx.Listen()
+				rx.Listen()
+				rx.StopListening()
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-injected
+
+	// No loop is left to take the frames.
+	d.mutex.Lock()
+	d.rxData = nil
+	d.mutex.Unlock()
+	d.InjectRx(heartbeat)
+	time.Sleep(30 * time.Millisecond)
+	if n := pending(); n != 1 {
+		t.Errorf("%d frames pending after StopListening, want the injected one left", n)
+	}
+
+	// Stopping does not wait for the 100 ms receive poll to run out.
+	rx.Listen()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	rx.StopListening()
+	if took := time.Since(start); took > 50*time.Millisecond {
+		t.Errorf("StopListening() took %v, want it to interrupt the receive poll", took)
+	}
+	rx.StopListening()
+}
+
+func TestReceiver_StopCleanupTask(t *testing.T) {
+	cfg := proto.Config{HeartbeatInterval: 10 * time.Millisecond, DeviceTimeout: 20 * time.Millisecond}
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver(), WithConfig(cfg))
+	rx.StartCleanupTask()
+	rx.StartCleanupTask()
+	rx.StopCleanupTask()
+
+	dev := proto.NewTransmitter(0xCAFE)
+	dev.IsPaired = true
+	rx.mu.Lock()
+	rx.pairedDevices[dev.ID] = dev
+	rx.mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	if !rx.IsPaired(0xCAFE) {
+		t.Error("cleanup task still running after StopCleanupTask")
+	}
+
+	rx.StartCleanupTask()
+	defer rx.StopCleanupTask()
+	deadline := time.Now().Add(time.Second)
+	for rx.IsPaired(0xCAFE) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if rx.IsPaired(0xCAFE) {
+		t.Error("restarted cleanup task did not remove the timed-out device")
+	}
+}
+
+func TestReceiver_Maintenance(t *testing.T) {
+	cfg := proto.Config{DeviceTimeout: 20 * time.Millisecond}
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver(), WithConfig(cfg))
+	pair := func() {
+		dev := proto.NewTransmitter(0xCAFE)
+		dev.IsPaired = true
+		dev.UpdateLastSeen()
+		rx.mu.Lock()
+		rx.pairedDevices[dev.ID] = dev
+		rx.mu.Unlock()
+	}
+	// timedOutAfter returns how long the maintenance task took to remove
+	// the device, or 0 if it did not within 300 ms.
+	timedOutAfter := func() time.Duration {
+		start := time.Now()
+		for time.Since(start) < 300*time.Millisecond {
+			if !rx.IsPaired(0xCAFE) {
+				return time.Since(start)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return 0
+	}
+
+	rx.StartMaintenance(150 * time.Millisecond)
+	rx.StartMaintenance(time.Millisecond) // no second task
+	pair()
+	if took := timedOutAfter(); took < 100*time.Millisecond {
+		t.Errorf("device removed after %v, want the next tick at 150 ms", took)
+	}
+	rx.StopMaintenance()
+	rx.StopMaintenance()
+
+	pair()
+	time.Sleep(60 * time.Millisecond)
+	if !rx.IsPaired(0xCAFE) {
+		t.Error("maintenance task still running after StopMaintenance")
+	}
+
+	rx.StartMaintenance(0) // half the device timeout
+	defer rx.StopMaintenance()
+	if took := timedOutAfter(); took == 0 || took > 50*time.Millisecond {
+		t.Errorf("device removed after %v with the default interval, want within 50 ms", took)
+	}
+}
+
+func TestTransmitter_PriorityQueueOrdering(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver)
+	tx.device.IsPaired = true
+
+	for i := 0; i < 50; i++ {
+		if err := tx.EnqueueWithPriority([]byte{byte(i)}, proto.PriorityNormal); err != nil {
+			t.Fatalf("EnqueueWithPriority(bulk) error = %v", err)
+		}
+	}
+	if err := tx.EnqueueWithPriority([]byte{0xA1}, proto.PriorityUrgent); err != nil {
+		t.Fatalf("EnqueueWithPriority(alarm) error = %v", err)
+	}
+	if err := tx.EnqueueWithPriority(nil, proto.Priority(7)); err != proto.ErrInvalidPriority {
+		t.Errorf("EnqueueWithPriority(7) error = %v, want %v", err, proto.ErrInvalidPriority)
+	}
+
+	if err := tx.FlushQueue(); err != nil {
+		t.Fatalf("FlushQueue() error = %v", err)
+	}
+
+	txLog := driver.GetTxLog()
+	if len(txLog) != 51 {
+		t.Fatalf("transmitted %d frames, want 51", len(txLog))
+	}
+	first := proto.DecodeFrame(txLog[0])
+	if first.Payload[0] != 0xA1 || first.Priority() != proto.PriorityUrgent {
+		t.Errorf("first frame = %v (priority %v), want the alarm", first.Payload, first.Priority())
+	}
+	for i, data := range txLog[1:] {
+		if f := proto.DecodeFrame(data); f.Payload[0] != byte(i) {
+			t.Fatalf("bulk frame %d out of order: got %v", i, f.Payload[0])
+		}
+	}
+}
+
+func TestReceiver_ExposesPriority(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	got := make(chan proto.Priority, 1)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) { got <- f.Priority() })
+
+	if err := tx.SendDataWithPriority([]byte{1}, proto.PriorityHigh); err != nil {
+		t.Fatalf("SendDataWithPriority() error = %v", err)
+	}
+	select {
+	case p := <-got:
+		if p != proto.PriorityHigh {
+			t.Errorf("Priority() = %v, want %v", p, proto.PriorityHigh)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("data callback not invoked")
+	}
+}
+
+func TestTransmitter_BatchingThresholdAndDelay(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver)
+	tx.device.IsPaired = true
+	tx.SetBatching(15, 30*time.Millisecond)
+
+	// Three 4-byte samples (5 bytes each with framing) reach the threshold.
+	for i := 0; i < 3; i++ {
+		if err := tx.SendDataBatched([]byte{byte(i), 0, 0, 0}); err != nil {
+			t.Fatalf("SendDataBatched() error = %v", err)
+		}
+	}
+	if n := len(driver.GetTxLog()); n != 1 {
+		t.Fatalf("frames after threshold = %d, want 1", n)
+	}
+
+	// A lone sample is flushed by the delay timer.
+	if err := tx.SendDataBatched([]byte{9}); err != nil {
+		t.Fatalf("SendDataBatched() error = %v", err)
+	}
+	if n := len(driver.GetTxLog()); n != 1 {
+		t.Fatalf("sample flushed before the delay: %d frames", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	txLog := driver.GetTxLog()
+	if len(txLog) != 2 {
+		t.Fatalf("frames after delay = %d, want 2", len(txLog))
+	}
+	if f := proto.DecodeFrame(txLog[1]); f.Type != proto.FrameTypeBatch || !bytes.Equal(f.Payload, []byte{1, 9}) {
+		t.Errorf("delayed batch = %+v", f)
+	}
+
+	// Flush sends immediately and is a no-op when nothing is buffered.
+	_ = tx.SendDataBatched([]byte{7})
+	if err := tx.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if err := tx.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if n := len(driver.GetTxLog()); n != 3 {
+		t.Errorf("frames after Flush = %d, want 3", n)
+	}
+}
+
+func TestTransmitter_CloseFlushesBatch(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver)
+	tx.device.IsPaired = true
+	tx.SetBatching(0, 30*time.Millisecond)
+
+	if err := tx.SendDataBatched([]byte{1, 2}); err != nil {
+		t.Fatalf("SendDataBatched() error = %v", err)
+	}
+	if err := tx.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	txLog := driver.GetTxLog()
+	if len(txLog) != 1 {
+		t.Fatalf("frames after Close = %d, want the batch", len(txLog))
+	}
+	if f := proto.DecodeFrame(txLog[0]); f == nil || f.Type != proto.FrameTypeBatch || !bytes.Equal(f.Payload, []byte{2, 1, 2}) {
+		t.Errorf("batch sent on Close = %+v", f)
+	}
+
+	// The delay timer is stopped, and nothing more is buffered.
+	if err := tx.SendDataBatched([]byte{3}); err != proto.ErrClosed {
+		t.Errorf("SendDataBatched() after Close = %v, want %v", err, proto.ErrClosed)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if n := len(driver.GetTxLog()); n != 1 {
+		t.Errorf("frames after the batch delay = %d, want 1", n)
+	}
+}
+
+func TestReceiver_BatchCallbackPerSample(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	got := make(chan byte, 16)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) { got <- f.Payload[0] })
+
+	for i := 0; i < 5; i++ {
+		if err := tx.SendDataBatched([]byte{byte(i)}); err != nil {
+			t.Fatalf("SendDataBatched() error = %v", err)
+		}
+	}
+	if err := tx.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case v := <-got:
+			if v != byte(i) {
+				t.Errorf("sample %d = %v", i, v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("only %d samples delivered", i)
+		}
+	}
+}
+
+func TestReceiver_CallbackCallsReceiver(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	got := make(chan int, 1)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		if rx.IsPaired(f.SenderID) {
+			got <- len(rx.GetPairedDevices())
+		}
+	})
+	if err := tx.SendDataReliable([]byte{1}, 3); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+	select {
+	case n := <-got:
+		if n != 1 {
+			t.Errorf("GetPairedDevices() in the callback = %d devices, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback calling GetPairedDevices() did not return")
+	}
+	// The receiver still processes frames afterwards.
+	if err := tx.SendDataReliable([]byte{2}, 3); err != nil {
+		t.Errorf("second SendDataReliable() error = %v", err)
+	}
+}
+
+func TestReceiver_MultipleCallbacks(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) func(*proto.Frame) {
+		return func(f *proto.Frame) {
+			mu.Lock()
+			calls = append(calls, fmt.Sprintf("%s%d", name, f.Payload[0]))
+			mu.Unlock()
+		}
+	}
+	first := rx.RegisterCallback(proto.FrameTypeData, record("a"))
+	second := rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		record("b")(f)
+		panic("boom")
+	})
+	done := make(chan struct{}, 2)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		record("c")(f)
+		done <- struct{}{}
+	})
+	if first == second {
+		t.Errorf("RegisterCallback() returned %d twice", first)
+	}
+	var panics []CallbackHandle
+	rx.OnCallbackError(func(err error) {
+		if pe, ok := err.(*CallbackPanicError); ok && pe.Value == "boom" {
+			mu.Lock()
+			panics = append(panics, pe.Handle)
+			mu.Unlock()
+		}
+	})
+
+	for i := byte(1); i <= 2; i++ {
+		if err := tx.SendDataReliable([]byte{i}, 3); err != nil {
+			t.Fatalf("SendDataReliable(%d) error = %v", i, err)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("last callback not called for frame %d", i)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := fmt.Sprint(calls), "[a1 b1 c1 a2 b2 c2]"; got != want {
+		t.Errorf("callbacks ran as %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(panics), fmt.Sprint([]CallbackHandle{second, second}); got != want {
+		t.Errorf("panics reported for %s, want %s", got, want)
+	}
+}
+
+func TestReceiver_UnregisterCallback(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	// Register and unregister while frames are dispatched.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(200 * time.Microsecond):
+				_, _ = tx.SendData([]byte{0})
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			var once sync.Once
+			var self CallbackHandle
+			var mu sync.Mutex
+			mu.Lock()
+			self = rx.RegisterCallback(proto.FrameTypeData, func(*proto.Frame) {
+				mu.Lock()
+				h := self
+				mu.Unlock()
+				once.Do(func() { rx.UnregisterCallback(h) })
+			})
+			mu.Unlock()
+			h := rx.RegisterCallback(proto.FrameTypeData, func(*proto.Frame) {})
+			time.Sleep(100 * time.Microsecond)
+			rx.UnregisterCallback(h)
+			if i%50 == 0 {
+				rx.ClearCallbacks(proto.FrameTypeData)
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	rx.ClearCallbacks(proto.FrameTypeData)
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string, done chan struct{}) func(*proto.Frame) {
+		return func(f *proto.Frame) {
+			mu.Lock()
+			calls = append(calls, fmt.Sprintf("%s%d", name, f.Payload[0]))
+			mu.Unlock()
+			if done != nil {
+				done <- struct{}{}
+			}
+		}
+	}
+	send := func(b byte, done chan struct{}) {
+		t.Helper()
+		if err := tx.SendDataReliable([]byte{b}, 3); err != nil {
+			t.Fatalf("SendDataReliable(%d) error = %v", b, err)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("last callback not called for frame %d", b)
+		}
+	}
+
+	removed := rx.RegisterCallback(proto.FrameTypeData, record("r", nil))
+	rx.RegisterCallback(proto.FrameTypeData, record("k", nil))
+	last := make(chan struct{}, 1)
+	rx.RegisterCallback(proto.FrameTypeData, record("l", last))
+	send(1, last)
+	rx.UnregisterCallback(removed)
+	rx.UnregisterCallback(removed) // unknown by now
+	send(2, last)
+
+	rx.ClearCallbacks(proto.FrameTypeData)
+	after := make(chan struct{}, 1)
+	rx.RegisterCallback(proto.FrameTypeData, record("a", after))
+	send(3, after)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := fmt.Sprint(calls), "[r1 k1 l1 k2 l2 a3]"; got != want {
+		t.Errorf("callbacks ran as %s, want %s", got, want)
+	}
+}
+
+func TestReceiver_DeviceCallbacks(t *testing.T) {
+	driverRx, driverA, driverB := NewMockDriver(), NewMockDriver(), NewMockDriver()
+	shareMedium(driverRx, driverA, driverB)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	a := NewTransmitterWithDriver(0xCAFE, driverA)
+	b := NewTransmitterWithDriver(0xF00D, driverB)
+	for _, tx := range []*Transmitter{a, b} {
+		if err := tx.StartPairing(0xBEEF); err != nil {
+			t.Fatalf("StartPairing(%d) error = %v", tx.device.ID, err)
+		}
+	}
+
+	var mu sync.Mutex
+	var calls []string
+	hit := make(chan struct{}, 8)
+	record := func(name string) func(*proto.Frame) {
+		return func(f *proto.Frame) {
+			mu.Lock()
+			calls = append(calls, fmt.Sprintf("%s:%x/%d", name, uint32(f.SenderID), f.Payload[0]))
+			mu.Unlock()
+			hit <- struct{}{}
+		}
+	}
+	send := func(tx *Transmitter, b byte, callbacks int) {
+		t.Helper()
+		if err := tx.SendDataReliable([]byte{b}, 3); err != nil {
+			t.Fatalf("SendDataReliable(%d) error = %v", b, err)
+		}
+		for i := 0; i < callbacks; i++ {
+			select {
+			case <-hit:
+			case <-time.After(time.Second):
+				t.Fatalf("frame %d reached %d callbacks, want %d", b, i, callbacks)
+			}
+		}
+	}
+
+	rx.RegisterCallback(proto.FrameTypeData, record("all"))
+	first := rx.RegisterDeviceCallback(0xCAFE, proto.FrameTypeData, record("a1"))
+	rx.RegisterDeviceCallback(0xCAFE, proto.FrameTypeData, record("a2"))
+	send(a, 1, 2)
+	send(b, 2, 1)
+
+	// Once the device's callbacks are gone its frames go to the type-wide one.
+	rx.UnregisterCallback(first)
+	send(a, 3, 1)
+	rx.ClearDeviceCallbacks(0xCAFE)
+	send(a, 4, 1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "[a1:cafe/1 a2:cafe/1 all:f00d/2 a2:cafe/3 all:cafe/4]"
+	if got := fmt.Sprint(calls); got != want {
+		t.Errorf("callbacks ran as %s, want %s", got, want)
+	}
+}
+
+func TestReceiver_Middleware(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	var mu sync.Mutex
+	var calls []string
+	note := func(s string) {
+		mu.Lock()
+		calls = append(calls, s)
+		mu.Unlock()
+	}
+	tag := func(name string) func(FrameHandler) FrameHandler {
+		return func(next FrameHandler) FrameHandler {
+			return func(f *proto.Frame) {
+				if f.Type == proto.FrameTypeData {
+					note(fmt.Sprintf("%s%d", name, f.Payload[0]))
+				}
+				next(f)
+			}
+		}
+	}
+	var heartbeats atomic.Int32
+	rx.Use(FrameRateLogger(0))
+	rx.Use(tag("m1"))
+	rx.Use(func(next FrameHandler) FrameHandler {
+		return func(f *proto.Frame) {
+			if f.Type == proto.FrameTypeHeartbeat {
+				heartbeats.Add(1)
+			}
+			if f.Type == proto.FrameTypeData && f.Payload[0] == 0xFF {
+				return // dropped
+			}
+			next(f)
+		}
+	})
+	rx.Use(tag("m2"))
+	done := make(chan struct{}, 1)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		note(fmt.Sprintf("cb%d", f.Payload[0]))
+		done <- struct{}{}
+	})
+
+	if err := tx.SendDataReliable([]byte{1}, 3); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("callback not called")
+	}
+	if err := tx.SendDataReliable([]byte{0xFF}, 2); err != proto.ErrTimeout {
+		t.Errorf("SendDataReliable() of a dropped frame error = %v, want ErrTimeout", err)
+	}
+	if _, err := tx.SendHeartbeat(); err != nil {
+		t.Fatalf("SendHeartbeat() error = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for heartbeats.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if heartbeats.Load() == 0 {
+		t.Error("middleware did not see the heartbeat")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Each attempt to send the dropped frame got past m1 only.
+	got := fmt.Sprint(calls)
+	if !strings.HasPrefix(got, "[m11 m21 cb1 m1255") || strings.Contains(got, "m2255") || strings.Contains(got, "cb255") {
+		t.Errorf("frames passed %s, want m1, m2 and cb for frame 1 and m1 alone for frame 255", got)
+	}
+}
+
+func TestReceiver_AckPolicy(t *testing.T) {
+	driver := NewMockDriver()
+	rx := NewReceiverWithDriver(0xBEEF, driver)
+	rx.ProcessFrame(pairingRequest(0xCAFE, 0xBEEF))
+	if !rx.IsPaired(0xCAFE) {
+		t.Fatal("pairing failed")
+	}
+
+	seq := uint32(0)
+	// acks processes ten data frames, every third asking for an ACK, and
+	// counts the ACKs sent.
+	acks := func() int {
+		driver.ClearTxLog()
+		for i := 0; i < 10; i++ {
+			seq++
+			f := &proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: seq, Payload: []byte{byte(i)}}
+			if i%3 == 0 {
+				f.Flags |= proto.FlagAckRequest
+			}
+			rx.ProcessFrame(f)
+		}
+		n := 0
+		for _, data := range driver.GetTxLog() {
+			if f := proto.DecodeFrame(data); f != nil && f.Type == proto.FrameTypeAck {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		policy AckPolicy
+		want   int
+	}{
+		{AckPolicy{}, 10},
+		{AckPolicy{Mode: AckNever}, 0},
+		{AckPolicy{Mode: AckOnRequest}, 4},
+		{AckPolicy{Mode: AckEveryN, N: 3}, 6}, // 4 requested, 2 of the other 6
+		{AckPolicy{Mode: AckEveryN, N: 1}, 10},
+		{AckPolicy{Mode: AckAlways}, 10},
+	} {
+		rx.SetAckPolicy(tc.policy)
+		if got := rx.AckPolicy(); got != tc.policy {
+			t.Errorf("AckPolicy() = %v, want %v", got, tc.policy)
+		}
+		if n := acks(); n != tc.want {
+			t.Errorf("policy %+v: %d ACKs, want %d", tc.policy, n, tc.want)
+		}
+	}
+
+	// Reliable sends ask for their ACKs.
+	tx, rx2 := pairConnected(t, 0xCAFE, 0xBEEF)
+	rx2.SetAckPolicy(AckPolicy{Mode: AckOnRequest})
+	if err := tx.SendDataReliable([]byte{1}, 3); err != nil {
+		t.Errorf("SendDataReliable() under AckOnRequest error = %v", err)
+	}
+}
+
+func TestHeartbeatAcks(t *testing.T) {
+	for _, on := range []bool{false, true} {
+		driverTx := NewMockDriver()
+		driverRx := NewMockDriver()
+		var mu sync.Mutex
+		acked := make(map[uint32]int)
+		counting := &lossyDriver{MockDriver: driverRx, drop: func(data []byte) bool {
+			if f := proto.DecodeFrame(data); f != nil && f.Type == proto.FrameTypeAck {
+				mu.Lock()
+				acked[f.Seq]++
+				mu.Unlock()
+			}
+			return false
+		}}
+
+		var opts []Option
+		if on {
+			opts = append(opts, WithHeartbeatAcks())
+		}
+		tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+		rx := NewReceiverWithDriver(0xBEEF, counting, opts...)
+		ConnectDrivers(driverTx, driverRx)
+		rx.Listen()
+		if err := tx.StartPairing(0xBEEF); err != nil {
+			t.Fatalf("StartPairing() error = %v", err)
+		}
+
+		before := tx.LastReceiverContact()
+		for !time.Now().After(before) {
+			time.Sleep(time.Millisecond)
+		}
+		seq, err := tx.SendHeartbeat()
+		if err != nil {
+			t.Fatalf("SendHeartbeat() error = %v", err)
+		}
+		// Pick up the ACK, should SendHeartbeat have stopped waiting for it.
+		deadline := time.Now().Add(time.Second)
+		for on && !tx.LastReceiverContact().After(before) && time.Now().Before(deadline) {
+			if frame := tx.ReceiveFrame(10 * time.Millisecond); frame != nil {
+				tx.handleUnpair(frame)
+			}
+		}
+		moved := tx.LastReceiverContact().After(before)
+		// The receiver handles frames in order, so once a later frame is
+		// acknowledged any heartbeat ACK has been sent.
+		if err := tx.SendDataReliable([]byte{1}, 5); err != nil {
+			t.Fatalf("SendDataReliable() error = %v", err)
+		}
+		rx.StopListening()
+
+		mu.Lock()
+		n := acked[seq]
+		mu.Unlock()
+		if on && n != 1 || !on && n != 0 {
+			t.Errorf("WithHeartbeatAcks %v: %d heartbeat ACKs sent", on, n)
+		}
+		if moved != on {
+			t.Errorf("WithHeartbeatAcks %v: LastReceiverContact moved %v, want %v", on, moved, on)
+		}
+	}
+}
+
+func TestReceiver_Stats(t *testing.T) {
+	driver := NewMockDriver()
+	rx := NewReceiverWithDriver(0xBEEF, driver)
+	defer rx.Close()
+	cfg := rx.Config()
+
+	// A pairing request, three data frames of which one is repeated and
+	// one follows a lost frame, a heartbeat and a frame that fails the CRC.
+	frames := []*proto.Frame{
+		pairingRequest(0xCAFE, 0xBEEF),
+		{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: 1, Payload: []byte{1, 2}},
+		{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: 1, Payload: []byte{1, 2}},
+		{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: 3, Payload: []byte{3}},
+		{SenderID: 0xCAFE, Type: proto.FrameTypeHeartbeat, Seq: 4},
+	}
+	var bytesIn uint64
+	for _, f := range frames {
+		data := cfg.EncodeFrame(f)
+		bytesIn += uint64(len(data))
+		driver.InjectRx(data)
+	}
+	bad := cfg.EncodeFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: 5, Payload: []byte{9}})
+	bad[len(bad)-1] ^= 0xFF
+	driver.InjectRx(bad)
+	for i := 0; i < len(frames)+1; i++ {
+		rx.ProcessFrame(rx.ReceiveFrame(10 * time.Millisecond))
+	}
+
+	got := rx.Stats()
+	var want RxStats
+	want.FramesReceived[proto.FrameTypePairing] = 1
+	want.FramesReceived[proto.FrameTypeData] = 3
+	want.FramesReceived[proto.FrameTypeHeartbeat] = 1
+	want.BytesReceived = bytesIn
+	want.CRCErrors = 1
+	want.FrameCRCErrors = 1
+	want.Duplicates = 1
+	want.Lost = 1
+	want.AcksSent = 4 // the pairing request and every data frame
+	want.PairedDevices = 1
+	dev := got.Devices[0xCAFE]
+	got.Devices = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	if dev.Frames != 4 || dev.DataFrames != 2 || dev.Duplicates != 1 || dev.Lost != 1 {
+		t.Errorf("Stats().Devices[0xCAFE] = %+v", dev)
+	}
+
+	// The hook gets the same counters, ready for JSON.
+	snapshots := make(chan Snapshot, 10)
+	rx.SetStatsHook(0, func(s Snapshot) { snapshots <- s })
+	rx.StartMaintenance(10 * time.Millisecond)
+	defer rx.StopMaintenance()
+	select {
+	case s := <-snapshots:
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatalf("json.Marshal(Snapshot) error = %v", err)
+		}
+		if !bytes.Contains(b, []byte(`"crc_errors":1`)) || !bytes.Contains(b, []byte(`"51966":{"frames":4`)) {
+			t.Errorf("snapshot JSON = %s", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stats hook not called")
+	}
+
+	// Transmitters count the frames that fail the CRC too.
+	txDriver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, txDriver)
+	txDriver.InjectRx(bad)
+	tx.ReceiveFrame(10 * time.Millisecond)
+	if n := tx.Stats().CRCErrors; n != 1 {
+		t.Errorf("transmitter CRCErrors = %d, want 1", n)
+	}
+}
+
+func TestReceiver_DeviceStats(t *testing.T) {
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver())
+	rx.ProcessFrame(pairingRequest(0xCAFE, 0xBEEF))
+	rx.ProcessFrame(pairingRequest(0xF00D, 0xBEEF))
+	if _, ok := rx.DeviceStats(0xCAFE); ok {
+		t.Error("DeviceStats() before any traffic = ok")
+	}
+
+	data := func(seq uint32, payload ...byte) *proto.Frame {
+		return &proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: seq, Payload: payload}
+	}
+	start := time.Now()
+	rx.ProcessFrame(data(1, 1, 2, 3))
+	rx.ProcessFrame(data(2, 4, 5))
+	rx.ProcessFrame(data(2, 4, 5)) // retransmission
+	rx.ProcessFrame(data(5, 6))    // 3 and 4 lost
+	rx.ProcessFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeHeartbeat, Seq: 6})
+	rx.ProcessFrame(&proto.Frame{SenderID: 0xF00D, Type: proto.FrameTypeHeartbeat, Seq: 9})
+	rx.ProcessFrame(&proto.Frame{SenderID: 0xDEAD, Type: proto.FrameTypeData, Seq: 1, Payload: []byte{1}})
+
+	got, ok := rx.DeviceStats(0xCAFE)
+	if !ok {
+		t.Fatal("DeviceStats() = !ok")
+	}
+	if got.LastSeen.Before(start) {
+		t.Errorf("LastSeen = %v, before the traffic", got.LastSeen)
+	}
+	got.LastSeen = time.Time{}
+	want := RxDeviceStats{Frames: 5, DataFrames: 3, Heartbeats: 1, Bytes: 6, Duplicates: 1, Lost: 2, LastSeq: 6}
+	if got != want {
+		t.Errorf("DeviceStats() = %+v, want %+v", got, want)
+	}
+
+	all := rx.AllDeviceStats()
+	if len(all) != 2 || all[0xF00D].Heartbeats != 1 || all[0xF00D].LastSeq != 9 {
+		t.Errorf("AllDeviceStats() = %+v, want 0xCAFE and one heartbeat of 0xF00D", all)
+	}
+
+	if err := rx.Unpair(0xCAFE); err != nil {
+		t.Fatalf("Unpair() error = %v", err)
+	}
+	if _, ok := rx.DeviceStats(0xCAFE); ok {
+		t.Error("stats kept after Unpair")
+	}
+	rx.ProcessFrame(pairingRequest(0xCAFE, 0xBEEF))
+	rx.ProcessFrame(data(7, 1))
+	if got, _ := rx.DeviceStats(0xCAFE); got.Frames != 1 || got.DataFrames != 1 || got.Lost != 0 {
+		t.Errorf("DeviceStats() after pairing again = %+v, want one frame", got)
+	}
+}
+
+func TestReceiver_TransmitterRestart(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	ConnectDrivers(driverTx, driverRx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	defer rx.Close()
+	got := make(chan byte, 100)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) { got <- f.Payload[0] })
+	events := make(chan DeviceEventType, 10)
+	rx.SetDeviceEventHandler(func(ev DeviceEvent) { events <- ev.Type })
+	rx.Listen()
+	defer rx.StopListening()
+
+	// Both runs draw the same pairing key, as a transmitter that derives
+	// it from a fixed seed would.
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithRandSource(proto.NewSeededRand(1)))
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	for i := byte(1); i <= 3; i++ {
+		if err := tx.SendDataReliable([]byte{i}, 3); err != nil {
+			t.Fatalf("SendDataReliable() error = %v", err)
+		}
+	}
+
+	restarted := NewTransmitterWithDriver(0xCAFE, driverTx, WithRandSource(proto.NewSeededRand(1)))
+	if err := restarted.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() after restart error = %v", err)
+	}
+	if err := restarted.SendDataReliable([]byte{9}, 3); err != nil {
+		t.Fatalf("SendDataReliable() after restart error = %v", err)
+	}
+	deadline := time.After(time.Second)
+	for delivered := false; !delivered; {
+		select {
+		case b := <-got:
+			delivered = b == 9
+		case <-deadline:
+			t.Fatal("data after the restart not delivered")
+		}
+	}
+	if !rx.IsPaired(0xCAFE) {
+		t.Error("transmitter unpaired by its restart")
+	}
+	for want := []DeviceEventType{DevicePaired, DeviceRebooted}; len(want) > 0; want = want[1:] {
+		select {
+		case ev := <-events:
+			if ev != want[0] {
+				t.Fatalf("event %d, want %d", ev, want[0])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want %d", want[0])
+		}
+	}
+
+	// A restart is also noticed from the data alone, with no pairing.
+	for seq := uint32(100); seq < 200; seq++ {
+		rx.ProcessFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeHeartbeat, Seq: seq})
+	}
+	rx.ProcessFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: 1, Payload: []byte{7}})
+	select {
+	case b := <-got:
+		if b != 7 {
+			t.Errorf("delivered %d, want 7", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("data restarting its sequence numbers not delivered")
+	}
+	select {
+	case ev := <-events:
+		if ev != DeviceRebooted {
+			t.Errorf("event %d, want DeviceRebooted", ev)
+		}
+	case <-time.After(time.Second):
+		t.Error("no DeviceRebooted for the data")
+	}
+}
+
+func TestReceiver_PauseDevice(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	var sent atomic.Int32
+	counting := &lossyDriver{MockDriver: driverTx, drop: func(data []byte) bool {
+		if f := proto.DecodeFrame(data); f != nil && f.Type == proto.FrameTypeData {
+			sent.Add(1)
+		}
+		return false
+	}}
+	tx := NewTransmitterWithDriver(0xCAFE, counting, WithTxQueue(TxQueueConfig{}))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	tx.Listen()
+	defer tx.Stop()
+
+	received := make(chan byte, 20)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) { received <- f.Payload[0] })
+	if _, err := tx.Enqueue([]byte{1}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	<-received
+
+	if err := rx.PauseDevice(0xCAFE); err != nil {
+		t.Fatalf("PauseDevice() error = %v", err)
+	}
+	if !tx.Paused() || !rx.DevicePaused(0xCAFE) {
+		t.Fatalf("Paused() = %v, DevicePaused() = %v after PauseDevice", tx.Paused(), rx.DevicePaused(0xCAFE))
+	}
+	before := sent.Load()
+	for i := byte(2); i <= 4; i++ {
+		if _, err := tx.Enqueue([]byte{i}); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+	go func() { _, _ = tx.SendData([]byte{5}) }()
+	if _, err := tx.SendHeartbeat(); err != nil {
+		t.Errorf("SendHeartbeat() while paused error = %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := sent.Load() - before; n != 0 {
+		t.Errorf("%d data frames sent while paused", n)
+	}
+
+	// A pause repeated after its ACK was lost does not undo the resume.
+	if err := rx.ResumeDevice(0xCAFE); err != nil {
+		t.Fatalf("ResumeDevice() error = %v", err)
+	}
+	tx.handleFlowControl(&proto.Frame{SenderID: 0xBEEF, Type: proto.FrameTypeControl, Seq: 0,
+		Payload: proto.EncodeControl(proto.ControlPause, 0xCAFE, []byte{0xFF, 0xFF, 0, 0})})
+	if tx.Paused() || rx.DevicePaused(0xCAFE) {
+		t.Error("still paused after ResumeDevice")
+	}
+	var got []byte
+	for len(got) < 4 {
+		select {
+		case b := <-received:
+			got = append(got, b)
+		case <-time.After(time.Second):
+			t.Fatalf("received %v after resuming, want 4 frames", got)
+		}
+	}
+
+	// The safety timeout resumes a transmitter that never hears the resume.
+	start := time.Now()
+	if err := rx.PauseDeviceFor(0xCAFE, 50*time.Millisecond); err != nil {
+		t.Fatalf("PauseDeviceFor() error = %v", err)
+	}
+	if _, err := tx.SendData([]byte{6}); err != nil {
+		t.Fatalf("SendData() error = %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("SendData returned after %v, want it held by the pause", waited)
+	}
+	if tx.Paused() || rx.DevicePaused(0xCAFE) {
+		t.Error("still paused after the safety timeout")
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithDispatchPool(DispatchPoolConfig{Workers: 1, Queue: 8}))
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	var slow atomic.Bool
+	rx.RegisterCallback(proto.FrameTypeData, func(*proto.Frame) {
+		if slow.Load() {
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	// send makes ten reliable sends and returns the highest backpressure
+	// reported along the way, as decoded from their ACKs.
+	send := func() uint8 {
+		var peak uint8
+		for i := 0; i < 10; i++ {
+			if err := tx.SendDataReliable([]byte{byte(i)}, 5); err != nil {
+				t.Fatalf("SendDataReliable() error = %v", err)
+			}
+			if b := tx.Backpressure(); b > peak {
+				peak = b
+			}
+		}
+		return peak
+	}
+
+	if peak := send(); peak != 0 {
+		t.Errorf("backpressure %d with an idle receiver", peak)
+	}
+	time.Sleep(50 * time.Millisecond)
+	slow.Store(true)
+	peak := send()
+	if peak == 0 {
+		t.Error("no backpressure reported by a receiver with a slow callback")
+	}
+	if d := backpressureDelay(peak); d <= 0 || d > maxBackpressureDelay {
+		t.Errorf("delay at backpressure %d = %v, want up to %v", peak, d, maxBackpressureDelay)
+	}
+	for level, want := range map[uint8]time.Duration{0: 0, 51: maxBackpressureDelay / 5, 255: maxBackpressureDelay} {
+		if got := backpressureDelay(level); got != want {
+			t.Errorf("backpressureDelay(%d) = %v, want %v", level, got, want)
+		}
+	}
+	time.Sleep(backpressureHold)
+	if b := tx.Backpressure(); b != 0 {
+		t.Errorf("Backpressure() = %d after a second without ACKs, want 0", b)
+	}
+}
+
+// loopbackDriver is a MockDriver that hears its own transmissions, as some
+// half-duplex radios and bridged setups do.
+type loopbackDriver struct {
+	*MockDriver
+}
+
+func (d loopbackDriver) Tx(data []byte) error {
+	d.InjectRx(data)
+	return d.MockDriver.Tx(data)
+}
+
+func TestEchoedFrames(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, loopbackDriver{driverTx})
+	rx := NewReceiverWithDriver(0xBEEF, loopbackDriver{driverRx})
+	ConnectDrivers(driverTx, driverRx)
+
+	var mu sync.Mutex
+	senders := make(map[proto.DeviceID]int)
+	rx.Use(func(next FrameHandler) FrameHandler {
+		return func(f *proto.Frame) {
+			mu.Lock()
+			senders[f.SenderID]++
+			mu.Unlock()
+			next(f)
+		}
+	})
+	rx.Listen()
+	defer rx.StopListening()
+	tx.Listen()
+	defer tx.Stop()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := tx.SendDataReliable([]byte{byte(i)}, 3); err != nil {
+			t.Fatalf("SendDataReliable() error = %v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	own := senders[0xBEEF]
+	mu.Unlock()
+	if own != 0 {
+		t.Errorf("receiver processed %d of its own frames", own)
+	}
+	if n := rx.EchoedFrames(); n < 4 {
+		t.Errorf("receiver EchoedFrames() = %d, want its pairing and data ACKs", n)
+	}
+	if n := tx.EchoedFrames(); n < 4 {
+		t.Errorf("transmitter EchoedFrames() = %d, want its pairing request and data frames", n)
+	}
+
+	rx.ProcessFrame(&proto.Frame{SenderID: 0xBEEF, Type: proto.FrameTypeData, Seq: 1, Payload: []byte{1}})
+	mu.Lock()
+	own = senders[0xBEEF]
+	mu.Unlock()
+	if own != 0 {
+		t.Error("ProcessFrame passed on a frame from the receiver itself")
+	}
+}
+
+func TestPairing_ChallengeResponse(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	tx.SetPairingKey(proto.PairingKeyFromUint32(0x5EC12E7))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	rx.SetPairingKey(proto.PairingKeyFromUint32(0x5EC12E7))
+
+	// Record everything the transmitter puts on the air.
+	var sniffed [][]byte
+	var sniffMu sync.Mutex
+	spy := &tapDriver{MockDriver: driverTx, tap: func(data []byte) {
+		sniffMu.Lock()
+		sniffed = append(sniffed, data)
+		sniffMu.Unlock()
+	}}
+	tx.driver = spy
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if !rx.IsPaired(0xCAFE) {
+		t.Error("receiver did not pair after a correct response")
+	}
+
+	sniffMu.Lock()
+	defer sniffMu.Unlock()
+	if len(sniffed) != 2 {
+		t.Fatalf("transmitter sent %d frames, want request and response", len(sniffed))
+	}
+	if req := proto.DecodeFrame(sniffed[0]); !bytes.Equal(req.Payload[:4], []byte{0, 0, 0, 0}) {
+		t.Errorf("pre-shared key leaked in pairing request: % X", req.Payload[:4])
+	}
+}
+
+func TestPairing_WrongKeyRejected(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	tx.SetPairingKey(proto.PairingKeyFromUint32(0xBAD))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	rx.SetPairingKey(proto.PairingKeyFromUint32(0x5EC12E7))
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != proto.ErrPairingRejected {
+		t.Errorf("StartPairing() error = %v, want %v", err, proto.ErrPairingRejected)
+	}
+	if rx.IsPaired(0xCAFE) || tx.device.IsPaired {
+		t.Error("wrong-key transmitter was paired")
+	}
+}
+
+// tapDriver passes every transmitted frame to tap before forwarding it.
+type tapDriver struct {
+	*MockDriver
+	tap func([]byte)
+}
+
+func (d *tapDriver) Tx(data []byte) error {
+	d.tap(append([]byte(nil), data...))
+	return d.MockDriver.Tx(data)
+}
+
+func TestPairing_SecureKeyExchange(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	tx.SetSecurePairing(true)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	rx.SetSecurePairing(true)
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	var rxKey []byte
+	for _, dev := range rx.GetPairedDevices() {
+		if dev.ID == 0xCAFE {
+			rxKey = dev.SessionKey
+		}
+	}
+	if len(tx.SessionKey()) != proto.SessionKeySize || !bytes.Equal(tx.SessionKey(), rxKey) {
+		t.Errorf("session keys differ: tx %x, rx %x", tx.SessionKey(), rxKey)
+	}
+}
+
+func TestPairing_SecureReceiverRefusesLegacyTransmitter(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	rx.SetSecurePairing(true)
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != proto.ErrSecurityMismatch {
+		t.Errorf("StartPairing() error = %v, want %v", err, proto.ErrSecurityMismatch)
+	}
+	if rx.IsPaired(0xCAFE) {
+		t.Error("secure receiver paired with a legacy transmitter")
+	}
+}
+
+func TestPairing_SecureTransmitterRefusesLegacyReceiver(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver)
+	tx.SetSecurePairing(true)
+
+	// A legacy receiver ACKs with just its ID and no public key.
+	driver.InjectRx(proto.EncodeFrame(&proto.Frame{
+		SenderID: 0xBEEF,
+		Type:     proto.FrameTypeAck,
+		Seq:      0,
+		Payload:  []byte{0xEF, 0xBE, 0, 0},
+	}))
+
+	if err := tx.StartPairing(0xBEEF); err != proto.ErrSecurityMismatch {
+		t.Errorf("StartPairing() error = %v, want %v", err, proto.ErrSecurityMismatch)
+	}
+	if tx.device.IsPaired {
+		t.Error("secure transmitter paired with a legacy receiver")
+	}
+
+	// The refusal is announced so the receiver can drop the half-open pairing.
+	txLog := driver.GetTxLog()
+	last := proto.DecodeFrame(txLog[len(txLog)-1])
+	if cmd, target, args, _ := proto.DecodeControl(last.Payload); last.Type != proto.FrameTypeControl ||
+		cmd != proto.ControlPairReject || target != 0xBEEF || args[0] != proto.RejectSecurityMismatch {
+		t.Errorf("last frame = %+v, want a security-mismatch reject", last)
+	}
+}
+
+// lossyDriver silently discards transmitted frames for which drop returns true.
+type lossyDriver struct {
+	*MockDriver
+	drop func([]byte) bool
+}
+
+func (d *lossyDriver) Tx(data []byte) error {
+	if d.drop(data) {
+		return nil
+	}
+	return d.MockDriver.Tx(data)
+}
+
+func TestReceiver_ReplaysCachedAck(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	// Lose the first ACK of every frame, keeping all that were sent.
+	var mu sync.Mutex
+	acks := make(map[uint32][][]byte)
+	lossy := &lossyDriver{MockDriver: driverRx, drop: func(data []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		f := proto.DecodeFrame(data)
+		if f == nil || f.Type != proto.FrameTypeAck {
+			return false
+		}
+		acks[f.Seq] = append(acks[f.Seq], append([]byte(nil), data...))
+		return len(acks[f.Seq]) == 1
+	}}
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithAckTimeout(AckTimeoutConfig{Max: 50 * time.Millisecond}))
+	rx := NewReceiverWithDriver(0xBEEF, lossy)
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	// A reply that differs every time it is generated.
+	var replies atomic.Int32
+	rx.SetReplyHandler(func(*proto.Frame) []byte {
+		return []byte{byte(replies.Add(1))}
+	})
+	seq := tx.SeqState().Seq
+	reply, err := tx.SendDataReliableWithReply([]byte{1}, 5)
+	if err != nil {
+		t.Fatalf("SendDataReliableWithReply() error = %v", err)
+	}
+	if !bytes.Equal(reply, []byte{1}) || replies.Load() != 1 {
+		t.Errorf("reply = %v after %d replies generated, want the first", reply, replies.Load())
+	}
+	mu.Lock()
+	sent := acks[seq]
+	mu.Unlock()
+	if len(sent) < 2 {
+		t.Fatalf("%d ACKs sent for seq=%d, want the lost one and its replay", len(sent), seq)
+	}
+	for _, ack := range sent[1:] {
+		if !bytes.Equal(ack, sent[0]) {
+			t.Errorf("replayed ACK %x, want %x", ack, sent[0])
+		}
+	}
+	rx.StopListening()
+
+	// A frame older than the latest gets its own ACK back too.
+	data := func(seq uint32) *proto.Frame {
+		return &proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: seq, Payload: []byte{2}}
+	}
+	rx.ProcessFrame(data(seq + 10))
+	rx.ProcessFrame(data(seq + 11))
+	rx.ProcessFrame(data(seq + 10))
+	mu.Lock()
+	defer mu.Unlock()
+	if sent := acks[seq+10]; len(sent) != 2 || !bytes.Equal(sent[1], sent[0]) {
+		t.Errorf("ACKs for an older frame %x, want the first replayed", sent)
+	}
+}
+
+func TestReceiver_SuppressesDuplicates(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	// Lose the first two ACKs of every frame.
+	var mu sync.Mutex
+	acks := make(map[uint32]int)
+	lossy := &lossyDriver{MockDriver: driverRx, drop: func(data []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		f := proto.DecodeFrame(data)
+		if f == nil || f.Type != proto.FrameTypeAck {
+			return false
+		}
+		acks[f.Seq]++
+		return acks[f.Seq] <= 2
+	}}
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithAckTimeout(AckTimeoutConfig{Max: 50 * time.Millisecond}))
+	rx := NewReceiverWithDriver(0xBEEF, lossy)
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	var replies atomic.Int32
+	rx.SetReplyHandler(func(f *proto.Frame) []byte {
+		replies.Add(1)
+		return []byte{0x40 + f.Payload[0]}
+	})
+	delivered := make(chan *proto.Frame, 10)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) { delivered <- f })
+
+	var got []byte
+	var last *proto.Frame
+	for i := byte(1); i <= 3; i++ {
+		reply, err := tx.SendDataReliableWithReply([]byte{i}, 5)
+		if err != nil {
+			t.Fatalf("SendDataReliableWithReply(%d) error = %v", i, err)
+		}
+		if len(reply) != 1 || reply[0] != 0x40+i {
+			t.Errorf("reply to %d = %v, want [%d]", i, reply, 0x40+i)
+		}
+		select {
+		case last = <-delivered:
+			got = append(got, last.Payload[0])
+		case <-time.After(time.Second):
+			t.Fatalf("frame %d not delivered", i)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(delivered) != 0 {
+		t.Errorf("%d frames delivered more than once", len(delivered))
+	}
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("delivered %v, want [1 2 3]", got)
+	}
+	if n := replies.Load(); n != 3 {
+		t.Errorf("reply handler called %d times, want 3", n)
+	}
+	if n := rx.DuplicateFrames(0xCAFE); n != 6 {
+		t.Errorf("DuplicateFrames() = %d, want 6", n)
+	}
+
+	// A transmitter that restarted may number its frames anew.
+	rx.StopListening()
+	again := &proto.Frame{Type: proto.FrameTypeData, SenderID: 0xCAFE, Seq: last.Seq, Payload: []byte{4}}
+	rx.ProcessFrame(again)
+	rx.ProcessFrame(&proto.Frame{Type: proto.FrameTypeHeartbeat, SenderID: 0xCAFE, Seq: last.Seq + 1, Payload: proto.AppendEpochTLV(nil, 1)})
+	rx.ProcessFrame(again)
+	if n := len(delivered); n != 1 {
+		t.Errorf("%d frames delivered around the restart, want only the one after it", n)
+	}
+	if n := rx.DuplicateFrames(0xCAFE); n != 7 {
+		t.Errorf("DuplicateFrames() = %d, want 7", n)
+	}
+}
+
+func TestReceiver_FrameLoss(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var gaps []string
+	rx.OnFrameLoss(func(id proto.DeviceID, first, count uint32) {
+		mu.Lock()
+		gaps = append(gaps, fmt.Sprintf("%x:%d+%d", uint32(id), first, count))
+		mu.Unlock()
+	})
+	done := make(chan struct{}, 1)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		if f.Seq == 50 {
+			done <- struct{}{}
+		}
+	})
+
+	inject := func(ftype byte, seq uint32, payload []byte) {
+		driverRx.InjectRx(rx.config.EncodeFrame(&proto.Frame{SenderID: 0xCAFE, Type: ftype, Seq: seq, Payload: payload}))
+	}
+	inject(proto.FrameTypeData, 5000, []byte{1}) // far ahead: taken for a restart
+	inject(proto.FrameTypeData, 5001, []byte{2})
+	inject(proto.FrameTypeData, 5004, []byte{3})
+	inject(proto.FrameTypeData, 5003, []byte{4}) // late
+	inject(proto.FrameTypeData, 0xFFFFFFFD, []byte{5})
+	inject(proto.FrameTypeData, 0xFFFFFFFE, []byte{6})
+	inject(proto.FrameTypeData, 1, []byte{7}) // wraps around
+	inject(proto.FrameTypeHeartbeat, 2, proto.AppendEpochTLV(nil, 1))
+	inject(proto.FrameTypeData, 50, []byte{8}) // first frame of the new epoch
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("frames not processed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := fmt.Sprint(gaps), "[cafe:5002+2 cafe:4294967295+2]"; got != want {
+		t.Errorf("gaps reported = %s, want %s", got, want)
+	}
+	if n := rx.LostFrames(0xCAFE); n != 4 {
+		t.Errorf("LostFrames() = %d, want 4", n)
+	}
+}
+
+func TestReceiver_DeviceEvents(t *testing.T) {
+	cfg := proto.Config{HeartbeatInterval: 10 * time.Millisecond, DeviceTimeout: 30 * time.Millisecond}
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithConfig(cfg))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithConfig(cfg))
+	defer rx.Close()
+
+	events := make(chan DeviceEvent, 10)
+	rx.SetDeviceEventHandler(func(ev DeviceEvent) {
+		// The handler may call the receiver.
+		want := ev.Type == DevicePaired || ev.Type == DeviceReturned
+		if paired := rx.IsPaired(ev.ID); paired != want {
+			t.Errorf("IsPaired(%d) = %v in event %d, want %v", ev.ID, paired, ev.Type, want)
+		}
+		events <- ev
+	})
+	next := func(want DeviceEventType) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Type != want || ev.ID != 0xCAFE || ev.Time.IsZero() {
+				t.Fatalf("event = %+v, want type %d for 0xCAFE", ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want type %d", want)
+		}
+	}
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	next(DevicePaired)
+
+	time.Sleep(50 * time.Millisecond)
+	rx.CleanupTimedOutDevices()
+	next(DeviceLost)
+
+	if _, err := tx.SendHeartbeat(); err != nil {
+		t.Fatalf("SendHeartbeat() error = %v", err)
+	}
+	next(DeviceReturned)
+
+	if err := rx.Unpair(0xCAFE); err != nil {
+		t.Fatalf("Unpair() error = %v", err)
+	}
+	next(DeviceUnpaired)
+
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %+v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n := rx.DroppedDeviceEvents(); n != 0 {
+		t.Errorf("DroppedDeviceEvents() = %d, want 0", n)
+	}
+}
+
+func TestReceiver_ReceiveDataFrom(t *testing.T) {
+	driverRx, driverA, driverB := NewMockDriver(), NewMockDriver(), NewMockDriver()
+	shareMedium(driverRx, driverA, driverB)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	a := NewTransmitterWithDriver(0xCAFE, driverA)
+	b := NewTransmitterWithDriver(0xF00D, driverB)
+	rx.Listen()
+	for _, tx := range []*Transmitter{a, b} {
+		if err := tx.StartPairing(0xBEEF); err != nil {
+			t.Fatalf("StartPairing(%d) error = %v", tx.device.ID, err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for !(rx.IsPaired(0xCAFE) && rx.IsPaired(0xF00D)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	var mu sync.Mutex
+	var delivered []string
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		mu.Lock()
+		delivered = append(delivered, fmt.Sprintf("%x/%d", uint32(f.SenderID), f.Payload[0]))
+		mu.Unlock()
+	})
+	sendBoth := func(first, second byte) chan error {
+		errs := make(chan error, 2)
+		go func() {
+			errs <- a.SendDataReliable([]byte{first}, 5)
+			errs <- b.SendDataReliable([]byte{second}, 5)
+		}()
+		return errs
+	}
+
+	for _, listening := range []bool{false, true} {
+		if !listening {
+			rx.StopListening()
+		} else {
+			rx.Listen()
+		}
+		mu.Lock()
+		delivered = nil
+		mu.Unlock()
+
+		errs := sendBoth(1, 2)
+		got, err := rx.ReceiveDataFrom(0xF00D, time.Second)
+		if err != nil || fmt.Sprint(got) != "[2]" {
+			t.Fatalf("listening=%v: ReceiveDataFrom() = %v, %v, want [2]", listening, got, err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				t.Errorf("listening=%v: SendDataReliable() error = %v", listening, err)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		if got := fmt.Sprint(delivered); got != "[cafe/1 f00d/2]" {
+			t.Errorf("listening=%v: callbacks got %s, want each frame once", listening, got)
+		}
+		mu.Unlock()
+	}
+	rx.StopListening()
+
+	if _, err := rx.ReceiveDataFrom(0xCAFE, 30*time.Millisecond); err != proto.ErrTimeout {
+		t.Errorf("ReceiveDataFrom() of a silent device error = %v, want %v", err, proto.ErrTimeout)
+	}
+	if _, err := rx.ReceiveDataFrom(0x1234, time.Second); err != proto.ErrNotPaired {
+		t.Errorf("ReceiveDataFrom() of an unknown device error = %v, want %v", err, proto.ErrNotPaired)
+	}
+}
+
+func TestReceiver_Frames(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	all, _ := rx.Frames(proto.FrameTypeData, 4, FramesBlock)
+	var called atomic.Int32
+	rx.RegisterCallback(proto.FrameTypeData, func(*proto.Frame) { called.Add(1) })
+	some, cancel := rx.Frames(proto.FrameTypeData, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var got []byte
+	go func() {
+		defer wg.Done()
+		for f := range all {
+			got = append(got, f.Payload[0])
+		}
+	}()
+	var slow int
+	go func() {
+		defer wg.Done()
+		for range some {
+			slow++
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+
+	const n = 50
+	for i := byte(0); i < n; i++ {
+		if err := tx.SendDataReliable([]byte{i}, 5); err != nil {
+			t.Fatalf("SendDataReliable(%d) error = %v", i, err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for called.Load() < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	cancel()
+	if err := rx.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	wg.Wait() // both channels closed
+
+	want := make([]byte, n)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("blocking subscription got %v, want every frame in order", got)
+	}
+	if c := called.Load(); c != n {
+		t.Errorf("callback called %d times, want %d", c, n)
+	}
+	if dropped := rx.DroppedSubscriptionFrames(); slow+int(dropped) != n || slow == 0 {
+		t.Errorf("dropping subscription got %d frames and dropped %d, want %d in all", slow, dropped, n)
+	}
+	late, _ := rx.Frames(proto.FrameTypeData, 1)
+	if _, ok := <-late; ok {
+		t.Error("Frames() after Close returned an open channel")
+	}
+}
+
+func TestReceiver_MaxFrameAge(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithDispatchPool(DispatchPoolConfig{Workers: 1, Queue: 4}))
+	defer rx.Close()
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	rx.SetMaxFrameAge(20 * time.Millisecond)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []byte
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		if f.Received.IsZero() {
+			t.Error("delivered frame has no arrival time")
+		}
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		mu.Lock()
+		got = append(got, f.Payload[0])
+		mu.Unlock()
+	})
+
+	if err := tx.SendDataReliable([]byte{0}, 3); err != nil {
+		t.Fatalf("SendDataReliable(0) error = %v", err)
+	}
+	<-started
+	for i := byte(1); i <= 2; i++ {
+		if err := tx.SendDataReliable([]byte{i}, 3); err != nil {
+			t.Fatalf("SendDataReliable(%d) error = %v", i, err)
+		}
+	}
+	time.Sleep(40 * time.Millisecond) // the queued frames go stale
+	close(release)
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	if !bytes.Equal(got, []byte{0}) {
+		t.Errorf("delivered %v, want only the frame that was not held up", got)
+	}
+	mu.Unlock()
+	if n := rx.StaleFrames(); n != 2 {
+		t.Errorf("StaleFrames() = %d, want 2", n)
+	}
+	if n := rx.Stats().StaleFrames; n != 2 {
+		t.Errorf("Stats().StaleFrames = %d, want 2", n)
+	}
+
+	rx.SetMaxFrameAge(0)
+	if err := tx.SendDataReliable([]byte{3}, 3); err != nil {
+		t.Fatalf("SendDataReliable(3) error = %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if !bytes.Equal(got, []byte{0, 3}) {
+		t.Errorf("delivered %v with the limit off, want [0 3]", got)
+	}
+}
+
+func TestReceiver_DispatchPolicy(t *testing.T) {
+	tests := []struct {
+		policy  DispatchPolicy
+		want    []byte // payloads the callback got
+		dropped uint64
+	}{
+		{DispatchDropNewest, []byte{0, 1, 2, 3, 4}, 2},
+		{DispatchDropOldest, []byte{0, 3, 4, 5, 6}, 2},
+		{DispatchBlock, []byte{0, 1, 2, 3, 4, 5, 6}, 0},
+	}
+	for _, tt := range tests {
+		var warnings atomic.Int32
+		rx := NewReceiverWithDriver(0xBEEF, NewMockDriver(), WithDispatchPool(DispatchPoolConfig{
+			Workers:     1,
+			Queue:       4,
+			Policy:      tt.policy,
+			OnFirstDrop: func() { warnings.Add(1) },
+		}))
+		rx.ProcessFrame(pairingRequest(0xCAFE, 0xBEEF))
+		if !rx.IsPaired(0xCAFE) {
+			t.Fatalf("policy %d: transmitter not paired", tt.policy)
+		}
+
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		var mu sync.Mutex
+		var got []byte
+		rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			mu.Lock()
+			got = append(got, f.Payload[0])
+			mu.Unlock()
+		})
+		send := func(i byte) {
+			rx.ProcessFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: 100 + uint32(i), Payload: []byte{i}})
+		}
+
+		send(0)
+		<-started // the worker is stuck on frame 0 with the queue empty
+		sent := make(chan struct{})
+		go func() {
+			defer close(sent)
+			for i := byte(1); i <= 6; i++ {
+				send(i)
+			}
+		}()
+		select {
+		case <-sent:
+			if tt.policy == DispatchBlock {
+				t.Errorf("policy %d: frames processed past a full queue", tt.policy)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if tt.policy != DispatchBlock {
+				t.Fatalf("policy %d: processing blocked on a full queue", tt.policy)
+			}
+		}
+		close(release)
+		<-sent
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			mu.Lock()
+			n := len(got)
+			mu.Unlock()
+			if n >= len(tt.want) || time.Now().After(deadline) {
+				break
+			}
+		}
+
+		mu.Lock()
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("policy %d: delivered %v, want %v", tt.policy, got, tt.want)
+		}
+		mu.Unlock()
+		s := rx.Stats()
+		if s.DispatchDrops[tt.policy] != tt.dropped || s.DispatchDropsByType[proto.FrameTypeData] != tt.dropped || rx.DroppedDispatchFrames() != tt.dropped {
+			t.Errorf("policy %d: drops = %v, by type %d, want %d", tt.policy, s.DispatchDrops, s.DispatchDropsByType[proto.FrameTypeData], tt.dropped)
+		}
+		wantWarnings := int32(0)
+		if tt.dropped > 0 {
+			wantWarnings = 1
+		}
+		if n := warnings.Load(); n != wantWarnings {
+			t.Errorf("policy %d: OnFirstDrop called %d times, want %d", tt.policy, n, wantWarnings)
+		}
+		rx.Close()
+	}
+}
+
+func TestReceiver_DispatchPool(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	var overflows atomic.Int32
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithDispatchPool(DispatchPoolConfig{
+		Workers:    1,
+		Queue:      2,
+		OnOverflow: func(*proto.Frame) { overflows.Add(1) },
+	}))
+	defer rx.Close()
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var got []byte
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release // a callback far slower than the link
+		mu.Lock()
+		got = append(got, f.Payload[0])
+		mu.Unlock()
+	})
+
+	if err := tx.SendDataReliable([]byte{0}, 3); err != nil {
+		t.Fatalf("SendDataReliable(0) error = %v", err)
+	}
+	<-started
+	// The stuck callback holds up neither the ACKs nor the listen loop.
+	for i := byte(1); i <= 5; i++ {
+		if err := tx.SendDataReliable([]byte{i}, 3); err != nil {
+			t.Fatalf("SendDataReliable(%d) while the callback is stuck error = %v", i, err)
+		}
+	}
+	if n := rx.DroppedDispatchFrames(); n != 3 {
+		t.Errorf("DroppedDispatchFrames() = %d, want 3", n)
+	}
+	if n := overflows.Load(); n != 3 {
+		t.Errorf("OnOverflow called %d times, want 3", n)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		s := fmt.Sprint(got)
+		mu.Unlock()
+		if s == "[0 1 2]" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("callbacks got %s, want [0 1 2]", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRekey_LostAckRetried(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	var mu sync.Mutex
+	dropNextAck := false
+	lossy := &lossyDriver{MockDriver: driverRx, drop: func(data []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if f := proto.DecodeFrame(data); dropNextAck && f != nil && f.Type == proto.FrameTypeAck {
+			dropNextAck = false
+			return true
+		}
+		return false
+	}}
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	tx.SetSecurePairing(true)
+	rx := NewReceiverWithDriver(0xBEEF, lossy)
+
+	var rotations []uint8
+	rx.SetRekeyHandler(func(id proto.DeviceID, index uint8) {
+		if id == 0xCAFE {
+			rotations = append(rotations, index)
+		}
+	})
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	paired := tx.SessionKey()
+
+	mu.Lock()
+	dropNextAck = true
+	mu.Unlock()
+
+	if err := tx.Rekey(); err != nil {
+		t.Fatalf("Rekey() error = %v", err)
+	}
+
+	rxDev := rx.GetPairedDevices()[0]
+	rx.mu.Lock()
+	rxKey, rxIndex, rxPrev := rxDev.SessionKey, rxDev.KeyIndex, rxDev.PrevSessionKey
+	rx.mu.Unlock()
+
+	if bytes.Equal(tx.SessionKey(), paired) {
+		t.Error("Rekey() kept the pairing session key")
+	}
+	if !bytes.Equal(tx.SessionKey(), rxKey) || tx.device.KeyIndex != rxIndex {
+		t.Errorf("keys differ after retried rekey: tx %x (index %d), rx %x (index %d)",
+			tx.SessionKey(), tx.device.KeyIndex, rxKey, rxIndex)
+	}
+	if !bytes.Equal(rxPrev, paired) {
+		t.Error("receiver did not keep the previous key for the overlap window")
+	}
+	if len(rotations) != 1 || rotations[0] != 1 {
+		t.Errorf("rekey handler calls = %v, want [1]", rotations)
+	}
+
+	// A second rotation chains from the first.
+	if err := tx.Rekey(); err != nil {
+		t.Fatalf("second Rekey() error = %v", err)
+	}
+	rx.mu.Lock()
+	rxKey = rxDev.SessionKey
+	rx.mu.Unlock()
+	if !bytes.Equal(tx.SessionKey(), rxKey) || tx.device.KeyIndex != 2 {
+		t.Errorf("keys differ after second rekey: tx %x, rx %x", tx.SessionKey(), rxKey)
+	}
+}
+
+func TestRekey_RequiresSessionKey(t *testing.T) {
+	tx, _ := pairConnected(t, 0xCAFE, 0xBEEF)
+	if err := tx.Rekey(); err != proto.ErrNoSessionKey {
+		t.Errorf("Rekey() error = %v, want %v", err, proto.ErrNoSessionKey)
+	}
+}
+
+func TestPairing_NumericComparison(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+
+	rxCode := make(chan uint32, 1)
+	rx.SetPairingConfirm(func(id proto.DeviceID, code uint32) bool {
+		rxCode <- code
+		return true
+	})
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	var txCode uint32
+	err := tx.StartPairingWithConfirm(0xBEEF, func(code uint32) bool {
+		txCode = code
+		return true
+	})
+	if err != nil {
+		t.Fatalf("StartPairingWithConfirm() error = %v", err)
+	}
+	if got := <-rxCode; got != txCode || txCode >= proto.ComparisonCodeModulus {
+		t.Errorf("comparison codes: tx %06d, rx %06d", txCode, got)
+	}
+	if !rx.IsPaired(0xCAFE) || tx.SessionKey() == nil {
+		t.Error("confirmed pairing did not complete")
+	}
+}
+
+func TestPairing_ReceiverUserRejects(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	rx.SetPairingConfirm(func(proto.DeviceID, uint32) bool { return false })
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	err := tx.StartPairingWithConfirm(0xBEEF, func(uint32) bool { return true })
+	if err != proto.ErrPairingRejected {
+		t.Errorf("StartPairingWithConfirm() error = %v, want %v", err, proto.ErrPairingRejected)
+	}
+	if rx.IsPaired(0xCAFE) || tx.device.IsPaired {
+		t.Error("rejected pairing was completed")
+	}
+}
+
+func TestPairing_ConfirmTimeout(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	cfg := proto.Config{ConfirmTimeout: 100 * time.Millisecond}
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithConfig(cfg))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithConfig(cfg))
+	rx.SetPairingConfirm(func(proto.DeviceID, uint32) bool { return true })
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	never := make(chan bool)
+	defer close(never)
+	start := time.Now()
+	err := tx.StartPairingWithConfirm(0xBEEF, func(uint32) bool { return <-never })
+	if err != proto.ErrTimeout {
+		t.Errorf("StartPairingWithConfirm() error = %v, want %v", err, proto.ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("confirmation timeout took %v", elapsed)
+	}
+
+	// The receiver drops the half-finished pairing when told to.
+	time.Sleep(50 * time.Millisecond)
+	rx.mu.Lock()
+	pending := len(rx.confirmations)
+	rx.mu.Unlock()
+	if rx.IsPaired(0xCAFE) || pending != 0 {
+		t.Errorf("receiver kept the aborted pairing (paired=%v, pending=%d)", rx.IsPaired(0xCAFE), pending)
+	}
+}
+
+func TestPairing_ApprovalHandler(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+
+	var mu sync.Mutex
+	approve := false
+	var asked []proto.DeviceID
+	rx.SetPairingHandler(func(id proto.DeviceID, key proto.PairingKey) bool {
+		// Runs unlocked, so it may call back into the receiver.
+		_ = rx.GetPairedDeviceIDs()
+		mu.Lock()
+		defer mu.Unlock()
+		asked = append(asked, id)
+		return approve && key == tx.pairingKey
+	})
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != proto.ErrPairingRejected {
+		t.Errorf("StartPairing() error = %v, want %v", err, proto.ErrPairingRejected)
+	}
+	if rx.IsPaired(0xCAFE) {
+		t.Error("receiver paired without approval")
+	}
+
+	mu.Lock()
+	approve = true
+	mu.Unlock()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() after approval error = %v", err)
+	}
+	if !rx.IsPaired(0xCAFE) {
+		t.Error("approved transmitter not paired")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(asked) != 2 || asked[0] != 0xCAFE {
+		t.Errorf("handler asked for %v, want two requests from 0xCAFE", asked)
+	}
+}
+
+func TestReceiver_AllowedDevices(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	cfg := proto.Config{PairingTimeout: 300 * time.Millisecond}
+	stranger := NewTransmitterWithDriver(0xBAD, driverTx, WithConfig(cfg))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	rx.SetAllowedDevices([]proto.DeviceID{0xCAFE})
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	// The right target ID is not enough for an unlisted transmitter.
+	if err := stranger.StartPairing(0xBEEF); err != proto.ErrTimeout {
+		t.Errorf("StartPairing() error = %v, want %v", err, proto.ErrTimeout)
+	}
+	if rx.IsPaired(0xBAD) {
+		t.Error("unlisted transmitter was paired")
+	}
+	if rx.DroppedFrames() == 0 {
+		t.Error("dropped pairing request was not counted")
+	}
+
+	rx.AddAllowedDevice(0xBAD)
+	if err := stranger.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() after AddAllowedDevice error = %v", err)
+	}
+
+	// Once removed, its data frames are dropped as well.
+	rx.RemoveAllowedDevice(0xBAD)
+	dropped := rx.DroppedFrames()
+	if err := stranger.SendDataReliable([]byte{1}, 2); err != proto.ErrTimeout {
+		t.Errorf("SendDataReliable() error = %v, want %v", err, proto.ErrTimeout)
+	}
+	if rx.DroppedFrames() != dropped+2 {
+		t.Errorf("DroppedFrames() = %d, want %d", rx.DroppedFrames(), dropped+2)
+	}
+
+	// Clearing the list restores open behaviour.
+	rx.SetAllowedDevices(nil)
+	if err := stranger.SendDataReliable([]byte{1}, 2); err != nil {
+		t.Errorf("SendDataReliable() after clearing error = %v", err)
+	}
+}
+
+// pairingRequest builds a plain pairing request from sender to target.
+func pairingRequest(sender, target proto.DeviceID) *proto.Frame {
+	payload := make([]byte, 8)
+	payload[0] = 0x42
+	for i := 0; i < 4; i++ {
+		payload[4+i] = byte(target >> (i * 8))
+	}
+	return &proto.Frame{SenderID: sender, Type: proto.FrameTypePairing, Payload: payload}
+}
+
+func TestReceiver_SinglePairMode(t *testing.T) {
+	cfg := proto.Config{PairingTimeout: 200 * time.Millisecond, DeviceTimeout: 50 * time.Millisecond}
+	d1, d2, drx := NewMockDriver(), NewMockDriver(), NewMockDriver()
+	shareMedium(d1, d2, drx)
+	tx1 := NewTransmitterWithDriver(0xCAFE, d1, WithConfig(cfg))
+	tx2 := NewTransmitterWithDriver(0xF00D, d2, WithConfig(cfg))
+	rx := NewReceiverWithDriver(0xBEEF, drx, WithConfig(cfg))
+	var mu sync.Mutex
+	var events []PairingWindowEvent
+	rx.SetPairingWindowHandler(func(ev PairingWindowEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	})
+	rx.SetSinglePairMode(true)
+	rx.EnablePairing(0)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx1.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if rx.PairingEnabled() {
+		t.Error("PairingEnabled() with the transmitter paired")
+	}
+	// Pairing ACKs name no transmitter: drop the one tx2 overheard.
+	d2.mutex.Lock()
+	d2.rxData = nil
+	d2.mutex.Unlock()
+	if err := tx2.StartPairing(0xBEEF); err == nil || rx.IsPaired(0xF00D) {
+		t.Fatalf("second transmitter paired while the first is alive (error %v)", err)
+	}
+	// The paired transmitter may pair again, e.g. after a restart.
+	again := NewTransmitterWithDriver(0xCAFE, d1, WithConfig(cfg))
+	if err := again.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() of the paired transmitter error = %v", err)
+	}
+
+	if err := rx.Unpair(0xCAFE); err != nil {
+		t.Fatalf("Unpair() error = %v", err)
+	}
+	if err := tx2.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() after Unpair error = %v", err)
+	}
+
+	// Pairing opens again once the transmitter times out.
+	time.Sleep(60 * time.Millisecond)
+	rx.CleanupTimedOutDevices()
+	if !rx.PairingEnabled() {
+		t.Error("pairing still closed after the transmitter timed out")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []PairingWindowEvent{PairingWindowOpened, PairingWindowClosed, PairingWindowOpened, PairingWindowClosed, PairingWindowOpened}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("events = %v, want %v", events, want)
+			break
+		}
+	}
+}
+
+func TestReceiver_PairingWindow(t *testing.T) {
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver())
+
+	var mu sync.Mutex
+	var events []PairingWindowEvent
+	rx.SetPairingWindowHandler(func(ev PairingWindowEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	})
+
+	rx.EnablePairing(50 * time.Millisecond)
+	rx.ProcessFrame(pairingRequest(0xCAFE, 0xBEEF))
+	if !rx.IsPaired(0xCAFE) {
+		t.Fatal("request inside the window was not accepted")
+	}
+
+	expired := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 2 && events[1] == PairingWindowExpired
+	}
+	for deadline := time.Now().Add(time.Second); !expired(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("window expiry not reported")
+		}
+	}
+	rx.ProcessFrame(pairingRequest(0xF00D, 0xBEEF))
+	if rx.IsPaired(0xF00D) {
+		t.Error("request after the window expired was accepted")
+	}
+	if !rx.IsPaired(0xCAFE) {
+		t.Error("closing the window dropped a paired device")
+	}
+
+	rx.EnablePairing(0)
+	rx.DisablePairing()
+	rx.ProcessFrame(pairingRequest(0xF00D, 0xBEEF))
+	if rx.IsPaired(0xF00D) || rx.PairingEnabled() {
+		t.Error("request accepted after DisablePairing")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []PairingWindowEvent{PairingWindowOpened, PairingWindowExpired, PairingWindowOpened, PairingWindowClosed}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("events = %v, want %v", events, want)
+			break
+		}
+	}
+}
+
+func TestReceiver_PairingWindowLapsed(t *testing.T) {
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver())
+	var events []PairingWindowEvent
+	rx.SetPairingWindowHandler(func(ev PairingWindowEvent) { events = append(events, ev) })
+
+	// The window runs out, but the calls come before its timer fires.
+	lapse := func() {
+		rx.mu.Lock()
+		rx.window.until = time.Now().Add(-time.Millisecond)
+		rx.mu.Unlock()
+	}
+	rx.EnablePairing(time.Hour)
+	lapse()
+	rx.DisablePairing()
+	rx.EnablePairing(time.Hour)
+	lapse()
+	rx.EnablePairing(0)
+	rx.DisablePairing()
+
+	want := []PairingWindowEvent{
+		PairingWindowOpened, PairingWindowExpired,
+		PairingWindowOpened, PairingWindowExpired, PairingWindowOpened, PairingWindowClosed,
+	}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
+
+func TestReceiver_StartPairingClosesWindow(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	cfg := proto.Config{PairingTimeout: 300 * time.Millisecond}
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithConfig(cfg))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	ConnectDrivers(driverTx, driverRx)
+
+	done := make(chan error, 1)
+	go func() { done <- rx.StartPairing() }()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("transmitter StartPairing() error = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("receiver StartPairing() error = %v", err)
+	}
+	if rx.PairingEnabled() {
+		t.Error("pairing window left open after StartPairing")
+	}
+
+	// A later request is ignored even while the receiver is listening.
+	rx.Listen()
+	defer rx.StopListening()
+	late := NewTransmitterWithDriver(0xF00D, driverTx, WithConfig(cfg))
+	if err := late.StartPairing(0xBEEF); err != proto.ErrTimeout {
+		t.Errorf("late StartPairing() error = %v, want %v", err, proto.ErrTimeout)
+	}
+}
+
+func TestUnpair_FullCycle(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+	tx.StartHeartbeatTask()
+
+	// Transmitter-initiated: the receiver forgets it too.
+	if err := tx.Unpair(); err != nil {
+		t.Fatalf("Transmitter.Unpair() error = %v", err)
+	}
+	if _, err := tx.SendData([]byte{1}); err != proto.ErrNotPaired {
+		t.Errorf("SendData() after Unpair error = %v, want %v", err, proto.ErrNotPaired)
+	}
+	if tx.heartbeatStop != nil {
+		t.Error("heartbeat task still running after Unpair")
+	}
+	deadline := time.Now().Add(time.Second)
+	for rx.IsPaired(0xCAFE) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rx.IsPaired(0xCAFE) {
+		t.Error("receiver kept the device after the transmitter unpaired")
+	}
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("re-pairing error = %v", err)
+	}
+
+	// Receiver-initiated: the transmitter notices on its next reliable send.
+	if err := rx.Unpair(0xCAFE); err != nil {
+		t.Fatalf("Receiver.Unpair() error = %v", err)
+	}
+	if err := rx.Unpair(0xCAFE); err != proto.ErrNotPaired {
+		t.Errorf("second Receiver.Unpair() error = %v, want %v", err, proto.ErrNotPaired)
+	}
+	if err := tx.SendDataReliable([]byte{1}, 3); err != proto.ErrNotPaired {
+		t.Errorf("SendDataReliable() after receiver Unpair error = %v, want %v", err, proto.ErrNotPaired)
+	}
+	if _, err := tx.SendData([]byte{1}); err != proto.ErrNotPaired {
+		t.Errorf("SendData() error = %v, want %v", err, proto.ErrNotPaired)
+	}
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("second re-pairing error = %v", err)
+	}
+	if err := tx.SendDataReliable([]byte{1}, 3); err != nil {
+		t.Errorf("SendDataReliable() after re-pairing error = %v", err)
+	}
+}
+
+func TestTransmitter_PairingState(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	var mu sync.Mutex
+	var events []string
+	tx.OnPairingStateChange(func(paired bool, id proto.DeviceID) {
+		mu.Lock()
+		events = append(events, fmt.Sprint(paired, id))
+		mu.Unlock()
+	})
+	if tx.IsPaired() || tx.PairedReceiver() != 0 || tx.PairingKey() != (proto.PairingKey{}) {
+		t.Fatalf("fresh transmitter reports paired %v with %d", tx.IsPaired(), tx.PairedReceiver())
+	}
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if !tx.IsPaired() || tx.PairedReceiver() != 0xBEEF {
+		t.Errorf("after pairing IsPaired() = %v, PairedReceiver() = %d, want true and %d", tx.IsPaired(), tx.PairedReceiver(), 0xBEEF)
+	}
+	if got := tx.PairingKey(); got != tx.linkKey() || got.Len() != 4 {
+		t.Errorf("PairingKey() = %v, want the 4-byte link key %v", got, tx.linkKey())
+	}
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("re-pairing error = %v", err)
+	}
+
+	// Polled from another goroutine while the receiver unpairs.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				tx.IsPaired()
+				tx.PairedReceivers()
+			}
+		}
+	}()
+	if err := rx.Unpair(0xCAFE); err != nil {
+		t.Fatalf("Receiver.Unpair() error = %v", err)
+	}
+	if err := tx.SendDataReliable([]byte{1}, 3); err != proto.ErrNotPaired {
+		t.Errorf("SendDataReliable() after receiver Unpair error = %v, want %v", err, proto.ErrNotPaired)
+	}
+	close(stop)
+	<-done
+	if tx.IsPaired() || tx.PairedReceiver() != 0 {
+		t.Errorf("after Unpair IsPaired() = %v, PairedReceiver() = %d", tx.IsPaired(), tx.PairedReceiver())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := fmt.Sprint(events); got != "[true 48879 false 48879]" {
+		t.Errorf("state changes = %s, want [true 48879 false 48879]", got)
+	}
+}
+
+func TestBondStore_RestoresPairings(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	rxBonds := NewMemoryBondStore()
+	txBonds := NewMemoryBondStore()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithBondStore(txBonds))
+	tx.SetSecurePairing(true)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithBondStore(rxBonds))
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	rx.StopListening()
+	time.Sleep(150 * time.Millisecond) // let the old listener exit
+
+	// Both ends restart from their stores and resume without pairing again.
+	tx2 := NewTransmitterWithDriver(0xCAFE, driverTx, WithBondStore(txBonds))
+	rx2 := NewReceiverWithDriver(0xBEEF, driverRx, WithBondStore(rxBonds))
+	if !rx2.IsPaired(0xCAFE) || !tx2.device.IsPaired || tx2.receiver != 0xBEEF {
+		t.Fatal("pairing not restored from the bond stores")
+	}
+	if !bytes.Equal(tx2.SessionKey(), tx.SessionKey()) {
+		t.Error("transmitter session key not restored")
+	}
+
+	got := make(chan []byte, 1)
+	rx2.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) { got <- f.Payload })
+	rx2.Listen()
+	defer rx2.StopListening()
+
+	if err := tx2.SendDataReliable([]byte{7}, 3); err != nil {
+		t.Fatalf("SendDataReliable() after restore error = %v", err)
+	}
+	if data := <-got; !bytes.Equal(data, []byte{7}) {
+		t.Errorf("restored receiver got %v, want [7]", data)
+	}
+
+	// Unpairing removes the bonds on both sides.
+	if err := tx2.Unpair(); err != nil {
+		t.Fatalf("Unpair() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if bonds, _ := txBonds.Load(); len(bonds) != 0 {
+		t.Errorf("transmitter bonds after Unpair = %v", bonds)
+	}
+	if bonds, _ := rxBonds.Load(); len(bonds) != 0 {
+		t.Errorf("receiver bonds after Unpair = %v", bonds)
+	}
+}
+
+func TestBondStore_RestoresSeveralReceivers(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverA := NewMockDriver()
+	driverB := NewMockDriver()
+	shareMedium(driverTx, driverA, driverB)
+	txBonds := NewMemoryBondStore()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithBondStore(txBonds))
+	got := make(chan proto.DeviceID, 1)
+	for _, r := range []struct {
+		id proto.DeviceID
+		d  *MockDriver
+	}{{0xA, driverA}, {0xB, driverB}} {
+		id := r.id
+		rx := NewReceiverWithDriver(id, r.d)
+		rx.RegisterCallback(proto.FrameTypeData, func(*proto.Frame) { got <- id })
+		rx.Listen()
+		defer rx.StopListening()
+	}
+	if err := tx.StartPairing(0xA); err != nil {
+		t.Fatalf("StartPairing(A) error = %v", err)
+	}
+	if err := tx.StartPairingWith(0xB); err != nil {
+		t.Fatalf("StartPairingWith(B) error = %v", err)
+	}
+
+	// Whatever order the store lists them in, a restart selects neither.
+	for i := 0; i < 5; i++ {
+		tx2 := NewTransmitterWithDriver(0xCAFE, driverTx, WithBondStore(txBonds))
+		if ids := tx2.PairedReceivers(); len(ids) != 2 || ids[0] != 0xA || ids[1] != 0xB {
+			t.Fatalf("PairedReceivers() = %v, want [10 11]", ids)
+		}
+		if tx2.device.IsPaired || tx2.receiver != 0 {
+			t.Fatalf("receiver %d selected after restart, want none", tx2.receiver)
+		}
+		if _, err := tx2.SendData([]byte("x")); err != proto.ErrSeveralReceivers {
+			t.Errorf("SendData() = %v, want %v", err, proto.ErrSeveralReceivers)
+		}
+	}
+
+	tx2 := NewTransmitterWithDriver(0xCAFE, driverTx, WithBondStore(txBonds))
+	if err := tx2.SendDataTo(0xB, []byte("b")); err != nil {
+		t.Fatalf("SendDataTo(B) error = %v", err)
+	}
+	select {
+	case id := <-got:
+		if id != 0xB {
+			t.Errorf("data delivered to %d, want %d", id, 0xB)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("data not delivered after restart")
+	}
+}
+
+func TestReceiver_ExportImportState(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	tx.SetSecurePairing(true)
+	tx.SetDeviceInfo(proto.DeviceInfo{Name: "sensor", Class: 3, Firmware: 0x0102})
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	rx.ProcessFrame(pairingRequest(0xF00D, 0xBEEF))
+	state, err := rx.ExportState()
+	if err != nil {
+		t.Fatalf("ExportState() error = %v", err)
+	}
+	rx.StopListening()
+	rx.Close()
+
+	// A receiver built from scratch serves the transmitters at once.
+	rx2 := NewReceiverWithDriver(0xBEEF, driverRx)
+	defer rx2.Close()
+	rx2.ProcessFrame(pairingRequest(0xDEAD, 0xBEEF))
+	if err := rx2.ImportState(state); err != nil {
+		t.Fatalf("ImportState() error = %v", err)
+	}
+	if !rx2.IsPaired(0xCAFE) || !rx2.IsPaired(0xF00D) || rx2.IsPaired(0xDEAD) {
+		t.Fatalf("paired after import: %v, want 0xCAFE and 0xF00D", rx2.GetPairedDeviceIDs())
+	}
+	if again, _ := rx2.ExportState(); !bytes.Equal(again, state) {
+		t.Error("state exported after the import differs from the one imported")
+	}
+	got := make(chan []byte, 1)
+	rx2.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) { got <- f.Payload })
+	rx2.Listen()
+	defer rx2.StopListening()
+	if err := tx.SendDataReliable([]byte{7}, 3); err != nil {
+		t.Fatalf("SendDataReliable() after import error = %v", err)
+	}
+	if data := <-got; !bytes.Equal(data, []byte{7}) {
+		t.Errorf("restored receiver got %v, want [7]", data)
+	}
+
+	// Bad snapshots leave the table alone.
+	corrupt := append([]byte(nil), state...)
+	corrupt[len(corrupt)/2] ^= 0x01
+	newer := append([]byte(nil), state...)
+	newer[4] = StateVersion + 1
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"flipped bit", corrupt, proto.ErrStateCorrupt},
+		{"truncated", state[:len(state)-1], proto.ErrStateCorrupt},
+		{"empty", nil, proto.ErrStateCorrupt},
+		{"newer version", newer, proto.ErrStateVersion},
+	} {
+		if err := rx2.ImportState(tc.data); err != tc.want {
+			t.Errorf("ImportState(%s) error = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if !rx2.IsPaired(0xCAFE) || !rx2.IsPaired(0xF00D) {
+		t.Error("a rejected import changed the paired devices")
+	}
+	empty, _ := NewReceiverWithDriver(0xBEEF, NewMockDriver()).ExportState()
+	if err := rx2.ImportState(empty); err != nil || len(rx2.GetPairedDeviceIDs()) != 0 {
+		t.Errorf("ImportState(empty table) = %v, paired %v", err, rx2.GetPairedDeviceIDs())
+	}
+}
+
+func TestPairing_DeviceInfo(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	info := proto.DeviceInfo{Name: "kitchen sensor", Class: 3, Firmware: 0x010203}
+	tx.SetDeviceInfo(info)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if got, ok := rx.DeviceInfo(0xCAFE); !ok || got != info {
+		t.Errorf("DeviceInfo() = %+v, %v, want %+v", got, ok, info)
+	}
+
+	// A name longer than the request budget arrives truncated: 113 payload
+	// bytes minus the fixed fields (8), frame size (3), capabilities (6),
+	// class (3), firmware (6) and name header (2) leave 85 bytes, i.e. 42
+	// two-byte runes.
+	long := info
+	long.Name = strings.Repeat("é", 100)
+	tx.SetDeviceInfo(long)
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	got, _ := rx.DeviceInfo(0xCAFE)
+	if want := strings.Repeat("é", 42); got.Name != want || got.Class != 3 {
+		t.Errorf("truncated name = %q (%d bytes), want %d bytes", got.Name, len(got.Name), len(want))
+	}
+}
+
+func TestCapabilities_MinimalReceiver(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	tx.SetSecurePairing(true)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithCapabilities(0))
+
+	got := make(chan []byte, 4)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) { got <- f.Payload })
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if tx.device.Capabilities != 0 || rx.GetPairedDevices()[0].HasCapability(proto.CapFragmentation) {
+		t.Errorf("negotiated capabilities = %b, want none", tx.device.Capabilities)
+	}
+
+	// Optional features degrade gracefully; plain data still flows.
+	if err := tx.SendDataLarge(make([]byte, 300)); err != proto.ErrUnsupported {
+		t.Errorf("SendDataLarge() error = %v, want %v", err, proto.ErrUnsupported)
+	}
+	if err := tx.Rekey(); err != proto.ErrUnsupported {
+		t.Errorf("Rekey() error = %v, want %v", err, proto.ErrUnsupported)
+	}
+	if err := tx.SendDataLarge([]byte{1, 2}); err != nil {
+		t.Fatalf("SendDataLarge(small) error = %v", err)
+	}
+	if data := <-got; !bytes.Equal(data, []byte{1, 2}) {
+		t.Errorf("received %v, want [1 2]", data)
+	}
+}
+
+func TestSendDataLarge_Reassembled(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+	if !tx.device.HasCapability(proto.AllCapabilities) {
+		t.Fatalf("negotiated capabilities = %b, want all", tx.device.Capabilities)
+	}
+
+	got := make(chan []byte, 1)
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) { got <- f.Payload })
+
+	msg := make([]byte, 300)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if err := tx.SendDataLarge(msg); err != nil {
+		t.Fatalf("SendDataLarge() error = %v", err)
+	}
+	select {
+	case data := <-got:
+		if !bytes.Equal(data, msg) {
+			t.Errorf("reassembled %d bytes, want the 300-byte message", len(data))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+// linkDriver tunes a MockDriver to a radio address and channel: transmitted
+// frames are tagged with the sender's link and lost if the peer is tuned
+// elsewhere when it receives them. Nothing gets through on a jammed channel
+// and only some frames on a lossy one.
+type linkDriver struct {
+	*MockDriver
+	mu     sync.Mutex
+	link   link
+	jammed map[uint8]bool
+	loss   map[uint8]float64
+	lost   map[uint8]float64 // frames owed to the loss of each channel
+	sent   map[uint8]int
+	heard  []proto.DeviceID // senders of the frames received
+	tunes  []uint8          // SetChannel calls
+}
+
+const linkTagSize = 6
+
+func newLinkDriver() *linkDriver {
+	return &linkDriver{
+		MockDriver: NewMockDriver(),
+		link:       link{proto.DefaultAddress, proto.DefaultPrefix, proto.DefaultChannel},
+		jammed:     make(map[uint8]bool),
+		loss:       make(map[uint8]float64),
+		lost:       make(map[uint8]float64),
+		sent:       make(map[uint8]int),
+	}
+}
+
+func (d *linkDriver) Configure(address uint32, prefix byte, channel uint8) error {
+	d.mu.Lock()
+	d.link = link{address, prefix, channel}
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *linkDriver) SetChannel(ch uint8) error {
+	d.mu.Lock()
+	d.link.channel = ch
+	d.tunes = append(d.tunes, ch)
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *linkDriver) Link() link {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.link
+}
+
+func (d *linkDriver) Channel() uint8 { return d.Link().channel }
+
+// Tunes returns the channels passed to SetChannel so far.
+func (d *linkDriver) Tunes() []uint8 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]uint8(nil), d.tunes...)
+}
+
+func (d *linkDriver) Jam(ch uint8) {
+	d.mu.Lock()
+	d.jammed[ch] = true
+	d.mu.Unlock()
+}
+
+// Lose drops ratio of the frames transmitted on ch, spread evenly.
+func (d *linkDriver) Lose(ch uint8, ratio float64) {
+	d.mu.Lock()
+	d.loss[ch] = ratio
+	d.mu.Unlock()
+}
+
+func (d *linkDriver) Sent(ch uint8) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sent[ch]
+}
+
+// Heard returns the senders of the frames received since the last call.
+func (d *linkDriver) Heard() []proto.DeviceID {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	heard := d.heard
+	d.heard = nil
+	return heard
+}
+
+func (d *linkDriver) tag(l link) []byte {
+	tag := make([]byte, linkTagSize)
+	tag[0] = l.channel
+	binary.LittleEndian.PutUint32(tag[1:5], l.address)
+	tag[5] = l.prefix
+	return tag
+}
+
+func (d *linkDriver) Tx(data []byte) error {
+	d.mu.Lock()
+	l := d.link
+	d.sent[l.channel]++
+	jammed := d.jammed[l.channel]
+	if d.lost[l.channel] += d.loss[l.channel]; d.lost[l.channel] >= 1 {
+		d.lost[l.channel]--
+		jammed = true
+	}
+	d.mu.Unlock()
+	if jammed {
+		return nil
+	}
+	return d.MockDriver.Tx(append(d.tag(l), data...))
+}
+
+func (d *linkDriver) Rx(timeout time.Duration) ([]byte, error) {
+	for {
+		data, err := d.MockDriver.Rx(timeout)
+		if err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		match := bytes.Equal(data[:linkTagSize], d.tag(d.link))
+		if match && len(data) >= linkTagSize+5 {
+			d.heard = append(d.heard, proto.DeviceID(binary.LittleEndian.Uint32(data[linkTagSize+1:])))
+		}
+		d.mu.Unlock()
+		if match {
+			return data[linkTagSize:], nil
+		}
+	}
+}
+
+// shareMedium delivers every frame transmitted by one driver to all others.
+func shareMedium(drivers ...*MockDriver) {
+	go func() {
+		for {
+			for _, from := range drivers {
+				from.mutex.Lock()
+				sent := from.txLog
+				from.txLog = nil
+				from.mutex.Unlock()
+				for _, data := range sent {
+					for _, to := range drivers {
+						if to != from {
+							to.InjectRx(data)
+						}
+					}
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+}
+
+func TestPairing_MovesToDataChannel(t *testing.T) {
+	driverTx := newLinkDriver()
+	driverRx := newLinkDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	if err := rx.SetDataChannel(40); err != nil {
+		t.Fatalf("SetDataChannel() error = %v", err)
+	}
+	rx.EnablePairing(0)
+
+	ConnectDrivers(driverTx.MockDriver, driverRx.MockDriver)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if driverTx.Channel() != 40 {
+		t.Fatalf("transmitter on channel %d after pairing, want 40", driverTx.Channel())
+	}
+
+	// With pairing closed the receiver settles on the data channel.
+	rx.DisablePairing()
+	deadline := time.Now().Add(time.Second)
+	for driverRx.Channel() != 40 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if driverRx.Channel() != 40 {
+		t.Fatalf("receiver on channel %d, want 40", driverRx.Channel())
+	}
+
+	before := driverTx.Sent(proto.DefaultChannel)
+	if err := tx.SendDataReliable([]byte{1}, 3); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+	if driverTx.Sent(proto.DefaultChannel) != before {
+		t.Error("data was sent on the pairing channel")
+	}
+}
+
+func TestReceiver_RxPollInterval(t *testing.T) {
+	r := NewReceiverWithDriver(1, NewMockDriver())
+	if got := r.tune(); got != DefaultRxPollInterval {
+		t.Errorf("default poll = %v, want %v", got, DefaultRxPollInterval)
+	}
+	r = NewReceiverWithDriver(1, NewMockDriver(), WithRxPollInterval(5*time.Millisecond))
+	if got := r.tune(); got != 5*time.Millisecond {
+		t.Errorf("poll = %v, want 5ms", got)
+	}
+}
+
+func TestReceiver_ScanChannels(t *testing.T) {
+	driverTx := newLinkDriver()
+	driverRx := newLinkDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	if err := tx.SetChannel(40); err != nil {
+		t.Fatalf("SetChannel() error = %v", err)
+	}
+	if err := rx.ScanChannels([]uint8{10, 126}, 0); err != proto.ErrInvalidChannel {
+		t.Fatalf("ScanChannels(126) error = %v, want ErrInvalidChannel", err)
+	}
+	if err := rx.ScanChannels([]uint8{10, 40, 80}, 20*time.Millisecond); err != nil {
+		t.Fatalf("ScanChannels() error = %v", err)
+	}
+
+	ConnectDrivers(driverTx.MockDriver, driverRx.MockDriver)
+	rx.Listen()
+	defer rx.StopListening()
+
+	// The receiver finds the transmitter pairing on channel 40 and stays.
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if rx.Scanning() || driverRx.Channel() != 40 {
+		t.Fatalf("Scanning() = %v on channel %d after pairing, want locked onto 40", rx.Scanning(), driverRx.Channel())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if driverRx.Channel() != 40 {
+		t.Fatalf("receiver moved on to channel %d", driverRx.Channel())
+	}
+	if err := tx.SendDataReliable([]byte{1}, 3); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+
+	// A paired transmitter is found by its traffic alone.
+	if err := rx.ScanChannels([]uint8{5, 40, 90}, 20*time.Millisecond); err != nil {
+		t.Fatalf("ScanChannels() error = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for rx.Scanning() && time.Now().Before(deadline) {
+		_, _ = tx.SendHeartbeat()
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rx.Scanning() || driverRx.Channel() != 40 {
+		t.Fatalf("Scanning() = %v on channel %d, want locked onto 40", rx.Scanning(), driverRx.Channel())
+	}
+
+	// SetChannel ends a scan that found nothing.
+	if err := rx.ScanChannels([]uint8{5, 90}, 20*time.Millisecond); err != nil {
+		t.Fatalf("ScanChannels() error = %v", err)
+	}
+	if err := rx.SetChannel(60); err != nil {
+		t.Fatalf("SetChannel() error = %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if rx.Scanning() || driverRx.Channel() != 60 {
+		t.Errorf("Scanning() = %v on channel %d after SetChannel(60)", rx.Scanning(), driverRx.Channel())
+	}
+}
+
+func TestPairing_DataChannelFallback(t *testing.T) {
+	driverTx := newLinkDriver()
+	driverRx := newLinkDriver()
+	driverTx.Jam(40)
+	driverRx.Jam(40)
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	_ = rx.SetDataChannel(40)
+
+	ConnectDrivers(driverTx.MockDriver, driverRx.MockDriver)
+	rx.Listen()
+	defer rx.StopListening()
+
+	// The switch fails, so the transmitter returns to the pairing channel
+	// and pairs again, staying there.
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if driverTx.Channel() != proto.DefaultChannel {
+		t.Errorf("transmitter on channel %d, want the pairing channel", driverTx.Channel())
+	}
+	if devs := rx.GetPairedDevices(); len(devs) != 1 || devs[0].Channel != proto.DefaultChannel {
+		t.Fatalf("receiver devices = %+v, want one on the pairing channel", devs)
+	}
+	if err := tx.SendDataReliable([]byte{1}, 3); err != nil {
+		t.Errorf("SendDataReliable() after fallback error = %v", err)
+	}
+}
+
+func TestPairing_PrivateAddress(t *testing.T) {
+	type pair struct {
+		tx       *Transmitter
+		rx       *Receiver
+		txd, rxd *linkDriver
+	}
+	pairs := make([]pair, 2)
+	var medium []*MockDriver
+	for i := range pairs {
+		p := &pairs[i]
+		p.txd, p.rxd = newLinkDriver(), newLinkDriver()
+		p.tx = NewTransmitterWithDriver(proto.DeviceID(0xCA00+i), p.txd)
+		p.rx = NewReceiverWithDriver(proto.DeviceID(0xBE00+i), p.rxd)
+		p.rx.SetPrivateAddress(true)
+		p.rx.EnablePairing(0)
+		p.rx.Listen()
+		defer p.rx.StopListening()
+		medium = append(medium, p.txd.MockDriver, p.rxd.MockDriver)
+	}
+	shareMedium(medium...)
+
+	for _, p := range pairs {
+		if err := p.tx.StartPairing(p.rx.device.ID); err != nil {
+			t.Fatalf("StartPairing(%d) error = %v", p.rx.device.ID, err)
+		}
+		p.rx.DisablePairing()
+	}
+
+	for _, p := range pairs {
+		address, prefix := proto.PrivateAddress(p.rx.device.ID)
+		if l := p.txd.Link(); l.address != address || l.prefix != prefix {
+			t.Fatalf("transmitter %d on %#x/%#x, want %#x/%#x", p.tx.device.ID, l.address, l.prefix, address, prefix)
+		}
+		deadline := time.Now().Add(time.Second)
+		for p.rxd.Link().address != address && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if p.rxd.Link().address != address {
+			t.Fatalf("receiver %d still on %#x", p.rx.device.ID, p.rxd.Link().address)
+		}
+		p.rxd.Heard()
+		p.txd.Heard()
+	}
+
+	for _, p := range pairs {
+		if err := p.tx.SendDataReliable([]byte{1}, 3); err != nil {
+			t.Fatalf("SendDataReliable() error = %v", err)
+		}
+	}
+	for _, p := range pairs {
+		for _, id := range p.rxd.Heard() {
+			if id != p.tx.device.ID {
+				t.Errorf("receiver %d got a frame from %d", p.rx.device.ID, id)
+			}
+		}
+		for _, id := range p.txd.Heard() {
+			if id != p.rx.device.ID {
+				t.Errorf("transmitter %d got a frame from %d", p.tx.device.ID, id)
+			}
+		}
+	}
+}
+
+func TestRollingKeys_Resync(t *testing.T) {
+	store := NewMemoryBondStore()
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithBondStore(store))
+	tx.SetSecurePairing(true)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	accepted := func() uint32 {
+		rx.mu.Lock()
+		defer rx.mu.Unlock()
+		return rx.pairedDevices[0xCAFE].RollCounter
+	}
+	waitAccepted := func(want uint32) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for accepted() != want && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if got := accepted(); got != want {
+			t.Fatalf("receiver at rotation %d, want %d", got, want)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := tx.SendHeartbeat(); err != nil {
+			t.Fatalf("SendHeartbeat() error = %v", err)
+		}
+	}
+	waitAccepted(3)
+
+	// A transmitter restored from the bond saved at pairing missed those
+	// rotations: its codes look like replays until the next data ACK makes
+	// it resync.
+	stale := NewTransmitterWithDriver(0xCAFE, driverTx, WithBondStore(store))
+	_, _ = stale.SendHeartbeat()
+	time.Sleep(50 * time.Millisecond)
+	waitAccepted(3)
+	if err := stale.SendDataReliable([]byte{1}, 3); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+	if stale.device.RollCounter != 3 {
+		t.Fatalf("transmitter at rotation %d after resync, want 3", stale.device.RollCounter)
+	}
+	_, _ = stale.SendHeartbeat()
+	waitAccepted(4)
+
+	// Heartbeats lost on the air beyond the window need an explicit resync.
+	stale.device.RollCounter += proto.RollingWindow + 2
+	_, _ = stale.SendHeartbeat()
+	time.Sleep(50 * time.Millisecond)
+	waitAccepted(4)
+	if err := stale.ResyncKeys(); err != nil {
+		t.Fatalf("ResyncKeys() error = %v", err)
+	}
+	_, _ = stale.SendHeartbeat()
+	waitAccepted(5)
+}
+
+func TestAutoRepair_ReceiverReboot(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	events := make(chan LinkEvent, 2)
+	tx.SetLinkHandler(func(e LinkEvent) { events <- e })
+	tx.EnableAutoRepair(2, 50*time.Millisecond)
+	defer tx.StopAutoRepair()
+
+	if err := tx.SendDataReliable([]byte{1}, 1); err != nil {
+		t.Fatalf("SendDataReliable() before reboot error = %v", err)
+	}
+
+	// The receiver reboots, forgetting its pairings.
+	rx.StopListening()
+	time.Sleep(20 * time.Millisecond)
+	rebooted := NewReceiverWithDriver(0xBEEF, driverRx)
+	rebooted.Listen()
+	defer rebooted.StopListening()
+
+	for i := 0; i < 2; i++ {
+		if err := tx.SendDataReliable([]byte{2}, 1); err != proto.ErrTimeout {
+			t.Fatalf("SendDataReliable() to the rebooted receiver error = %v, want ErrTimeout", err)
+		}
+	}
+	for _, want := range []LinkEvent{LinkLost, LinkRestored} {
+		select {
+		case e := <-events:
+			if e != want {
+				t.Fatalf("link event = %d, want %d", e, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("no link event %d", want)
+		}
+	}
+
+	if err := tx.SendDataReliable([]byte{3}, 3); err != nil {
+		t.Errorf("SendDataReliable() after re-pairing error = %v", err)
+	}
+	if !rebooted.IsPaired(0xCAFE) {
+		t.Error("rebooted receiver did not pair again")
+	}
+}
+
+func TestPairing_RetransmitsLostRequests(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	var mu sync.Mutex
+	var requests []*proto.Frame
+	lossy := &lossyDriver{MockDriver: driverTx, drop: func(data []byte) bool {
+		frame := proto.DecodeFrame(data)
+		if frame == nil || frame.Type != proto.FrameTypePairing {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, frame)
+		return len(requests) <= 2
+	}}
+
+	tx := NewTransmitterWithDriver(0xCAFE, lossy)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	start := time.Now()
+	err := tx.StartPairingWithOptions(0xBEEF, PairingOptions{RetryInterval: 50 * time.Millisecond, Jitter: -1})
+	if err != nil {
+		t.Fatalf("StartPairingWithOptions() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("pairing took %v", elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) < 3 {
+		t.Fatalf("%d pairing requests sent, want at least 3", len(requests))
+	}
+	for _, f := range requests[1:] {
+		if f.Seq != requests[0].Seq {
+			t.Errorf("retransmission numbered %d, want %d", f.Seq, requests[0].Seq)
+		}
+	}
+}
+
+func TestPairing_DuplicateRequestReACKed(t *testing.T) {
+	driverRx := NewMockDriver()
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+
+	frame := pairingRequest(0xCAFE, 0xBEEF)
+	frame.Seq = 7
+	rx.ProcessFrame(frame)
+	rx.mu.Lock()
+	dev := rx.pairedDevices[0xCAFE]
+	rx.mu.Unlock()
+	if dev == nil {
+		t.Fatal("first request did not pair")
+	}
+	first := driverRx.GetTxLog()
+
+	rx.ProcessFrame(frame)
+	acks := driverRx.GetTxLog()
+	if len(acks) != len(first)+1 || !bytes.Equal(acks[len(acks)-1], first[len(first)-1]) {
+		t.Fatalf("duplicate request answered with %d frames, want the same ACK again", len(acks)-len(first))
+	}
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	if rx.pairedDevices[0xCAFE] != dev || rx.pairings != 1 {
+		t.Error("duplicate request reset the pairing")
+	}
+}
+
+func TestReceiver_DeviceLimit(t *testing.T) {
+	pair := func(rx *Receiver, n int) {
+		for i := 0; i < n; i++ {
+			id := proto.DeviceID(0x100 + i)
+			rx.ProcessFrame(pairingRequest(id, 0xBEEF))
+			rx.mu.Lock()
+			if dev := rx.pairedDevices[id]; dev != nil {
+				dev.LastSeen = int64(1000 + i) // oldest first
+			}
+			rx.mu.Unlock()
+		}
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		driver := NewMockDriver()
+		rx := NewReceiverWithDriver(0xBEEF, driver)
+		if rx.MaxPairedDevices() != DefaultMaxPairedDevices {
+			t.Fatalf("MaxPairedDevices() = %d, want %d", rx.MaxPairedDevices(), DefaultMaxPairedDevices)
+		}
+		pair(rx, DefaultMaxPairedDevices+3)
+
+		if n := rx.PairedDeviceCount(); n != DefaultMaxPairedDevices {
+			t.Fatalf("PairedDeviceCount() = %d, want %d", n, DefaultMaxPairedDevices)
+		}
+		rejects := 0
+		for _, data := range driver.GetTxLog() {
+			f := proto.DecodeFrame(data)
+			if cmd, _, args, ok := proto.DecodeControl(f.Payload); f.Type == proto.FrameTypeControl && ok &&
+				cmd == proto.ControlPairReject && len(args) == 1 && args[0] == proto.RejectDeviceLimit {
+				rejects++
+			}
+		}
+		if rejects != 3 {
+			t.Errorf("%d device limit rejects sent, want 3", rejects)
+		}
+		if rx.IsPaired(0x100+DefaultMaxPairedDevices) || !rx.IsPaired(0x100) {
+			t.Error("paired devices were replaced")
+		}
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		rx := NewReceiverWithDriver(0xBEEF, NewMockDriver())
+		rx.SetMaxPairedDevices(4, EvictLeastRecentlySeen)
+		var evicted []proto.DeviceID
+		rx.SetEvictionHandler(func(id proto.DeviceID) { evicted = append(evicted, id) })
+		pair(rx, 4+3)
+
+		if n := rx.PairedDeviceCount(); n != 4 {
+			t.Fatalf("PairedDeviceCount() = %d, want 4", n)
+		}
+		want := []proto.DeviceID{0x100, 0x101, 0x102}
+		if len(evicted) != len(want) {
+			t.Fatalf("evicted %v, want %v", evicted, want)
+		}
+		for i, id := range want {
+			if evicted[i] != id || rx.IsPaired(id) {
+				t.Errorf("evicted %v, want %v", evicted, want)
+				break
+			}
+		}
+		for id := proto.DeviceID(0x103); id < 0x107; id++ {
+			if !rx.IsPaired(id) {
+				t.Errorf("device %d not paired", id)
+			}
+		}
+	})
+}
+
+func TestReceiver_PairingEvents(t *testing.T) {
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver())
+	var events []PairingEvent
+	rx.OnPairingEvent(func(id proto.DeviceID, ev PairingEvent) {
+		if id != 0xCAFE {
+			t.Errorf("event for device %d, want %d", id, 0xCAFE)
+		}
+		events = append(events, ev)
+	})
+	expect := func(step string, want PairingEvent) {
+		t.Helper()
+		if len(events) != 1 || events[0] != want {
+			t.Fatalf("%s: events %v, want [%d]", step, events, want)
+		}
+		events = nil
+	}
+
+	frame := pairingRequest(0xCAFE, 0xBEEF)
+	frame.Seq = 1
+	rx.ProcessFrame(frame)
+	expect("first request", PairingNewDevice)
+
+	rx.ProcessFrame(frame)
+	expect("retransmitted request", PairingDuplicate)
+
+	frame.Seq = 2
+	rx.ProcessFrame(frame)
+	expect("same key again", PairingDuplicate)
+
+	rx.mu.Lock()
+	rx.assembly[0xCAFE] = &reassembly{msgID: 1, parts: make([][]byte, 2)}
+	rx.mu.Unlock()
+	rebooted := pairingRequest(0xCAFE, 0xBEEF)
+	rebooted.Payload[0] = 0x43
+	rebooted.Seq = 1
+	rx.ProcessFrame(rebooted)
+	expect("new key", PairingKeyChanged)
+
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	if rx.assembly[0xCAFE] != nil {
+		t.Error("reassembly state kept across the key change")
+	}
+	if dev := rx.pairedDevices[0xCAFE]; dev == nil || dev.PairingKey != proto.PairingKeyFromUint32(0x43) {
+		t.Error("device not paired with the new key")
+	}
+}
+
+func TestReceiver_EventHandlersCallReceiver(t *testing.T) {
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver())
+	rx.SetMaxPairedDevices(1, EvictLeastRecentlySeen)
+	var events []string
+	rx.OnPairingEvent(func(id proto.DeviceID, ev PairingEvent) {
+		events = append(events, fmt.Sprintf("paired %d: %v", id, rx.IsPaired(id)))
+	})
+	rx.SetEvictionHandler(func(id proto.DeviceID) {
+		events = append(events, fmt.Sprintf("evicted %d: %v", id, rx.IsPaired(id)))
+	})
+	for i, id := range []proto.DeviceID{0xCAFE, 0xF00D} {
+		frame := pairingRequest(id, 0xBEEF)
+		frame.Seq = uint32(i + 1)
+		rx.ProcessFrame(frame)
+	}
+	want := "[paired 51966: true evicted 51966: false paired 61453: true]"
+	if got := fmt.Sprint(events); got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	tx.SetSecurePairing(true)
+	rx = NewReceiverWithDriver(0xBEEF, driverRx)
+	var mu sync.Mutex
+	var indices []uint8
+	var reported []bool
+	rx.SetRekeyHandler(func(id proto.DeviceID, index uint8) {
+		dev := rx.GetPairedDevices()[0]
+		rx.mu.Lock()
+		defer rx.mu.Unlock()
+		mu.Lock()
+		indices = append(indices, dev.KeyIndex)
+		mu.Unlock()
+	})
+	rx.OnHealthReport(func(id proto.DeviceID, h proto.HealthReport) {
+		_, ok := rx.Health(id)
+		mu.Lock()
+		reported = append(reported, ok)
+		mu.Unlock()
+	})
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if err := tx.Rekey(); err != nil {
+		t.Fatalf("Rekey() error = %v", err)
+	}
+	if err := tx.SetHealthProvider(func() proto.HealthReport { return proto.HealthReport{Uptime: 1} }); err != nil {
+		t.Fatalf("SetHealthProvider() error = %v", err)
+	}
+	if _, err := tx.SendHeartbeat(); err != nil {
+		t.Fatalf("SendHeartbeat() error = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		done := len(reported) > 0
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(indices) != 1 || indices[0] != 1 {
+		t.Errorf("rekey handler saw key indices %v, want [1]", indices)
+	}
+	if len(reported) != 1 || !reported[0] {
+		t.Errorf("health handler saw Health() = %v, want [true]", reported)
+	}
+}
+
+func TestPairing_KeySizes(t *testing.T) {
+	for _, size := range []int{4, 8, 16} {
+		for _, legacy := range []bool{false, true} {
+			driverTx := NewMockDriver()
+			driverRx := NewMockDriver()
+			tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+			if err := tx.SetPairingKeySize(size); err != nil {
+				t.Fatalf("SetPairingKeySize(%d) error = %v", size, err)
+			}
+			var opts []Option
+			if legacy {
+				opts = append(opts, WithCapabilities(proto.AllCapabilities&^proto.CapLongPairingKey))
+			}
+			rx := NewReceiverWithDriver(0xBEEF, driverRx, opts...)
+			var advertised proto.PairingKey
+			rx.SetPairingHandler(func(id proto.DeviceID, key proto.PairingKey) bool {
+				advertised = key
+				return true
+			})
+			ConnectDrivers(driverTx, driverRx)
+			rx.Listen()
+
+			if err := tx.StartPairing(0xBEEF); err != nil {
+				t.Fatalf("%d-byte key, legacy %v: StartPairing() error = %v", size, legacy, err)
+			}
+			rx.StopListening()
+
+			want := tx.pairingKey
+			if legacy {
+				want = want.Truncate(4)
+			}
+			rx.mu.Lock()
+			got := rx.pairedDevices[0xCAFE].PairingKey
+			rx.mu.Unlock()
+			if advertised != want || got != want || tx.device.PairingKey != want {
+				t.Errorf("%d-byte key, legacy %v: advertised %v, receiver keeps %v, transmitter %v, want %v",
+					size, legacy, advertised, got, tx.device.PairingKey, want)
+			}
+		}
+	}
+	if err := NewTransmitterWithDriver(0xCAFE, NewMockDriver()).SetPairingKeySize(12); err != proto.ErrInvalidKeySize {
+		t.Errorf("SetPairingKeySize(12) error = %v, want %v", err, proto.ErrInvalidKeySize)
+	}
+}
+
+func TestPairing_SeededRequest(t *testing.T) {
+	request := func() []byte {
+		driver := NewMockDriver()
+		tx := NewTransmitterWithDriver(0xCAFE, driver, WithRandSource(proto.NewSeededRand(1)))
+		_ = tx.StartPairingWithOptions(0xBEEF, PairingOptions{RetryInterval: -1, Timeout: 10 * time.Millisecond})
+		return driver.GetTxLog()[0]
+	}
+
+	key, _ := proto.GeneratePairingKey(proto.NewSeededRand(1), proto.DefaultPairingKeySize)
+	want := make([]byte, 8)
+	binary.LittleEndian.PutUint32(want[0:4], key.Uint32())
+	binary.LittleEndian.PutUint32(want[4:8], 0xBEEF)
+	want = proto.AppendTLV(want, proto.TagMaxFrameSize, []byte{proto.MaxFrameSize})
+	want = proto.AppendCapabilityTLV(want, proto.AllCapabilities)
+
+	first := request()
+	if got := proto.DecodeFrame(first).Payload; !bytes.Equal(got, want) {
+		t.Errorf("pairing payload = %x, want %x", got, want)
+	}
+	if again := request(); !bytes.Equal(again, first) {
+		t.Errorf("seeded transmitters sent %x and %x", first, again)
+	}
+}
+
+func TestPairing_PSKSealsPairing(t *testing.T) {
+	psk := WithPairingPSK([]byte("deployment secret"))
+	driverTx, driverRx, sniffer, driverPlain := NewMockDriver(), NewMockDriver(), NewMockDriver(), NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, psk)
+	if err := tx.SetPairingKeySize(16); err != nil {
+		t.Fatal(err)
+	}
+	tx.SetSecurePairing(true)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, psk)
+	shareMedium(driverTx, driverRx, sniffer, driverPlain)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	rx.mu.Lock()
+	got := rx.pairedDevices[0xCAFE].PairingKey
+	rx.mu.Unlock()
+	if got != tx.pairingKey {
+		t.Errorf("receiver keeps key %v, want %v", got, tx.pairingKey)
+	}
+
+	// A sniffer sees the pairing exchange but neither the key nor which
+	// receiver the request was for.
+	time.Sleep(10 * time.Millisecond)
+	var beef [4]byte
+	binary.LittleEndian.PutUint32(beef[:], 0xBEEF)
+	heard := 0
+	for {
+		data, err := sniffer.Rx(0)
+		if err != nil {
+			break
+		}
+		f := proto.DecodeFrame(data)
+		if f == nil {
+			continue
+		}
+		heard++
+		if bytes.Contains(f.Payload, tx.pairingKey.Bytes()[:4]) {
+			t.Errorf("pairing key visible in %x", f.Payload)
+		}
+		if f.Type == proto.FrameTypePairing && bytes.Contains(f.Payload, beef[:]) {
+			t.Errorf("receiver ID visible in pairing request %x", f.Payload)
+		}
+	}
+	if heard == 0 {
+		t.Fatal("sniffer heard nothing")
+	}
+
+	// Without the PSK the transmitter is turned away.
+	plain := NewTransmitterWithDriver(0xF00D, driverPlain)
+	if err := plain.StartPairing(0xBEEF); err != proto.ErrSecurityMismatch {
+		t.Errorf("unsealed StartPairing() error = %v, want %v", err, proto.ErrSecurityMismatch)
+	}
+}
+
+func TestScan_DiscoversBeaconingReceivers(t *testing.T) {
+	driverTx, driverA, driverB := NewMockDriver(), NewMockDriver(), NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rxA := NewReceiverWithDriver(0xA1, driverA)
+	rxB := NewReceiverWithDriver(0xB2, driverB)
+	for _, rx := range []*Receiver{rxA, rxB} {
+		rx.EnablePairing(0)
+		rx.EnableBeacons(proto.DeviceInfo{Name: fmt.Sprintf("hub %x", rx.device.ID)}, 20*time.Millisecond)
+		rx.Listen()
+		defer rx.StopListening()
+	}
+	shareMedium(driverTx, driverA, driverB)
+
+	found, err := tx.Scan(200 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("Scan() found %+v, want two receivers", found)
+	}
+	var picked ReceiverInfo
+	for _, ri := range found {
+		if ri.Channel != proto.DefaultChannel || ri.Info.Name != fmt.Sprintf("hub %x", ri.ID) {
+			t.Errorf("Scan() reported %+v", ri)
+		}
+		if ri.ID == 0xB2 {
+			picked = ri
+		}
+	}
+
+	if err := tx.StartPairing(picked.ID); err != nil {
+		t.Fatalf("StartPairing(%d) error = %v", picked.ID, err)
+	}
+	if !rxB.IsPaired(0xCAFE) || rxA.IsPaired(0xCAFE) {
+		t.Error("paired with the wrong receiver")
+	}
+
+	// Closing pairing mode stops the beacons.
+	rxA.DisablePairing()
+	rxB.DisablePairing()
+	time.Sleep(50 * time.Millisecond)
+	for { // drop the beacons heard meanwhile
+		if _, err := driverTx.Rx(0); err != nil {
+			break
+		}
+	}
+	if found, err := tx.Scan(100 * time.Millisecond); err != proto.ErrTimeout {
+		t.Errorf("Scan() after closing pairing = %+v, %v, want %v", found, err, proto.ErrTimeout)
+	}
+}
+
+func TestPairing_FixedPairingChannel(t *testing.T) {
+	driverTx := newLinkDriver()
+	driverRx := newLinkDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithPairingChannel(proto.PairingChannel))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithPairingChannel(proto.PairingChannel))
+	// Operating channels that never meet.
+	_ = tx.SetChannel(60)
+	_ = rx.SetChannel(40)
+
+	ConnectDrivers(driverTx.MockDriver, driverRx.MockDriver)
+	rx.Listen()
+	defer rx.StopListening()
+	paired := make(chan error, 1)
+	go func() { paired <- rx.StartPairing() }()
+
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	if err := <-paired; err != nil {
+		t.Fatalf("receiver StartPairing() error = %v", err)
+	}
+	if got, want := driverTx.Tunes(), []uint8{60, proto.PairingChannel, 40}; !bytes.Equal(got, want) {
+		t.Errorf("transmitter tuned to %v, want %v", got, want)
+	}
+	tunes := driverRx.Tunes()
+	if len(tunes) < 3 || tunes[0] != 40 || tunes[1] != proto.PairingChannel || tunes[len(tunes)-1] != 40 {
+		t.Errorf("receiver tuned to %v, want 40, %d, ..., 40", tunes, proto.PairingChannel)
+	}
+	if err := tx.SendDataReliable([]byte{1}, 3); err != nil {
+		t.Errorf("SendDataReliable() on the operating channel error = %v", err)
+	}
+
+	// A failed attempt puts the transmitter back where it was.
+	lone := newLinkDriver()
+	tx = NewTransmitterWithDriver(0xF00D, lone, WithPairingChannel(proto.PairingChannel))
+	_ = tx.SetChannel(60)
+	if err := tx.StartPairingWithOptions(0xBEEF, PairingOptions{Timeout: 50 * time.Millisecond}); err != proto.ErrTimeout {
+		t.Fatalf("StartPairing() without a receiver error = %v, want %v", err, proto.ErrTimeout)
+	}
+	if got, want := lone.Tunes(), []uint8{60, proto.PairingChannel, 60}; !bytes.Equal(got, want) || lone.Channel() != 60 {
+		t.Errorf("transmitter tuned to %v, want %v", got, want)
+	}
+
+	// So does one of the receiver.
+	lone = newLinkDriver()
+	rx = NewReceiverWithDriver(0xBEEF, lone, WithPairingChannel(proto.PairingChannel),
+		WithConfig(proto.Config{PairingTimeout: 50 * time.Millisecond}))
+	_ = rx.SetChannel(40)
+	if err := rx.StartPairing(); err != proto.ErrTimeout {
+		t.Fatalf("receiver StartPairing() without a transmitter error = %v, want %v", err, proto.ErrTimeout)
+	}
+	if got, want := lone.Tunes(), []uint8{40, proto.PairingChannel, 40}; !bytes.Equal(got, want) || lone.Channel() != 40 {
+		t.Errorf("receiver tuned to %v, want %v", got, want)
+	}
+}
+
+func TestPairing_ConfiguredTimeout(t *testing.T) {
+	tx := NewTransmitterWithDriver(0xCAFE, NewMockDriver(), WithPairingTimeout(100*time.Millisecond))
+	start := time.Now()
+	if err := tx.StartPairing(0xBEEF); err != proto.ErrTimeout {
+		t.Fatalf("StartPairing() error = %v, want %v", err, proto.ErrTimeout)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond || took > time.Second {
+		t.Errorf("transmitter gave up after %v, want about 100ms", took)
+	}
+
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver())
+	rx.SetPairingTimeout(100 * time.Millisecond)
+	start = time.Now()
+	if err := rx.StartPairing(); err != proto.ErrTimeout {
+		t.Fatalf("receiver StartPairing() error = %v, want %v", err, proto.ErrTimeout)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond || took > time.Second {
+		t.Errorf("receiver gave up after %v, want about 100ms", took)
+	}
+
+	rx.SetPairingTimeout(0)
+	if got := rx.Config().PairingTimeout; got != proto.PairingTimeout*time.Millisecond {
+		t.Errorf("PairingTimeout after reset = %v, want the default", got)
+	}
+}
+
+func TestTransmitter_AckHandler(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	var mu sync.Mutex
+	seen := make(map[uint32]int)
+	tx.SetAckHandler(func(seq uint32, payload []byte) {
+		mu.Lock()
+		seen[seq]++
+		mu.Unlock()
+	})
+	tx.Listen()
+	defer tx.Stop()
+
+	var seqs []uint32
+	for i := 0; i < 5; i++ {
+		seq, err := tx.Enqueue([]byte{byte(i)})
+		if err != nil {
+			t.Fatalf("Enqueue(%d) error = %v", i, err)
+		}
+		seqs = append(seqs, seq)
+	}
+	// Reliable sends still get their ACKs while the listen loop runs.
+	if err := tx.SendDataReliable([]byte{5}, 3); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+	seqs = append(seqs, tx.seq-1)
+
+	// Repeated ACKs are reported once.
+	driverTx := tx.driver.(*MockDriver)
+	for _, seq := range seqs[:2] {
+		driverTx.InjectRx(rx.config.EncodeFrame(rx.ackFrame(seq, nil)))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(seen)
+		mu.Unlock()
+		if n >= len(seqs) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, seq := range seqs {
+		if seen[seq] != 1 {
+			t.Errorf("handler saw seq %d %d times, want 1", seq, seen[seq])
+		}
+	}
+	if len(seen) != len(seqs) {
+		t.Errorf("handler saw %d seqs, want %d: %v", len(seen), len(seqs), seen)
+	}
+}
+
+func TestTransmitter_Stats(t *testing.T) {
+	d := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, d)
+	tx.device.IsPaired = true
+	tx.receiver = 0xBEEF
+
+	for i := 0; i < 3; i++ {
+		if _, err := tx.SendData([]byte{byte(i), 0}); err != nil {
+			t.Fatalf("SendData() error = %v", err)
+		}
+	}
+	if _, err := tx.SendHeartbeat(); err != nil {
+		t.Fatalf("SendHeartbeat() error = %v", err)
+	}
+	if err := tx.SendDataReliable([]byte{3}, 2); err != proto.ErrTimeout {
+		t.Fatalf("SendDataReliable() error = %v, want %v", err, proto.ErrTimeout)
+	}
+	// Queue the ACK for the next frame before it is sent.
+	d.InjectRx(proto.EncodeFrame(&proto.Frame{
+		SenderID: 0xBEEF,
+		Type:     proto.FrameTypeAck,
+		Seq:      tx.seq,
+		Payload:  []byte{0xEF, 0xBE, 0, 0},
+	}))
+	if err := tx.SendDataReliable([]byte{4}, 2); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+
+	var bytes uint64
+	for _, data := range d.GetTxLog() {
+		bytes += uint64(len(data))
+	}
+	stats := tx.Stats()
+	var frames [proto.FrameTypeMask + 1]uint64
+	frames[proto.FrameTypeData] = 6
+	frames[proto.FrameTypeHeartbeat] = 1
+	if stats.FramesSent != frames {
+		t.Errorf("FramesSent = %v, want %v", stats.FramesSent, frames)
+	}
+	if stats.BytesSent != bytes {
+		t.Errorf("BytesSent = %d, want %d", stats.BytesSent, bytes)
+	}
+	if stats.ReliableSends != 2 || stats.Delivered != 1 || stats.Attempts != 3 || stats.Timeouts != 1 {
+		t.Errorf("Stats() = %+v, want 2 reliable sends, 1 delivered, 3 attempts, 1 timeout", stats)
+	}
+	if r := stats.AckRatio(); r != 0.5 {
+		t.Errorf("AckRatio() = %v, want 0.5", r)
+	}
+	if stats.AcksReceived != 1 || stats.LastAck.IsZero() || stats.LastAckAge <= 0 || stats.LastAckAge > time.Second {
+		t.Errorf("AcksReceived = %d, LastAck = %v, LastAckAge = %v, want one recent ACK", stats.AcksReceived, stats.LastAck, stats.LastAckAge)
+	}
+
+	tx.ResetStats()
+	// The round-trip estimate survives ResetStats.
+	if stats := tx.Stats(); stats != (TxStats{RTT: stats.RTT, RTTVar: stats.RTTVar, AckTimeout: stats.AckTimeout}) {
+		t.Errorf("Stats() after ResetStats = %+v, want zero counters", stats)
+	}
+}
+
+// closingDriver is a lossyDriver that counts calls to its Close method.
+type closingDriver struct {
+	lossyDriver
+	closes atomic.Int32
+}
+
+func (d *closingDriver) Close() error {
+	d.closes.Add(1)
+	return nil
+}
+
+func TestTransmitter_Close(t *testing.T) {
+	// Data frames never reach the receiver, so reliable sends block.
+	driverTx := &closingDriver{lossyDriver: lossyDriver{NewMockDriver(), func(data []byte) bool {
+		return data[5]&proto.FrameTypeMask == proto.FrameTypeData
+	}}}
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithGoodbye())
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	ConnectDrivers(driverTx.MockDriver, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	before := runtime.NumGoroutine()
+
+	tx.StartHeartbeatTask()
+	tx.Listen()
+	errc := make(chan error, 1)
+	go func() { errc <- tx.SendDataReliable([]byte{1}, 100) }()
+	time.Sleep(50 * time.Millisecond)
+	if !rx.IsPairedDeviceConnected() {
+		t.Fatal("receiver does not see the transmitter before Close")
+	}
+
+	if err := tx.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != proto.ErrClosed {
+			t.Errorf("SendDataReliable() in flight = %v, want %v", err, proto.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not cancel the reliable send in flight")
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after Close, want at most %d", n, before)
+	}
+	if n := driverTx.closes.Load(); n != 1 {
+		t.Errorf("driver closed %d times, want 1", n)
+	}
+
+	// The goodbye makes the receiver drop the transmitter at once.
+	for deadline := time.Now().Add(time.Second); rx.IsPairedDeviceConnected() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rx.IsPairedDeviceConnected() {
+		t.Error("receiver still sees the transmitter after its goodbye")
+	}
+
+	if err := tx.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+	if n := driverTx.closes.Load(); n != 1 {
+		t.Errorf("driver closed %d times after a second Close, want 1", n)
+	}
+	if _, err := tx.SendData([]byte{2}); err != proto.ErrClosed {
+		t.Errorf("SendData() after Close = %v, want %v", err, proto.ErrClosed)
+	}
+	if _, err := tx.SendHeartbeat(); err != proto.ErrClosed {
+		t.Errorf("SendHeartbeat() after Close = %v, want %v", err, proto.ErrClosed)
+	}
+	if err := tx.SendDataReliable([]byte{3}, 3); err != proto.ErrClosed {
+		t.Errorf("SendDataReliable() after Close = %v, want %v", err, proto.ErrClosed)
+	}
+	if _, err := tx.Enqueue([]byte{4}); err != proto.ErrClosed {
+		t.Errorf("Enqueue() after Close = %v, want %v", err, proto.ErrClosed)
+	}
+	if err := tx.StartPairing(0xBEEF); err != proto.ErrClosed {
+		t.Errorf("StartPairing() after Close = %v, want %v", err, proto.ErrClosed)
+	}
+}
+
+func TestReceiver_Close(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := &closingDriver{lossyDriver: lossyDriver{NewMockDriver(), func([]byte) bool { return false }}}
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithGoodbye())
+	ConnectDrivers(driverTx, driverRx.MockDriver)
+	down := make(chan struct{}, 1)
+	tx.OnLinkDown(func() { down <- struct{}{} })
+	tx.EnableLinkMonitor(3)
+	tx.Listen()
+	defer tx.Close()
+	before := runtime.NumGoroutine()
+
+	rx.Listen()
+	rx.StartCleanupTask()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	rx.EnablePairing(time.Hour)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rx.ReceiveDataCtx(context.Background())
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := rx.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != proto.ErrClosed {
+			t.Errorf("ReceiveDataCtx() in progress = %v, want %v", err, proto.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not end the ReceiveDataCtx in progress")
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after Close, want at most %d", n, before)
+	}
+	select {
+	case <-down:
+	case <-time.After(time.Second):
+		t.Error("transmitter did not take the goodbye as the link going down")
+	}
+
+	if err := rx.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+	if n := driverRx.closes.Load(); n != 1 {
+		t.Errorf("driver closed %d times, want 1", n)
+	}
+	if _, err := rx.ReceiveData(); err != proto.ErrClosed {
+		t.Errorf("ReceiveData() after Close = %v, want %v", err, proto.ErrClosed)
+	}
+	if err := rx.SendAck(0xCAFE, 1); err != proto.ErrClosed {
+		t.Errorf("SendAck() after Close = %v, want %v", err, proto.ErrClosed)
+	}
+	if err := rx.StartPairing(); err != proto.ErrClosed {
+		t.Errorf("StartPairing() after Close = %v, want %v", err, proto.ErrClosed)
+	}
+}
+
+func TestDownlink(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	var mu sync.Mutex
+	var down, up [][]byte
+	tx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		mu.Lock()
+		down = append(down, append([]byte(nil), f.Payload...))
+		mu.Unlock()
+	})
+	rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+		mu.Lock()
+		up = append(up, append([]byte(nil), f.Payload...))
+		mu.Unlock()
+	})
+	tx.Listen()
+	defer tx.Stop()
+
+	if err := rx.SendDataTo(0xCAFE, []byte("rate=10")); err != nil {
+		t.Fatalf("SendDataTo() error = %v", err)
+	}
+	if err := tx.SendDataReliable([]byte("sample"), 3); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+	if err := rx.SendDataTo(0xCAFE, []byte("rate=20")); err != nil {
+		t.Fatalf("second SendDataTo() error = %v", err)
+	}
+
+	// A repeat of the last downlink frame is ACKed but not delivered again.
+	repeat := rx.config.EncodeFrame(&proto.Frame{
+		SenderID: 0xBEEF,
+		Type:     proto.FrameTypeData,
+		Seq:      rx.seq - 1,
+		Payload:  proto.EncodeAddressed(0xCAFE, []byte("rate=20")),
+	})
+	tx.driver.(*MockDriver).InjectRx(repeat)
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(down) != 2 || string(down[0]) != "rate=10" || string(down[1]) != "rate=20" {
+		t.Errorf("transmitter received %q, want [rate=10 rate=20]", down)
+	}
+	if len(up) != 1 || string(up[0]) != "sample" {
+		t.Errorf("receiver received %q, want [sample]", up)
+	}
+
+	if err := rx.SendDataTo(0xDEAD, []byte{1}); err != proto.ErrNotPaired {
+		t.Errorf("SendDataTo(unpaired) = %v, want %v", err, proto.ErrNotPaired)
+	}
+	if err := rx.SendDataTo(0xCAFE, make([]byte, proto.MaxPayloadSize)); err != proto.ErrInvalidPayload {
+		t.Errorf("SendDataTo(oversized) = %v, want %v", err, proto.ErrInvalidPayload)
+	}
+}
+
+func TestTransmitter_MultipleReceivers(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverA := NewMockDriver()
+	driverB := NewMockDriver()
+	shareMedium(driverTx, driverA, driverB)
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	var mu sync.Mutex
+	got := make(map[proto.DeviceID][]string)
+	for _, r := range []struct {
+		id proto.DeviceID
+		d  *MockDriver
+	}{{0xA, driverA}, {0xB, driverB}} {
+		id := r.id
+		rx := NewReceiverWithDriver(id, r.d)
+		rx.RegisterCallback(proto.FrameTypeData, func(f *proto.Frame) {
+			mu.Lock()
+			got[id] = append(got[id], string(f.Payload))
+			mu.Unlock()
+		})
+		rx.Listen()
+		defer rx.StopListening()
+	}
+
+	if err := tx.StartPairing(0xA); err != nil {
+		t.Fatalf("StartPairing(A) error = %v", err)
+	}
+	if err := tx.StartPairingWith(0xB); err != nil {
+		t.Fatalf("StartPairingWith(B) error = %v", err)
+	}
+	if ids := tx.PairedReceivers(); len(ids) != 2 || ids[0] != 0xA || ids[1] != 0xB {
+		t.Fatalf("PairedReceivers() = %v, want [10 11]", ids)
+	}
+
+	if _, err := tx.SendData([]byte("x")); err != proto.ErrSeveralReceivers {
+		t.Errorf("SendData() = %v, want %v", err, proto.ErrSeveralReceivers)
+	}
+	if err := tx.SendDataAll([]byte("all")); err != nil {
+		t.Fatalf("SendDataAll() error = %v", err)
+	}
+	if err := tx.SendDataTo(0xA, []byte("a")); err != nil {
+		t.Fatalf("SendDataTo(A) error = %v", err)
+	}
+	if err := tx.SendDataTo(0xB, []byte("b")); err != nil {
+		t.Fatalf("SendDataTo(B) error = %v", err)
+	}
+	if err := tx.SendDataTo(0xC, []byte("c")); err != proto.ErrNotPaired {
+		t.Errorf("SendDataTo(C) = %v, want %v", err, proto.ErrNotPaired)
+	}
+
+	tx.ResetStats()
+	if err := tx.heartbeatAll(); err != nil {
+		t.Fatalf("heartbeatAll() error = %v", err)
+	}
+	if n := tx.Stats().FramesSent[proto.FrameTypeHeartbeat]; n != 2 {
+		t.Errorf("heartbeats sent = %d, want one per receiver", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[proto.DeviceID][]string{0xA: {"all", "a"}, 0xB: {"all", "b"}}
+	for id, w := range want {
+		if fmt.Sprint(got[id]) != fmt.Sprint(w) {
+			t.Errorf("receiver %d got %q, want %q", id, got[id], w)
+		}
+	}
+}
+
+// burstDriver is a MockDriver that also transmits bursts, recording each.
+type burstDriver struct {
+	*MockDriver
+	bursts int
+}
+
+func (d *burstDriver) TxBurst(frames [][]byte) error {
+	d.bursts++
+	for _, f := range frames {
+		if err := d.MockDriver.Tx(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestTransmitter_UntargetedSendsWithSeveralReceivers(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverA := NewMockDriver()
+	driverB := NewMockDriver()
+	shareMedium(driverTx, driverA, driverB)
+
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	for _, r := range []struct {
+		id proto.DeviceID
+		d  *MockDriver
+	}{{0xA, driverA}, {0xB, driverB}} {
+		rx := NewReceiverWithDriver(r.id, r.d)
+		rx.Listen()
+		defer rx.StopListening()
+	}
+	if err := tx.StartPairing(0xA); err != nil {
+		t.Fatalf("StartPairing(A) error = %v", err)
+	}
+	if err := tx.StartPairingWith(0xB); err != nil {
+		t.Fatalf("StartPairingWith(B) error = %v", err)
+	}
+	tx.ResetStats()
+
+	sends := []struct {
+		name string
+		send func() error
+	}{
+		{"SendDataWithPriority", func() error { return tx.SendDataWithPriority([]byte("x"), proto.PriorityHigh) }},
+		{"SendDataLarge", func() error { return tx.SendDataLarge([]byte("x")) }},
+		{"SendDataBatched", func() error { return tx.SendDataBatched([]byte("x")) }},
+		{"EnqueueWithPriority", func() error { return tx.EnqueueWithPriority([]byte("x"), proto.PriorityNormal) }},
+		{"FlushQueue", tx.FlushQueue},
+		{"Stream", func() error {
+			_, err := tx.Stream().Write([]byte("x"))
+			return err
+		}},
+		{"SendBlob", func() error { return SendBlob(tx, bytes.NewReader([]byte("x")), 1, BlobOptions{}) }},
+	}
+	for _, s := range sends {
+		if err := s.send(); err != proto.ErrSeveralReceivers {
+			t.Errorf("%s() = %v, want %v", s.name, err, proto.ErrSeveralReceivers)
+		}
+	}
+	for typ, n := range tx.Stats().FramesSent {
+		if n != 0 {
+			t.Errorf("%d frames of type %d sent, want none", n, typ)
+		}
+	}
+}
+
+func TestTransmitter_SendBurst(t *testing.T) {
+	payloads := [][]byte{{1}, {2, 2}, {3, 3, 3}}
+	for _, burst := range []bool{false, true} {
+		d := &burstDriver{MockDriver: NewMockDriver()}
+		var driver RadioDriver = d.MockDriver
+		if burst {
+			driver = d
+		}
+		tx := NewTransmitterWithDriver(0xCAFE, driver)
+		tx.device.IsPaired = true
+		tx.seq = 7
+
+		if err := tx.SendBurst([][]byte{{1}, make([]byte, tx.maxPayload()+1)}); err != proto.ErrInvalidPayload {
+			t.Errorf("SendBurst(oversized) = %v, want %v", err, proto.ErrInvalidPayload)
+		}
+		if n := len(d.GetTxLog()); n != 0 || tx.seq != 7 {
+			t.Fatalf("rejected burst sent %d frames and advanced seq to %d", n, tx.seq)
+		}
+
+		if err := tx.SendBurst(payloads); err != nil {
+			t.Fatalf("SendBurst() error = %v", err)
+		}
+		sent := d.GetTxLog()
+		if len(sent) != len(payloads) {
+			t.Fatalf("burst=%v: sent %d frames, want %d", burst, len(sent), len(payloads))
+		}
+		for i, data := range sent {
+			f := proto.DecodeFrame(data)
+			if f == nil || f.Type != proto.FrameTypeData || f.Seq != uint32(7+i) || !bytes.Equal(f.Payload, payloads[i]) {
+				t.Errorf("burst=%v: frame %d = %+v, want seq %d payload %v", burst, i, f, 7+i, payloads[i])
+			}
+		}
+		if want := map[bool]int{false: 0, true: 1}[burst]; d.bursts != want {
+			t.Errorf("burst=%v: TxBurst called %d times, want %d", burst, d.bursts, want)
+		}
+		if n := tx.Stats().FramesSent[proto.FrameTypeData]; n != uint64(len(payloads)) {
+			t.Errorf("burst=%v: FramesSent[data] = %d, want %d", burst, n, len(payloads))
+		}
+	}
+}
+
+func TestTransmitter_DutyCycle(t *testing.T) {
+	newLimited := func(cfg DutyCycleConfig) (*Transmitter, *MockDriver, *time.Time) {
+		d := NewMockDriver()
+		tx := NewTransmitterWithDriver(0xCAFE, d, WithDutyCycle(cfg))
+		tx.device.IsPaired = true
+		now := time.Unix(1000, 0)
+		tx.dutyCycle.now = func() time.Time { return now }
+		tx.dutyCycle.last = now
+		return tx, d, &now
+	}
+	// A data frame with a 15-byte payload is 30 bytes, 36 on the air:
+	// 288µs at 1 Mbit/s.
+	payload := make([]byte, 15)
+	const frameAirtime = 288 * time.Microsecond
+
+	t.Run("Reject", func(t *testing.T) {
+		tx, d, now := newLimited(DutyCycleConfig{Airtime: 10 * frameAirtime, Mode: DutyCycleReject, ExemptHeartbeats: true})
+		for i := 0; i < 10; i++ {
+			if _, err := tx.SendData(payload); err != nil {
+				t.Fatalf("SendData(%d) error = %v", i, err)
+			}
+		}
+		if _, err := tx.SendData(payload); err != proto.ErrDutyCycle {
+			t.Fatalf("SendData() over budget = %v, want %v", err, proto.ErrDutyCycle)
+		}
+		if _, err := tx.SendHeartbeat(); err != nil {
+			t.Errorf("SendHeartbeat() over budget = %v, want it exempt", err)
+		}
+		stats := tx.Stats()
+		if stats.FramesSent[proto.FrameTypeData] != 10 || stats.DutyCycleRejects != 1 || stats.AirtimeLeft != 0 {
+			t.Errorf("Stats() = %+v, want 10 data frames, 1 reject and no airtime left", stats)
+		}
+		if want := 10*frameAirtime + tx.dutyCycle.airtime(len(d.GetTxLog()[10])); stats.Airtime != want {
+			t.Errorf("Airtime = %v, want %v", stats.Airtime, want)
+		}
+
+		// A tenth of a second refills a tenth of the budget, one frame.
+		*now = now.Add(100 * time.Millisecond)
+		if left := tx.Stats().AirtimeLeft; left > frameAirtime {
+			t.Errorf("AirtimeLeft = %v after the heartbeat overdraft, want at most %v", left, frameAirtime)
+		}
+		*now = now.Add(time.Second)
+		if left := tx.Stats().AirtimeLeft; left != 10*frameAirtime {
+			t.Errorf("AirtimeLeft = %v after a second, want the full %v", left, 10*frameAirtime)
+		}
+		if _, err := tx.SendData(payload); err != nil {
+			t.Errorf("SendData() after refill = %v", err)
+		}
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		tx, _, _ := newLimited(DutyCycleConfig{Airtime: 2 * frameAirtime})
+		tx.dutyCycle.now = time.Now
+		tx.dutyCycle.last = time.Now()
+		start := time.Now()
+		for i := 0; i < 4; i++ {
+			if _, err := tx.SendData(payload); err != nil {
+				t.Fatalf("SendData(%d) error = %v", i, err)
+			}
+		}
+		// Two frames fit the bucket; the other two wait for a second's
+		// worth of refill.
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Errorf("4 frames took %v, want the limiter to hold them for about a second", elapsed)
+		}
+		if n := tx.Stats().DutyCycleWaits; n != 2 {
+			t.Errorf("DutyCycleWaits = %d, want 2", n)
+		}
+	})
+}
+
+// echoDriver ACKs every data frame it transmits after a delay, standing in
+// for a receiver whose turnaround can be changed while a test runs.
+type echoDriver struct {
+	*MockDriver
+	mu    sync.Mutex
+	delay time.Duration
+}
+
+func (d *echoDriver) setDelay(delay time.Duration) {
+	d.mu.Lock()
+	d.delay = delay
+	d.mu.Unlock()
+}
+
+func (d *echoDriver) Tx(data []byte) error {
+	if f := proto.DecodeFrame(data); f != nil && f.Type == proto.FrameTypeData {
+		ack := proto.EncodeFrame(&proto.Frame{
+			SenderID: 0xBEEF,
+			Type:     proto.FrameTypeAck,
+			Seq:      f.Seq,
+			Payload:  []byte{0xEF, 0xBE, 0, 0},
+		})
+		d.mu.Lock()
+		time.AfterFunc(d.delay, func() { d.InjectRx(ack) })
+		d.mu.Unlock()
+	}
+	return d.MockDriver.Tx(data)
+}
+
+func TestTransmitter_AckTimeout(t *testing.T) {
+	d := &echoDriver{MockDriver: NewMockDriver(), delay: 3 * time.Millisecond}
+	tx := NewTransmitterWithDriver(0xCAFE, d)
+	tx.device.IsPaired = true
+	tx.receiver = 0xBEEF
+
+	if got := tx.Stats().AckTimeout; got != 200*time.Millisecond {
+		t.Fatalf("AckTimeout before any ACK = %v, want 200ms", got)
+	}
+	for i := 0; i < 20; i++ {
+		if err := tx.SendDataReliable([]byte{byte(i)}, 3); err != nil {
+			t.Fatalf("SendDataReliable(%d) error = %v", i, err)
+		}
+	}
+	stats := tx.Stats()
+	if stats.RTT < 3*time.Millisecond || stats.RTT > 20*time.Millisecond {
+		t.Errorf("RTT = %v with a 3ms turnaround", stats.RTT)
+	}
+	if stats.AckTimeout >= 50*time.Millisecond || stats.AckTimeout < stats.RTT {
+		t.Errorf("AckTimeout = %v with RTT %v, want it to have converged near the RTT", stats.AckTimeout, stats.RTT)
+	}
+	fast := stats.AckTimeout
+
+	// A slower receiver costs retransmissions until the timeout catches up,
+	// but every frame still gets through.
+	d.setDelay(40 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		if err := tx.SendDataReliable([]byte{byte(i)}, 5); err != nil {
+			t.Fatalf("SendDataReliable(%d) after slowing down error = %v", i, err)
+		}
+	}
+	stats = tx.Stats()
+	if stats.RTT < 20*time.Millisecond || stats.AckTimeout <= fast || stats.AckTimeout < stats.RTT {
+		t.Errorf("RTT = %v, AckTimeout = %v with a 40ms turnaround, want both to have grown", stats.RTT, stats.AckTimeout)
+	}
+	if stats.Retransmitted == 0 {
+		t.Error("no retransmissions when the turnaround grew past the timeout")
+	}
+
+	// WithAckTimeout bounds the timeout.
+	capped := NewTransmitterWithDriver(0xCAFE, NewMockDriver(), WithAckTimeout(AckTimeoutConfig{Min: 10 * time.Millisecond, Max: 30 * time.Millisecond}))
+	capped.device.IsPaired = true
+	capped.receiver = 0xBEEF
+	start := time.Now()
+	if err := capped.SendDataReliable([]byte{1}, 1); err != proto.ErrTimeout {
+		t.Fatalf("SendDataReliable() unanswered = %v, want %v", err, proto.ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unanswered send took %v, want about the 30ms maximum", elapsed)
+	}
+}
+
+func TestSetTxPower(t *testing.T) {
+	driverTx, driverRx := NewMockDriver(), NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+
+	if err := tx.SetTxPower(-12); err != nil || driverTx.txPower != -12 {
+		t.Errorf("Transmitter.SetTxPower(-12) = %v, driver power %d", err, driverTx.txPower)
+	}
+	if err := rx.SetTxPower(4); err != nil || driverRx.txPower != 4 {
+		t.Errorf("Receiver.SetTxPower(4) = %v, driver power %d", err, driverRx.txPower)
+	}
+	for _, dbm := range []int8{MaxTxPower + 1, MinTxPower - 1} {
+		if err := tx.SetTxPower(dbm); err != proto.ErrInvalidTxPower {
+			t.Errorf("Transmitter.SetTxPower(%d) = %v, want %v", dbm, err, proto.ErrInvalidTxPower)
+		}
+		if err := rx.SetTxPower(dbm); err != proto.ErrInvalidTxPower {
+			t.Errorf("Receiver.SetTxPower(%d) = %v, want %v", dbm, err, proto.ErrInvalidTxPower)
+		}
+	}
+	if driverTx.txPower != -12 || driverRx.txPower != 4 {
+		t.Errorf("rejected levels reached the drivers: %d, %d", driverTx.txPower, driverRx.txPower)
+	}
+}
+
+func TestSetDataRate(t *testing.T) {
+	driverTx, driverRx := NewMockDriver(), NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+
+	if err := tx.SetDataRate(DataRate2Mbit); err != nil || driverTx.rate != DataRate2Mbit {
+		t.Errorf("Transmitter.SetDataRate(2 Mbit) = %v, driver rate %v", err, driverTx.rate)
+	}
+	if err := rx.SetDataRate(DataRate250Kbit); err != nil || driverRx.rate != DataRate250Kbit {
+		t.Errorf("Receiver.SetDataRate(250 kbit) = %v, driver rate %v", err, driverRx.rate)
+	}
+	if err := tx.SetDataRate(DataRate250Kbit + 1); err != proto.ErrInvalidDataRate {
+		t.Errorf("Transmitter.SetDataRate(unknown) = %v, want %v", err, proto.ErrInvalidDataRate)
+	}
+	if err := rx.SetDataRate(DataRate250Kbit + 1); err != proto.ErrInvalidDataRate {
+		t.Errorf("Receiver.SetDataRate(unknown) = %v, want %v", err, proto.ErrInvalidDataRate)
+	}
+	if tx.DataRate() != DataRate2Mbit || rx.DataRate() != DataRate250Kbit {
+		t.Errorf("rates = %v, %v after rejected values, want 2 Mbit, 250 kbit", tx.DataRate(), rx.DataRate())
+	}
+}
+
+func TestPairing_DataRateMismatch(t *testing.T) {
+	driverTx, driverRx := NewMockDriver(), NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	if err := rx.SetDataRate(DataRate2Mbit); err != nil {
+		t.Fatalf("SetDataRate() error = %v", err)
+	}
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+
+	if err := tx.StartPairing(0xBEEF); err != proto.ErrDataRateMismatch {
+		t.Errorf("StartPairing() at 1 Mbit error = %v, want %v", err, proto.ErrDataRateMismatch)
+	}
+	if rx.IsPaired(0xCAFE) {
+		t.Error("receiver paired with a transmitter at another data rate")
+	}
+
+	if err := tx.SetDataRate(DataRate2Mbit); err != nil {
+		t.Fatalf("SetDataRate() error = %v", err)
+	}
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() at 2 Mbit error = %v", err)
+	}
+	if !rx.IsPaired(0xCAFE) {
+		t.Error("receiver did not pair at the same data rate")
+	}
+}
+
+func TestPairing_DataRateMismatchWithLegacyReceiver(t *testing.T) {
+	driver := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driver)
+	if err := tx.SetDataRate(DataRate2Mbit); err != nil {
+		t.Fatalf("SetDataRate() error = %v", err)
+	}
+
+	// A receiver that announces no rate is taken to use 1 Mbit.
+	driver.InjectRx(proto.EncodeFrame(&proto.Frame{
+		SenderID: 0xBEEF,
+		Type:     proto.FrameTypeAck,
+		Seq:      0,
+		Payload:  []byte{0xEF, 0xBE, 0, 0},
+	}))
+
+	if err := tx.StartPairing(0xBEEF); err != proto.ErrDataRateMismatch {
+		t.Errorf("StartPairing() error = %v, want %v", err, proto.ErrDataRateMismatch)
+	}
+	if tx.device.IsPaired {
+		t.Error("transmitter paired with a receiver at another data rate")
+	}
+}
+
+func TestTransmitter_ChannelHopping(t *testing.T) {
+	// hunt pairs on the default channel, makes it lose most frames sent
+	// upstream and sends until the supervisor has hunted once.
+	hunt := func(t *testing.T, candidates []uint8, jammed ...uint8) (*Transmitter, *linkDriver, *linkDriver, []HopEvent) {
+		t.Helper()
+		driverTx, driverRx := newLinkDriver(), newLinkDriver()
+		tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+		rx := NewReceiverWithDriver(0xBEEF, driverRx)
+		ConnectDrivers(driverTx.MockDriver, driverRx.MockDriver)
+		rx.Listen()
+		t.Cleanup(rx.StopListening)
+		if err := tx.StartPairing(0xBEEF); err != nil {
+			t.Fatalf("StartPairing() error = %v", err)
+		}
+		rx.DisablePairing()
+
+		var mu sync.Mutex
+		var events []HopEvent
+		tx.OnChannelHop(func(e HopEvent) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		})
+		if err := tx.EnableChannelHopping(ChannelHoppingConfig{Channels: candidates, Window: 6}); err != nil {
+			t.Fatalf("EnableChannelHopping() error = %v", err)
+		}
+		for _, ch := range jammed {
+			driverTx.Jam(ch)
+			driverRx.Jam(ch)
+		}
+		driverTx.Lose(proto.DefaultChannel, 0.6)
+
+		for i := 0; i < 6; i++ {
+			_ = tx.SendDataReliable([]byte{byte(i)}, 1)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return tx, driverTx, driverRx, append([]HopEvent(nil), events...)
+	}
+
+	t.Run("Moves", func(t *testing.T) {
+		tx, driverTx, driverRx, events := hunt(t, []uint8{40, 60}, 40)
+		want := []HopEvent{{HopStarted, proto.DefaultChannel}, {HopFailed, 40}, {HopMoved, 60}}
+		if fmt.Sprint(events) != fmt.Sprint(want) {
+			t.Fatalf("events = %v, want %v", events, want)
+		}
+		if driverTx.Channel() != 60 {
+			t.Errorf("transmitter on channel %d, want 60", driverTx.Channel())
+		}
+		deadline := time.Now().Add(time.Second)
+		for driverRx.Channel() != 60 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if driverRx.Channel() != 60 {
+			t.Errorf("receiver on channel %d, want 60", driverRx.Channel())
+		}
+		for i := 0; i < 5; i++ {
+			if err := tx.SendDataReliable([]byte{byte(i)}, 1); err != nil {
+				t.Fatalf("SendDataReliable() on the new channel error = %v", err)
+			}
+		}
+	})
+
+	t.Run("ReturnsHome", func(t *testing.T) {
+		tx, driverTx, driverRx, events := hunt(t, []uint8{40}, 40)
+		want := []HopEvent{{HopStarted, proto.DefaultChannel}, {HopFailed, 40}, {HopHome, proto.DefaultChannel}}
+		if fmt.Sprint(events) != fmt.Sprint(want) {
+			t.Fatalf("events = %v, want %v", events, want)
+		}
+		if driverTx.Channel() != proto.DefaultChannel {
+			t.Errorf("transmitter on channel %d, want %d", driverTx.Channel(), proto.DefaultChannel)
+		}
+		// The receiver gives the switch up once it has not heard the
+		// transmitter on channel 40 for its grace period.
+		deadline := time.Now().Add(2 * channelGracePeriod)
+		for driverRx.Channel() != proto.DefaultChannel && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if driverRx.Channel() != proto.DefaultChannel {
+			t.Errorf("receiver on channel %d, want %d", driverRx.Channel(), proto.DefaultChannel)
+		}
+		if err := tx.SendDataReliable([]byte{1}, 5); err != nil {
+			t.Errorf("SendDataReliable() back home error = %v", err)
+		}
+	})
+}
+
+func TestTransmitter_SeqState(t *testing.T) {
+	t.Run("Callback", func(t *testing.T) {
+		tx := NewTransmitterWithDriver(0xCAFE, NewMockDriver())
+		tx.device.IsPaired = true
+		var saved []SeqState
+		tx.OnSeqCheckpoint(func(s SeqState) { saved = append(saved, s) })
+		for i := 0; i < 600; i++ {
+			if _, err := tx.SendData([]byte{1}); err != nil {
+				t.Fatalf("SendData() error = %v", err)
+			}
+		}
+		want := []SeqState{{0, 0}, {seqCheckpointInterval, 0}}
+		if fmt.Sprint(saved) != fmt.Sprint(want) {
+			t.Fatalf("checkpoints = %v, want %v", saved, want)
+		}
+
+		// The restarted transmitter jumps past anything sent after the
+		// last checkpoint and saves its new epoch straight away.
+		d := NewMockDriver()
+		restarted := NewTransmitterWithDriver(0xCAFE, d, WithSeqState(saved[len(saved)-1]))
+		restarted.device.IsPaired = true
+		restarted.OnSeqCheckpoint(func(s SeqState) { saved = append(saved, s) })
+		if s := saved[len(saved)-1]; s != (SeqState{seqCheckpointInterval + SeqJump, 1}) {
+			t.Errorf("state after restart = %+v, want seq %d, epoch 1", s, seqCheckpointInterval+SeqJump)
+		}
+		seq, err := restarted.SendData([]byte{1})
+		if err != nil || seq <= 600 {
+			t.Errorf("SendData() after restart = %d, %v, want a number above the 600 sent before", seq, err)
+		}
+	})
+
+	t.Run("BondStore", func(t *testing.T) {
+		driverTx, driverRx := NewMockDriver(), NewMockDriver()
+		txBonds := NewMemoryBondStore()
+		tx := NewTransmitterWithDriver(0xCAFE, driverTx, WithBondStore(txBonds))
+		rx := NewReceiverWithDriver(0xBEEF, driverRx)
+		ConnectDrivers(driverTx, driverRx)
+		rx.Listen()
+		defer rx.StopListening()
+		if err := tx.StartPairing(0xBEEF); err != nil {
+			t.Fatalf("StartPairing() error = %v", err)
+		}
+		for i := 0; i < seqCheckpointInterval; i++ {
+			if _, err := tx.SendFrame(proto.FrameTypeControl, nil); err != nil {
+				t.Fatalf("SendFrame() error = %v", err)
+			}
+		}
+		last := tx.SeqState().Seq
+
+		epoch := func() uint32 {
+			rx.mu.Lock()
+			defer rx.mu.Unlock()
+			return rx.pairedDevices[0xCAFE].Epoch
+		}
+		for restart := uint32(1); restart <= 2; restart++ {
+			tx = NewTransmitterWithDriver(0xCAFE, driverTx, WithBondStore(txBonds))
+			if s := tx.SeqState(); s.Epoch != restart || int32(s.Seq-last) <= 0 {
+				t.Fatalf("restart %d: state = %+v, want epoch %d and a seq above %d", restart, s, restart, last)
+			}
+			last = tx.SeqState().Seq
+			if _, err := tx.SendHeartbeat(); err != nil {
+				t.Fatalf("SendHeartbeat() error = %v", err)
+			}
+			deadline := time.Now().Add(time.Second)
+			for epoch() != restart && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if got := epoch(); got != restart {
+				t.Fatalf("restart %d: receiver has epoch %d", restart, got)
+			}
+			if err := tx.SendDataReliable([]byte{byte(restart)}, 3); err != nil {
+				t.Fatalf("restart %d: SendDataReliable() error = %v", restart, err)
+			}
+		}
+	})
+}
+
+func TestReceiver_Reader(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	tx := NewTransmitterWithDriver(0xCAFE, driverTx)
+	rx := NewReceiverWithDriver(0xBEEF, driverRx, WithReaderHighWater(128))
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	rd := rx.Reader(0xCAFE)
+
+	data := make([]byte, 2048)
+	for i := range data {
+		data[i] = byte(i*7 + i/256)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		for off := 0; off < len(data); off += 16 {
+			if err := tx.SendDataReliable(data[off:off+16], 5); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	// A slow reader holds the transmitter back instead of losing data.
+	got := make([]byte, 0, len(data))
+	buf := make([]byte, 16)
+	sawPause := false
+	for len(got) < len(data) {
+		n, err := rd.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() after %d bytes error = %v", len(got), err)
+		}
+		got = append(got, buf[:n]...)
+		sawPause = sawPause || rx.DevicePaused(0xCAFE)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data read differs from data sent")
+	}
+	if !sawPause {
+		t.Error("transmitter never paused for the slow reader")
+	}
+	deadline := time.Now().Add(time.Second)
+	for (rx.DevicePaused(0xCAFE) || tx.Paused()) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rx.DevicePaused(0xCAFE) || tx.Paused() {
+		t.Error("transmitter still paused once the reader caught up")
+	}
+
+	// What is left is read before the end of the unpaired device's data.
+	if err := tx.SendDataReliable([]byte("tail"), 5); err != nil {
+		t.Fatalf("SendDataReliable() error = %v", err)
+	}
+	if err := rx.Unpair(0xCAFE); err != nil {
+		t.Fatalf("Unpair() error = %v", err)
+	}
+	rest, err := io.ReadAll(rd)
+	if err != nil || string(rest) != "tail" {
+		t.Errorf("ReadAll() after Unpair = %q, %v, want \"tail\"", rest, err)
+	}
+
+	// A new reader replaces the old one.
+	rd2 := rx.Reader(0xCAFE)
+	if _, err := rd.Read(buf); err != proto.ErrClosed {
+		t.Errorf("Read() of a replaced reader error = %v, want ErrClosed", err)
+	}
+	if err := rd2.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestReceiver_ReaderOverflow(t *testing.T) {
+	rx := NewReceiverWithDriver(0xBEEF, NewMockDriver(), WithReaderHighWater(8))
+	rx.ProcessFrame(pairingRequest(0xCAFE, 0xBEEF))
+	rd := rx.Reader(0xCAFE)
+	for seq := uint32(1); seq <= 3; seq++ {
+		rx.ProcessFrame(&proto.Frame{SenderID: 0xCAFE, Type: proto.FrameTypeData, Seq: seq, Payload: bytes.Repeat([]byte{byte(seq)}, 6)})
+	}
+	// Up to twice the mark is held; the third message is dropped.
+	buf := make([]byte, 32)
+	n, err := rd.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte{1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2}) {
+		t.Fatalf("Read() = %v, %v, want the first two messages", buf[:n], err)
+	}
+	if _, err := rd.Read(buf); err != proto.ErrOverflow {
+		t.Errorf("Read() at the gap error = %v, want ErrOverflow", err)
+	}
+}
+
+func TestStream_CopiesThroughLoss(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+
+	var mu sync.Mutex
+	var chunks, acks int
+	lossyTx := &lossyDriver{MockDriver: driverTx, drop: func(data []byte) bool {
+		frame := proto.DecodeFrame(data)
+		if frame == nil || frame.Type != proto.FrameTypeStream {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		chunks++
+		return chunks%7 == 0
+	}}
+	lossyRx := &lossyDriver{MockDriver: driverRx, drop: func(data []byte) bool {
+		frame := proto.DecodeFrame(data)
+		if frame == nil || frame.Type != proto.FrameTypeAck {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		acks++
+		return acks%5 == 0
+	}}
+
+	tx := NewTransmitterWithDriver(0xCAFE, lossyTx, WithAckTimeout(AckTimeoutConfig{Max: 50 * time.Millisecond}))
+	rx := NewReceiverWithDriver(0xBEEF, lossyRx)
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+	// Reads receive the frames themselves.
+	rx.StopListening()
+	time.Sleep(20 * time.Millisecond)
+
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(i*7 + i/256)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		w := tx.Stream()
+		if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+			errc <- err
+			return
+		}
+		errc <- w.Close()
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(h, rx.Stream(0xCAFE))
+	if err != nil {
+		t.Fatalf("reading the stream: %v", err)
+	}
+	// Answer the end of the stream again should its ACK have been lost.
+	rx.Listen()
+	defer rx.StopListening()
+	if err := <-errc; err != nil {
+		t.Fatalf("writing the stream: %v", err)
+	}
+	if want := sha256.Sum256(data); n != int64(len(data)) || !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Errorf("read %d bytes with checksum %x, want %d bytes with %x", n, h.Sum(nil), len(data), want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if chunks < 7 || acks < 5 {
+		t.Errorf("%d chunks and %d ACKs sent, want some of each lost", chunks, acks)
+	}
+}
+
+func TestStream_NewStreamAfterEnd(t *testing.T) {
+	tx, rx := pairConnected(t, 0xCAFE, 0xBEEF)
+
+	for _, msg := range []string{"first stream", "second"} {
+		w := tx.Stream()
+		if _, err := io.WriteString(w, msg); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		if _, err := w.Write([]byte{1}); err != proto.ErrClosed {
+			t.Errorf("Write() after Close() error = %v, want ErrClosed", err)
+		}
+		got, err := io.ReadAll(rx.Stream(0xCAFE))
+		if err != nil || string(got) != msg {
+			t.Errorf("read %q, %v, want %q", got, err, msg)
+		}
+	}
+}
+
+// swapDriver sends and receives through whichever MockDriver it was last
+// given, to take a transmitter off the air and back.
+type swapDriver struct {
+	*MockDriver
+	mu     sync.Mutex
+	cur    *MockDriver
+	chunks []uint32 // indices of the blob chunks sent on the air
+}
+
+func (d *swapDriver) Swap(m *MockDriver) {
+	d.mu.Lock()
+	d.cur = m
+	d.mu.Unlock()
+}
+
+func (d *swapDriver) current() *MockDriver {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cur
+}
+
+func (d *swapDriver) Tx(data []byte) error {
+	d.mu.Lock()
+	if f := proto.DecodeFrame(data); f != nil && f.Type == proto.FrameTypeBlob && d.cur == d.MockDriver {
+		if _, index, _, ok := proto.DecodeBlobChunk(f.Payload); ok {
+			d.chunks = append(d.chunks, index)
+		}
+	}
+	d.mu.Unlock()
+	return d.current().Tx(data)
+}
+
+func (d *swapDriver) Rx(timeout time.Duration) ([]byte, error) {
+	return d.current().Rx(timeout)
+}
+
+func TestSendBlob_Resumes(t *testing.T) {
+	driverTx := NewMockDriver()
+	driverRx := NewMockDriver()
+	swap := &swapDriver{MockDriver: driverTx, cur: driverTx}
+
+	tx := NewTransmitterWithDriver(0xCAFE, swap, WithAckTimeout(AckTimeoutConfig{Max: 20 * time.Millisecond}))
+	rx := NewReceiverWithDriver(0xBEEF, driverRx)
+	ConnectDrivers(driverTx, driverRx)
+	rx.Listen()
+	defer rx.StopListening()
+	if err := tx.StartPairing(0xBEEF); err != nil {
+		t.Fatalf("StartPairing() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var received []byte
+	var rxHeld int64
+	NewBlobReceiver(rx, BlobReceiverOptions{
+		OnProgress: func(from proto.DeviceID, info BlobInfo, held int64) {
+			mu.Lock()
+			rxHeld = held
+			mu.Unlock()
+		},
+		OnComplete: func(from proto.DeviceID, info BlobInfo, data []byte) {
+			mu.Lock()
+			received = data
+			mu.Unlock()
+		},
+	})
+
+	blob := make([]byte, 3000)
+	for i := range blob {
+		blob[i] = byte(i * 31 >> 3)
+	}
+	opts := BlobOptions{ChunkSize: 100, Retries: 2}
+
+	// Take the transmitter off the air half way through.
+	opts.OnProgress = func(held, size int64) {
+		if held >= size/2 {
+			swap.Swap(NewMockDriver())
+		}
+	}
+	if err := SendBlob(tx, bytes.NewReader(blob), int64(len(blob)), opts); err != proto.ErrTimeout {
+		t.Fatalf("interrupted SendBlob() error = %v, want ErrTimeout", err)
+	}
+	mu.Lock()
+	if received != nil || rxHeld < 1500 || rxHeld >= 3000 {
+		t.Errorf("receiver holds %d bytes after the interruption", rxHeld)
+	}
+	held := uint32(rxHeld / 100)
+	mu.Unlock()
+
+	swap.Swap(driverTx)
+	swap.mu.Lock()
+	first := len(swap.chunks)
+	swap.mu.Unlock()
+	var progress []int64
+	opts.OnProgress = func(held, size int64) { progress = append(progress, held) }
+	if err := SendBlob(tx, bytes.NewReader(blob), int64(len(blob)), opts); err != nil {
+		t.Fatalf("resumed SendBlob() error = %v", err)
+	}
+
+	// The chunks the receiver held are not sent again. Those it lacked
+	// are, some more than once if an ACK was late.
+	swap.mu.Lock()
+	resent := make(map[uint32]bool)
+	for _, index := range swap.chunks[first:] {
+		if index < held {
+			t.Errorf("resumed transfer sent chunk %d, which the receiver held", index)
+		}
+		resent[index] = true
+	}
+	swap.mu.Unlock()
+	if want := 30 - int(held); len(resent) != want {
+		t.Errorf("resumed transfer sent %d distinct chunks, want the %d missing", len(resent), want)
+	}
+	if len(progress) != 30 || progress[len(progress)-1] != 3000 {
+		t.Errorf("resumed progress = %v, want 30 steps to 3000", progress)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if crc32.ChecksumIEEE(received) != crc32.ChecksumIEEE(blob) || len(received) != len(blob) {
+		t.Errorf("received %d bytes that differ from the blob", len(received))
+	}
+}
+
+func TestSendBlob_Rejected(t *testing.T) {
+	tx, _ := pairConnected(t, 0xCAFE, 0xBEEF)
+	if err := SendBlob(tx, bytes.NewReader([]byte("blob")), 4, BlobOptions{}); err != proto.ErrBlobRejected {
+		t.Errorf("SendBlob() without a BlobReceiver error = %v, want ErrBlobRejected", err)
+	}
+}
+
+// airMedium is a channel shared by mediumDrivers. Each transmission keeps
+// it busy for airtime; frames on the air at the same time collide.
+type airMedium struct {
+	mu      sync.Mutex
+	airtime time.Duration
+	on      []time.Time // start of every transmission
+}
+
+// collisions counts the transmissions that overlapped another.
+func (m *airMedium) collisions() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for i, a := range m.on {
+		for j, b := range m.on {
+			if i != j && a.Sub(b) < m.airtime && b.Sub(a) < m.airtime {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+type mediumDriver struct {
+	*MockDriver
+	m *airMedium
+}
+
+func (d *mediumDriver) Tx(data []byte) error {
+	d.m.mu.Lock()
+	d.m.on = append(d.m.on, time.Now())
+	d.m.mu.Unlock()
+	time.Sleep(d.m.airtime)
+	return d.MockDriver.Tx(data)
+}
+
+func (d *mediumDriver) SampleRSSI() (int8, error) {
+	d.m.mu.Lock()
+	defer d.m.mu.Unlock()
+	if n := len(d.m.on); n > 0 && time.Since(d.m.on[n-1]) < d.m.airtime {
+		return -40, nil
+	}
+	return -100, nil
+}
+
+func TestCSMA_FewerCollisions(t *testing.T) {
+	run := func(opts ...Option) int {
+		m := &airMedium{airtime: 2 * time.Millisecond}
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			tx := NewTransmitterWithDriver(proto.DeviceID(0xCA00+i), &mediumDriver{NewMockDriver(), m}, opts...)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for n := 0; n < 30; n++ {
+					_, _ = tx.SendFrame(proto.FrameTypeControl, []byte{byte(n)})
+					time.Sleep(time.Duration((n*7+i*3)%4) * time.Millisecond / 2)
+				}
+			}(i)
+		}
+		wg.Wait()
+		return m.collisions()
+	}
+
+	blind := run()
+	csma := run(WithCSMA(CSMAConfig{Backoff: 2 * time.Millisecond, Retries: 8}))
+	if blind == 0 || csma >= blind/2 {
+		t.Errorf("%d of 90 frames collided with CSMA, %d without, want far fewer", csma, blind)
+	}
+}
+
+func TestRetryBackoff_Desynchronises(t *testing.T) {
+	const airtime = time.Millisecond
+	// Two transmitters lose their first frames to a collision and retry
+	// after the same ACK timeout. Without jitter they would collide on
+	// every attempt.
+	for seed := int64(1); seed <= 20; seed++ {
+		a, b := proto.NewSeededRand(seed), proto.NewSeededRand(seed+100)
+		var at, bt time.Duration
+		apart := false
+		for attempt := 0; attempt < 4 && !apart; attempt++ {
+			at += retryBackoff(a, attempt)
+			bt += retryBackoff(b, attempt)
+			apart = at-bt >= airtime || bt-at >= airtime
+		}
+		if !apart {
+			t.Errorf("seed %d: still in step after 4 attempts", seed)
+		}
+	}
+
+	src := proto.NewSeededRand(7)
+	for attempt := 0; attempt < 5; attempt++ {
+		mean := time.Duration(20+10*attempt) * time.Millisecond
+		if d := retryBackoff(src, attempt); d < mean/2 || d >= mean*3/2 {
+			t.Errorf("backoff after attempt %d = %v, want within [%v, %v)", attempt, d, mean/2, mean*3/2)
+		}
+	}
+	if retryBackoff(proto.NewSeededRand(3), 2) != retryBackoff(proto.NewSeededRand(3), 2) {
+		t.Error("backoff differs for the same RandSource seed")
+	}
+}
@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"context"
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// txAsync transmits an encoded frame as tx does, on a driver that
+// implements RadioAsyncTx: it returns once the frame is on its way, and
+// done is called with the outcome once it is sent, or at once if it could
+// not be started. It reports false, without calling done, if the driver
+// does not implement RadioAsyncTx.
+func (t *Transmitter) txAsync(data []byte, done func(error)) bool {
+	a, ok := t.driver.(RadioAsyncTx)
+	if !ok {
+		return false
+	}
+	t.txMu.Lock()
+	release := t.awake()
+	err := t.clearToSendLocked(data)
+	if err == nil {
+		err = a.TxAsync(data, func(err error) {
+			if err == nil {
+				t.recordTx(data)
+			}
+			release()
+			done(err)
+		})
+	}
+	if err == nil {
+		t.maybeCheckpointLocked()
+	}
+	t.txMu.Unlock()
+	if err != nil {
+		release()
+		done(err)
+	}
+	return true
+}
+
+// sendQueuedAsync starts sending a message taken from the transmit queue
+// and reports its outcome once it has left the radio, so that the worker
+// can take the next message meanwhile. It reports false if the message is
+// for sendQueued instead: the driver does not implement RadioAsyncTx, the
+// queue sends reliably, or the message is the head of the queue's store,
+// which stays there until sent.
+func (t *Transmitter) sendQueuedAsync(m queuedMsg) bool {
+	q := &t.sendQueue
+	if _, ok := t.driver.(RadioAsyncTx); !ok || q.cfg.Retries > 0 || m.stored {
+		return false
+	}
+	if !t.device.IsPaired || len(m.data) > t.maxPayload() {
+		return false
+	}
+	if err := t.easeOff(context.Background()); err != nil {
+		return false
+	}
+	encoded := t.linkConfig().EncodeFrame(t.newFrame(proto.FrameTypeData, m.seq, m.data))
+	q.inflight.Add(1)
+	return t.txAsync(encoded, func(err error) {
+		defer q.inflight.Done()
+		if err != nil {
+			log.Printf("[Transmitter] Queued frame %d failed: %v\r\n", m.seq, err)
+		}
+		m.report(err)
+	})
+}
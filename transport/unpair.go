@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"log"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// Unpair tears down the pairing with the receiver: the receiver is told to
+// forget this transmitter, the session state is cleared and the heartbeat
+// task is stopped. Sends fail with ErrNotPaired until the next StartPairing.
+func (t *Transmitter) Unpair() error {
+	if !t.device.IsPaired {
+		return proto.ErrNotPaired
+	}
+	_, err := t.SendFrame(proto.FrameTypeControl, proto.EncodeControl(proto.ControlUnpair, t.receiver, nil))
+	t.unpairLocal()
+	return err
+}
+
+// unpairLocal forgets the pairing without telling the receiver.
+func (t *Transmitter) unpairLocal() {
+	if !t.hasPeers() {
+		t.StopHeartbeatTask()
+	}
+	t.device.IsPaired = false
+	t.deleteBond(t.receiver)
+	t.device.ResetSessionKey(nil)
+	t.device.MaxFrameSize = t.config.MaxFrameSize
+	t.rekey = nil
+	t.resetFlow()
+	t.pairingChanged()
+}
+
+// handleUnpair reports whether frame is an unpair notice from the paired
+// receiver, unpairing the transmitter if so. A goodbye from the receiver
+// is acted on as well, see receiverGone, but not reported.
+func (t *Transmitter) handleUnpair(frame *proto.Frame) bool {
+	if frame.Type != proto.FrameTypeControl || frame.SenderID != t.receiver || !t.device.IsPaired {
+		return false
+	}
+	cmd, target, _, ok := proto.DecodeControl(frame.Payload)
+	if ok && cmd == proto.ControlGoodbye && target == t.device.ID {
+		t.receiverGone()
+		return false
+	}
+	if !ok || cmd != proto.ControlUnpair || target != t.device.ID {
+		return false
+	}
+	log.Printf("[Transmitter] Unpaired by receiver %d\r\n", frame.SenderID)
+	t.unpairLocal()
+	return true
+}
+
+// Unpair forgets the given transmitter and tells it so. The transmitter
+// notices the next time it waits for an ACK; until then its frames are
+// ignored.
+func (r *Receiver) Unpair(id proto.DeviceID) error {
+	defer r.noteSinglePair()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.devEvents.lost, id)
+	if _, ok := r.pairedDevices[id]; !ok {
+		return proto.ErrNotPaired
+	}
+	delete(r.pairedDevices, id)
+	delete(r.pairingAcks, id)
+	delete(r.devStats, id)
+	delete(r.paused, id)
+	r.deleteBondLocked(id)
+	log.Printf("[Receiver] Device %d unpaired\r\n", id)
+	r.deviceEventLocked(DeviceUnpaired, id)
+	return r.sendControl(0, proto.ControlUnpair, id, nil)
+}
@@ -0,0 +1,206 @@
+package transport
+
+import (
+	"log"
+	"time"
+
+	proto "github.com/ystepanoff/nrfcomm/protocol"
+)
+
+// PairingWindowEvent reports a change of the receiver's pairing window.
+type PairingWindowEvent uint8
+
+const (
+	PairingWindowOpened  PairingWindowEvent = iota + 1 // EnablePairing was called, or see SetSinglePairMode
+	PairingWindowClosed                                // DisablePairing was called, or see SetSinglePairMode
+	PairingWindowExpired                               // the window ran out
+)
+
+// pairingWindow tracks when pairing requests are accepted. Until the window
+// is first enabled or disabled the receiver is not gated and accepts them at
+// any time.
+type pairingWindow struct {
+	gated bool
+	open  bool
+	until time.Time // zero: open until disabled
+	timer *time.Timer
+	gen   uint64 // invalidates the expiry timer of an earlier window
+}
+
+// EnablePairing accepts pairing requests for the given window, or until
+// DisablePairing if window is not positive. Outside the window pairing
+// requests are ignored; paired devices keep working. Calling it again
+// restarts the window.
+func (r *Receiver) EnablePairing(window time.Duration) {
+	r.mu.Lock()
+	w := &r.window
+	lapsed := w.lapsed()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.gen++
+	w.gated = true
+	w.open = true
+	w.until = time.Time{}
+	if window > 0 {
+		w.until = time.Now().Add(window)
+		gen := w.gen
+		w.timer = time.AfterFunc(window, func() { r.expirePairing(gen) })
+	}
+	h := r.windowHandler
+	r.mu.Unlock()
+
+	if lapsed {
+		log.Printf("[Receiver] Pairing window expired\r\n")
+	}
+	log.Printf("[Receiver] Pairing enabled\r\n")
+	if h != nil {
+		if lapsed {
+			h(PairingWindowExpired)
+		}
+		h(PairingWindowOpened)
+	}
+}
+
+// DisablePairing stops accepting pairing requests. If the window ran out
+// before its expiry was reported, the handler of SetPairingWindowHandler is
+// told PairingWindowExpired rather than PairingWindowClosed.
+func (r *Receiver) DisablePairing() {
+	r.mu.Lock()
+	w := &r.window
+	wasOpen, lapsed := w.open, w.lapsed()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.gen++
+	w.gated = true
+	w.open = false
+	h := r.windowHandler
+	r.mu.Unlock()
+
+	switch {
+	case lapsed:
+		log.Printf("[Receiver] Pairing window expired\r\n")
+		if h != nil {
+			h(PairingWindowExpired)
+		}
+	case wasOpen:
+		log.Printf("[Receiver] Pairing disabled\r\n")
+		if h != nil {
+			h(PairingWindowClosed)
+		}
+	}
+}
+
+// PairingEnabled reports whether pairing requests are currently accepted.
+func (r *Receiver) PairingEnabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pairingOpenLocked() && !(r.singlePair && len(r.pairedDevices) > 0)
+}
+
+// SetPairingWindowHandler registers a handler told when the pairing window
+// opens, is closed or expires, e.g. to drive a pairing LED. It runs without
+// the receiver locked. Pass nil to remove it.
+func (r *Receiver) SetPairingWindowHandler(h func(PairingWindowEvent)) {
+	r.mu.Lock()
+	r.windowHandler = h
+	r.mu.Unlock()
+}
+
+func (r *Receiver) pairingOpenLocked() bool {
+	w := &r.window
+	if !w.gated {
+		return true
+	}
+	return w.open && (w.until.IsZero() || time.Now().Before(w.until))
+}
+
+// acceptsPairing reports whether a pairing request may be processed now.
+func (r *Receiver) acceptsPairing() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pairingOpenLocked()
+}
+
+// lapsed reports whether the window has run out but its expiry timer has
+// not closed it yet. EnablePairing and DisablePairing, which make the timer
+// stale, report the expiry in its place.
+func (w *pairingWindow) lapsed() bool {
+	return w.open && !w.until.IsZero() && !time.Now().Before(w.until)
+}
+
+// expirePairing closes the window opened as generation gen.
+func (r *Receiver) expirePairing(gen uint64) {
+	r.mu.Lock()
+	w := &r.window
+	if w.gen != gen || !w.open {
+		r.mu.Unlock()
+		return
+	}
+	w.open = false
+	w.timer = nil
+	h := r.windowHandler
+	r.mu.Unlock()
+
+	log.Printf("[Receiver] Pairing window expired\r\n")
+	if h != nil {
+		h(PairingWindowExpired)
+	}
+}
+
+// SetPairingTimeout changes how long StartPairing, challenges and unfinished
+// pairing exchanges last; a non-positive d restores
+// proto.PairingTimeout.
+func (r *Receiver) SetPairingTimeout(d time.Duration) {
+	r.mu.Lock()
+	r.config.PairingTimeout = d
+	r.config = r.config.Normalize()
+	r.mu.Unlock()
+}
+
+// StartPairing opens the pairing window for the pairing timeout and blocks
+// until a transmitter pairs, closing the window again. It returns ErrTimeout
+// if the window runs out or is closed first, and ErrClosed if the receiver
+// is. With WithPairingChannel the receiver moves to the pairing channel
+// meanwhile, and returns once the transmitter has completed the exchange
+// there.
+func (r *Receiver) StartPairing() error {
+	if r.hop {
+		restore, err := r.hopToPairingChannel()
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+	r.mu.Lock()
+	start := r.pairings
+	timeout := r.config.PairingTimeout
+	r.mu.Unlock()
+
+	defer r.pollSelf()()
+
+	r.EnablePairing(timeout)
+	for r.acceptsPairing() {
+		if r.isClosed() {
+			return proto.ErrClosed
+		}
+		frame := r.pollFrame()
+		if frame != nil && (frame.Type == proto.FrameTypePairing || frame.Type == proto.FrameTypeControl) {
+			r.ProcessFrame(frame)
+		}
+		r.mu.Lock()
+		paired := r.pairings != start
+		r.mu.Unlock()
+		if paired {
+			r.DisablePairing()
+			if r.hop {
+				r.finishPairing(time.Now().Add(timeout))
+			}
+			return nil
+		}
+	}
+	return proto.ErrTimeout
+}